@@ -0,0 +1,358 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package admin
+
+// Assets of the dashboard, embedded in the binary.
+
+const indexHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Asynq Dashboard</title>
+<link rel="stylesheet" href="app.css">
+</head>
+<body data-read-only="{{.ReadOnly}}">
+<header>
+  <h1>Asynq</h1>
+  <nav>
+    <a href="#overview" data-view="overview">Overview</a>
+    <a href="#tasks" data-view="tasks">Tasks</a>
+    <a href="#servers" data-view="servers">Servers</a>
+    <a href="#workers" data-view="workers">Workers</a>
+  </nav>
+  {{if .ReadOnly}}<span class="badge">read-only</span>{{end}}
+</header>
+<div id="error" class="error" hidden></div>
+<main id="app"></main>
+<script src="app.js"></script>
+</body>
+</html>
+`
+
+const appCSS = `* { box-sizing: border-box; }
+body { margin: 0; font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; font-size: 14px; color: #24292e; background: #f6f8fa; }
+header { display: flex; align-items: center; padding: 0 24px; background: #24292e; color: #fff; }
+header h1 { font-size: 18px; margin: 12px 24px 12px 0; }
+nav a { color: #c8ccd1; text-decoration: none; margin-right: 16px; padding: 14px 0; display: inline-block; }
+nav a.active { color: #fff; border-bottom: 2px solid #fff; }
+.badge { margin-left: auto; padding: 2px 8px; border-radius: 10px; background: #6a737d; font-size: 12px; }
+main { padding: 24px; }
+.error { margin: 16px 24px 0; padding: 8px 12px; border: 1px solid #d73a49; border-radius: 4px; background: #ffeef0; color: #86181d; }
+.cards { display: flex; flex-wrap: wrap; gap: 12px; margin-bottom: 24px; }
+.card { min-width: 120px; padding: 12px 16px; background: #fff; border: 1px solid #e1e4e8; border-radius: 4px; }
+.card .label { color: #586069; font-size: 12px; }
+.card .value { font-size: 24px; font-weight: 600; }
+h2 { font-size: 16px; margin: 24px 0 8px; }
+table { width: 100%; border-collapse: collapse; background: #fff; border: 1px solid #e1e4e8; }
+th, td { padding: 6px 10px; border-bottom: 1px solid #e1e4e8; text-align: left; vertical-align: top; }
+th { background: #f1f3f5; font-weight: 600; }
+td.payload { font-family: SFMono-Regular, Consolas, Menlo, monospace; font-size: 12px; word-break: break-all; max-width: 360px; }
+td.empty { color: #6a737d; text-align: center; }
+.toolbar { display: flex; flex-wrap: wrap; align-items: center; gap: 8px; margin-bottom: 12px; }
+.tabs a { margin-right: 12px; color: #0366d6; text-decoration: none; cursor: pointer; }
+.tabs a.active { font-weight: 600; color: #24292e; }
+input { padding: 4px 6px; border: 1px solid #d1d5da; border-radius: 3px; }
+button { padding: 4px 10px; border: 1px solid #d1d5da; border-radius: 3px; background: #fafbfc; cursor: pointer; }
+button:hover { background: #f3f4f6; }
+button.danger { color: #cb2431; }
+button:disabled { opacity: 0.5; cursor: default; }
+.pager { margin-top: 12px; display: flex; align-items: center; gap: 8px; }
+svg.chart { background: #fff; border: 1px solid #e1e4e8; }
+svg.chart text { font-size: 11px; fill: #586069; }
+.legend span { margin-right: 16px; }
+.legend .processed { color: #28a745; }
+.legend .failed { color: #d73a49; }
+`
+
+const appJS = `(function () {
+  'use strict';
+
+  var app = document.getElementById('app');
+  var errorBox = document.getElementById('error');
+  var readOnly = document.body.getAttribute('data-read-only') === 'true';
+  var states = ['enqueued', 'in_progress', 'scheduled', 'retry', 'dead'];
+  // cursors holds the cursor of each page of a filtered listing.
+  var filter = { state: 'retry', queue: '', type: '', page: 1, cursors: [0], pageSize: 30 };
+  var timer = null;
+
+  function api(method, path) {
+    var opts = { method: method, credentials: 'same-origin', headers: { 'X-Requested-With': 'XMLHttpRequest' } };
+    return fetch('api/' + path, opts).then(function (res) {
+      if (res.status === 204) {
+        return null;
+      }
+      return res.json().then(function (body) {
+        if (!res.ok) {
+          throw new Error(body.error || res.statusText);
+        }
+        return body;
+      });
+    });
+  }
+
+  function el(tag, attrs, children) {
+    var node = document.createElement(tag);
+    Object.keys(attrs || {}).forEach(function (k) {
+      if (k.indexOf('on') === 0) {
+        node.addEventListener(k.slice(2), attrs[k]);
+      } else {
+        node.setAttribute(k, attrs[k]);
+      }
+    });
+    (children || []).forEach(function (c) {
+      if (c !== null && c !== undefined) {
+        node.appendChild(typeof c === 'object' ? c : document.createTextNode(String(c)));
+      }
+    });
+    return node;
+  }
+
+  function showError(err) {
+    errorBox.textContent = err ? err.message : '';
+    errorBox.hidden = !err;
+  }
+
+  function time(s) {
+    return s ? new Date(s).toLocaleString() : '';
+  }
+
+  function table(headers, rows) {
+    var body = rows.length ? rows : [el('tr', {}, [el('td', { colspan: headers.length, 'class': 'empty' }, ['No data'])])];
+    return el('table', {}, [
+      el('thead', {}, [el('tr', {}, headers.map(function (h) { return el('th', {}, [h]); }))]),
+      el('tbody', {}, body)
+    ]);
+  }
+
+  function render(nodes) {
+    app.innerHTML = '';
+    nodes.forEach(function (n) { app.appendChild(n); });
+  }
+
+  // act runs a mutating request after confirmation and reloads the view.
+  function act(message, method, path) {
+    if (!window.confirm(message)) {
+      return;
+    }
+    api(method, path).then(function () { showError(null); }, showError).then(load);
+  }
+
+  function actionButton(label, message, method, path, danger) {
+    return el('button', { 'class': danger ? 'danger' : '', onclick: function () { act(message, method, path); } }, [label]);
+  }
+
+  function chart(days) {
+    var w = 720, h = 200, pad = 30;
+    var points = days.slice().reverse();
+    var max = 1;
+    points.forEach(function (d) { max = Math.max(max, d.processed, d.failed); });
+    var step = points.length > 1 ? (w - 2 * pad) / (points.length - 1) : 0;
+    function line(field, color) {
+      var coords = points.map(function (d, i) {
+        return (pad + i * step).toFixed(1) + ',' + (h - pad - (d[field] / max) * (h - 2 * pad)).toFixed(1);
+      }).join(' ');
+      var node = document.createElementNS('http://www.w3.org/2000/svg', 'polyline');
+      node.setAttribute('points', coords);
+      node.setAttribute('fill', 'none');
+      node.setAttribute('stroke', color);
+      node.setAttribute('stroke-width', '2');
+      return node;
+    }
+    function text(x, y, s, anchor) {
+      var node = document.createElementNS('http://www.w3.org/2000/svg', 'text');
+      node.setAttribute('x', x);
+      node.setAttribute('y', y);
+      node.setAttribute('text-anchor', anchor);
+      node.textContent = s;
+      return node;
+    }
+    var svg = document.createElementNS('http://www.w3.org/2000/svg', 'svg');
+    svg.setAttribute('class', 'chart');
+    svg.setAttribute('viewBox', '0 0 ' + w + ' ' + h);
+    svg.setAttribute('width', w);
+    svg.setAttribute('height', h);
+    svg.appendChild(line('processed', '#28a745'));
+    svg.appendChild(line('failed', '#d73a49'));
+    svg.appendChild(text(pad - 4, pad, String(max), 'end'));
+    svg.appendChild(text(pad - 4, h - pad, '0', 'end'));
+    if (points.length) {
+      svg.appendChild(text(pad, h - 10, points[0].date, 'start'));
+      svg.appendChild(text(w - pad, h - 10, points[points.length - 1].date, 'end'));
+    }
+    return el('div', {}, [
+      svg,
+      el('div', { 'class': 'legend' }, [
+        el('span', { 'class': 'processed' }, ['■ processed']),
+        el('span', { 'class': 'failed' }, ['■ failed'])
+      ])
+    ]);
+  }
+
+  var views = {
+    overview: function () {
+      return Promise.all([api('GET', 'stats'), api('GET', 'history?days=30')]).then(function (res) {
+        var stats = res[0], history = res[1].days;
+        var cards = [
+          ['Enqueued', stats.enqueued], ['In progress', stats.in_progress], ['Scheduled', stats.scheduled],
+          ['Retry', stats.retry], ['Dead', stats.dead], ['Processed today', stats.processed], ['Failed today', stats.failed]
+        ];
+        render([
+          el('div', { 'class': 'cards' }, cards.map(function (c) {
+            return el('div', { 'class': 'card' }, [el('div', { 'class': 'label' }, [c[0]]), el('div', { 'class': 'value' }, [c[1]])]);
+          })),
+          el('h2', {}, ['Queues']),
+          table(['Queue', 'Size'], stats.queues.map(function (q) {
+            var link = el('a', { href: '#tasks', onclick: function () {
+              filter = { state: 'enqueued', queue: q.name, type: '', page: 1, cursors: [0], pageSize: filter.pageSize };
+            } }, [q.name]);
+            return el('tr', {}, [el('td', {}, [link]), el('td', {}, [q.size])]);
+          })),
+          el('h2', {}, ['Processed and failed tasks, last 30 days']),
+          chart(history)
+        ]);
+      });
+    },
+
+    tasks: function () {
+      var filtered = filter.type || (filter.queue && filter.state !== 'enqueued');
+      var query = (filtered ? 'cursor=' + filter.cursors[filter.page - 1] : 'page=' + filter.page) +
+        '&page_size=' + filter.pageSize;
+      if (filter.queue) {
+        query += '&queue=' + encodeURIComponent(filter.queue);
+      }
+      if (filter.type) {
+        query += '&type=' + encodeURIComponent(filter.type);
+      }
+      var list = filter.state === 'enqueued' && !filter.queue ?
+        Promise.resolve({ tasks: [], page: 1 }) : api('GET', 'tasks/' + filter.state + '?' + query);
+      return list.then(function (res) {
+        var queueInput = el('input', { placeholder: 'queue', value: filter.queue });
+        var typeInput = el('input', { placeholder: 'type pattern, e.g. email:*', value: filter.type });
+        var apply = function () {
+          filter.queue = queueInput.value.trim();
+          filter.type = typeInput.value.trim();
+          filter.page = 1;
+          filter.cursors = [0];
+          load();
+        };
+        var tabs = el('div', { 'class': 'tabs' }, states.map(function (s) {
+          return el('a', { 'class': s === filter.state ? 'active' : '', onclick: function () {
+            filter.state = s;
+            filter.page = 1;
+            filter.cursors = [0];
+            load();
+          } }, [s.replace('_', ' ')]);
+        }));
+        var bulk = [];
+        if (!readOnly) {
+          var s = filter.state;
+          if (s === 'scheduled' || s === 'retry' || s === 'dead') {
+            bulk.push(actionButton('Enqueue all', 'Enqueue all ' + s + ' tasks?', 'POST', 'tasks/' + s + '/enqueue'));
+          }
+          if (s === 'scheduled' || s === 'retry') {
+            bulk.push(actionButton('Kill all', 'Kill all ' + s + ' tasks?', 'POST', 'tasks/' + s + '/kill', true));
+          }
+          if (s === 'scheduled' || s === 'retry' || s === 'dead') {
+            bulk.push(actionButton('Delete all', 'Delete all ' + s + ' tasks?', 'DELETE', 'tasks/' + s, true));
+          }
+        }
+        var rows = res.tasks.map(function (t) {
+          var actions = [];
+          if (!readOnly && t.key) {
+            var path = 'tasks/' + filter.state + '/' + encodeURIComponent(t.key);
+            actions.push(actionButton(filter.state === 'dead' ? 'Retry' : 'Enqueue', 'Enqueue task ' + t.id + '?', 'POST', path + '/enqueue'));
+            if (filter.state !== 'dead') {
+              actions.push(actionButton('Kill', 'Kill task ' + t.id + '?', 'POST', path + '/kill', true));
+            }
+            actions.push(actionButton('Delete', 'Delete task ' + t.id + '?', 'DELETE', path, true));
+          } else if (!readOnly) {
+            actions.push(actionButton('Cancel', 'Cancel task ' + t.id + '?', 'POST', 'cancel/' + encodeURIComponent(t.id), true));
+          }
+          return el('tr', {}, [
+            el('td', {}, [t.id]),
+            el('td', {}, [t.type]),
+            el('td', {}, [t.queue]),
+            el('td', { 'class': 'payload' }, [JSON.stringify(t.payload)]),
+            el('td', { 'class': 'payload' }, [t.headers ? JSON.stringify(t.headers) : '']),
+            el('td', {}, [t.max_retry ? t.retried + '/' + t.max_retry : '']),
+            el('td', {}, [t.error_msg || '']),
+            el('td', {}, [time(t.next_process_at || t.last_failed_at)]),
+            el('td', {}, actions)
+          ]);
+        });
+        var prev = el('button', { onclick: function () { filter.page--; load(); } }, ['Previous']);
+        prev.disabled = filter.page <= 1;
+        var next = el('button', { onclick: function () {
+          filter.cursors[filter.page] = res.next_cursor;
+          filter.page++;
+          load();
+        } }, ['Next']);
+        // Filtered listings scan a limited number of tasks per request,
+        // so a page may have fewer tasks even if more tasks match.
+        next.disabled = filtered ? !res.next_cursor : res.tasks.length < filter.pageSize;
+        var notice = filter.state === 'enqueued' && !filter.queue ?
+          el('p', {}, ['Enter a queue name to list enqueued tasks.']) : null;
+        render([
+          tabs,
+          el('div', { 'class': 'toolbar' }, [queueInput, typeInput, el('button', { onclick: apply }, ['Filter'])].concat(bulk)),
+          notice || table(['ID', 'Type', 'Queue', 'Payload', 'Headers', 'Retried', 'Error', 'Process at / Failed at', ''], rows),
+          el('div', { 'class': 'pager' }, [prev, 'Page ' + filter.page, next])
+        ]);
+      });
+    },
+
+    servers: function () {
+      return api('GET', 'servers').then(function (res) {
+        render([table(['Host', 'PID', 'Concurrency', 'Queues', 'Strict priority', 'Status', 'Started', 'Active workers'],
+          res.servers.map(function (s) {
+            var queues = Object.keys(s.queues).sort().map(function (q) { return q + ':' + s.queues[q]; }).join(', ');
+            return el('tr', {}, [
+              el('td', {}, [s.host]), el('td', {}, [s.pid]), el('td', {}, [s.concurrency]), el('td', {}, [queues]),
+              el('td', {}, [s.strict_priority ? 'yes' : 'no']), el('td', {}, [s.status]),
+              el('td', {}, [time(s.started)]), el('td', {}, [s.active_workers])
+            ]);
+          }))]);
+      });
+    },
+
+    workers: function () {
+      return api('GET', 'workers').then(function (res) {
+        render([table(['Host', 'PID', 'Task ID', 'Type', 'Queue', 'Payload', 'Started', ''],
+          res.workers.map(function (w) {
+            var cancel = readOnly ? null :
+              actionButton('Cancel', 'Cancel task ' + w.task_id + '?', 'POST', 'cancel/' + encodeURIComponent(w.task_id), true);
+            return el('tr', {}, [
+              el('td', {}, [w.host]), el('td', {}, [w.pid]), el('td', {}, [w.task_id]), el('td', {}, [w.type]),
+              el('td', {}, [w.queue]), el('td', { 'class': 'payload' }, [JSON.stringify(w.payload)]),
+              el('td', {}, [time(w.started)]), el('td', {}, [cancel])
+            ]);
+          }))]);
+      });
+    }
+  };
+
+  function current() {
+    var name = window.location.hash.replace('#', '');
+    return views[name] ? name : 'overview';
+  }
+
+  function load() {
+    var name = current();
+    Array.prototype.forEach.call(document.querySelectorAll('nav a'), function (a) {
+      a.className = a.getAttribute('data-view') === name ? 'active' : '';
+    });
+    clearTimeout(timer);
+    views[name]().then(function () { showError(null); }, showError);
+    // Refresh the views without user input; the task list changes only on request.
+    if (name !== 'tasks') {
+      timer = setTimeout(load, 5000);
+    }
+  }
+
+  window.addEventListener('hashchange', load);
+  load();
+})();
+`
@@ -0,0 +1,66 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/hibiken/asynq"
+)
+
+// NewDashboard returns an http.Handler serving a web dashboard to monitor
+// and administer queues and tasks, along with the admin API it uses under "/api/".
+//
+// The dashboard shows queue sizes, charts of processed and failed tasks,
+// servers and active workers, and lets users browse, retry, kill and delete tasks.
+// Its assets are embedded in the binary. The options apply to both
+// the dashboard and its API.
+//
+// The dashboard refers to the API with relative paths, so mount it under
+// a path prefix ending with a slash, e.g.
+//
+//	mux.Handle("/dashboard/", http.StripPrefix("/dashboard", admin.NewDashboard(inspector, opts)))
+func NewDashboard(inspector *asynq.Inspector, opts Options) http.Handler {
+	api := &handler{inspector: inspector, readOnly: opts.ReadOnly}
+	d := &dashboard{api: http.StripPrefix("/api", api), readOnly: opts.ReadOnly}
+	return wrap(d, opts.Middleware)
+}
+
+type dashboard struct {
+	api      http.Handler
+	readOnly bool
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(indexHTML))
+
+func (d *dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		d.api.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	// The dashboard loads its scripts and styles only from itself.
+	w.Header().Set("Content-Security-Policy", "default-src 'self'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	switch r.URL.Path {
+	case "/", "/index.html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		indexTemplate.Execute(w, struct{ ReadOnly bool }{d.readOnly})
+	case "/app.js":
+		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		w.Write([]byte(appJS))
+	case "/app.css":
+		w.Header().Set("Content-Type", "text/css; charset=utf-8")
+		w.Write([]byte(appCSS))
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hibiken/asynq"
+)
+
+func TestDashboard(t *testing.T) {
+	setup(t)
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: redisAddr, DB: redisDB})
+	handler := NewDashboard(inspector, Options{})
+
+	tests := []struct {
+		method      string
+		target      string
+		code        int
+		contentType string
+		contains    string
+	}{
+		{http.MethodGet, "/", http.StatusOK, "text/html; charset=utf-8", `data-read-only="false"`},
+		{http.MethodGet, "/index.html", http.StatusOK, "text/html; charset=utf-8", `<script src="app.js">`},
+		{http.MethodGet, "/app.js", http.StatusOK, "application/javascript; charset=utf-8", "fetch('api/'"},
+		{http.MethodGet, "/app.css", http.StatusOK, "text/css; charset=utf-8", "svg.chart"},
+		{http.MethodGet, "/api/stats", http.StatusOK, "application/json", `"queues":[]`},
+		{http.MethodGet, "/nonexistent.js", http.StatusNotFound, "", ""},
+		{http.MethodPost, "/", http.StatusMethodNotAllowed, "", ""},
+	}
+
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.target, nil))
+		if rec.Code != tc.code {
+			t.Errorf("%s %s returned %d, want %d", tc.method, tc.target, rec.Code, tc.code)
+			continue
+		}
+		if got := rec.Header().Get("Content-Type"); tc.contentType != "" && got != tc.contentType {
+			t.Errorf("%s %s returned Content-Type %q, want %q", tc.method, tc.target, got, tc.contentType)
+		}
+		if !strings.Contains(rec.Body.String(), tc.contains) {
+			t.Errorf("%s %s returned body without %q", tc.method, tc.target, tc.contains)
+		}
+	}
+}
+
+func TestDashboardReadOnly(t *testing.T) {
+	setup(t)
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: redisAddr, DB: redisDB})
+	handler := NewDashboard(inspector, Options{
+		ReadOnly:   true,
+		Middleware: []func(http.Handler) http.Handler{BearerAuth("token123")},
+	})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET / without token returned %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	tests := []struct {
+		method   string
+		target   string
+		code     int
+		contains string
+	}{
+		{http.MethodGet, "/", http.StatusOK, `data-read-only="true"`},
+		{http.MethodDelete, "/api/tasks/dead", http.StatusForbidden, errReadOnly.Error()},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, tc.target, nil)
+		req.Header.Set("Authorization", "Bearer token123")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s %s returned %d, want %d", tc.method, tc.target, rec.Code, tc.code)
+		}
+		if !strings.Contains(rec.Body.String(), tc.contains) {
+			t.Errorf("%s %s returned body without %q", tc.method, tc.target, tc.contains)
+		}
+	}
+}
@@ -0,0 +1,694 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package admin provides a JSON HTTP API to inspect and administer
+// queues and tasks.
+//
+// The handler serves the following endpoints, relative to where it is mounted:
+//
+//	GET    /stats                          current stats of the queues
+//	GET    /history?days=N                 daily processed and failed counts
+//	GET    /tasks/{state}                  list tasks in the state
+//	POST   /tasks/{state}/enqueue          enqueue all tasks in the state
+//	POST   /tasks/{state}/kill             kill all tasks in the state
+//	DELETE /tasks/{state}                  delete all tasks in the state
+//	POST   /tasks/{state}/{key}/enqueue    enqueue the task
+//	POST   /tasks/{state}/{key}/kill       kill the task
+//	DELETE /tasks/{state}/{key}            delete the task
+//	POST   /cancel/{id}                    cancel the task
+//	DELETE /queues/{qname}?force=true      remove the queue
+//	GET    /servers                        running servers
+//	GET    /workers                        workers processing tasks
+//
+// The state is one of "enqueued", "in_progress", "scheduled", "retry" and "dead".
+// Tasks are listed with "page" (starting at one) and "page_size" query parameters,
+// and can be filtered by "queue" and "type" (a pattern using the syntax of
+// path.Match) parameters. Listing enqueued tasks requires the "queue" parameter.
+//
+// Filtered listings scan at most 1000 tasks per request, and are paginated
+// with the "cursor" query parameter instead of "page": the response has
+// a "next_cursor" field to pass to get the next tasks until all tasks have
+// been scanned. A response may have fewer tasks than the page size, or none,
+// even if more tasks match.
+//
+// Requests to the endpoints which change queues and tasks must have
+// an X-Requested-With header, which cross-site forms cannot send, to prevent
+// cross-site request forgery when credentials are sent by browsers.
+//
+// Errors are reported with a JSON object with an "error" field.
+//
+// NewDashboard serves a web dashboard built on the API.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// Options configures the handler.
+type Options struct {
+	// ReadOnly disables the endpoints which change queues and tasks.
+	// Requests to those endpoints fail with 403 Forbidden.
+	ReadOnly bool
+
+	// Middleware wraps the handler, e.g. to authenticate requests.
+	// The first middleware is the outermost one.
+	Middleware []func(http.Handler) http.Handler
+}
+
+// NewHandler returns an http.Handler serving the admin API
+// with the given inspector.
+//
+// To mount the handler under a path prefix, use http.StripPrefix.
+func NewHandler(inspector *asynq.Inspector, opts Options) http.Handler {
+	return wrap(&handler{inspector: inspector, readOnly: opts.ReadOnly}, opts.Middleware)
+}
+
+// wrap applies the middleware to the handler, the first one being the outermost.
+func wrap(h http.Handler, middleware []func(http.Handler) http.Handler) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+type handler struct {
+	inspector *asynq.Inspector
+	readOnly  bool
+}
+
+// Task states accepted by the tasks endpoints.
+const (
+	stateEnqueued   = "enqueued"
+	stateInProgress = "in_progress"
+	stateScheduled  = "scheduled"
+	stateRetry      = "retry"
+	stateDead       = "dead"
+)
+
+// keyPrefixes maps states to the prefix of the keys of tasks in the state.
+var keyPrefixes = map[string]string{
+	stateScheduled: "s:",
+	stateRetry:     "r:",
+	stateDead:      "d:",
+}
+
+const (
+	defaultPageSize = 30
+	maxPageSize     = 1000
+	defaultDays     = 10
+	maxDays         = 90
+
+	// scanPageSize is the number of tasks read at a time to filter tasks.
+	scanPageSize = 100
+
+	// maxScanned is the maximum number of tasks scanned by a request
+	// listing tasks with filters.
+	maxScanned = 1000
+)
+
+// requestedWithHeader is the header required on requests to mutating endpoints.
+const requestedWithHeader = "X-Requested-With"
+
+var (
+	// errReadOnly is reported when a mutating endpoint is requested
+	// while the handler is read-only.
+	errReadOnly = errors.New("mutating endpoints are disabled")
+
+	// errCrossSite is reported when a mutating endpoint is requested
+	// by a request which could be sent by another site.
+	errCrossSite = errors.New("requests to mutating endpoints require the " + requestedWithHeader + " header")
+)
+
+// statusError is an error with the HTTP status code to report it with.
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+
+func errorf(code int, format string, args ...interface{}) error {
+	return &statusError{code, fmt.Errorf(format, args...)}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	res, err := h.route(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if res == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// route dispatches the request and returns the response body.
+// A nil response is sent as 204 No Content.
+func (h *handler) route(r *http.Request) (interface{}, error) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "stats":
+		if err := allow(r, http.MethodGet); err != nil {
+			return nil, err
+		}
+		return h.stats()
+	case len(parts) == 1 && parts[0] == "history":
+		if err := allow(r, http.MethodGet); err != nil {
+			return nil, err
+		}
+		return h.history(r)
+	case len(parts) == 1 && parts[0] == "servers":
+		if err := allow(r, http.MethodGet); err != nil {
+			return nil, err
+		}
+		return h.servers()
+	case len(parts) == 1 && parts[0] == "workers":
+		if err := allow(r, http.MethodGet); err != nil {
+			return nil, err
+		}
+		return h.workers()
+	case len(parts) >= 2 && parts[0] == "tasks":
+		return h.tasks(r, parts[1:])
+	case len(parts) == 2 && parts[0] == "cancel":
+		if err := h.mutation(r, http.MethodPost); err != nil {
+			return nil, err
+		}
+		return h.cancel(parts[1])
+	case len(parts) == 2 && parts[0] == "queues":
+		if err := h.mutation(r, http.MethodDelete); err != nil {
+			return nil, err
+		}
+		return nil, h.removeQueue(parts[1], r.URL.Query().Get("force") == "true")
+	}
+	return nil, errorf(http.StatusNotFound, "no endpoint for %s", r.URL.Path)
+}
+
+// tasks dispatches requests to the tasks endpoints.
+// parts is the path after "/tasks", starting with the state.
+func (h *handler) tasks(r *http.Request, parts []string) (interface{}, error) {
+	state := parts[0]
+	switch state {
+	case stateEnqueued, stateInProgress, stateScheduled, stateRetry, stateDead:
+	default:
+		return nil, errorf(http.StatusNotFound, "unknown task state %q", state)
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		return h.listTasks(r, state)
+	case len(parts) == 1:
+		if err := h.mutation(r, http.MethodDelete); err != nil {
+			return nil, err
+		}
+		return h.deleteAll(state)
+	case len(parts) == 2 && (parts[1] == "enqueue" || parts[1] == "kill"):
+		if err := h.mutation(r, http.MethodPost); err != nil {
+			return nil, err
+		}
+		if parts[1] == "enqueue" {
+			return h.enqueueAll(state)
+		}
+		return h.killAll(state)
+	case len(parts) == 2:
+		if err := h.mutation(r, http.MethodDelete); err != nil {
+			return nil, err
+		}
+		return nil, h.taskByKey(state, parts[1], h.inspector.DeleteTaskByKey)
+	case len(parts) == 3 && parts[2] == "enqueue":
+		if err := h.mutation(r, http.MethodPost); err != nil {
+			return nil, err
+		}
+		return nil, h.taskByKey(state, parts[1], h.inspector.EnqueueTaskByKey)
+	case len(parts) == 3 && parts[2] == "kill":
+		if err := h.mutation(r, http.MethodPost); err != nil {
+			return nil, err
+		}
+		if state == stateDead {
+			return nil, errorf(http.StatusBadRequest, "cannot kill a task in %q state", state)
+		}
+		return nil, h.taskByKey(state, parts[1], h.inspector.KillTaskByKey)
+	}
+	return nil, errorf(http.StatusNotFound, "no endpoint for %s", r.URL.Path)
+}
+
+// allow reports an error if the request method is not the given method.
+func allow(r *http.Request, method string) error {
+	if r.Method != method {
+		return errorf(http.StatusMethodNotAllowed, "method %s is not allowed", r.Method)
+	}
+	return nil
+}
+
+// mutation reports an error if the request method is not the given method,
+// the handler is read-only, or the request could be sent by another site.
+//
+// Browsers send cookies and basic authentication credentials with requests
+// from other sites, but cannot send custom headers with them without asking
+// the handler through a CORS preflight request, which is not served.
+func (h *handler) mutation(r *http.Request, method string) error {
+	if err := allow(r, method); err != nil {
+		return err
+	}
+	if h.readOnly {
+		return &statusError{http.StatusForbidden, errReadOnly}
+	}
+	if r.Header.Get(requestedWithHeader) == "" || r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		return &statusError{http.StatusForbidden, errCrossSite}
+	}
+	return nil
+}
+
+type statsJSON struct {
+	Enqueued   int          `json:"enqueued"`
+	InProgress int          `json:"in_progress"`
+	Scheduled  int          `json:"scheduled"`
+	Retry      int          `json:"retry"`
+	Dead       int          `json:"dead"`
+	Processed  int          `json:"processed"`
+	Failed     int          `json:"failed"`
+	Queues     []*queueJSON `json:"queues"`
+	Timestamp  time.Time    `json:"timestamp"`
+}
+
+type queueJSON struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+}
+
+func (h *handler) stats() (interface{}, error) {
+	stats, err := h.inspector.CurrentStats()
+	if err != nil {
+		return nil, err
+	}
+	qs := []*queueJSON{}
+	for _, q := range stats.Queues {
+		qs = append(qs, &queueJSON{Name: q.Name, Size: q.Size})
+	}
+	return &statsJSON{
+		Enqueued:   stats.Enqueued,
+		InProgress: stats.InProgress,
+		Scheduled:  stats.Scheduled,
+		Retry:      stats.Retry,
+		Dead:       stats.Dead,
+		Processed:  stats.Processed,
+		Failed:     stats.Failed,
+		Queues:     qs,
+		Timestamp:  stats.Timestamp,
+	}, nil
+}
+
+type dailyStatsJSON struct {
+	Date      string `json:"date"`
+	Processed int    `json:"processed"`
+	Failed    int    `json:"failed"`
+}
+
+func (h *handler) history(r *http.Request) (interface{}, error) {
+	days, err := intParam(r, "days", defaultDays, 1, maxDays)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := h.inspector.History(days)
+	if err != nil {
+		return nil, err
+	}
+	res := []*dailyStatsJSON{}
+	for _, s := range stats {
+		res = append(res, &dailyStatsJSON{
+			Date:      s.Date.Format("2006-01-02"),
+			Processed: s.Processed,
+			Failed:    s.Failed,
+		})
+	}
+	return map[string]interface{}{"days": res}, nil
+}
+
+type taskJSON struct {
+	ID            string            `json:"id"`
+	Key           string            `json:"key,omitempty"`
+	Type          string            `json:"type"`
+	Payload       asynq.Payload     `json:"payload"`
+	Queue         string            `json:"queue"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	MaxRetry      int               `json:"max_retry,omitempty"`
+	Retried       int               `json:"retried,omitempty"`
+	ErrorMsg      string            `json:"error_msg,omitempty"`
+	NextProcessAt *time.Time        `json:"next_process_at,omitempty"`
+	LastFailedAt  *time.Time        `json:"last_failed_at,omitempty"`
+}
+
+type taskListJSON struct {
+	Tasks      []*taskJSON `json:"tasks"`
+	Page       int         `json:"page,omitempty"`
+	PageSize   int         `json:"page_size"`
+	NextCursor int         `json:"next_cursor,omitempty"`
+}
+
+func (h *handler) listTasks(r *http.Request, state string) (interface{}, error) {
+	page, err := intParam(r, "page", 1, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	size, err := intParam(r, "page_size", defaultPageSize, 1, maxPageSize)
+	if err != nil {
+		return nil, err
+	}
+	qname := r.URL.Query().Get("queue")
+	if state == stateEnqueued && qname == "" {
+		return nil, errorf(http.StatusBadRequest, "queue parameter is required to list enqueued tasks")
+	}
+	pattern := r.URL.Query().Get("type")
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, errorf(http.StatusBadRequest, "invalid type pattern %q", pattern)
+	}
+	res := &taskListJSON{PageSize: size}
+	if pattern == "" && (qname == "" || state == stateEnqueued) {
+		res.Page = page
+		res.Tasks, err = h.listPage(state, qname, page, size)
+	} else {
+		if r.URL.Query().Get("page") != "" {
+			return nil, errorf(http.StatusBadRequest, "page parameter is not supported with filters, use cursor parameter")
+		}
+		var cursor int
+		if cursor, err = intParam(r, "cursor", 0, 0, 0); err != nil {
+			return nil, err
+		}
+		res.Tasks, res.NextCursor, err = h.listMatching(state, qname, pattern, cursor, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.Tasks == nil {
+		res.Tasks = []*taskJSON{}
+	}
+	return res, nil
+}
+
+// listMatching scans the tasks in the state from the cursor, the number of
+// tasks scanned by the previous requests, and returns up to size tasks which
+// match the queue name and type pattern along with the cursor to continue
+// scanning from. The returned cursor is zero if all tasks have been scanned.
+//
+// At most maxScanned tasks are scanned, so that a filter matching few tasks
+// does not read all tasks in the state in a request.
+func (h *handler) listMatching(state, qname, pattern string, cursor, size int) ([]*taskJSON, int, error) {
+	var res []*taskJSON
+	for scanned := 0; scanned < maxScanned; {
+		page, skip := cursor/scanPageSize+1, cursor%scanPageSize
+		tasks, err := h.listPage(state, qname, page, scanPageSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		if skip >= len(tasks) {
+			return res, 0, nil
+		}
+		for _, t := range tasks[skip:] {
+			cursor++
+			scanned++
+			if (qname == "" || strings.EqualFold(t.Queue, qname)) && matchType(pattern, t.Type) {
+				res = append(res, t)
+				if len(res) == size {
+					return res, cursor, nil
+				}
+			}
+			if scanned == maxScanned {
+				break
+			}
+		}
+		if len(tasks) < scanPageSize && cursor == (page-1)*scanPageSize+len(tasks) {
+			return res, 0, nil
+		}
+	}
+	return res, cursor, nil
+}
+
+// matchType reports whether the task type matches the pattern.
+// An empty pattern matches any type.
+func matchType(pattern, typename string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, typename)
+	return ok
+}
+
+// listPage returns the given page of the tasks in the state.
+// qname is used only to list enqueued tasks.
+func (h *handler) listPage(state, qname string, page, size int) ([]*taskJSON, error) {
+	opts := []asynq.ListOption{asynq.Page(page), asynq.PageSize(size)}
+	var res []*taskJSON
+	switch state {
+	case stateEnqueued:
+		tasks, err := h.inspector.ListEnqueuedTasks(qname, opts...)
+		if errors.Is(err, asynq.ErrQueueNotFound) {
+			return nil, &statusError{http.StatusNotFound, err}
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tasks {
+			res = append(res, &taskJSON{ID: t.ID, Type: t.Type, Payload: t.Payload, Queue: t.Queue, Headers: t.Headers})
+		}
+	case stateInProgress:
+		tasks, err := h.inspector.ListInProgressTasks(opts...)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tasks {
+			res = append(res, &taskJSON{ID: t.ID, Type: t.Type, Payload: t.Payload, Queue: t.Queue, Headers: t.Headers})
+		}
+	case stateScheduled:
+		tasks, err := h.inspector.ListScheduledTasks(opts...)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tasks {
+			processAt := t.NextEnqueueAt
+			res = append(res, &taskJSON{ID: t.ID, Key: t.Key(), Type: t.Type, Payload: t.Payload,
+				Queue: t.Queue, Headers: t.Headers, NextProcessAt: &processAt})
+		}
+	case stateRetry:
+		tasks, err := h.inspector.ListRetryTasks(opts...)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tasks {
+			processAt := t.NextEnqueueAt
+			res = append(res, &taskJSON{ID: t.ID, Key: t.Key(), Type: t.Type, Payload: t.Payload,
+				Queue: t.Queue, Headers: t.Headers, MaxRetry: t.MaxRetry, Retried: t.Retried, ErrorMsg: t.ErrorMsg,
+				NextProcessAt: &processAt})
+		}
+	case stateDead:
+		tasks, err := h.inspector.ListDeadTasks(opts...)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tasks {
+			failedAt := t.LastFailedAt
+			res = append(res, &taskJSON{ID: t.ID, Key: t.Key(), Type: t.Type, Payload: t.Payload,
+				Queue: t.Queue, Headers: t.Headers, MaxRetry: t.MaxRetry, Retried: t.Retried, ErrorMsg: t.ErrorMsg,
+				LastFailedAt: &failedAt})
+		}
+	}
+	return res, nil
+}
+
+func (h *handler) enqueueAll(state string) (interface{}, error) {
+	var fn func() (int, error)
+	switch state {
+	case stateScheduled:
+		fn = h.inspector.EnqueueAllScheduledTasks
+	case stateRetry:
+		fn = h.inspector.EnqueueAllRetryTasks
+	case stateDead:
+		fn = h.inspector.EnqueueAllDeadTasks
+	default:
+		return nil, errorf(http.StatusBadRequest, "cannot enqueue tasks in %q state", state)
+	}
+	n, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"enqueued": n}, nil
+}
+
+func (h *handler) killAll(state string) (interface{}, error) {
+	var fn func() (int, error)
+	switch state {
+	case stateScheduled:
+		fn = h.inspector.KillAllScheduledTasks
+	case stateRetry:
+		fn = h.inspector.KillAllRetryTasks
+	default:
+		return nil, errorf(http.StatusBadRequest, "cannot kill tasks in %q state", state)
+	}
+	n, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"killed": n}, nil
+}
+
+func (h *handler) deleteAll(state string) (interface{}, error) {
+	var fn func() (int, error)
+	switch state {
+	case stateScheduled:
+		fn = h.inspector.DeleteAllScheduledTasks
+	case stateRetry:
+		fn = h.inspector.DeleteAllRetryTasks
+	case stateDead:
+		fn = h.inspector.DeleteAllDeadTasks
+	default:
+		return nil, errorf(http.StatusBadRequest, "cannot delete tasks in %q state", state)
+	}
+	n, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"deleted": n}, nil
+}
+
+// taskByKey runs the operation on the task with the key,
+// which should be the key of a task in the state.
+func (h *handler) taskByKey(state, key string, op func(key string) error) error {
+	prefix, ok := keyPrefixes[state]
+	if !ok || !strings.HasPrefix(key, prefix) {
+		return errorf(http.StatusBadRequest, "invalid key %q for a task in %q state", key, state)
+	}
+	err := op(key)
+	switch {
+	case errors.Is(err, asynq.ErrTaskNotFound):
+		return &statusError{http.StatusNotFound, err}
+	case errors.Is(err, asynq.ErrInvalidTaskKey):
+		return &statusError{http.StatusBadRequest, err}
+	}
+	return err
+}
+
+func (h *handler) cancel(id string) (interface{}, error) {
+	res, err := h.inspector.CancelTask(id)
+	if err != nil {
+		return nil, err
+	}
+	if res == asynq.CancelNotFound {
+		return nil, errorf(http.StatusNotFound, "task %q not found", id)
+	}
+	return map[string]string{"result": res.String()}, nil
+}
+
+func (h *handler) removeQueue(qname string, force bool) error {
+	err := h.inspector.RemoveQueue(qname, force)
+	switch {
+	case errors.Is(err, asynq.ErrQueueNotFound):
+		return &statusError{http.StatusNotFound, err}
+	case errors.Is(err, asynq.ErrQueueNotEmpty):
+		return &statusError{http.StatusConflict, err}
+	}
+	return err
+}
+
+type serverJSON struct {
+	ID             string         `json:"id"`
+	Host           string         `json:"host"`
+	PID            int            `json:"pid"`
+	Concurrency    int            `json:"concurrency"`
+	Queues         map[string]int `json:"queues"`
+	StrictPriority bool           `json:"strict_priority"`
+	Status         string         `json:"status"`
+	Started        time.Time      `json:"started"`
+	ActiveWorkers  int            `json:"active_workers"`
+}
+
+func (h *handler) servers() (interface{}, error) {
+	servers, err := h.inspector.ListServers()
+	if err != nil {
+		return nil, err
+	}
+	res := []*serverJSON{}
+	for _, s := range servers {
+		res = append(res, &serverJSON{
+			ID:             s.ID,
+			Host:           s.Host,
+			PID:            s.PID,
+			Concurrency:    s.Concurrency,
+			Queues:         s.Queues,
+			StrictPriority: s.StrictPriority,
+			Status:         s.Status,
+			Started:        s.Started,
+			ActiveWorkers:  s.ActiveWorkers,
+		})
+	}
+	return map[string]interface{}{"servers": res}, nil
+}
+
+type workerJSON struct {
+	Host    string        `json:"host"`
+	PID     int           `json:"pid"`
+	TaskID  string        `json:"task_id"`
+	Type    string        `json:"type"`
+	Payload asynq.Payload `json:"payload"`
+	Queue   string        `json:"queue"`
+	Started time.Time     `json:"started"`
+}
+
+func (h *handler) workers() (interface{}, error) {
+	workers, err := h.inspector.ListWorkers()
+	if err != nil {
+		return nil, err
+	}
+	res := []*workerJSON{}
+	for _, w := range workers {
+		res = append(res, &workerJSON{
+			Host:    w.Host,
+			PID:     w.PID,
+			TaskID:  w.TaskID,
+			Type:    w.Task.Type,
+			Payload: w.Task.Payload,
+			Queue:   w.Queue,
+			Started: w.Started,
+		})
+	}
+	return map[string]interface{}{"workers": res}, nil
+}
+
+// intParam returns the value of the integer query parameter, or def if not set.
+// The value should be at least min, and at most max if max is positive.
+func intParam(r *http.Request, name string, def, min, max int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < min || (max > 0 && n > max) {
+		if max > 0 {
+			return 0, errorf(http.StatusBadRequest, "%s parameter should be an integer between %d and %d", name, min, max)
+		}
+		return 0, errorf(http.StatusBadRequest, "%s parameter should be an integer of at least %d", name, min)
+	}
+	return n, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if se, ok := err.(*statusError); ok {
+		code = se.code
+	}
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
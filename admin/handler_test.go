@@ -0,0 +1,376 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hibiken/asynq"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// redis used for package testing.
+const (
+	redisAddr = "localhost:6379"
+	redisDB   = 11
+)
+
+func setup(t *testing.T) *redis.Client {
+	t.Helper()
+	r := redis.NewClient(&redis.Options{
+		Addr: redisAddr,
+		DB:   redisDB,
+	})
+	// Start each test with a clean slate.
+	h.FlushDB(t, r)
+	return r
+}
+
+func newTestHandler(t *testing.T, opts Options) http.Handler {
+	t.Helper()
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: redisAddr, DB: redisDB})
+	return NewHandler(inspector, opts)
+}
+
+// serve sends the request to the handler, with the header required by
+// mutating endpoints, and returns the response code and the decoded JSON body.
+func serve(t *testing.T, handler http.Handler, method, target string) (int, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	return serveRequest(t, handler, req)
+}
+
+// serveRequest sends the request to the handler and returns the response code
+// and the decoded JSON body.
+func serveRequest(t *testing.T, handler http.Handler, req *http.Request) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	method, target := req.Method, req.URL.String()
+	var body map[string]interface{}
+	if rec.Code != http.StatusNoContent {
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("%s %s: could not decode response body: %v", method, target, err)
+		}
+	}
+	return rec.Code, body
+}
+
+func TestHandlerStats(t *testing.T) {
+	r := setup(t)
+	handler := newTestHandler(t, Options{})
+	now := time.Now()
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{h.NewTaskMessage("send_email", nil)})
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{h.NewTaskMessageWithQueue("reindex", nil, "critical")}, "critical")
+	h.SeedDeadQueue(t, r, []h.ZSetEntry{{Msg: h.NewTaskMessage("sync", nil), Score: float64(now.Unix())}})
+	r.Set(h.Keys.ProcessedKey(now), 120, 0)
+	r.Set(h.Keys.FailureKey(now), 3, 0)
+
+	code, body := serve(t, handler, http.MethodGet, "/stats")
+	if code != http.StatusOK {
+		t.Fatalf("GET /stats returned %d, want %d: %v", code, http.StatusOK, body)
+	}
+	delete(body, "timestamp")
+	want := map[string]interface{}{
+		"enqueued":    2.0,
+		"in_progress": 0.0,
+		"scheduled":   0.0,
+		"retry":       0.0,
+		"dead":        1.0,
+		"processed":   120.0,
+		"failed":      3.0,
+		"queues": []interface{}{
+			map[string]interface{}{"name": "critical", "size": 1.0},
+			map[string]interface{}{"name": "default", "size": 1.0},
+		},
+	}
+	if diff := cmp.Diff(want, body); diff != "" {
+		t.Errorf("GET /stats = %v, want %v; (-want, +got)\n%s", body, want, diff)
+	}
+}
+
+func TestHandlerHistory(t *testing.T) {
+	r := setup(t)
+	handler := newTestHandler(t, Options{})
+	now := time.Now().UTC()
+	r.Set(h.Keys.ProcessedKey(now), 1000, 0)
+	r.Set(h.Keys.FailureKey(now), 10, 0)
+
+	code, body := serve(t, handler, http.MethodGet, "/history?days=2")
+	if code != http.StatusOK {
+		t.Fatalf("GET /history returned %d, want %d: %v", code, http.StatusOK, body)
+	}
+	want := map[string]interface{}{
+		"days": []interface{}{
+			map[string]interface{}{"date": now.Format("2006-01-02"), "processed": 1000.0, "failed": 10.0},
+			map[string]interface{}{"date": now.Add(-24 * time.Hour).Format("2006-01-02"), "processed": 0.0, "failed": 0.0},
+		},
+	}
+	if diff := cmp.Diff(want, body); diff != "" {
+		t.Errorf("GET /history = %v, want %v; (-want, +got)\n%s", body, want, diff)
+	}
+}
+
+func TestHandlerListTasks(t *testing.T) {
+	r := setup(t)
+	handler := newTestHandler(t, Options{})
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"to": "user@example.com"})
+	m1.Headers = map[string]string{"request_id": "abc123"}
+	m2 := h.NewTaskMessage("send_sms", nil)
+	m3 := h.NewTaskMessageWithQueue("reindex", nil, "low")
+	m4 := h.NewTaskMessage("sync", nil)
+	now := time.Now()
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1, m2})
+	h.SeedRetryQueue(t, r, []h.ZSetEntry{
+		{Msg: m3, Score: float64(now.Add(time.Minute).Unix())},
+		{Msg: m4, Score: float64(now.Add(time.Hour).Unix())},
+	})
+
+	tests := []struct {
+		target string
+		want   []string // IDs of the listed tasks
+	}{
+		{"/tasks/enqueued?queue=default", []string{m1.ID.String(), m2.ID.String()}},
+		{"/tasks/enqueued?queue=default&page_size=1&page=2", []string{m2.ID.String()}},
+		{"/tasks/enqueued?queue=default&type=send_e*", []string{m1.ID.String()}},
+		{"/tasks/retry", []string{m3.ID.String(), m4.ID.String()}},
+		{"/tasks/retry?queue=low", []string{m3.ID.String()}},
+		{"/tasks/retry?type=sync&cursor=2", []string{}},
+		{"/tasks/scheduled", []string{}},
+	}
+
+	for _, tc := range tests {
+		code, body := serve(t, handler, http.MethodGet, tc.target)
+		if code != http.StatusOK {
+			t.Errorf("GET %s returned %d, want %d: %v", tc.target, code, http.StatusOK, body)
+			continue
+		}
+		got := []string{}
+		for _, task := range body["tasks"].([]interface{}) {
+			got = append(got, task.(map[string]interface{})["id"].(string))
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("GET %s listed %v, want %v; (-want, +got)\n%s", tc.target, got, tc.want, diff)
+		}
+	}
+
+	if code, body := serve(t, handler, http.MethodGet, "/tasks/enqueued?queue=nonexistent"); code != http.StatusNotFound {
+		t.Errorf("GET /tasks/enqueued?queue=nonexistent returned %d, want %d: %v", code, http.StatusNotFound, body)
+	}
+	if code, body := serve(t, handler, http.MethodGet, "/tasks/retry?type=sync&page=2"); code != http.StatusBadRequest {
+		t.Errorf("GET /tasks/retry?type=sync&page=2 returned %d, want %d: %v", code, http.StatusBadRequest, body)
+	}
+
+	_, body := serve(t, handler, http.MethodGet, "/tasks/enqueued?queue=default&page_size=1")
+	task := body["tasks"].([]interface{})[0].(map[string]interface{})
+	want := map[string]interface{}{
+		"id":      m1.ID.String(),
+		"type":    "send_email",
+		"payload": map[string]interface{}{"to": "user@example.com"},
+		"queue":   "default",
+		"headers": map[string]interface{}{"request_id": "abc123"},
+	}
+	if diff := cmp.Diff(want, task); diff != "" {
+		t.Errorf("GET /tasks/enqueued listed %v, want %v; (-want, +got)\n%s", task, want, diff)
+	}
+}
+
+func TestHandlerListTasksWithCursor(t *testing.T) {
+	r := setup(t)
+	handler := newTestHandler(t, Options{})
+	now := time.Now()
+	var entries []h.ZSetEntry
+	for i := 0; i < maxScanned+50; i++ {
+		entries = append(entries, h.ZSetEntry{Msg: h.NewTaskMessage("sync", nil), Score: float64(now.Unix() + int64(i))})
+	}
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("send_email", nil)
+	entries[10].Msg = m1
+	entries[maxScanned+20].Msg = m2
+	h.SeedRetryQueue(t, r, entries)
+
+	tests := []struct {
+		target     string
+		want       []string // IDs of the listed tasks
+		nextCursor float64
+	}{
+		{"/tasks/retry?type=send_*&page_size=1", []string{m1.ID.String()}, 11},
+		{"/tasks/retry?type=send_*&page_size=1&cursor=11", []string{}, maxScanned + 11},
+		{"/tasks/retry?type=send_*&page_size=1&cursor=1011", []string{m2.ID.String()}, maxScanned + 21},
+		{"/tasks/retry?type=send_*&page_size=10&cursor=1021", []string{}, 0},
+		{"/tasks/retry?type=send_*&cursor=5000", []string{}, 0},
+	}
+
+	for _, tc := range tests {
+		code, body := serve(t, handler, http.MethodGet, tc.target)
+		if code != http.StatusOK {
+			t.Errorf("GET %s returned %d, want %d: %v", tc.target, code, http.StatusOK, body)
+			continue
+		}
+		got := []string{}
+		for _, task := range body["tasks"].([]interface{}) {
+			got = append(got, task.(map[string]interface{})["id"].(string))
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("GET %s listed %v, want %v; (-want, +got)\n%s", tc.target, got, tc.want, diff)
+		}
+		next, _ := body["next_cursor"].(float64)
+		if next != tc.nextCursor {
+			t.Errorf("GET %s returned next_cursor %v, want %v", tc.target, next, tc.nextCursor)
+		}
+	}
+}
+
+func TestHandlerTaskOperations(t *testing.T) {
+	r := setup(t)
+	handler := newTestHandler(t, Options{})
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("send_sms", nil)
+	m3 := h.NewTaskMessage("reindex", nil)
+	score := time.Now().Add(time.Hour).Unix()
+	h.SeedRetryQueue(t, r, []h.ZSetEntry{{Msg: m1, Score: float64(score)}, {Msg: m2, Score: float64(score)}})
+	h.SeedDeadQueue(t, r, []h.ZSetEntry{{Msg: m3, Score: float64(score)}})
+
+	key := fmt.Sprintf("r:%d:%v", score, m1.ID)
+	tests := []struct {
+		method string
+		target string
+		code   int
+		want   map[string]interface{}
+	}{
+		{http.MethodPost, "/tasks/retry/" + key + "/kill", http.StatusNoContent, nil},
+		{http.MethodPost, "/tasks/retry/" + key + "/kill", http.StatusNotFound, nil},
+		{http.MethodPost, "/tasks/retry/d" + key[1:] + "/kill", http.StatusBadRequest, nil},
+		{http.MethodPost, "/tasks/retry/r:abc:def/enqueue", http.StatusBadRequest, nil},
+		{http.MethodPost, "/tasks/dead/d" + key[1:] + "/kill", http.StatusBadRequest, nil},
+		{http.MethodPost, "/tasks/dead/kill", http.StatusBadRequest, nil},
+		{http.MethodPost, "/tasks/dead/enqueue", http.StatusOK, map[string]interface{}{"enqueued": 2.0}},
+		{http.MethodDelete, "/tasks/retry", http.StatusOK, map[string]interface{}{"deleted": 1.0}},
+		{http.MethodPut, "/tasks/retry", http.StatusMethodNotAllowed, nil},
+		{http.MethodGet, "/tasks/unknown", http.StatusNotFound, nil},
+		{http.MethodGet, "/tasks/enqueued", http.StatusBadRequest, nil},
+		{http.MethodGet, "/tasks/dead?page=0", http.StatusBadRequest, nil},
+		{http.MethodGet, "/tasks/dead?type=[", http.StatusBadRequest, nil},
+	}
+
+	for _, tc := range tests {
+		code, body := serve(t, handler, tc.method, tc.target)
+		if code != tc.code {
+			t.Errorf("%s %s returned %d, want %d: %v", tc.method, tc.target, code, tc.code, body)
+			continue
+		}
+		if tc.want != nil {
+			if diff := cmp.Diff(tc.want, body); diff != "" {
+				t.Errorf("%s %s = %v, want %v; (-want, +got)\n%s", tc.method, tc.target, body, tc.want, diff)
+			}
+		}
+	}
+	if got := len(h.GetEnqueuedMessages(t, r)); got != 2 {
+		t.Errorf("%q has %d tasks, want 2", h.Keys.DefaultQueue(), got)
+	}
+	if got := len(h.GetRetryMessages(t, r)) + len(h.GetDeadMessages(t, r)); got != 0 {
+		t.Errorf("%d tasks are left in retry and dead states, want 0", got)
+	}
+}
+
+func TestHandlerCancelAndRemoveQueue(t *testing.T) {
+	r := setup(t)
+	handler := newTestHandler(t, Options{})
+	m1 := h.NewTaskMessage("send_email", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+	h.SeedTaskIndex(t, r, []*base.TaskMessage{m1})
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{h.NewTaskMessageWithQueue("reindex", nil, "low")}, "low")
+
+	tests := []struct {
+		method string
+		target string
+		code   int
+	}{
+		{http.MethodPost, "/cancel/" + m1.ID.String(), http.StatusOK},
+		{http.MethodPost, "/cancel/" + m1.ID.String(), http.StatusNotFound},
+		{http.MethodGet, "/cancel/" + m1.ID.String(), http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/queues/low", http.StatusConflict},
+		{http.MethodDelete, "/queues/nonexistent", http.StatusNotFound},
+		{http.MethodDelete, "/queues/low?force=true", http.StatusNoContent},
+	}
+
+	for _, tc := range tests {
+		if code, body := serve(t, handler, tc.method, tc.target); code != tc.code {
+			t.Errorf("%s %s returned %d, want %d: %v", tc.method, tc.target, code, tc.code, body)
+		}
+	}
+}
+
+func TestHandlerRejectsCrossSiteRequests(t *testing.T) {
+	r := setup(t)
+	handler := newTestHandler(t, Options{})
+	m1 := h.NewTaskMessage("send_email", nil)
+	h.SeedDeadQueue(t, r, []h.ZSetEntry{{Msg: m1, Score: float64(time.Now().Unix())}})
+
+	tests := []struct {
+		method string
+		target string
+		header map[string]string
+		code   int
+	}{
+		{http.MethodGet, "/tasks/dead", nil, http.StatusOK},
+		{http.MethodPost, "/tasks/dead/enqueue", nil, http.StatusForbidden},
+		{http.MethodPost, "/cancel/" + m1.ID.String(), nil, http.StatusForbidden},
+		{http.MethodDelete, "/tasks/dead", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, http.StatusForbidden},
+		{http.MethodPost, "/tasks/dead/enqueue", map[string]string{"X-Requested-With": "XMLHttpRequest", "Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, tc.target, nil)
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		if code, body := serveRequest(t, handler, req); code != tc.code {
+			t.Errorf("%s %s with header %v returned %d, want %d: %v", tc.method, tc.target, tc.header, code, tc.code, body)
+		}
+	}
+	if got := len(h.GetDeadMessages(t, r)); got != 1 {
+		t.Errorf("%q has %d tasks, want 1", h.Keys.DeadQueue(), got)
+	}
+}
+
+func TestHandlerReadOnly(t *testing.T) {
+	r := setup(t)
+	handler := newTestHandler(t, Options{ReadOnly: true})
+	m1 := h.NewTaskMessage("send_email", nil)
+	h.SeedDeadQueue(t, r, []h.ZSetEntry{{Msg: m1, Score: float64(time.Now().Unix())}})
+
+	tests := []struct {
+		method string
+		target string
+		code   int
+	}{
+		{http.MethodGet, "/tasks/dead", http.StatusOK},
+		{http.MethodGet, "/servers", http.StatusOK},
+		{http.MethodGet, "/workers", http.StatusOK},
+		{http.MethodPost, "/tasks/dead/enqueue", http.StatusForbidden},
+		{http.MethodDelete, "/tasks/dead", http.StatusForbidden},
+		{http.MethodPost, "/cancel/" + m1.ID.String(), http.StatusForbidden},
+		{http.MethodDelete, "/queues/default", http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		if code, body := serve(t, handler, tc.method, tc.target); code != tc.code {
+			t.Errorf("%s %s returned %d, want %d: %v", tc.method, tc.target, code, tc.code, body)
+		}
+	}
+	if got := len(h.GetDeadMessages(t, r)); got != 1 {
+		t.Errorf("%q has %d tasks, want 1", h.Keys.DeadQueue(), got)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBasicAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := BasicAuth("admin", "secret")(ok)
+
+	tests := []struct {
+		desc     string
+		username string
+		password string
+		setAuth  bool
+		want     int
+	}{
+		{"valid credentials", "admin", "secret", true, http.StatusOK},
+		{"wrong password", "admin", "wrong", true, http.StatusUnauthorized},
+		{"wrong username", "root", "secret", true, http.StatusUnauthorized},
+		{"no credentials", "", "", false, http.StatusUnauthorized},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		if tc.setAuth {
+			req.SetBasicAuth(tc.username, tc.password)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s; got status %d, want %d", tc.desc, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := BearerAuth("token123")(ok)
+
+	tests := []struct {
+		auth string
+		want int
+	}{
+		{"Bearer token123", http.StatusOK},
+		{"Bearer token12", http.StatusUnauthorized},
+		{"token123", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("Authorization %q; got status %d, want %d", tc.auth, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestNewHandlerMiddlewareOrder(t *testing.T) {
+	var calls []string
+	mw := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, name)
+				w.WriteHeader(http.StatusTeapot)
+			})
+		}
+	}
+	handler := NewHandler(nil, Options{Middleware: []func(http.Handler) http.Handler{mw("first"), mw("second")}})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if len(calls) != 1 || calls[0] != "first" {
+		t.Errorf("middleware calls = %v, want [first]", calls)
+	}
+}
@@ -5,14 +5,18 @@
 package asynq
 
 import (
+	"fmt"
 	"os"
 	"sort"
 	"testing"
 
 	"github.com/go-redis/redis/v7"
 	"github.com/google/go-cmp/cmp"
+	"github.com/hibiken/asynq/broker/inmem"
 	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
 	"github.com/hibiken/asynq/internal/log"
+	"github.com/hibiken/asynq/internal/rdb"
 )
 
 // This file defines test helper functions used by
@@ -147,3 +151,150 @@ func TestParseRedisURIErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateRedisClient(t *testing.T) {
+	tests := []struct {
+		desc string
+		opt  RedisConnOpt
+		want string // type of the client
+	}{
+		{"RedisClientOpt", RedisClientOpt{Addr: "localhost:6379"}, "*redis.Client"},
+		{"*RedisClientOpt", &RedisClientOpt{Addr: "localhost:6379"}, "*redis.Client"},
+		{"RedisFailoverClientOpt", RedisFailoverClientOpt{MasterName: "mymaster", SentinelAddrs: []string{"localhost:5000"}}, "*redis.Client"},
+		{"RedisClusterClientOpt", RedisClusterClientOpt{Addrs: []string{"localhost:7000", "localhost:7001"}}, "*redis.ClusterClient"},
+		{"*RedisClusterClientOpt", &RedisClusterClientOpt{Addrs: []string{"localhost:7000", "localhost:7001"}}, "*redis.ClusterClient"},
+	}
+
+	for _, tc := range tests {
+		c := createRedisClient(tc.opt)
+		if got := fmt.Sprintf("%T", c); got != tc.want {
+			t.Errorf("%s: createRedisClient returned %s, want %s", tc.desc, got, tc.want)
+		}
+		c.Close()
+	}
+}
+
+// brokerFixture is a broker used in tests along with helpers to seed and
+// inspect the state of the broker.
+type brokerFixture interface {
+	// name of the broker implementation used in test failure messages.
+	name() string
+
+	// broker returns the broker under test.
+	broker() base.Broker
+
+	// flush clears all data in the broker.
+	flush(tb testing.TB)
+
+	seedEnqueued(tb testing.TB, msgs []*base.TaskMessage, qname string)
+	seedInProgress(tb testing.TB, msgs []*base.TaskMessage)
+
+	getInProgress(tb testing.TB) []*base.TaskMessage
+	getScheduledEntries(tb testing.TB) []h.ZSetEntry
+	getRetryEntries(tb testing.TB) []h.ZSetEntry
+	getDead(tb testing.TB) []*base.TaskMessage
+}
+
+// brokerFixtures returns fixtures for each broker implementation
+// the server should work with.
+func brokerFixtures(tb testing.TB) []brokerFixture {
+	r := setup(tb)
+	return []brokerFixture{
+		&redisFixture{r: r, rdb: rdb.NewRDB(r)},
+		&inmemFixture{b: inmem.New()},
+	}
+}
+
+type redisFixture struct {
+	r   *redis.Client
+	rdb *rdb.RDB
+}
+
+func (f *redisFixture) name() string        { return "redis" }
+func (f *redisFixture) broker() base.Broker { return f.rdb }
+func (f *redisFixture) flush(tb testing.TB) { h.FlushDB(tb, f.r) }
+
+func (f *redisFixture) seedEnqueued(tb testing.TB, msgs []*base.TaskMessage, qname string) {
+	h.SeedEnqueuedQueue(tb, f.r, msgs, qname)
+}
+
+func (f *redisFixture) seedInProgress(tb testing.TB, msgs []*base.TaskMessage) {
+	h.SeedInProgressQueue(tb, f.r, msgs)
+}
+
+func (f *redisFixture) getInProgress(tb testing.TB) []*base.TaskMessage {
+	return h.GetInProgressMessages(tb, f.r)
+}
+
+func (f *redisFixture) getScheduledEntries(tb testing.TB) []h.ZSetEntry {
+	return h.GetScheduledEntries(tb, f.r)
+}
+
+func (f *redisFixture) getRetryEntries(tb testing.TB) []h.ZSetEntry {
+	return h.GetRetryEntries(tb, f.r)
+}
+
+func (f *redisFixture) getDead(tb testing.TB) []*base.TaskMessage {
+	return h.GetDeadMessages(tb, f.r)
+}
+
+type inmemFixture struct {
+	b *inmem.Broker
+}
+
+func (f *inmemFixture) name() string        { return "inmem" }
+func (f *inmemFixture) broker() base.Broker { return f.b }
+func (f *inmemFixture) flush(tb testing.TB) { f.b = inmem.New() }
+
+func (f *inmemFixture) seedEnqueued(tb testing.TB, msgs []*base.TaskMessage, qname string) {
+	tb.Helper()
+	for _, msg := range msgs {
+		m := *msg
+		m.Queue = qname
+		if err := f.b.Enqueue(&m); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// seedInProgress moves each message to in-progress list
+// by enqueueing and dequeueing it.
+func (f *inmemFixture) seedInProgress(tb testing.TB, msgs []*base.TaskMessage) {
+	tb.Helper()
+	for _, msg := range msgs {
+		if err := f.b.Enqueue(msg); err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := f.b.Dequeue(msg.Queue); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func (f *inmemFixture) getInProgress(tb testing.TB) []*base.TaskMessage {
+	return f.b.InProgressTasks()
+}
+
+func (f *inmemFixture) getScheduledEntries(tb testing.TB) []h.ZSetEntry {
+	var res []h.ZSetEntry
+	for _, e := range f.b.ScheduledTasks() {
+		res = append(res, h.ZSetEntry{Msg: e.Msg, Score: float64(e.Time.Unix())})
+	}
+	return res
+}
+
+func (f *inmemFixture) getRetryEntries(tb testing.TB) []h.ZSetEntry {
+	var res []h.ZSetEntry
+	for _, e := range f.b.RetryTasks() {
+		res = append(res, h.ZSetEntry{Msg: e.Msg, Score: float64(e.Time.Unix())})
+	}
+	return res
+}
+
+func (f *inmemFixture) getDead(tb testing.TB) []*base.TaskMessage {
+	var res []*base.TaskMessage
+	for _, e := range f.b.DeadTasks() {
+		res = append(res, e.Msg)
+	}
+	return res
+}
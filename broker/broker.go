@@ -0,0 +1,106 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package broker defines the contract between asynq and the message broker
+// which stores tasks.
+//
+// Server and Client use redis as their broker by default.
+// To run them on a different backend, implement the Broker interface
+// and pass it to asynq.NewServerWithBroker and asynq.NewClientWithBroker.
+package broker
+
+import "github.com/hibiken/asynq/internal/base"
+
+// Broker is a message broker that supports operations to manage task queues.
+//
+// Dequeue must return ErrNoProcessableTask if all of the given queues are
+// empty. It should block for a short while, e.g. a second, waiting for a task
+// before returning the error since the server calls Dequeue in a loop.
+// EnqueueUnique and ScheduleUnique must return ErrDuplicateTask if
+// another task holds the uniqueness lock identified by TaskMessage.UniqueKey.
+type Broker = base.Broker
+
+// BatchDequeuer is an optional interface implemented by brokers which can
+// dequeue multiple tasks in a single round trip.
+// The server uses it when Config.PrefetchCount is greater than one.
+type BatchDequeuer = base.BatchDequeuer
+
+// DeadTrimmer is an optional interface implemented by brokers which let the
+// server enforce Config.DeadRetention and pass evicted tasks to
+// Config.DeadTaskSink. Brokers which don't implement it should trim the
+// dead queue themselves when a task is killed; the server logs a warning
+// if the retention or the sink is configured for such a broker.
+type DeadTrimmer = base.DeadTrimmer
+
+// Retention specifies how many dead tasks are kept and for how long.
+type Retention = base.Retention
+
+// DeadEntry is a task in the dead queue along with the time it was killed.
+type DeadEntry = base.DeadEntry
+
+// Rescheduler is an optional interface implemented by brokers which can
+// move a task back to the scheduled tasks without counting it as a retry.
+// Tasks rescheduled by handlers are retried at the time instead if the
+// broker does not implement it.
+type Rescheduler = base.Rescheduler
+
+// HistoryRecorder is an optional interface implemented by brokers which can
+// record the lifecycle history of tasks. Servers and clients record
+// events only if history is enabled.
+type HistoryRecorder = base.HistoryRecorder
+
+// TaskEvent is an event in the lifecycle of a task.
+type TaskEvent = base.TaskEvent
+
+// Canceler is an optional interface implemented by brokers which can
+// cancel tasks by ID. Client.Cancel uses it to remove tasks which have not
+// started, and the server skips dequeued tasks which have a tombstone.
+type Canceler = base.Canceler
+
+// CancelResult is the outcome of canceling a task by ID.
+type CancelResult = base.CancelResult
+
+// TaskMessage is the message passed around between the client, the broker
+// and the server.
+type TaskMessage = base.TaskMessage
+
+// ServerState holds the state of a running server.
+// It is passed to the broker to record server heartbeats.
+type ServerState = base.ServerState
+
+// ServerInfo holds information about a running server.
+type ServerInfo = base.ServerInfo
+
+// WorkerInfo holds information about a task being processed by a server.
+type WorkerInfo = base.WorkerInfo
+
+// Subscription is a subscription to task cancelation messages.
+type Subscription = base.Subscription
+
+// Errors that a Broker implementation returns to signal conditions
+// which the server and client handle.
+var (
+	// ErrNoProcessableTask indicates that there are no tasks ready to be processed.
+	ErrNoProcessableTask = base.ErrNoProcessableTask
+
+	// ErrTaskNotFound indicates that a task that matches the given identifier was not found.
+	ErrTaskNotFound = base.ErrTaskNotFound
+
+	// ErrDuplicateTask indicates that another task with the same unique key holds the uniqueness lock.
+	ErrDuplicateTask = base.ErrDuplicateTask
+)
+
+// Outcomes of canceling a task that a Canceler returns.
+const (
+	// CancelNotFound indicates that no pending, scheduled or running task
+	// with the ID was found.
+	CancelNotFound = base.CancelNotFound
+
+	// CancelRemoved indicates that the task had not started and was removed.
+	CancelRemoved = base.CancelRemoved
+
+	// CancelRunning indicates that the task may be running and a tombstone
+	// is recorded for the task.
+	CancelRunning = base.CancelRunning
+)
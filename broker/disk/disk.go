@@ -0,0 +1,931 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package disk provides a broker which persists tasks to a file on local disk.
+//
+// The broker keeps all tasks in memory and records every change to an
+// append-only log file. When the broker is opened, the log is replayed to
+// restore the tasks, so pending, scheduled, retry and dead tasks survive
+// process restarts. Tasks which were in progress when the process stopped
+// are restored by the server when it starts. The log is compacted
+// periodically by rewriting it with the current state.
+//
+// Enqueued and scheduled tasks are synced to disk before the client is
+// acknowledged. Other changes are written to the file without syncing,
+// so a crash of the operating system may cause a task to be processed again.
+//
+// The broker is meant to be used by a single process; a client and a server
+// in the process should share the same broker.
+//
+// Example:
+//
+//	b, err := disk.Open("/var/lib/myapp/tasks.log", disk.Options{})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	client := asynq.NewClientWithBroker(b)
+//	srv := asynq.NewServerWithBroker(b, asynq.Config{Concurrency: 10})
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/broker"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/pubsub"
+)
+
+// ErrClosed is returned by the broker operations after the broker is closed.
+var ErrClosed = errors.New("disk: broker is closed")
+
+const (
+	// time to wait for a task to be enqueued before Dequeue gives up.
+	dequeueTimeout = time.Second
+
+	defaultCompactInterval = 5 * time.Minute
+
+	// max number of dead tasks passed to evict at once by TrimDead.
+	trimBatchSize = 100
+)
+
+// Options specifies the broker's behavior.
+type Options struct {
+	// CompactInterval specifies how often the log file is compacted.
+	//
+	// If unset or zero, default interval of 5 minutes is used.
+	CompactInterval time.Duration
+}
+
+// Entry is a task in a set ordered by time, such as the scheduled, retry or
+// dead set, along with the time associated with the task.
+type Entry struct {
+	Msg *broker.TaskMessage
+
+	// Time is when the task is to be processed for scheduled and retry tasks,
+	// and when the task died for dead tasks.
+	Time time.Time
+}
+
+type state int
+
+const (
+	statePending state = iota
+	stateInProgress
+	stateScheduled
+	stateRetry
+	stateDead
+)
+
+// names of the sets recorded in the log.
+var setNames = map[state]string{
+	stateScheduled: "scheduled",
+	stateRetry:     "retry",
+	stateDead:      "dead",
+}
+
+var setStates = map[string]state{
+	"scheduled": stateScheduled,
+	"retry":     stateRetry,
+	"dead":      stateDead,
+}
+
+// task is a task stored in the broker.
+type task struct {
+	msg   *base.TaskMessage
+	state state
+	time  time.Time // process time for scheduled and retry tasks, died time for dead tasks
+}
+
+type lock struct {
+	id       string
+	expireAt time.Time
+}
+
+// Broker is a file-backed implementation of broker.Broker.
+//
+// Brokers are safe for concurrent use by multiple goroutines.
+type Broker struct {
+	path string
+
+	mu sync.Mutex // guards all fields below
+	f  logFile
+
+	// writeErr is set if the log file could not be restored after a failed
+	// write. Writes fail with writeErr until the log is compacted, since
+	// records appended after a partially written record cannot be replayed.
+	writeErr error
+
+	// tasks keyed by task ID.
+	tasks map[string]*task
+
+	// IDs of pending tasks keyed by lowercased queue name;
+	// head of the slice is dequeued first.
+	queues map[string][]string
+
+	// uniqueness locks keyed by unique key.
+	locks map[string]lock
+
+	// number of records appended to the log since the last compaction.
+	appended int
+
+	closed bool
+
+	// closed and replaced whenever a task is pushed to a queue
+	// to wake up goroutines waiting in Dequeue.
+	notify chan struct{}
+
+	pubsub *pubsub.PubSub
+
+	// channel to stop the compaction goroutine.
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open opens the log file at the given path, creating it if it does not
+// exist, and returns a broker which stores its tasks in the file.
+func Open(path string, opt Options) (*Broker, error) {
+	interval := opt.CompactInterval
+	if interval == 0 {
+		interval = defaultCompactInterval
+	}
+	b := &Broker{
+		path:   path,
+		tasks:  make(map[string]*task),
+		queues: make(map[string][]string),
+		locks:  make(map[string]lock),
+		notify: make(chan struct{}),
+		pubsub: pubsub.New(),
+		done:   make(chan struct{}),
+	}
+	if err := b.replay(); err != nil {
+		return nil, err
+	}
+	// Rewrite the log to drop obsolete records and any partially written
+	// record left by a crash.
+	if err := b.compact(); err != nil {
+		return nil, err
+	}
+	b.wg.Add(1)
+	go b.compactLoop(interval)
+	return b, nil
+}
+
+// logFile is the log file the broker appends records to; an *os.File.
+type logFile interface {
+	io.WriteCloser
+	Seek(offset int64, whence int) (int64, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// record is an entry in the log file describing a change to the tasks.
+type record struct {
+	Op string `json:"op"`
+
+	Msg  *base.TaskMessage `json:"msg,omitempty"`
+	ID   string            `json:"id,omitempty"`
+	Key  string            `json:"key,omitempty"`
+	Set  string            `json:"set,omitempty"`
+	Time time.Time         `json:"time"`
+	Head bool              `json:"head,omitempty"`
+}
+
+// Log record operations.
+const (
+	opPush     = "push"     // add Msg to its queue; to the head if Head is true
+	opActivate = "activate" // move pending task ID to in-progress
+	opAdd      = "add"      // add Msg to Set with Time
+	opDelete   = "delete"   // remove task ID
+	opLock     = "lock"     // acquire uniqueness lock Key for task ID until Time
+	opUnlock   = "unlock"   // release uniqueness lock Key
+)
+
+func pushRecord(msg *base.TaskMessage, head bool) record {
+	return record{Op: opPush, Msg: msg, Head: head}
+}
+
+func addRecord(msg *base.TaskMessage, s state, t time.Time) record {
+	return record{Op: opAdd, Msg: msg, Set: setNames[s], Time: t}
+}
+
+// replay reads the log file and applies each record.
+func (b *Broker) replay() error {
+	f, err := os.Open(b.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Ignore a record without a trailing newline;
+			// the process stopped while writing the record.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("disk: corrupt record at offset %d in %s: %v", offset, b.path, err)
+		}
+		b.apply(rec)
+		offset += int64(len(line))
+	}
+}
+
+// write appends the records to the log file and applies them.
+// If sync is true, the file is synced to disk before returning.
+//
+// Must be called with b.mu held.
+func (b *Broker) write(sync bool, recs ...record) error {
+	if b.closed {
+		return ErrClosed
+	}
+	if b.writeErr != nil {
+		return b.writeErr
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf) // Encode appends a newline to each record.
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	offset, err := b.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := b.f.Write(buf.Bytes()); err != nil {
+		return b.truncate(offset, err)
+	}
+	if sync {
+		if err := b.f.Sync(); err != nil {
+			return b.truncate(offset, err)
+		}
+	}
+	for _, rec := range recs {
+		b.apply(rec)
+	}
+	b.appended += len(recs)
+	return nil
+}
+
+// truncate removes the data written to the log file after offset by
+// a failed write and returns err, so that the records which are not applied
+// are not replayed and later records are not appended to a partial record.
+//
+// Must be called with b.mu held.
+func (b *Broker) truncate(offset int64, err error) error {
+	if terr := b.f.Truncate(offset); terr != nil {
+		b.writeErr = fmt.Errorf("disk: could not truncate %s after failed write (%v): %v", b.path, err, terr)
+		return b.writeErr
+	}
+	return err
+}
+
+// apply applies the record to the in-memory state.
+//
+// Must be called with b.mu held.
+func (b *Broker) apply(rec record) {
+	switch rec.Op {
+	case opPush:
+		id := rec.Msg.ID.String()
+		b.remove(id)
+		b.tasks[id] = &task{msg: rec.Msg, state: statePending}
+		key := queueKey(rec.Msg.Queue)
+		if rec.Head {
+			b.queues[key] = append([]string{id}, b.queues[key]...)
+		} else {
+			b.queues[key] = append(b.queues[key], id)
+		}
+		close(b.notify)
+		b.notify = make(chan struct{})
+	case opActivate:
+		t, ok := b.tasks[rec.ID]
+		if !ok || t.state != statePending {
+			return
+		}
+		b.removeFromQueue(t.msg.Queue, rec.ID)
+		t.state = stateInProgress
+	case opAdd:
+		id := rec.Msg.ID.String()
+		b.remove(id)
+		b.tasks[id] = &task{msg: rec.Msg, state: setStates[rec.Set], time: rec.Time}
+	case opDelete:
+		b.remove(rec.ID)
+	case opLock:
+		b.locks[rec.Key] = lock{id: rec.ID, expireAt: rec.Time}
+	case opUnlock:
+		delete(b.locks, rec.Key)
+	}
+}
+
+// remove removes the task with the given id, if any.
+//
+// Must be called with b.mu held.
+func (b *Broker) remove(id string) {
+	t, ok := b.tasks[id]
+	if !ok {
+		return
+	}
+	if t.state == statePending {
+		b.removeFromQueue(t.msg.Queue, id)
+	}
+	delete(b.tasks, id)
+}
+
+// Must be called with b.mu held.
+func (b *Broker) removeFromQueue(qname, id string) {
+	key := queueKey(qname)
+	q := b.queues[key]
+	for i, x := range q {
+		if x == id {
+			b.queues[key] = append(q[:i:i], q[i+1:]...)
+			return
+		}
+	}
+}
+
+func queueKey(qname string) string {
+	return strings.ToLower(qname)
+}
+
+// clone returns a deep copy of the message.
+func clone(msg *base.TaskMessage) (*base.TaskMessage, error) {
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var c base.TaskMessage
+	if err := json.Unmarshal(bytes, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func mustClone(msg *base.TaskMessage) *base.TaskMessage {
+	c, err := clone(msg)
+	if err != nil {
+		// msg was decoded from JSON when stored, so encoding cannot fail.
+		panic(err)
+	}
+	return c
+}
+
+// lockRecord returns a record to acquire the uniqueness lock for the message.
+// It reports false if the lock is held by another task.
+//
+// Must be called with b.mu held.
+func (b *Broker) lockRecord(msg *base.TaskMessage, ttl time.Duration) (record, bool) {
+	now := time.Now()
+	if l, ok := b.locks[msg.UniqueKey]; ok && now.Before(l.expireAt) {
+		return record{}, false
+	}
+	return record{Op: opLock, Key: msg.UniqueKey, ID: msg.ID.String(), Time: now.Add(ttl)}, true
+}
+
+// Enqueue inserts the given task to the tail of the queue.
+func (b *Broker) Enqueue(msg *broker.TaskMessage) error {
+	c, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.write(true, pushRecord(c, false))
+}
+
+// EnqueueUnique inserts the given task if the task's uniqueness lock can be acquired.
+// It returns broker.ErrDuplicateTask if the lock cannot be acquired.
+func (b *Broker) EnqueueUnique(msg *broker.TaskMessage, ttl time.Duration) error {
+	c, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lockRec, ok := b.lockRecord(c, ttl)
+	if !ok {
+		return base.ErrDuplicateTask
+	}
+	return b.write(true, lockRec, pushRecord(c, false))
+}
+
+// Dequeue queries given queues in order and pops a task message if there is one and returns it.
+// If all queues are empty, it waits up to a second for a task to be enqueued
+// before returning broker.ErrNoProcessableTask.
+func (b *Broker) Dequeue(qnames ...string) (*broker.TaskMessage, error) {
+	timer := time.NewTimer(dequeueTimeout)
+	defer timer.Stop()
+	for {
+		b.mu.Lock()
+		msg, err := b.pop(qnames)
+		notify := b.notify
+		b.mu.Unlock()
+		if msg != nil || err != nil {
+			return msg, err
+		}
+		select {
+		case <-notify:
+		case <-timer.C:
+			return nil, base.ErrNoProcessableTask
+		}
+	}
+}
+
+// pop moves the task at the head of the first non-empty queue to in-progress
+// and returns the task. It returns nil if all queues are empty.
+//
+// Must be called with b.mu held.
+func (b *Broker) pop(qnames []string) (*base.TaskMessage, error) {
+	for _, qname := range qnames {
+		q := b.queues[queueKey(qname)]
+		if len(q) == 0 {
+			continue
+		}
+		id := q[0]
+		if err := b.write(false, record{Op: opActivate, ID: id}); err != nil {
+			return nil, err
+		}
+		return mustClone(b.tasks[id].msg), nil
+	}
+	return nil, nil
+}
+
+// Done removes the task from in-progress tasks to mark the task as done.
+// It removes a uniqueness lock acquired by the task, if any.
+func (b *Broker) Done(msg *broker.TaskMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	recs := []record{{Op: opDelete, ID: msg.ID.String()}}
+	if l, ok := b.locks[msg.UniqueKey]; ok && l.id == msg.ID.String() {
+		recs = append(recs, record{Op: opUnlock, Key: msg.UniqueKey})
+	}
+	return b.write(false, recs...)
+}
+
+// Requeue moves the task from in-progress tasks to the head of its queue.
+func (b *Broker) Requeue(msg *broker.TaskMessage) error {
+	c, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.write(false, pushRecord(c, true))
+}
+
+// Schedule adds the task to the scheduled set to be processed in the future.
+func (b *Broker) Schedule(msg *broker.TaskMessage, processAt time.Time) error {
+	c, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.write(true, addRecord(c, stateScheduled, processAt))
+}
+
+// ScheduleUnique adds the task to the scheduled set if the uniqueness lock can be acquired.
+// It returns broker.ErrDuplicateTask if the lock cannot be acquired.
+func (b *Broker) ScheduleUnique(msg *broker.TaskMessage, processAt time.Time, ttl time.Duration) error {
+	c, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lockRec, ok := b.lockRecord(c, ttl)
+	if !ok {
+		return base.ErrDuplicateTask
+	}
+	return b.write(true, lockRec, addRecord(c, stateScheduled, processAt))
+}
+
+// Retry moves the task from in-progress tasks to retry set, incrementing retry count
+// and assigning error message to the task message.
+func (b *Broker) Retry(msg *broker.TaskMessage, processAt time.Time, errMsg string) error {
+	c, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	c.Retried++
+	c.ErrorMsg = errMsg
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.write(false, addRecord(c, stateRetry, processAt))
+}
+
+// Reschedule moves the task from in-progress tasks to scheduled set
+// without modifying the task.
+func (b *Broker) Reschedule(msg *broker.TaskMessage, processAt time.Time) error {
+	c, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.write(false, addRecord(c, stateScheduled, processAt))
+}
+
+// Kill moves the task from in-progress tasks to dead set, assigning
+// the error message to the task.
+//
+// The dead set is not trimmed, servers trim it periodically with TrimDead.
+func (b *Broker) Kill(msg *broker.TaskMessage, errMsg string) error {
+	c, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	c.ErrorMsg = errMsg
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.write(false, addRecord(c, stateDead, time.Now()))
+}
+
+// TrimDead removes dead tasks which exceed the given retention limits
+// and returns the number of tasks removed, see broker.DeadTrimmer.
+//
+// The broker is not locked while evict runs, so tasks removed from
+// the dead set in the meantime are not counted.
+func (b *Broker) TrimDead(def broker.Retention, perQueue map[string]broker.Retention, evict func([]*broker.DeadEntry) error) (int, error) {
+	b.mu.Lock()
+	dead := b.entries(stateDead)
+	entries := make([]*base.DeadEntry, len(dead))
+	for i, e := range dead {
+		entries[i] = &base.DeadEntry{Msg: e.Msg, DiedAt: e.Time}
+	}
+	trim := base.DeadToTrim(entries, def, perQueue, time.Now())
+	for _, e := range trim {
+		e.Msg = mustClone(e.Msg)
+	}
+	b.mu.Unlock()
+
+	var n int
+	for len(trim) > 0 {
+		batch := trim
+		if len(batch) > trimBatchSize {
+			batch = batch[:trimBatchSize]
+		}
+		trim = trim[len(batch):]
+		if evict != nil {
+			if err := evict(batch); err != nil {
+				return n, err
+			}
+		}
+		removed, err := b.removeDead(batch)
+		n += removed
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// removeDead removes the tasks of the entries which are still in the dead set
+// and returns the number of tasks removed.
+func (b *Broker) removeDead(entries []*base.DeadEntry) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var recs []record
+	for _, e := range entries {
+		id := e.Msg.ID.String()
+		if t, ok := b.tasks[id]; ok && t.state == stateDead {
+			recs = append(recs, record{Op: opDelete, ID: id})
+		}
+	}
+	if len(recs) == 0 {
+		return 0, nil
+	}
+	if err := b.write(false, recs...); err != nil {
+		return 0, err
+	}
+	return len(recs), nil
+}
+
+// entries returns the tasks in the given state ordered by time.
+// The returned messages are not copied.
+//
+// Must be called with b.mu held.
+func (b *Broker) entries(s state) []Entry {
+	var res []Entry
+	for _, t := range b.tasks {
+		if t.state == s {
+			res = append(res, Entry{Msg: t.msg, Time: t.time})
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Time.Equal(res[j].Time) {
+			return res[i].Msg.ID.String() < res[j].Msg.ID.String()
+		}
+		return res[i].Time.Before(res[j].Time)
+	})
+	return res
+}
+
+// inProgress returns the in-progress tasks ordered by ID.
+// The returned messages are not copied.
+//
+// Must be called with b.mu held.
+func (b *Broker) inProgress() []*base.TaskMessage {
+	var res []*base.TaskMessage
+	for _, t := range b.tasks {
+		if t.state == stateInProgress {
+			res = append(res, t.msg)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID.String() < res[j].ID.String()
+	})
+	return res
+}
+
+// RequeueAll moves all tasks from in-progress tasks to the head of their queues
+// and reports the number of tasks restored.
+func (b *Broker) RequeueAll() (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var recs []record
+	for _, msg := range b.inProgress() {
+		recs = append(recs, pushRecord(msg, true))
+	}
+	if err := b.write(false, recs...); err != nil {
+		return 0, err
+	}
+	return int64(len(recs)), nil
+}
+
+// RecoverAll moves all tasks from in-progress tasks back to their queues,
+// incrementing the number of times each task has been recovered.
+// A task that has been recovered more than maxRecovery times is moved
+// to the dead set with the given error message instead.
+// Negative maxRecovery means no limit.
+//
+// It reports the number of tasks requeued and the number of tasks killed.
+func (b *Broker) RecoverAll(maxRecovery int, errMsg string) (requeued, killed int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, msg := range b.inProgress() {
+		c := mustClone(msg)
+		c.Recovered++
+		if maxRecovery >= 0 && c.Recovered > maxRecovery {
+			c.ErrorMsg = errMsg
+			if err := b.write(false, addRecord(c, stateDead, time.Now())); err != nil {
+				return requeued, killed, err
+			}
+			killed++
+			continue
+		}
+		if err := b.write(false, pushRecord(c, true)); err != nil {
+			return requeued, killed, err
+		}
+		requeued++
+	}
+	return requeued, killed, nil
+}
+
+// CheckAndEnqueue checks for all scheduled and retry tasks and enqueues any
+// tasks that have to be processed.
+//
+// The tasks are moved to the queue they were enqueued to, so qnames is not used.
+func (b *Broker) CheckAndEnqueue(qnames ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	var recs []record
+	for _, s := range []state{stateScheduled, stateRetry} {
+		for _, e := range b.entries(s) {
+			if e.Time.After(now) {
+				break
+			}
+			recs = append(recs, pushRecord(e.Msg, false))
+		}
+	}
+	return b.write(false, recs...)
+}
+
+// WriteServerState is a no-op; server states are not recorded since
+// the broker is used by a single process.
+func (b *Broker) WriteServerState(ss *broker.ServerState, ttl time.Duration) error {
+	return nil
+}
+
+// ClearServerState is a no-op; server states are not recorded since
+// the broker is used by a single process.
+func (b *Broker) ClearServerState(ss *broker.ServerState) error {
+	return nil
+}
+
+// SubscribeCancelation returns a subscription to cancelation messages.
+func (b *Broker) SubscribeCancelation() (broker.Subscription, error) {
+	return b.pubsub.Subscribe(), nil
+}
+
+// PublishCancelation sends the cancelation message to all subscribers.
+// The message is the ID for the task to be canceled.
+func (b *Broker) PublishCancelation(id string) error {
+	b.pubsub.Publish(id)
+	return nil
+}
+
+// Compact rewrites the log file with the current state of the tasks.
+func (b *Broker) Compact() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	return b.compact()
+}
+
+func (b *Broker) compactLoop(interval time.Duration) {
+	defer b.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.mu.Lock()
+			// Skip compaction if the log has few obsolete records.
+			if !b.closed && b.appended > len(b.tasks) {
+				b.compact() // on failure, keep appending to the current log.
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+// compact writes the current state to a temporary file and replaces
+// the log file with it.
+//
+// Must be called with b.mu held.
+func (b *Broker) compact() error {
+	tmp := b.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	var encErr error
+	encode := func(rec record) {
+		if encErr == nil {
+			encErr = enc.Encode(rec)
+		}
+	}
+	for _, key := range sortedKeys(b.queues) {
+		for _, id := range b.queues[key] {
+			encode(pushRecord(b.tasks[id].msg, false))
+		}
+	}
+	for _, msg := range b.inProgress() {
+		encode(pushRecord(msg, false))
+		encode(record{Op: opActivate, ID: msg.ID.String()})
+	}
+	for _, s := range []state{stateScheduled, stateRetry, stateDead} {
+		for _, e := range b.entries(s) {
+			encode(addRecord(e.Msg, s, e.Time))
+		}
+	}
+	now := time.Now()
+	for key, l := range b.locks {
+		if now.Before(l.expireAt) {
+			encode(record{Op: opLock, Key: key, ID: l.id, Time: l.expireAt})
+		}
+	}
+	if encErr == nil {
+		encErr = w.Flush()
+	}
+	if encErr == nil {
+		encErr = f.Sync()
+	}
+	if err := f.Close(); encErr == nil {
+		encErr = err
+	}
+	if encErr != nil {
+		os.Remove(tmp)
+		return encErr
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		return err
+	}
+	// Replace the file handle to append to the compacted log.
+	nf, err := os.OpenFile(b.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if b.f != nil {
+		b.f.Close()
+	}
+	b.f = nf
+	b.appended = 0
+	b.writeErr = nil
+	// Sync the directory so that the rename survives a crash.
+	return syncDir(b.path)
+}
+
+// syncDir syncs the directory containing the file at path.
+func syncDir(path string) error {
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func sortedKeys(m map[string][]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Close stops the background compaction and closes the log file.
+// Operations on the broker return ErrClosed after Close.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.mu.Unlock()
+
+	close(b.done)
+	b.wg.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.f.Close()
+}
+
+// PendingTasks returns the tasks waiting in the given queue
+// in the order they will be processed.
+func (b *Broker) PendingTasks(qname string) []*broker.TaskMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var res []*broker.TaskMessage
+	for _, id := range b.queues[queueKey(qname)] {
+		res = append(res, mustClone(b.tasks[id].msg))
+	}
+	return res
+}
+
+// InProgressTasks returns the tasks currently being processed.
+func (b *Broker) InProgressTasks() []*broker.TaskMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var res []*broker.TaskMessage
+	for _, msg := range b.inProgress() {
+		res = append(res, mustClone(msg))
+	}
+	return res
+}
+
+// ScheduledTasks returns the scheduled tasks ordered by process time.
+func (b *Broker) ScheduledTasks() []Entry {
+	return b.cloneEntries(stateScheduled)
+}
+
+// RetryTasks returns the tasks to be retried ordered by process time.
+func (b *Broker) RetryTasks() []Entry {
+	return b.cloneEntries(stateRetry)
+}
+
+// DeadTasks returns the dead tasks ordered by the time they died.
+func (b *Broker) DeadTasks() []Entry {
+	return b.cloneEntries(stateDead)
+}
+
+func (b *Broker) cloneEntries(s state) []Entry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entries := b.entries(s)
+	for i := range entries {
+		entries[i].Msg = mustClone(entries[i].Msg)
+	}
+	return entries
+}
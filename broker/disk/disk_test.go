@@ -0,0 +1,473 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// Compile-time check that Broker implements base.Broker.
+var _ base.Broker = (*Broker)(nil)
+
+// Compile-time check that Broker implements base.Rescheduler.
+var _ base.Rescheduler = (*Broker)(nil)
+
+// Compile-time check that Broker implements base.DeadTrimmer.
+var _ base.DeadTrimmer = (*Broker)(nil)
+
+// setup returns a path to a log file in a new temporary directory
+// and a function to remove the directory.
+func setup(t *testing.T) (path string, cleanup func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "asynq-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "tasks.log"), func() { os.RemoveAll(dir) }
+}
+
+func open(t *testing.T, path string) *Broker {
+	t.Helper()
+	b, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("Open(%q) returned error: %v", path, err)
+	}
+	return b
+}
+
+// timeOpt compares times ignoring the monotonic clock reading
+// which is not persisted.
+var timeOpt = cmp.Comparer(func(x, y time.Time) bool { return x.Equal(y) })
+
+func TestEnqueueDequeue(t *testing.T) {
+	path, cleanup := setup(t)
+	defer cleanup()
+	b := open(t, path)
+	defer b.Close()
+
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("reindex", nil)
+	t2.Queue = "critical"
+	t3 := h.NewTaskMessage("sync", nil)
+
+	for _, msg := range []*base.TaskMessage{t1, t2, t3} {
+		if err := b.Enqueue(msg); err != nil {
+			t.Fatalf("(*Broker).Enqueue(msg) = %v, want nil", err)
+		}
+	}
+
+	want := []*base.TaskMessage{t2, t1, t3}
+	var got []*base.TaskMessage
+	for {
+		msg, err := b.Dequeue("critical", "default")
+		if err == base.ErrNoProcessableTask {
+			break
+		}
+		if err != nil {
+			t.Fatalf("(*Broker).Dequeue() returned error: %v", err)
+		}
+		got = append(got, msg)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("dequeued tasks mismatch; (-want,+got)\n%s", diff)
+	}
+	if diff := cmp.Diff(want, b.InProgressTasks(), h.SortMsgOpt); diff != "" {
+		t.Errorf("in-progress tasks mismatch; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestEnqueueUnique(t *testing.T) {
+	path, cleanup := setup(t)
+	defer cleanup()
+	b := open(t, path)
+	defer b.Close()
+
+	m1 := h.NewTaskMessage("email", nil)
+	m1.UniqueKey = "unique:email"
+	m2 := h.NewTaskMessage("email", nil)
+	m2.UniqueKey = "unique:email"
+
+	if err := b.EnqueueUnique(m1, time.Minute); err != nil {
+		t.Fatalf("First message: (*Broker).EnqueueUnique(%v, time.Minute) = %v, want nil", m1, err)
+	}
+	if err := b.ScheduleUnique(m2, time.Now().Add(time.Hour), time.Minute); err != base.ErrDuplicateTask {
+		t.Errorf("Second message: (*Broker).ScheduleUnique(%v, time.Minute) = %v, want %v", m2, err, base.ErrDuplicateTask)
+	}
+
+	msg, err := b.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Done(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.EnqueueUnique(m2, time.Minute); err != nil {
+		t.Errorf("After done: (*Broker).EnqueueUnique(%v, time.Minute) = %v, want nil", m2, err)
+	}
+}
+
+func TestRetryKillAndCheckAndEnqueue(t *testing.T) {
+	path, cleanup := setup(t)
+	defer cleanup()
+	b := open(t, path)
+	defer b.Close()
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("sync", nil)
+	for _, msg := range []*base.TaskMessage{m1, m2} {
+		if err := b.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Dequeue(base.DefaultQueueName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scheduleAt := time.Now().Add(time.Hour)
+	if err := b.Schedule(m3, scheduleAt); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Retry(m1, time.Now().Add(-time.Second), "oops"); err != nil {
+		t.Fatalf("(*Broker).Retry() = %v, want nil", err)
+	}
+	if err := b.Kill(m2, "fatal"); err != nil {
+		t.Fatalf("(*Broker).Kill() = %v, want nil", err)
+	}
+	if err := b.CheckAndEnqueue(base.DefaultQueueName); err != nil {
+		t.Fatalf("(*Broker).CheckAndEnqueue() = %v, want nil", err)
+	}
+
+	r1 := *m1
+	r1.Retried++
+	r1.ErrorMsg = "oops"
+	if diff := cmp.Diff([]*base.TaskMessage{&r1}, b.PendingTasks(base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in default queue; (-want,+got)\n%s", diff)
+	}
+	if n := len(b.RetryTasks()); n != 0 {
+		t.Errorf("got %d retry tasks, want 0", n)
+	}
+	if diff := cmp.Diff([]Entry{{Msg: m3, Time: scheduleAt}}, b.ScheduledTasks(), timeOpt); diff != "" {
+		t.Errorf("mismatch found in scheduled tasks; (-want,+got)\n%s", diff)
+	}
+	d2 := *m2
+	d2.ErrorMsg = "fatal"
+	gotDead := b.DeadTasks()
+	if len(gotDead) != 1 {
+		t.Fatalf("got %d dead tasks, want 1", len(gotDead))
+	}
+	if diff := cmp.Diff(&d2, gotDead[0].Msg); diff != "" {
+		t.Errorf("mismatch found in dead tasks; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	path, cleanup := setup(t)
+	defer cleanup()
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("sync", nil)
+	m4 := h.NewTaskMessage("export_csv", nil)
+	m5 := h.NewTaskMessage("generate_thumbnail", nil)
+	scheduleAt := time.Now().Add(time.Hour)
+	retryAt := time.Now().Add(time.Minute)
+
+	b := open(t, path)
+	for _, msg := range []*base.TaskMessage{m1, m2, m3, m4} {
+		if err := b.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// m1 is processed, m2 is to be retried, m3 is in progress when the process stops.
+	for i := 0; i < 3; i++ {
+		if _, err := b.Dequeue(base.DefaultQueueName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Done(m1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Retry(m2, retryAt, "oops"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Schedule(m5, scheduleAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("(*Broker).Close() = %v, want nil", err)
+	}
+	if err := b.Enqueue(m1); err != ErrClosed {
+		t.Errorf("(*Broker).Enqueue() after Close = %v, want %v", err, ErrClosed)
+	}
+
+	b = open(t, path)
+	defer b.Close()
+
+	if diff := cmp.Diff([]*base.TaskMessage{m4}, b.PendingTasks(base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in default queue after reopen; (-want,+got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{m3}, b.InProgressTasks()); diff != "" {
+		t.Errorf("mismatch found in in-progress tasks after reopen; (-want,+got)\n%s", diff)
+	}
+	r2 := *m2
+	r2.Retried++
+	r2.ErrorMsg = "oops"
+	if diff := cmp.Diff([]Entry{{Msg: &r2, Time: retryAt}}, b.RetryTasks(), timeOpt); diff != "" {
+		t.Errorf("mismatch found in retry tasks after reopen; (-want,+got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]Entry{{Msg: m5, Time: scheduleAt}}, b.ScheduledTasks(), timeOpt); diff != "" {
+		t.Errorf("mismatch found in scheduled tasks after reopen; (-want,+got)\n%s", diff)
+	}
+
+	// in-progress task is restored to the head of the queue by the server.
+	requeued, killed, err := b.RecoverAll(3, "crashed")
+	if err != nil || requeued != 1 || killed != 0 {
+		t.Fatalf("(*Broker).RecoverAll() = %d, %d, %v; want 1, 0, nil", requeued, killed, err)
+	}
+	r3 := *m3
+	r3.Recovered++
+	if diff := cmp.Diff([]*base.TaskMessage{&r3, m4}, b.PendingTasks(base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in default queue after recovery; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestReschedule(t *testing.T) {
+	path, cleanup := setup(t)
+	defer cleanup()
+
+	msg := h.NewTaskMessage("send_email", nil)
+	msg.Retried = 3
+	processAt := time.Now().Add(time.Hour)
+
+	b := open(t, path)
+	if err := b.Enqueue(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Dequeue(base.DefaultQueueName); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Reschedule(msg, processAt); err != nil {
+		t.Fatalf("(*Broker).Reschedule() = %v, want nil", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b = open(t, path)
+	defer b.Close()
+	if diff := cmp.Diff([]Entry{{Msg: msg, Time: processAt}}, b.ScheduledTasks(), timeOpt); diff != "" {
+		t.Errorf("mismatch found in scheduled tasks after reopen; (-want,+got)\n%s", diff)
+	}
+	if n := len(b.InProgressTasks()); n != 0 {
+		t.Errorf("got %d in-progress tasks after reopen, want 0", n)
+	}
+}
+
+func TestTrimDead(t *testing.T) {
+	path, cleanup := setup(t)
+	defer cleanup()
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessageWithQueue("sync", nil, "critical")
+	m3 := h.NewTaskMessage("reindex", nil)
+	b := open(t, path)
+	for _, msg := range []*base.TaskMessage{m1, m2, m3} {
+		if err := b.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Dequeue(msg.Queue); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Kill(msg, "fatal"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var evicted []string
+	evict := func(entries []*base.DeadEntry) error {
+		for _, e := range entries {
+			evicted = append(evicted, e.Msg.ID.String())
+		}
+		return nil
+	}
+	n, err := b.TrimDead(base.Retention{MaxSize: 1}, map[string]base.Retention{"critical": {MaxSize: 1}}, evict)
+	if n != 1 || err != nil {
+		t.Errorf("(*Broker).TrimDead() = %d, %v, want 1, nil", n, err)
+	}
+	if diff := cmp.Diff([]string{m1.ID.String()}, evicted); diff != "" {
+		t.Errorf("mismatch found in evicted tasks; (-want,+got)\n%s", diff)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b = open(t, path)
+	defer b.Close()
+	var got []string
+	for _, e := range b.DeadTasks() {
+		got = append(got, e.Msg.ID.String())
+	}
+	if diff := cmp.Diff([]string{m2.ID.String(), m3.ID.String()}, got); diff != "" {
+		t.Errorf("mismatch found in dead tasks after reopen; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestReopenWithPartialRecord(t *testing.T) {
+	path, cleanup := setup(t)
+	defer cleanup()
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	b := open(t, path)
+	if err := b.Enqueue(m1); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	// simulate a crash while writing a record.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"push","msg":{"Type":"rei`)
+	f.Close()
+
+	b = open(t, path)
+	defer b.Close()
+	if diff := cmp.Diff([]*base.TaskMessage{m1}, b.PendingTasks(base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in default queue after reopen; (-want,+got)\n%s", diff)
+	}
+}
+
+// shortWriteFile is a log file which writes only part of the data
+// and fails, as a write to a full disk does.
+type shortWriteFile struct {
+	logFile
+}
+
+func (f shortWriteFile) Write(p []byte) (int, error) {
+	n, _ := f.logFile.Write(p[:len(p)/2])
+	return n, syscall.ENOSPC
+}
+
+func TestFailedWrite(t *testing.T) {
+	path, cleanup := setup(t)
+	defer cleanup()
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("sync", nil)
+	b := open(t, path)
+	if err := b.Enqueue(m1); err != nil {
+		t.Fatal(err)
+	}
+	f := b.f
+	b.f = shortWriteFile{f}
+	if err := b.Enqueue(m2); err == nil {
+		t.Errorf("(*Broker).Enqueue(msg) = nil with a failing write, want error")
+	}
+	b.f = f
+	if err := b.Enqueue(m3); err != nil {
+		t.Fatalf("(*Broker).Enqueue(msg) = %v, want nil", err)
+	}
+	want := []*base.TaskMessage{m1, m3}
+	if diff := cmp.Diff(want, b.PendingTasks(base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in default queue; (-want,+got)\n%s", diff)
+	}
+	b.Close()
+
+	// The partial record is removed, so the log is replayed.
+	b = open(t, path)
+	defer b.Close()
+	if diff := cmp.Diff(want, b.PendingTasks(base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in default queue after reopen; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path, cleanup := setup(t)
+	defer cleanup()
+	b := open(t, path)
+	defer b.Close()
+
+	var msgs []*base.TaskMessage
+	for i := 0; i < 100; i++ {
+		msg := h.NewTaskMessage("send_email", nil)
+		if err := b.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	for _, msg := range msgs[:99] {
+		if _, err := b.Dequeue(base.DefaultQueueName); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Done(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Compact(); err != nil {
+		t.Fatalf("(*Broker).Compact() = %v, want nil", err)
+	}
+
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Errorf("log size after compaction is %d, want less than %d", after.Size(), before.Size())
+	}
+	// broker keeps appending to the compacted log.
+	extra := h.NewTaskMessage("reindex", nil)
+	if err := b.Enqueue(extra); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	b = open(t, path)
+	defer b.Close()
+	want := []*base.TaskMessage{msgs[99], extra}
+	if diff := cmp.Diff(want, b.PendingTasks(base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in default queue after reopen; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestCancelation(t *testing.T) {
+	path, cleanup := setup(t)
+	defer cleanup()
+	b := open(t, path)
+	defer b.Close()
+
+	sub, err := b.SubscribeCancelation()
+	if err != nil {
+		t.Fatalf("(*Broker).SubscribeCancelation() returned an error: %v", err)
+	}
+	defer sub.Close()
+
+	go b.PublishCancelation("abc123")
+
+	select {
+	case id := <-sub.Channel():
+		if id != "abc123" {
+			t.Errorf("subscriber received %q, want %q", id, "abc123")
+		}
+	case <-time.After(time.Second):
+		t.Error("subscriber did not receive the cancelation message")
+	}
+}
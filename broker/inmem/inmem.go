@@ -0,0 +1,627 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package inmem provides a broker which keeps all tasks in memory.
+//
+// The broker lets a Client and a Server run in a single process without
+// any external services, which is useful in tests and in applications
+// embedding a task queue. Tasks are lost when the process exits.
+//
+// Example:
+//
+//	b := inmem.New()
+//	client := asynq.NewClientWithBroker(b)
+//	srv := asynq.NewServerWithBroker(b, asynq.Config{Concurrency: 10})
+package inmem
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/broker"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/pubsub"
+)
+
+const (
+	// time to wait for a task to be enqueued before Dequeue gives up.
+	dequeueTimeout = time.Second
+
+	// max number of dead tasks passed to evict at once by TrimDead.
+	trimBatchSize = 100
+)
+
+// Entry is a task in a set ordered by time, such as the scheduled, retry or
+// dead set, along with the time associated with the task.
+type Entry struct {
+	Msg *broker.TaskMessage
+
+	// Time is when the task is to be processed for scheduled and retry tasks,
+	// and when the task died for dead tasks.
+	Time time.Time
+}
+
+// Broker is an in-memory implementation of broker.Broker.
+//
+// Brokers are safe for concurrent use by multiple goroutines.
+type Broker struct {
+	mu sync.Mutex // guards all fields below
+
+	// pending tasks keyed by lowercased queue name; head of the slice is dequeued first.
+	queues     map[string][]*base.TaskMessage
+	inProgress []*base.TaskMessage
+	scheduled  []Entry
+	retry      []Entry
+	dead       []Entry
+
+	// uniqueness locks keyed by unique key.
+	locks map[string]lock
+
+	// server states keyed by server ID.
+	servers map[string]serverEntry
+
+	// daily stats keyed by date in yyyy-mm-dd format.
+	processed map[string]int
+	failed    map[string]int
+
+	pubsub *pubsub.PubSub
+
+	// closed and replaced whenever a task is pushed to a queue
+	// to wake up goroutines waiting in Dequeue.
+	notify chan struct{}
+}
+
+type lock struct {
+	id       string
+	expireAt time.Time
+}
+
+type serverEntry struct {
+	info     *base.ServerInfo
+	workers  []*base.WorkerInfo
+	expireAt time.Time
+}
+
+// New returns a new empty Broker.
+func New() *Broker {
+	return &Broker{
+		queues:    make(map[string][]*base.TaskMessage),
+		locks:     make(map[string]lock),
+		servers:   make(map[string]serverEntry),
+		processed: make(map[string]int),
+		failed:    make(map[string]int),
+		pubsub:    pubsub.New(),
+		notify:    make(chan struct{}),
+	}
+}
+
+// clone returns a deep copy of the message.
+//
+// Messages are copied through their JSON encoding so that handlers see
+// the same payload types as they would with the redis broker.
+func clone(msg *base.TaskMessage) (*base.TaskMessage, error) {
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var c base.TaskMessage
+	if err := json.Unmarshal(bytes, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func mustClone(msg *base.TaskMessage) *base.TaskMessage {
+	c, err := clone(msg)
+	if err != nil {
+		// msg was decoded from JSON when stored, so encoding cannot fail.
+		panic(err)
+	}
+	return c
+}
+
+func queueKey(qname string) string {
+	return strings.ToLower(qname)
+}
+
+func day(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// push inserts the message to the tail of its queue and wakes up waiting
+// dequeuers. If head is true, the message is inserted to the head instead.
+//
+// Must be called with b.mu held.
+func (b *Broker) push(msg *base.TaskMessage, head bool) {
+	key := queueKey(msg.Queue)
+	if head {
+		b.queues[key] = append([]*base.TaskMessage{msg}, b.queues[key]...)
+	} else {
+		b.queues[key] = append(b.queues[key], msg)
+	}
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+// acquire acquires the uniqueness lock for the message.
+// It reports whether the lock was acquired.
+//
+// Must be called with b.mu held.
+func (b *Broker) acquire(msg *base.TaskMessage, ttl time.Duration) bool {
+	now := time.Now()
+	if l, ok := b.locks[msg.UniqueKey]; ok && now.Before(l.expireAt) {
+		return false
+	}
+	b.locks[msg.UniqueKey] = lock{id: msg.ID.String(), expireAt: now.Add(ttl)}
+	return true
+}
+
+// removeInProgress removes the message from the in-progress list.
+//
+// Must be called with b.mu held.
+func (b *Broker) removeInProgress(msg *base.TaskMessage) {
+	for i, m := range b.inProgress {
+		if m.ID == msg.ID {
+			b.inProgress = append(b.inProgress[:i], b.inProgress[i+1:]...)
+			return
+		}
+	}
+}
+
+// Enqueue inserts the given task to the tail of the queue.
+func (b *Broker) Enqueue(msg *broker.TaskMessage) error {
+	c, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.push(c, false)
+	return nil
+}
+
+// EnqueueUnique inserts the given task if the task's uniqueness lock can be acquired.
+// It returns broker.ErrDuplicateTask if the lock cannot be acquired.
+func (b *Broker) EnqueueUnique(msg *broker.TaskMessage, ttl time.Duration) error {
+	c, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.acquire(c, ttl) {
+		return base.ErrDuplicateTask
+	}
+	b.push(c, false)
+	return nil
+}
+
+// Dequeue queries given queues in order and pops a task message if there is one and returns it.
+// If all queues are empty, it waits up to a second for a task to be enqueued
+// before returning broker.ErrNoProcessableTask.
+func (b *Broker) Dequeue(qnames ...string) (*broker.TaskMessage, error) {
+	timer := time.NewTimer(dequeueTimeout)
+	defer timer.Stop()
+	for {
+		b.mu.Lock()
+		msg := b.pop(qnames)
+		notify := b.notify
+		b.mu.Unlock()
+		if msg != nil {
+			return msg, nil
+		}
+		select {
+		case <-notify:
+		case <-timer.C:
+			return nil, base.ErrNoProcessableTask
+		}
+	}
+}
+
+// pop removes the message at the head of the first non-empty queue
+// and moves it to the in-progress list. It returns nil if all queues are empty.
+//
+// Must be called with b.mu held.
+func (b *Broker) pop(qnames []string) *base.TaskMessage {
+	for _, qname := range qnames {
+		key := queueKey(qname)
+		q := b.queues[key]
+		if len(q) == 0 {
+			continue
+		}
+		msg := q[0]
+		b.queues[key] = q[1:]
+		b.inProgress = append(b.inProgress, msg)
+		return mustClone(msg)
+	}
+	return nil
+}
+
+// Done removes the task from in-progress list to mark the task as done.
+// It removes a uniqueness lock acquired by the task, if any.
+func (b *Broker) Done(msg *broker.TaskMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeInProgress(msg)
+	b.processed[day(time.Now())]++
+	if l, ok := b.locks[msg.UniqueKey]; ok && l.id == msg.ID.String() {
+		delete(b.locks, msg.UniqueKey)
+	}
+	return nil
+}
+
+// Requeue moves the task from in-progress list to the head of its queue.
+func (b *Broker) Requeue(msg *broker.TaskMessage) error {
+	c, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeInProgress(msg)
+	b.push(c, true)
+	return nil
+}
+
+// Schedule adds the task to the scheduled set to be processed in the future.
+func (b *Broker) Schedule(msg *broker.TaskMessage, processAt time.Time) error {
+	c, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.scheduled = append(b.scheduled, Entry{Msg: c, Time: processAt})
+	return nil
+}
+
+// ScheduleUnique adds the task to the scheduled set if the uniqueness lock can be acquired.
+// It returns broker.ErrDuplicateTask if the lock cannot be acquired.
+func (b *Broker) ScheduleUnique(msg *broker.TaskMessage, processAt time.Time, ttl time.Duration) error {
+	c, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.acquire(c, ttl) {
+		return base.ErrDuplicateTask
+	}
+	b.scheduled = append(b.scheduled, Entry{Msg: c, Time: processAt})
+	return nil
+}
+
+// Retry moves the task from in-progress list to retry set, incrementing retry count
+// and assigning error message to the task message.
+func (b *Broker) Retry(msg *broker.TaskMessage, processAt time.Time, errMsg string) error {
+	c, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	c.Retried++
+	c.ErrorMsg = errMsg
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeInProgress(msg)
+	b.retry = append(b.retry, Entry{Msg: c, Time: processAt})
+	now := day(time.Now())
+	b.processed[now]++
+	b.failed[now]++
+	return nil
+}
+
+// Reschedule moves the task from in-progress list to scheduled set
+// without modifying the task.
+func (b *Broker) Reschedule(msg *broker.TaskMessage, processAt time.Time) error {
+	c, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeInProgress(msg)
+	b.scheduled = append(b.scheduled, Entry{Msg: c, Time: processAt})
+	return nil
+}
+
+// Kill moves the task from in-progress list to dead set, assigning
+// the error message to the task.
+//
+// The dead set is not trimmed, servers trim it periodically with TrimDead.
+func (b *Broker) Kill(msg *broker.TaskMessage, errMsg string) error {
+	c, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	c.ErrorMsg = errMsg
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeInProgress(msg)
+	b.kill(c)
+	return nil
+}
+
+// kill adds the message to the dead set.
+//
+// Must be called with b.mu held.
+func (b *Broker) kill(msg *base.TaskMessage) {
+	now := time.Now()
+	b.dead = append(b.dead, Entry{Msg: msg, Time: now})
+	b.processed[day(now)]++
+	b.failed[day(now)]++
+}
+
+// TrimDead removes dead tasks which exceed the given retention limits
+// and returns the number of tasks removed, see broker.DeadTrimmer.
+//
+// The broker is not locked while evict runs, so tasks removed from
+// the dead set in the meantime are not counted.
+func (b *Broker) TrimDead(def broker.Retention, perQueue map[string]broker.Retention, evict func([]*broker.DeadEntry) error) (int, error) {
+	b.mu.Lock()
+	sortEntries(b.dead)
+	entries := make([]*base.DeadEntry, len(b.dead))
+	for i, e := range b.dead {
+		entries[i] = &base.DeadEntry{Msg: e.Msg, DiedAt: e.Time}
+	}
+	trim := base.DeadToTrim(entries, def, perQueue, time.Now())
+	for _, e := range trim {
+		e.Msg = mustClone(e.Msg)
+	}
+	b.mu.Unlock()
+
+	var n int
+	for len(trim) > 0 {
+		batch := trim
+		if len(batch) > trimBatchSize {
+			batch = batch[:trimBatchSize]
+		}
+		trim = trim[len(batch):]
+		if evict != nil {
+			if err := evict(batch); err != nil {
+				return n, err
+			}
+		}
+		n += b.removeDead(batch)
+	}
+	return n, nil
+}
+
+// removeDead removes the tasks of the entries from the dead set
+// and returns the number of tasks removed.
+func (b *Broker) removeDead(entries []*base.DeadEntry) int {
+	ids := make(map[string]bool)
+	for _, e := range entries {
+		ids[e.Msg.ID.String()] = true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var dead []Entry
+	for _, e := range b.dead {
+		if !ids[e.Msg.ID.String()] {
+			dead = append(dead, e)
+		}
+	}
+	n := len(b.dead) - len(dead)
+	b.dead = dead
+	return n
+}
+
+// RequeueAll moves all tasks from in-progress list to the head of their queues
+// and reports the number of tasks restored.
+func (b *Broker) RequeueAll() (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(b.inProgress)
+	for _, msg := range b.inProgress {
+		b.push(msg, true)
+	}
+	b.inProgress = nil
+	return int64(n), nil
+}
+
+// RecoverAll moves all tasks from in-progress list back to their queues,
+// incrementing the number of times each task has been recovered.
+// A task that has been recovered more than maxRecovery times is moved
+// to the dead set with the given error message instead.
+// Negative maxRecovery means no limit.
+//
+// It reports the number of tasks requeued and the number of tasks killed.
+func (b *Broker) RecoverAll(maxRecovery int, errMsg string) (requeued, killed int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, msg := range b.inProgress {
+		msg.Recovered++
+		if maxRecovery >= 0 && msg.Recovered > maxRecovery {
+			msg.ErrorMsg = errMsg
+			b.kill(msg)
+			killed++
+			continue
+		}
+		b.push(msg, true)
+		requeued++
+	}
+	b.inProgress = nil
+	return requeued, killed, nil
+}
+
+// CheckAndEnqueue checks for all scheduled and retry tasks and enqueues any
+// tasks that have to be processed.
+//
+// The tasks are moved to the queue they were enqueued to, so qnames is not used.
+func (b *Broker) CheckAndEnqueue(qnames ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.scheduled = b.forward(b.scheduled, now)
+	b.retry = b.forward(b.retry, now)
+	return nil
+}
+
+// forward pushes all messages in the entries which are due at now
+// to their queues and returns the remaining entries.
+//
+// Must be called with b.mu held.
+func (b *Broker) forward(entries []Entry, now time.Time) []Entry {
+	sortEntries(entries)
+	var remaining []Entry
+	for _, e := range entries {
+		if e.Time.After(now) {
+			remaining = append(remaining, e)
+			continue
+		}
+		b.push(e.Msg, false)
+	}
+	return remaining
+}
+
+func sortEntries(entries []Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+}
+
+// WriteServerState records the server state with expiration set to the value ttl.
+func (b *Broker) WriteServerState(ss *broker.ServerState, ttl time.Duration) error {
+	info := ss.GetInfo()
+	workers := ss.GetWorkers()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.servers[info.ServerID] = serverEntry{
+		info:     info,
+		workers:  workers,
+		expireAt: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+// ClearServerState deletes the server state.
+func (b *Broker) ClearServerState(ss *broker.ServerState) error {
+	info := ss.GetInfo()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.servers, info.ServerID)
+	return nil
+}
+
+// SubscribeCancelation returns a subscription to cancelation messages.
+func (b *Broker) SubscribeCancelation() (broker.Subscription, error) {
+	return b.pubsub.Subscribe(), nil
+}
+
+// PublishCancelation sends the cancelation message to all subscribers.
+// The message is the ID for the task to be canceled.
+func (b *Broker) PublishCancelation(id string) error {
+	b.pubsub.Publish(id)
+	return nil
+}
+
+// Close is a no-op; the tasks are kept so that the broker can be
+// shared by a client and servers which are closed independently.
+func (b *Broker) Close() error {
+	return nil
+}
+
+// PendingTasks returns the tasks waiting in the given queue
+// in the order they will be processed.
+func (b *Broker) PendingTasks(qname string) []*broker.TaskMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var res []*broker.TaskMessage
+	for _, msg := range b.queues[queueKey(qname)] {
+		res = append(res, mustClone(msg))
+	}
+	return res
+}
+
+// InProgressTasks returns the tasks currently being processed.
+func (b *Broker) InProgressTasks() []*broker.TaskMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var res []*broker.TaskMessage
+	for _, msg := range b.inProgress {
+		res = append(res, mustClone(msg))
+	}
+	return res
+}
+
+// ScheduledTasks returns the scheduled tasks ordered by process time.
+func (b *Broker) ScheduledTasks() []Entry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return cloneEntries(b.scheduled)
+}
+
+// RetryTasks returns the tasks to be retried ordered by process time.
+func (b *Broker) RetryTasks() []Entry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return cloneEntries(b.retry)
+}
+
+// DeadTasks returns the dead tasks ordered by the time they died.
+func (b *Broker) DeadTasks() []Entry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return cloneEntries(b.dead)
+}
+
+func cloneEntries(entries []Entry) []Entry {
+	res := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, Entry{Msg: mustClone(e.Msg), Time: e.Time})
+	}
+	sortEntries(res)
+	return res
+}
+
+// Servers returns information about the servers which have sent
+// a heartbeat and whose state has not yet expired.
+func (b *Broker) Servers() []*broker.ServerInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	var res []*broker.ServerInfo
+	for _, s := range b.servers {
+		if now.Before(s.expireAt) {
+			info := *s.info
+			res = append(res, &info)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ServerID < res[j].ServerID
+	})
+	return res
+}
+
+// Workers returns information about the tasks being processed
+// by the servers returned by Servers.
+func (b *Broker) Workers() []*broker.WorkerInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	var res []*broker.WorkerInfo
+	for _, s := range b.servers {
+		if now.Before(s.expireAt) {
+			for _, w := range s.workers {
+				info := *w
+				res = append(res, &info)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID.String() < res[j].ID.String()
+	})
+	return res
+}
+
+// DailyStats returns the number of processed and failed tasks
+// on the day of the given time.
+func (b *Broker) DailyStats(t time.Time) (processed, failed int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.processed[day(t)], b.failed[day(t)]
+}
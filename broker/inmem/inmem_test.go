@@ -0,0 +1,389 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package inmem
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// Compile-time check that Broker implements base.Broker.
+var _ base.Broker = (*Broker)(nil)
+
+// Compile-time check that Broker implements base.Rescheduler.
+var _ base.Rescheduler = (*Broker)(nil)
+
+// Compile-time check that Broker implements base.DeadTrimmer.
+var _ base.DeadTrimmer = (*Broker)(nil)
+
+func TestEnqueueDequeue(t *testing.T) {
+	t1 := h.NewTaskMessage("send_email", map[string]interface{}{"user_id": 42})
+	t2 := h.NewTaskMessage("reindex", nil)
+	t2.Queue = "critical"
+	t3 := h.NewTaskMessage("sync", nil)
+	t3.Queue = "low"
+
+	tests := []struct {
+		enqueued []*base.TaskMessage
+		qnames   []string // queues to dequeue from
+		want     []*base.TaskMessage
+	}{
+		{
+			enqueued: []*base.TaskMessage{t1, t2, t3},
+			qnames:   []string{"critical", "default", "low"},
+			want:     []*base.TaskMessage{t2, t1, t3},
+		},
+		{
+			enqueued: []*base.TaskMessage{t1, t2, t3},
+			qnames:   []string{"low", "default"},
+			want:     []*base.TaskMessage{t3, t1},
+		},
+	}
+
+	for _, tc := range tests {
+		b := New()
+		for _, msg := range tc.enqueued {
+			if err := b.Enqueue(msg); err != nil {
+				t.Fatalf("(*Broker).Enqueue(msg) = %v, want nil", err)
+			}
+		}
+
+		var got []*base.TaskMessage
+		for {
+			msg, err := b.Dequeue(tc.qnames...)
+			if err == base.ErrNoProcessableTask {
+				break
+			}
+			if err != nil {
+				t.Fatalf("(*Broker).Dequeue(%v) returned error: %v", tc.qnames, err)
+			}
+			got = append(got, msg)
+		}
+		// payload values are decoded as JSON numbers.
+		if diff := cmp.Diff(tc.want, got, cmpopts.IgnoreFields(base.TaskMessage{}, "Payload")); diff != "" {
+			t.Errorf("dequeued tasks mismatch; (-want,+got)\n%s", diff)
+		}
+		if diff := cmp.Diff(tc.want, b.InProgressTasks(), h.SortMsgOpt, cmpopts.IgnoreFields(base.TaskMessage{}, "Payload")); diff != "" {
+			t.Errorf("in-progress tasks mismatch; (-want,+got)\n%s", diff)
+		}
+	}
+}
+
+func TestDequeueWaitsForTask(t *testing.T) {
+	b := New()
+	msg := h.NewTaskMessage("send_email", nil)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		b.Enqueue(msg)
+	}()
+
+	start := time.Now()
+	got, err := b.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("(*Broker).Dequeue(%q) returned error: %v", base.DefaultQueueName, err)
+	}
+	if diff := cmp.Diff(msg, got); diff != "" {
+		t.Errorf("(*Broker).Dequeue(%q) = %v, want %v; (-want,+got)\n%s", base.DefaultQueueName, got, msg, diff)
+	}
+	if elapsed := time.Since(start); elapsed >= dequeueTimeout {
+		t.Errorf("(*Broker).Dequeue took %v, want less than %v", elapsed, dequeueTimeout)
+	}
+}
+
+func TestEnqueueUnique(t *testing.T) {
+	b := New()
+	m1 := h.NewTaskMessage("email", map[string]interface{}{"user_id": 123})
+	m1.UniqueKey = "unique:email"
+	m2 := h.NewTaskMessage("email", map[string]interface{}{"user_id": 123})
+	m2.UniqueKey = "unique:email"
+
+	if err := b.EnqueueUnique(m1, time.Minute); err != nil {
+		t.Fatalf("First message: (*Broker).EnqueueUnique(%v, time.Minute) = %v, want nil", m1, err)
+	}
+	if err := b.EnqueueUnique(m2, time.Minute); err != base.ErrDuplicateTask {
+		t.Errorf("Second message: (*Broker).EnqueueUnique(%v, time.Minute) = %v, want %v", m2, err, base.ErrDuplicateTask)
+	}
+
+	// lock is released when the task is done.
+	msg, err := b.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Done(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.EnqueueUnique(m2, time.Minute); err != nil {
+		t.Errorf("After done: (*Broker).EnqueueUnique(%v, time.Minute) = %v, want nil", m2, err)
+	}
+}
+
+func TestScheduleAndCheckAndEnqueue(t *testing.T) {
+	b := New()
+	now := time.Now()
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m2.Queue = "critical"
+	m3 := h.NewTaskMessage("sync", nil)
+
+	if err := b.Schedule(m1, now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Schedule(m2, now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Schedule(m3, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.CheckAndEnqueue(base.DefaultQueueName); err != nil {
+		t.Fatalf("(*Broker).CheckAndEnqueue() = %v, want nil", err)
+	}
+
+	if diff := cmp.Diff([]*base.TaskMessage{m1}, b.PendingTasks(base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in default queue; (-want,+got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{m2}, b.PendingTasks("critical")); diff != "" {
+		t.Errorf("mismatch found in critical queue; (-want,+got)\n%s", diff)
+	}
+	wantScheduled := []Entry{{Msg: m3, Time: now.Add(time.Hour)}}
+	if diff := cmp.Diff(wantScheduled, b.ScheduledTasks()); diff != "" {
+		t.Errorf("mismatch found in scheduled tasks; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestTrimDead(t *testing.T) {
+	b := New()
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessageWithQueue("sync", nil, "critical")
+	m3 := h.NewTaskMessage("reindex", nil)
+	for _, msg := range []*base.TaskMessage{m1, m2, m3} {
+		if err := b.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Dequeue(msg.Queue); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Kill(msg, "fatal"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var evicted []string
+	evict := func(entries []*base.DeadEntry) error {
+		for _, e := range entries {
+			evicted = append(evicted, e.Msg.ID.String())
+		}
+		return nil
+	}
+	n, err := b.TrimDead(base.Retention{MaxSize: 1}, map[string]base.Retention{"critical": {MaxSize: 1}}, evict)
+	if n != 1 || err != nil {
+		t.Errorf("(*Broker).TrimDead() = %d, %v, want 1, nil", n, err)
+	}
+	if diff := cmp.Diff([]string{m1.ID.String()}, evicted); diff != "" {
+		t.Errorf("mismatch found in evicted tasks; (-want,+got)\n%s", diff)
+	}
+	var got []string
+	for _, e := range b.DeadTasks() {
+		got = append(got, e.Msg.ID.String())
+	}
+	if diff := cmp.Diff([]string{m2.ID.String(), m3.ID.String()}, got); diff != "" {
+		t.Errorf("mismatch found in dead tasks; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestRetryAndKill(t *testing.T) {
+	b := New()
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	for _, msg := range []*base.TaskMessage{m1, m2} {
+		if err := b.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Dequeue(base.DefaultQueueName); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	retryAt := time.Now().Add(time.Minute)
+	if err := b.Retry(m1, retryAt, "oops"); err != nil {
+		t.Fatalf("(*Broker).Retry() = %v, want nil", err)
+	}
+	if err := b.Kill(m2, "fatal"); err != nil {
+		t.Fatalf("(*Broker).Kill() = %v, want nil", err)
+	}
+
+	r1 := *m1
+	r1.Retried++
+	r1.ErrorMsg = "oops"
+	if diff := cmp.Diff([]Entry{{Msg: &r1, Time: retryAt}}, b.RetryTasks()); diff != "" {
+		t.Errorf("mismatch found in retry tasks; (-want,+got)\n%s", diff)
+	}
+
+	d2 := *m2
+	d2.ErrorMsg = "fatal"
+	gotDead := b.DeadTasks()
+	if len(gotDead) != 1 {
+		t.Fatalf("got %d dead tasks, want 1", len(gotDead))
+	}
+	if diff := cmp.Diff(&d2, gotDead[0].Msg); diff != "" {
+		t.Errorf("mismatch found in dead tasks; (-want,+got)\n%s", diff)
+	}
+	if n := len(b.InProgressTasks()); n != 0 {
+		t.Errorf("got %d in-progress tasks, want 0", n)
+	}
+
+	processed, failed := b.DailyStats(time.Now())
+	if processed != 2 || failed != 2 {
+		t.Errorf("(*Broker).DailyStats() = %d, %d; want 2, 2", processed, failed)
+	}
+}
+
+func TestReschedule(t *testing.T) {
+	b := New()
+	msg := h.NewTaskMessage("send_email", nil)
+	msg.Retried = 3
+	if err := b.Enqueue(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Dequeue(base.DefaultQueueName); err != nil {
+		t.Fatal(err)
+	}
+
+	processAt := time.Now().Add(time.Hour)
+	if err := b.Reschedule(msg, processAt); err != nil {
+		t.Fatalf("(*Broker).Reschedule() = %v, want nil", err)
+	}
+
+	if diff := cmp.Diff([]Entry{{Msg: msg, Time: processAt}}, b.ScheduledTasks()); diff != "" {
+		t.Errorf("mismatch found in scheduled tasks; (-want,+got)\n%s", diff)
+	}
+	if n := len(b.InProgressTasks()); n != 0 {
+		t.Errorf("got %d in-progress tasks, want 0", n)
+	}
+	processed, failed := b.DailyStats(time.Now())
+	if processed != 0 || failed != 0 {
+		t.Errorf("(*Broker).DailyStats() = %d, %d; want 0, 0", processed, failed)
+	}
+}
+
+func TestRecoverAll(t *testing.T) {
+	b := New()
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("segfault", nil)
+	m2.Recovered = 3
+	for _, msg := range []*base.TaskMessage{m1, m2} {
+		if err := b.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Dequeue(base.DefaultQueueName); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	requeued, killed, err := b.RecoverAll(3, "crashed")
+	if err != nil || requeued != 1 || killed != 1 {
+		t.Fatalf("(*Broker).RecoverAll(3, %q) = %d, %d, %v; want 1, 1, nil", "crashed", requeued, killed, err)
+	}
+
+	r1 := *m1
+	r1.Recovered = 1
+	if diff := cmp.Diff([]*base.TaskMessage{&r1}, b.PendingTasks(base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in default queue; (-want,+got)\n%s", diff)
+	}
+	d2 := *m2
+	d2.Recovered = 4
+	d2.ErrorMsg = "crashed"
+	gotDead := b.DeadTasks()
+	if len(gotDead) != 1 {
+		t.Fatalf("got %d dead tasks, want 1", len(gotDead))
+	}
+	if diff := cmp.Diff(&d2, gotDead[0].Msg); diff != "" {
+		t.Errorf("mismatch found in dead tasks; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestServerState(t *testing.T) {
+	b := New()
+	ss := base.NewServerState("localhost", 1234, 10, map[string]int{"default": 1}, false)
+	msg := h.NewTaskMessage("send_email", nil)
+	ss.AddWorkerStats(msg, time.Now())
+
+	if err := b.WriteServerState(ss, 5*time.Second); err != nil {
+		t.Fatalf("(*Broker).WriteServerState() = %v, want nil", err)
+	}
+	servers := b.Servers()
+	if len(servers) != 1 || servers[0].Host != "localhost" || servers[0].PID != 1234 {
+		t.Errorf("(*Broker).Servers() = %v, want one server localhost:1234", servers)
+	}
+	workers := b.Workers()
+	if len(workers) != 1 || workers[0].ID != msg.ID {
+		t.Errorf("(*Broker).Workers() = %v, want one worker processing %v", workers, msg.ID)
+	}
+
+	if err := b.ClearServerState(ss); err != nil {
+		t.Fatalf("(*Broker).ClearServerState() = %v, want nil", err)
+	}
+	if servers := b.Servers(); len(servers) != 0 {
+		t.Errorf("(*Broker).Servers() = %v after ClearServerState, want empty", servers)
+	}
+
+	// server state expires without heartbeat.
+	if err := b.WriteServerState(ss, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if servers := b.Servers(); len(servers) != 0 {
+		t.Errorf("(*Broker).Servers() = %v after expiration, want empty", servers)
+	}
+}
+
+func TestCancelation(t *testing.T) {
+	b := New()
+	sub, err := b.SubscribeCancelation()
+	if err != nil {
+		t.Fatalf("(*Broker).SubscribeCancelation() returned an error: %v", err)
+	}
+
+	var (
+		mu       sync.Mutex
+		received []string
+		done     = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		for id := range sub.Channel() {
+			mu.Lock()
+			received = append(received, id)
+			mu.Unlock()
+		}
+	}()
+
+	publish := []string{"one", "two", "three"}
+	for _, id := range publish {
+		if err := b.PublishCancelation(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sub.Close()
+	<-done // channel is closed when the subscription is closed.
+
+	// publishing after close should not block.
+	if err := b.PublishCancelation("four"); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff(publish, received); diff != "" {
+		t.Errorf("subscriber received %v, want %v; (-want,+got)\n%s", received, publish, diff)
+	}
+}
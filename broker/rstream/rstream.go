@@ -0,0 +1,939 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package rstream provides a broker which stores pending tasks in
+// redis streams and delivers them through a consumer group.
+//
+// Each queue is a stream read by a consumer group shared by all servers.
+// A task delivered to a server stays in the pending entries list of the
+// server's consumer until it is acknowledged, so a task is never lost when
+// the server crashes. Pending entries of a server which stopped sending
+// heartbeats are claimed by other servers and put back to the stream.
+//
+// Scheduled, retry and dead tasks, server states and cancelation messages
+// use the same redis keys as the default broker.
+//
+// Example:
+//
+//	b := rstream.New(redis.NewClient(&redis.Options{Addr: "localhost:6379"}), rstream.Options{})
+//	client := asynq.NewClientWithBroker(b)
+//	srv := asynq.NewServerWithBroker(b, asynq.Config{Concurrency: 10})
+package rstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/broker"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/rs/xid"
+)
+
+const (
+	// name of the consumer group shared by all servers.
+	group = "asynq"
+
+	// field name of stream entries holding the task message.
+	msgField = "msg"
+
+	// time to wait for a task to be enqueued before Dequeue gives up.
+	dequeueTimeout = time.Second
+
+	defaultClaimMinIdle = time.Minute
+
+	statsTTL = 90 * 24 * time.Hour // 90 days
+)
+
+// Options specifies the broker's behavior.
+type Options struct {
+	// Namespace specifies the prefix of all redis keys used by the broker.
+	//
+	// If unset, default namespace "asynq" is used.
+	Namespace string
+
+	// ClaimMinIdle specifies how long a delivered task may stay
+	// unacknowledged without a heartbeat from the server processing it
+	// before another server claims the task.
+	//
+	// Servers refresh their tasks on every heartbeat, so the value should
+	// be larger than the heartbeat interval of 5 seconds.
+	//
+	// If unset or zero, default value of one minute is used.
+	ClaimMinIdle time.Duration
+}
+
+// delivery is a stream entry delivered to this consumer.
+type delivery struct {
+	stream string
+	id     string // stream entry ID
+	data   string // encoded task message
+}
+
+// Broker is an implementation of broker.Broker on top of redis streams.
+//
+// Brokers are safe for concurrent use by multiple goroutines.
+type Broker struct {
+	client redis.UniversalClient
+	keys   base.Keys
+
+	// rdb handles the operations shared with the default broker.
+	rdb *rdb.RDB
+
+	// name of the consumer in the consumer group.
+	consumer string
+
+	claimMinIdle time.Duration
+
+	mu sync.Mutex // guards all fields below
+
+	// deliveries not yet acknowledged keyed by task ID.
+	deliveries map[string]delivery
+
+	// entries read from streams but not yet returned by Dequeue.
+	buffered []delivery
+
+	// streams for which the consumer group has been created.
+	groups map[string]bool
+
+	// crash recovery limit set by RecoverAll.
+	recovering  bool
+	maxRecovery int
+	errMsg      string
+}
+
+// New returns a new Broker which stores tasks in redis
+// using the given client.
+//
+// The client may be connected to a single redis server, to redis sentinels,
+// or to redis cluster nodes.
+func New(client redis.UniversalClient, opt Options) *Broker {
+	minIdle := opt.ClaimMinIdle
+	if minIdle == 0 {
+		minIdle = defaultClaimMinIdle
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown-host"
+	}
+	r := rdb.NewRDBWithNamespace(client, opt.Namespace)
+	return &Broker{
+		client:       client,
+		keys:         r.Keys(),
+		rdb:          r,
+		consumer:     fmt.Sprintf("%s:%d:%s", host, os.Getpid(), xid.New()),
+		claimMinIdle: minIdle,
+		deliveries:   make(map[string]delivery),
+		groups:       make(map[string]bool),
+	}
+}
+
+// Keys returns the keys used by b.
+func (b *Broker) Keys() base.Keys {
+	return b.keys
+}
+
+// KEYS[1] -> asynq:streams:<qname>
+// KEYS[2] -> asynq:streams
+// KEYS[3] -> asynq:tasks
+// KEYS[4] -> asynq:stream_entries
+// ARGV[1] -> task message data
+// ARGV[2] -> task ID
+var enqueueCmd = redis.NewScript(`
+local entry = redis.call("XADD", KEYS[1], "*", "msg", ARGV[1])
+redis.call("SADD", KEYS[2], KEYS[1])
+redis.call("HSET", KEYS[3], ARGV[2], ARGV[1])
+redis.call("HSET", KEYS[4], ARGV[2], entry)
+return 1`)
+
+// Enqueue appends the given task to the stream of its queue.
+func (b *Broker) Enqueue(msg *broker.TaskMessage) error {
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return enqueueCmd.Run(b.client,
+		[]string{b.keys.StreamKey(msg.Queue), b.keys.AllStreams(), b.keys.TaskIndex(), b.keys.StreamEntries()},
+		bytes, msg.ID.String()).Err()
+}
+
+// KEYS[1] -> unique key
+// KEYS[2] -> asynq:streams:<qname>
+// KEYS[3] -> asynq:streams
+// KEYS[4] -> asynq:tasks
+// KEYS[5] -> asynq:stream_entries
+// ARGV[1] -> task ID
+// ARGV[2] -> uniqueness lock TTL
+// ARGV[3] -> task message data
+var enqueueUniqueCmd = redis.NewScript(`
+local ok = redis.call("SET", KEYS[1], ARGV[1], "NX", "EX", ARGV[2])
+if not ok then
+  return 0
+end
+local entry = redis.call("XADD", KEYS[2], "*", "msg", ARGV[3])
+redis.call("SADD", KEYS[3], KEYS[2])
+redis.call("HSET", KEYS[4], ARGV[1], ARGV[3])
+redis.call("HSET", KEYS[5], ARGV[1], entry)
+return 1`)
+
+// EnqueueUnique appends the given task if the task's uniqueness lock can be acquired.
+// It returns broker.ErrDuplicateTask if the lock cannot be acquired.
+func (b *Broker) EnqueueUnique(msg *broker.TaskMessage, ttl time.Duration) error {
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	res, err := enqueueUniqueCmd.Run(b.client,
+		[]string{msg.UniqueKey, b.keys.StreamKey(msg.Queue), b.keys.AllStreams(), b.keys.TaskIndex(), b.keys.StreamEntries()},
+		msg.ID.String(), int(ttl.Seconds()), bytes).Result()
+	if err != nil {
+		return err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return fmt.Errorf("could not cast %v to int64", res)
+	}
+	if n == 0 {
+		return base.ErrDuplicateTask
+	}
+	return nil
+}
+
+// ensureGroups creates the consumer group for the given streams
+// if it does not exist yet.
+func (b *Broker) ensureGroups(streams []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range streams {
+		if b.groups[s] {
+			continue
+		}
+		// Read from the beginning of the stream so that tasks added
+		// before the group was created are delivered.
+		err := b.client.XGroupCreateMkStream(s, group, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return err
+		}
+		if err := b.client.SAdd(b.keys.AllStreams(), s).Err(); err != nil {
+			return err
+		}
+		b.groups[s] = true
+	}
+	return nil
+}
+
+// Dequeue queries given queues in order and returns a task if there is one.
+// If all queues are empty, it blocks for up to a second waiting for a task
+// before returning broker.ErrNoProcessableTask.
+func (b *Broker) Dequeue(qnames ...string) (*broker.TaskMessage, error) {
+	var streams []string
+	for _, qname := range qnames {
+		streams = append(streams, b.keys.StreamKey(qname))
+	}
+	if err := b.ensureGroups(streams); err != nil {
+		return nil, err
+	}
+	if d, ok := b.popBuffered(streams); ok {
+		return b.decode(d)
+	}
+	// Query streams in order to respect queue priority.
+	for _, s := range streams {
+		res, err := b.client.XReadGroup(&redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: b.consumer,
+			Streams:  []string{s, ">"},
+			Count:    1,
+			Block:    -1, // do not block
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return b.deliver(streams, res)
+	}
+	// All queues are empty; block on all streams.
+	args := append([]string(nil), streams...)
+	for range streams {
+		args = append(args, ">")
+	}
+	res, err := b.client.XReadGroup(&redis.XReadGroupArgs{
+		Group:    group,
+		Consumer: b.consumer,
+		Streams:  args,
+		Count:    1,
+		Block:    dequeueTimeout,
+	}).Result()
+	if err == redis.Nil {
+		return nil, base.ErrNoProcessableTask
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.deliver(streams, res)
+}
+
+// deliver records the entries read from streams as deliveries and
+// returns the task from the stream with the highest priority.
+// The other entries are buffered to be returned by subsequent calls to Dequeue.
+func (b *Broker) deliver(streams []string, res []redis.XStream) (*broker.TaskMessage, error) {
+	b.mu.Lock()
+	for _, xs := range res {
+		for _, xm := range xs.Messages {
+			data, _ := xm.Values[msgField].(string)
+			b.buffered = append(b.buffered, delivery{stream: xs.Stream, id: xm.ID, data: data})
+		}
+	}
+	b.mu.Unlock()
+	d, ok := b.popBuffered(streams)
+	if !ok {
+		return nil, base.ErrNoProcessableTask
+	}
+	return b.decode(d)
+}
+
+// popBuffered removes and returns a buffered entry from the first of the
+// given streams which has one.
+func (b *Broker) popBuffered(streams []string) (delivery, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range streams {
+		for i, d := range b.buffered {
+			if d.stream == s {
+				b.buffered = append(b.buffered[:i], b.buffered[i+1:]...)
+				return d, true
+			}
+		}
+	}
+	return delivery{}, false
+}
+
+// decode decodes the task message of the delivered entry and records
+// the delivery to acknowledge the entry later.
+func (b *Broker) decode(d delivery) (*broker.TaskMessage, error) {
+	var msg base.TaskMessage
+	if err := json.Unmarshal([]byte(d.data), &msg); err != nil {
+		// bad data; remove the entry so that it is not delivered again.
+		b.client.XAck(d.stream, group, d.id)
+		b.client.XDel(d.stream, d.id)
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deliveries[msg.ID.String()] = d
+	return &msg, nil
+}
+
+// lookupDelivery returns the delivery of the task.
+// If the task is not delivered to this consumer, it returns a delivery
+// without an entry ID along with the stream of the task's queue.
+func (b *Broker) lookupDelivery(msg *base.TaskMessage) delivery {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d, ok := b.deliveries[msg.ID.String()]
+	if !ok {
+		return delivery{stream: b.keys.StreamKey(msg.Queue)}
+	}
+	return d
+}
+
+// forgetDelivery removes the delivery of the task if err is nil, i.e. the
+// script acknowledging the entry succeeded, and returns err.
+//
+// The delivery is kept on error, so that retrying the operation acknowledges
+// the entry and WriteServerState keeps the entry from being claimed by
+// other consumers in the meantime.
+func (b *Broker) forgetDelivery(msg *base.TaskMessage, err error) error {
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.deliveries, msg.ID.String())
+	return nil
+}
+
+// KEYS[1] -> asynq:streams:<qname>
+// KEYS[2] -> asynq:processed:<yyyy-mm-dd>
+// KEYS[3] -> asynq:tasks
+// KEYS[4] -> asynq:stream_entries
+// KEYS[5] -> unique key, if any
+// ARGV[1] -> consumer group
+// ARGV[2] -> stream entry ID
+// ARGV[3] -> stats expiration timestamp
+// ARGV[4] -> task ID
+var doneCmd = redis.NewScript(`
+if string.len(ARGV[2]) > 0 then
+	redis.call("XACK", KEYS[1], ARGV[1], ARGV[2])
+	redis.call("XDEL", KEYS[1], ARGV[2])
+end
+redis.call("HDEL", KEYS[3], ARGV[4])
+redis.call("HDEL", KEYS[4], ARGV[4])
+local n = redis.call("INCR", KEYS[2])
+if tonumber(n) == 1 then
+	redis.call("EXPIREAT", KEYS[2], ARGV[3])
+end
+if KEYS[5] and redis.call("GET", KEYS[5]) == ARGV[4] then
+	redis.call("DEL", KEYS[5])
+end
+return redis.status_reply("OK")`)
+
+// Done acknowledges the task to mark the task as done.
+// It removes a uniqueness lock acquired by the task, if any.
+func (b *Broker) Done(msg *broker.TaskMessage) error {
+	d := b.lookupDelivery(msg)
+	now := time.Now()
+	keys := withUniqueKey([]string{d.stream, b.keys.ProcessedKey(now), b.keys.TaskIndex(), b.keys.StreamEntries()}, msg)
+	err := doneCmd.Run(b.client, keys, group, d.id, now.Add(statsTTL).Unix(), msg.ID.String()).Err()
+	return b.forgetDelivery(msg, err)
+}
+
+// withUniqueKey appends the unique key of the task to the keys of a script
+// if the task has one, so that all keys hash to the same slot in Redis Cluster.
+func withUniqueKey(keys []string, msg *broker.TaskMessage) []string {
+	if msg.UniqueKey == "" {
+		return keys
+	}
+	return append(keys, msg.UniqueKey)
+}
+
+// KEYS[1] -> stream of the delivered entry
+// KEYS[2] -> asynq:streams:<qname>
+// KEYS[3] -> asynq:streams
+// KEYS[4] -> asynq:tasks
+// KEYS[5] -> asynq:stream_entries
+// ARGV[1] -> consumer group
+// ARGV[2] -> stream entry ID
+// ARGV[3] -> task message data
+// Note: The task ID is read from the message since tasks delivered to
+// the consumer are requeued without being decoded.
+var requeueCmd = redis.NewScript(`
+if string.len(ARGV[2]) > 0 then
+	redis.call("XACK", KEYS[1], ARGV[1], ARGV[2])
+	redis.call("XDEL", KEYS[1], ARGV[2])
+end
+local entry = redis.call("XADD", KEYS[2], "*", "msg", ARGV[3])
+redis.call("SADD", KEYS[3], KEYS[2])
+local ok, decoded = pcall(cjson.decode, ARGV[3])
+if ok and type(decoded["ID"]) == "string" then
+	redis.call("HSET", KEYS[4], decoded["ID"], ARGV[3])
+	redis.call("HSET", KEYS[5], decoded["ID"], entry)
+end
+return redis.status_reply("OK")`)
+
+// Requeue acknowledges the task and appends the task to its stream.
+//
+// Unlike the default broker, the task is added to the tail of the queue
+// since an entry cannot be inserted at the head of a stream.
+func (b *Broker) Requeue(msg *broker.TaskMessage) error {
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	d := b.lookupDelivery(msg)
+	return b.forgetDelivery(msg, b.requeue(d, msg.Queue, string(bytes)))
+}
+
+func (b *Broker) requeue(d delivery, qname, data string) error {
+	return requeueCmd.Run(b.client,
+		[]string{d.stream, b.keys.StreamKey(qname), b.keys.AllStreams(), b.keys.TaskIndex(), b.keys.StreamEntries()},
+		group, d.id, data).Err()
+}
+
+// Schedule adds the task to the scheduled set to be processed in the future.
+func (b *Broker) Schedule(msg *broker.TaskMessage, processAt time.Time) error {
+	return b.rdb.Schedule(msg, processAt)
+}
+
+// ScheduleUnique adds the task to the scheduled set if the uniqueness lock can be acquired.
+// It returns broker.ErrDuplicateTask if the lock cannot be acquired.
+func (b *Broker) ScheduleUnique(msg *broker.TaskMessage, processAt time.Time, ttl time.Duration) error {
+	return b.rdb.ScheduleUnique(msg, processAt, ttl)
+}
+
+// KEYS[1] -> stream of the delivered entry
+// KEYS[2] -> asynq:retry
+// KEYS[3] -> asynq:processed:<yyyy-mm-dd>
+// KEYS[4] -> asynq:failure:<yyyy-mm-dd>
+// KEYS[5] -> asynq:tasks
+// KEYS[6] -> asynq:stream_entries
+// ARGV[1] -> consumer group
+// ARGV[2] -> stream entry ID
+// ARGV[3] -> base.TaskMessage value to add to Retry queue
+// ARGV[4] -> retry_at UNIX timestamp
+// ARGV[5] -> stats expiration timestamp
+// ARGV[6] -> task ID
+var retryCmd = redis.NewScript(`
+if string.len(ARGV[2]) > 0 then
+	redis.call("XACK", KEYS[1], ARGV[1], ARGV[2])
+	redis.call("XDEL", KEYS[1], ARGV[2])
+end
+redis.call("HDEL", KEYS[6], ARGV[6])
+redis.call("ZADD", KEYS[2], ARGV[4], ARGV[3])
+redis.call("HSET", KEYS[5], ARGV[6], ARGV[3])
+local n = redis.call("INCR", KEYS[3])
+if tonumber(n) == 1 then
+	redis.call("EXPIREAT", KEYS[3], ARGV[5])
+end
+local m = redis.call("INCR", KEYS[4])
+if tonumber(m) == 1 then
+	redis.call("EXPIREAT", KEYS[4], ARGV[5])
+end
+return redis.status_reply("OK")`)
+
+// Retry acknowledges the task and adds the task to retry queue, incrementing
+// retry count and assigning error message to the task message.
+func (b *Broker) Retry(msg *broker.TaskMessage, processAt time.Time, errMsg string) error {
+	modified := *msg
+	modified.Retried++
+	modified.ErrorMsg = errMsg
+	bytes, err := json.Marshal(&modified)
+	if err != nil {
+		return err
+	}
+	d := b.lookupDelivery(msg)
+	now := time.Now()
+	err = retryCmd.Run(b.client,
+		[]string{d.stream, b.keys.RetryQueue(), b.keys.ProcessedKey(now), b.keys.FailureKey(now), b.keys.TaskIndex(), b.keys.StreamEntries()},
+		group, d.id, string(bytes), processAt.Unix(), now.Add(statsTTL).Unix(), msg.ID.String()).Err()
+	return b.forgetDelivery(msg, err)
+}
+
+// KEYS[1] -> stream of the delivered entry
+// KEYS[2] -> asynq:scheduled
+// KEYS[3] -> asynq:stream_entries
+// ARGV[1] -> consumer group
+// ARGV[2] -> stream entry ID
+// ARGV[3] -> base.TaskMessage value to add to Scheduled queue
+// ARGV[4] -> process_at UNIX timestamp
+// ARGV[5] -> task ID
+var rescheduleCmd = redis.NewScript(`
+if string.len(ARGV[2]) > 0 then
+	redis.call("XACK", KEYS[1], ARGV[1], ARGV[2])
+	redis.call("XDEL", KEYS[1], ARGV[2])
+end
+redis.call("HDEL", KEYS[3], ARGV[5])
+redis.call("ZADD", KEYS[2], ARGV[4], ARGV[3])
+return redis.status_reply("OK")`)
+
+// Reschedule acknowledges the task and adds the task to scheduled queue
+// without modifying the task.
+func (b *Broker) Reschedule(msg *broker.TaskMessage, processAt time.Time) error {
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	d := b.lookupDelivery(msg)
+	err = rescheduleCmd.Run(b.client,
+		[]string{d.stream, b.keys.ScheduledQueue(), b.keys.StreamEntries()},
+		group, d.id, string(bytes), processAt.Unix(), msg.ID.String()).Err()
+	return b.forgetDelivery(msg, err)
+}
+
+// KEYS[1] -> stream of the delivered entry
+// KEYS[2] -> asynq:dead
+// KEYS[3] -> asynq:processed:<yyyy-mm-dd>
+// KEYS[4] -> asynq:failure:<yyyy-mm-dd>
+// KEYS[5] -> asynq:tasks
+// KEYS[6] -> asynq:dead_queues
+// KEYS[7] -> asynq:stream_entries
+// ARGV[1] -> consumer group
+// ARGV[2] -> stream entry ID
+// ARGV[3] -> base.TaskMessage value to add to Dead queue
+// ARGV[4] -> died_at UNIX timestamp
+// ARGV[5] -> stats expiration timestamp
+// ARGV[6] -> task ID
+// ARGV[7] -> dead index prefix
+var killCmd = redis.NewScript(rdb.DeadIndexScript + `
+if string.len(ARGV[2]) > 0 then
+	redis.call("XACK", KEYS[1], ARGV[1], ARGV[2])
+	redis.call("XDEL", KEYS[1], ARGV[2])
+end
+redis.call("HDEL", KEYS[7], ARGV[6])
+redis.call("ZADD", KEYS[2], ARGV[4], ARGV[3])
+indexDead(KEYS[6], ARGV[7], ARGV[3], ARGV[4])
+redis.call("HSET", KEYS[5], ARGV[6], ARGV[3])
+local n = redis.call("INCR", KEYS[3])
+if tonumber(n) == 1 then
+	redis.call("EXPIREAT", KEYS[3], ARGV[5])
+end
+local m = redis.call("INCR", KEYS[4])
+if tonumber(m) == 1 then
+	redis.call("EXPIREAT", KEYS[4], ARGV[5])
+end
+return redis.status_reply("OK")`)
+
+// Kill acknowledges the task and adds the task to "dead" queue, assigning
+// the error message to the task.
+//
+// The dead queue is not trimmed, servers trim it periodically with TrimDead.
+func (b *Broker) Kill(msg *broker.TaskMessage, errMsg string) error {
+	modified := *msg
+	modified.ErrorMsg = errMsg
+	bytes, err := json.Marshal(&modified)
+	if err != nil {
+		return err
+	}
+	return b.forgetDelivery(msg, b.kill(b.lookupDelivery(msg), msg.ID.String(), string(bytes)))
+}
+
+func (b *Broker) kill(d delivery, id, data string) error {
+	now := time.Now()
+	return killCmd.Run(b.client,
+		[]string{d.stream, b.keys.DeadQueue(), b.keys.ProcessedKey(now), b.keys.FailureKey(now), b.keys.TaskIndex(), b.keys.DeadQueues(), b.keys.StreamEntries()},
+		group, d.id, data, now.Unix(), now.Add(statsTTL).Unix(), id, b.keys.DeadIndexPrefix()).Err()
+}
+
+// RecordEvent appends the event to the history of the task with the given ID.
+func (b *Broker) RecordEvent(id string, e *broker.TaskEvent, ttl time.Duration) error {
+	return b.rdb.RecordEvent(id, e, ttl)
+}
+
+// KEYS[1] -> asynq:tasks
+// KEYS[2] -> asynq:stream_entries
+// ARGV[1] -> task ID
+// ARGV[2] -> consumer group
+// ARGV[3] -> stream prefix
+//
+// Returns 1 if the entry of the task is removed from its stream, and 0 if
+// the task is not in a stream or has been delivered to a consumer.
+var cancelCmd = redis.NewScript(`
+local entry = redis.call("HGET", KEYS[2], ARGV[1])
+local msg = redis.call("HGET", KEYS[1], ARGV[1])
+if not entry or not msg then
+	return 0
+end
+local decoded = cjson.decode(msg)
+local skey = ARGV[3] .. string.lower(decoded["Queue"])
+local pending = redis.pcall("XPENDING", skey, ARGV[2], entry, entry, 1)
+if type(pending) == "table" and not pending["err"] and #pending > 0 then
+	return 0
+end
+if redis.call("XDEL", skey, entry) == 0 then
+	return 0
+end
+redis.call("HDEL", KEYS[1], ARGV[1])
+redis.call("HDEL", KEYS[2], ARGV[1])
+local ukey = decoded["UniqueKey"]
+if type(ukey) == "string" and string.len(ukey) > 0 and redis.call("GET", ukey) == ARGV[1] then
+	redis.call("DEL", ukey)
+end
+return 1`)
+
+// Cancel removes the task with the given ID from its stream if the task has
+// not been delivered to a consumer yet, or from the scheduled or retry queue.
+// If the task has been delivered, a tombstone is recorded for the task
+// instead and the task is skipped if it has not started.
+func (b *Broker) Cancel(id string, ttl time.Duration) (broker.CancelResult, error) {
+	res, err := cancelCmd.Run(b.client, []string{b.keys.TaskIndex(), b.keys.StreamEntries()},
+		id, group, b.keys.StreamPrefix()).Result()
+	if err != nil {
+		return broker.CancelNotFound, err
+	}
+	if n, ok := res.(int64); ok && n == 1 {
+		return broker.CancelRemoved, nil
+	}
+	return b.rdb.Cancel(id, ttl)
+}
+
+// KEYS[1] -> asynq:canceled:<task_id>
+// KEYS[2] -> stream of the delivered entry
+// KEYS[3] -> asynq:tasks
+// KEYS[4] -> asynq:stream_entries
+// KEYS[5] -> unique key, if any
+// ARGV[1] -> consumer group
+// ARGV[2] -> stream entry ID
+// ARGV[3] -> task ID
+var skipCanceledCmd = redis.NewScript(`
+if redis.call("DEL", KEYS[1]) == 0 then
+	return 0
+end
+if string.len(ARGV[2]) > 0 then
+	redis.call("XACK", KEYS[2], ARGV[1], ARGV[2])
+	redis.call("XDEL", KEYS[2], ARGV[2])
+end
+redis.call("HDEL", KEYS[3], ARGV[3])
+redis.call("HDEL", KEYS[4], ARGV[3])
+if KEYS[5] and redis.call("GET", KEYS[5]) == ARGV[3] then
+	redis.call("DEL", KEYS[5])
+end
+return 1`)
+
+// SkipCanceled reports whether a tombstone is recorded for the task.
+// If so, it acknowledges the task and removes it from the stream.
+func (b *Broker) SkipCanceled(msg *broker.TaskMessage) (bool, error) {
+	id := msg.ID.String()
+	d := b.lookupDelivery(msg)
+	keys := withUniqueKey([]string{b.keys.TombstoneKey(id), d.stream, b.keys.TaskIndex(), b.keys.StreamEntries()}, msg)
+	res, err := skipCanceledCmd.Run(b.client, keys, group, d.id, id).Result()
+	if err != nil {
+		return false, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return false, fmt.Errorf("could not cast %v to int64", res)
+	}
+	if n == 1 {
+		b.forgetDelivery(msg, nil)
+	}
+	return n == 1, nil
+}
+
+// TrimDead removes dead tasks which exceed the given retention limits.
+// The dead queue is shared with the default broker, see rdb.RDB.TrimDead.
+func (b *Broker) TrimDead(def broker.Retention, perQueue map[string]broker.Retention, evict func([]*broker.DeadEntry) error) (int, error) {
+	return b.rdb.TrimDead(def, perQueue, evict)
+}
+
+// RequeueAll puts all tasks delivered to this consumer and not yet
+// acknowledged back to their streams and reports the number of tasks restored.
+func (b *Broker) RequeueAll() (int64, error) {
+	b.mu.Lock()
+	var ds []delivery
+	for _, d := range b.deliveries {
+		ds = append(ds, d)
+	}
+	ds = append(ds, b.buffered...)
+	b.deliveries = make(map[string]delivery)
+	b.buffered = nil
+	b.mu.Unlock()
+
+	var n int64
+	for _, d := range ds {
+		qname := strings.TrimPrefix(d.stream, b.keys.StreamPrefix())
+		if err := b.requeue(d, qname, d.data); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// RecoverAll claims tasks delivered to other consumers which have been idle
+// longer than Options.ClaimMinIdle, and puts them back to their streams,
+// incrementing the number of times each task has been recovered.
+// A task that has been recovered more than maxRecovery times is moved
+// to the dead queue with the given error message instead.
+// Negative maxRecovery means no limit.
+//
+// The broker keeps recovering tasks from crashed consumers periodically
+// in CheckAndEnqueue using the limit and the error message given
+// to the last call to RecoverAll.
+//
+// It reports the number of tasks requeued and the number of tasks killed.
+func (b *Broker) RecoverAll(maxRecovery int, errMsg string) (requeued, killed int64, err error) {
+	b.mu.Lock()
+	b.recovering = true
+	b.maxRecovery = maxRecovery
+	b.errMsg = errMsg
+	b.mu.Unlock()
+	return b.recover(maxRecovery, errMsg)
+}
+
+func (b *Broker) recover(maxRecovery int, errMsg string) (requeued, killed int64, err error) {
+	streams, err := b.client.SMembers(b.keys.AllStreams()).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, s := range streams {
+		ds, err := b.claim(s)
+		if err != nil {
+			return requeued, killed, err
+		}
+		for _, d := range ds {
+			var msg base.TaskMessage
+			if err := json.Unmarshal([]byte(d.data), &msg); err != nil {
+				b.client.XAck(d.stream, group, d.id)
+				b.client.XDel(d.stream, d.id)
+				continue // bad data, ignore and continue
+			}
+			msg.Recovered++
+			dead := maxRecovery >= 0 && msg.Recovered > maxRecovery
+			if dead {
+				msg.ErrorMsg = errMsg
+			}
+			bytes, err := json.Marshal(&msg)
+			if err != nil {
+				return requeued, killed, err
+			}
+			if dead {
+				if err := b.kill(d, msg.ID.String(), string(bytes)); err != nil {
+					return requeued, killed, err
+				}
+				killed++
+				continue
+			}
+			if err := b.requeue(d, msg.Queue, string(bytes)); err != nil {
+				return requeued, killed, err
+			}
+			requeued++
+		}
+	}
+	return requeued, killed, nil
+}
+
+// claim transfers the ownership of the entries in the stream which have been
+// idle longer than claimMinIdle from other consumers to this consumer.
+func (b *Broker) claim(stream string) ([]delivery, error) {
+	pending, err := b.client.XPendingExt(&redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  group,
+		Start:  "-",
+		End:    "+",
+		Count:  1000,
+	}).Result()
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "NOGROUP") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	for _, p := range pending {
+		if p.Consumer != b.consumer && p.Idle >= b.claimMinIdle {
+			ids = append(ids, p.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	// XCLAIM checks the idle time again so that an entry is claimed
+	// by only one consumer.
+	msgs, err := b.client.XClaim(&redis.XClaimArgs{
+		Stream:   stream,
+		Group:    group,
+		Consumer: b.consumer,
+		MinIdle:  b.claimMinIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	var res []delivery
+	for _, xm := range msgs {
+		data, _ := xm.Values[msgField].(string)
+		res = append(res, delivery{stream: stream, id: xm.ID, data: data})
+	}
+	return res, nil
+}
+
+// KEYS[1] -> source queue (e.g. scheduled or retry queue)
+// KEYS[2] -> asynq:streams
+// KEYS[3] -> asynq:stream_entries
+// ARGV[1] -> current unix time
+// ARGV[2] -> stream prefix
+var forwardCmd = redis.NewScript(`
+local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+for _, msg in ipairs(msgs) do
+	local decoded = cjson.decode(msg)
+	local skey = ARGV[2] .. string.lower(decoded["Queue"])
+	local entry = redis.call("XADD", skey, "*", "msg", msg)
+	redis.call("SADD", KEYS[2], skey)
+	redis.call("HSET", KEYS[3], decoded["ID"], entry)
+	redis.call("ZREM", KEYS[1], msg)
+end
+return table.getn(msgs)`)
+
+// CheckAndEnqueue checks for all scheduled and retry tasks and appends any
+// tasks that have to be processed to their streams.
+//
+// It also recovers tasks from crashed consumers once RecoverAll has been called.
+// The tasks are moved to the queue they were enqueued to, so qnames is not used.
+func (b *Broker) CheckAndEnqueue(qnames ...string) error {
+	now := time.Now().Unix()
+	for _, zset := range []string{b.keys.ScheduledQueue(), b.keys.RetryQueue()} {
+		err := forwardCmd.Run(b.client,
+			[]string{zset, b.keys.AllStreams(), b.keys.StreamEntries()}, now, b.keys.StreamPrefix()).Err()
+		if err != nil {
+			return err
+		}
+	}
+	b.mu.Lock()
+	recovering, maxRecovery, errMsg := b.recovering, b.maxRecovery, b.errMsg
+	b.mu.Unlock()
+	if !recovering {
+		return nil
+	}
+	_, _, err := b.recover(maxRecovery, errMsg)
+	return err
+}
+
+// WriteServerState writes server state data to redis with expiration set to the value ttl.
+//
+// It also resets the idle time of the tasks delivered to this consumer
+// so that the tasks are not claimed by other consumers while being processed.
+func (b *Broker) WriteServerState(ss *broker.ServerState, ttl time.Duration) error {
+	if err := b.rdb.WriteServerState(ss, ttl); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	ids := make(map[string][]string) // entry IDs by stream
+	for _, d := range b.deliveries {
+		ids[d.stream] = append(ids[d.stream], d.id)
+	}
+	for _, d := range b.buffered {
+		ids[d.stream] = append(ids[d.stream], d.id)
+	}
+	b.mu.Unlock()
+	for stream, entryIDs := range ids {
+		err := b.client.XClaimJustID(&redis.XClaimArgs{
+			Stream:   stream,
+			Group:    group,
+			Consumer: b.consumer,
+			Messages: entryIDs,
+		}).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClearServerState deletes server state data from redis.
+//
+// It also removes this consumer from the consumer group
+// if it has no tasks left unacknowledged.
+func (b *Broker) ClearServerState(ss *broker.ServerState) error {
+	if err := b.rdb.ClearServerState(ss); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	idle := len(b.deliveries) == 0 && len(b.buffered) == 0
+	var streams []string
+	for s := range b.groups {
+		streams = append(streams, s)
+	}
+	b.mu.Unlock()
+	if !idle {
+		return nil
+	}
+	for _, s := range streams {
+		if err := b.client.XGroupDelConsumer(s, group, b.consumer).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SubscribeCancelation returns a subscription to cancelation messages.
+func (b *Broker) SubscribeCancelation() (broker.Subscription, error) {
+	return b.rdb.SubscribeCancelation()
+}
+
+// PublishCancelation publish cancelation message to all subscribers.
+// The message is the ID for the task to be canceled.
+func (b *Broker) PublishCancelation(id string) error {
+	return b.rdb.PublishCancelation(id)
+}
+
+// Close closes the connection with redis server.
+func (b *Broker) Close() error {
+	return b.client.Close()
+}
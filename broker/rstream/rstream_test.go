@@ -0,0 +1,594 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// Compile-time check that Broker implements base.Broker.
+var _ base.Broker = (*Broker)(nil)
+
+// Compile-time check that Broker implements base.Rescheduler.
+var _ base.Rescheduler = (*Broker)(nil)
+
+// Compile-time check that Broker implements base.Canceler.
+var _ base.Canceler = (*Broker)(nil)
+
+func setup(t *testing.T, opt Options) (*Broker, redis.UniversalClient) {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+		DB:   12,
+	})
+	// Fail scripts which could not run in Redis Cluster.
+	client.AddHook(h.ClusterSlotHook{})
+	// Start each test with a clean slate.
+	h.FlushDB(t, client)
+	return New(client, opt), client
+}
+
+// getStreamMessages returns all task messages in the stream of the queue.
+func getStreamMessages(t *testing.T, client redis.UniversalClient, qname string) []*base.TaskMessage {
+	t.Helper()
+	xms, err := client.XRange(h.Keys.StreamKey(qname), "-", "+").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*base.TaskMessage
+	for _, xm := range xms {
+		var msg base.TaskMessage
+		if err := json.Unmarshal([]byte(xm.Values[msgField].(string)), &msg); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, &msg)
+	}
+	return msgs
+}
+
+// countPending returns the number of entries delivered but not acknowledged in the stream of the queue.
+func countPending(t *testing.T, client redis.UniversalClient, qname string) int64 {
+	t.Helper()
+	res, err := client.XPending(h.Keys.StreamKey(qname), group).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Count
+}
+
+func TestEnqueueDequeue(t *testing.T) {
+	t1 := h.NewTaskMessage("send_email", map[string]interface{}{"user_id": 42})
+	t2 := h.NewTaskMessage("reindex", nil)
+	t2.Queue = "critical"
+	t3 := h.NewTaskMessage("sync", nil)
+	t3.Queue = "low"
+
+	tests := []struct {
+		enqueued []*base.TaskMessage
+		qnames   []string // queues to dequeue from
+		want     []*base.TaskMessage
+	}{
+		{
+			enqueued: []*base.TaskMessage{t1, t2, t3},
+			qnames:   []string{"critical", "default", "low"},
+			want:     []*base.TaskMessage{t2, t1, t3},
+		},
+		{
+			enqueued: []*base.TaskMessage{t1, t2, t3},
+			qnames:   []string{"low", "default"},
+			want:     []*base.TaskMessage{t3, t1},
+		},
+	}
+
+	for _, tc := range tests {
+		b, client := setup(t, Options{})
+		for _, msg := range tc.enqueued {
+			if err := b.Enqueue(msg); err != nil {
+				t.Fatalf("(*Broker).Enqueue(msg) = %v, want nil", err)
+			}
+		}
+
+		var got []*base.TaskMessage
+		for {
+			msg, err := b.Dequeue(tc.qnames...)
+			if err == base.ErrNoProcessableTask {
+				break
+			}
+			if err != nil {
+				t.Fatalf("(*Broker).Dequeue(%v) returned error: %v", tc.qnames, err)
+			}
+			got = append(got, msg)
+		}
+		// payload values are decoded as JSON numbers.
+		if diff := cmp.Diff(tc.want, got, cmpopts.IgnoreFields(base.TaskMessage{}, "Payload")); diff != "" {
+			t.Errorf("dequeued tasks mismatch; (-want,+got)\n%s", diff)
+		}
+		for _, msg := range tc.want {
+			if n := countPending(t, client, msg.Queue); n != 1 {
+				t.Errorf("%q stream has %d pending entries, want 1", msg.Queue, n)
+			}
+		}
+	}
+}
+
+func TestDequeueWaitsForTask(t *testing.T) {
+	b, _ := setup(t, Options{})
+	msg := h.NewTaskMessage("send_email", nil)
+	msg.Queue = "low"
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		b.Enqueue(msg)
+	}()
+
+	start := time.Now()
+	got, err := b.Dequeue("critical", "low")
+	if err != nil {
+		t.Fatalf("(*Broker).Dequeue(%q, %q) returned error: %v", "critical", "low", err)
+	}
+	if diff := cmp.Diff(msg, got); diff != "" {
+		t.Errorf("(*Broker).Dequeue = %v, want %v; (-want,+got)\n%s", got, msg, diff)
+	}
+	if elapsed := time.Since(start); elapsed >= dequeueTimeout {
+		t.Errorf("(*Broker).Dequeue took %v, want less than %v", elapsed, dequeueTimeout)
+	}
+}
+
+func TestEnqueueUnique(t *testing.T) {
+	b, _ := setup(t, Options{})
+	m1 := h.NewTaskMessage("email", map[string]interface{}{"user_id": 123})
+	m1.UniqueKey = h.Keys.UniqueKey(base.DefaultQueueName, "email", "user_id=123")
+	m2 := h.NewTaskMessage("email", map[string]interface{}{"user_id": 123})
+	m2.UniqueKey = m1.UniqueKey
+
+	if err := b.EnqueueUnique(m1, time.Minute); err != nil {
+		t.Fatalf("First message: (*Broker).EnqueueUnique(%v, time.Minute) = %v, want nil", m1, err)
+	}
+	if err := b.EnqueueUnique(m2, time.Minute); err != base.ErrDuplicateTask {
+		t.Errorf("Second message: (*Broker).EnqueueUnique(%v, time.Minute) = %v, want %v", m2, err, base.ErrDuplicateTask)
+	}
+
+	// lock is released when the task is done.
+	msg, err := b.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Done(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.EnqueueUnique(m2, time.Minute); err != nil {
+		t.Errorf("After done: (*Broker).EnqueueUnique(%v, time.Minute) = %v, want nil", m2, err)
+	}
+}
+
+func TestDone(t *testing.T) {
+	b, client := setup(t, Options{})
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	for _, msg := range []*base.TaskMessage{m1, m2} {
+		if err := b.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, err := b.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Done(msg); err != nil {
+		t.Fatalf("(*Broker).Done(msg) = %v, want nil", err)
+	}
+
+	if diff := cmp.Diff([]*base.TaskMessage{m2}, getStreamMessages(t, client, base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in stream; (-want,+got)\n%s", diff)
+	}
+	if n := countPending(t, client, base.DefaultQueueName); n != 0 {
+		t.Errorf("stream has %d pending entries, want 0", n)
+	}
+	processedKey := h.Keys.ProcessedKey(time.Now())
+	if n := client.Get(processedKey).Val(); n != "1" {
+		t.Errorf("GET %q = %q, want 1", processedKey, n)
+	}
+	wantIndex := map[string]*base.TaskMessage{m2.ID.String(): m2}
+	if diff := cmp.Diff(wantIndex, h.GetTaskIndex(t, client)); diff != "" {
+		t.Errorf("mismatch found in task index; (-want,+got)\n%s", diff)
+	}
+}
+
+// failScriptsHook fails scripts with an error while fail is set.
+type failScriptsHook struct {
+	fail bool
+}
+
+func (hook *failScriptsHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if hook.fail && (cmd.Name() == "evalsha" || cmd.Name() == "eval") {
+		return ctx, errors.New("connection reset")
+	}
+	return ctx, nil
+}
+
+func (hook *failScriptsHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (hook *failScriptsHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (hook *failScriptsHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func TestDoneAfterError(t *testing.T) {
+	b, client := setup(t, Options{})
+	hook := &failScriptsHook{}
+	client.(*redis.Client).AddHook(hook)
+	if err := b.Enqueue(h.NewTaskMessage("send_email", nil)); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := b.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hook.fail = true
+	if err := b.Done(msg); err == nil {
+		t.Fatal("(*Broker).Done(msg) = nil, want error")
+	}
+	hook.fail = false
+	// the syncer retries the operation.
+	if err := b.Done(msg); err != nil {
+		t.Fatalf("(*Broker).Done(msg) = %v, want nil", err)
+	}
+
+	if n := countPending(t, client, base.DefaultQueueName); n != 0 {
+		t.Errorf("stream has %d pending entries, want 0", n)
+	}
+	if got := getStreamMessages(t, client, base.DefaultQueueName); len(got) != 0 {
+		t.Errorf("stream has %d entries, want 0", len(got))
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	b, client := setup(t, Options{})
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	for _, msg := range []*base.TaskMessage{m1, m2} {
+		if err := b.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, err := b.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Requeue(msg); err != nil {
+		t.Fatalf("(*Broker).Requeue(msg) = %v, want nil", err)
+	}
+
+	// requeued task is added to the tail of the stream.
+	want := []*base.TaskMessage{m2, m1}
+	if diff := cmp.Diff(want, getStreamMessages(t, client, base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in stream; (-want,+got)\n%s", diff)
+	}
+	if n := countPending(t, client, base.DefaultQueueName); n != 0 {
+		t.Errorf("stream has %d pending entries, want 0", n)
+	}
+}
+
+func TestRetryAndKill(t *testing.T) {
+	b, client := setup(t, Options{})
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	for _, msg := range []*base.TaskMessage{m1, m2} {
+		if err := b.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Dequeue(base.DefaultQueueName); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	retryAt := time.Now().Add(time.Minute)
+	if err := b.Retry(m1, retryAt, "oops"); err != nil {
+		t.Fatalf("(*Broker).Retry() = %v, want nil", err)
+	}
+	if err := b.Kill(m2, "fatal"); err != nil {
+		t.Fatalf("(*Broker).Kill() = %v, want nil", err)
+	}
+
+	r1 := *m1
+	r1.Retried++
+	r1.ErrorMsg = "oops"
+	wantRetry := []h.ZSetEntry{{Msg: &r1, Score: float64(retryAt.Unix())}}
+	if diff := cmp.Diff(wantRetry, h.GetRetryEntries(t, client)); diff != "" {
+		t.Errorf("mismatch found in retry queue; (-want,+got)\n%s", diff)
+	}
+	d2 := *m2
+	d2.ErrorMsg = "fatal"
+	if diff := cmp.Diff([]*base.TaskMessage{&d2}, h.GetDeadMessages(t, client)); diff != "" {
+		t.Errorf("mismatch found in dead queue; (-want,+got)\n%s", diff)
+	}
+	if msgs := getStreamMessages(t, client, base.DefaultQueueName); len(msgs) != 0 {
+		t.Errorf("stream has %d entries, want 0", len(msgs))
+	}
+	if n := countPending(t, client, base.DefaultQueueName); n != 0 {
+		t.Errorf("stream has %d pending entries, want 0", n)
+	}
+	failureKey := h.Keys.FailureKey(time.Now())
+	if n := client.Get(failureKey).Val(); n != "2" {
+		t.Errorf("GET %q = %q, want 2", failureKey, n)
+	}
+	wantIndex := map[string]*base.TaskMessage{m1.ID.String(): &r1, m2.ID.String(): &d2}
+	if diff := cmp.Diff(wantIndex, h.GetTaskIndex(t, client)); diff != "" {
+		t.Errorf("mismatch found in task index; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestReschedule(t *testing.T) {
+	b, client := setup(t, Options{})
+	msg := h.NewTaskMessage("send_email", nil)
+	msg.Retried = 3
+	if err := b.Enqueue(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Dequeue(base.DefaultQueueName); err != nil {
+		t.Fatal(err)
+	}
+
+	processAt := time.Now().Add(time.Hour)
+	if err := b.Reschedule(msg, processAt); err != nil {
+		t.Fatalf("(*Broker).Reschedule() = %v, want nil", err)
+	}
+
+	want := []h.ZSetEntry{{Msg: msg, Score: float64(processAt.Unix())}}
+	if diff := cmp.Diff(want, h.GetScheduledEntries(t, client)); diff != "" {
+		t.Errorf("mismatch found in scheduled queue; (-want,+got)\n%s", diff)
+	}
+	if msgs := getStreamMessages(t, client, base.DefaultQueueName); len(msgs) != 0 {
+		t.Errorf("stream has %d entries, want 0", len(msgs))
+	}
+	if n := countPending(t, client, base.DefaultQueueName); n != 0 {
+		t.Errorf("stream has %d pending entries, want 0", n)
+	}
+}
+
+func TestCheckAndEnqueue(t *testing.T) {
+	b, client := setup(t, Options{})
+	now := time.Now()
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m2.Queue = "critical"
+	m3 := h.NewTaskMessage("sync", nil)
+	h.SeedScheduledQueue(t, client, []h.ZSetEntry{
+		{Msg: m1, Score: float64(now.Add(-time.Minute).Unix())},
+		{Msg: m3, Score: float64(now.Add(time.Hour).Unix())},
+	})
+	h.SeedRetryQueue(t, client, []h.ZSetEntry{
+		{Msg: m2, Score: float64(now.Add(-time.Second).Unix())},
+	})
+
+	if err := b.CheckAndEnqueue(); err != nil {
+		t.Fatalf("(*Broker).CheckAndEnqueue() = %v, want nil", err)
+	}
+
+	if diff := cmp.Diff([]*base.TaskMessage{m1}, getStreamMessages(t, client, base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in default stream; (-want,+got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{m2}, getStreamMessages(t, client, "critical")); diff != "" {
+		t.Errorf("mismatch found in critical stream; (-want,+got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{m3}, h.GetScheduledMessages(t, client)); diff != "" {
+		t.Errorf("mismatch found in scheduled queue; (-want,+got)\n%s", diff)
+	}
+	if n := len(h.GetRetryMessages(t, client)); n != 0 {
+		t.Errorf("retry queue has %d tasks, want 0", n)
+	}
+}
+
+func TestRequeueAll(t *testing.T) {
+	b, client := setup(t, Options{})
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m2.Queue = "critical"
+	for _, msg := range []*base.TaskMessage{m1, m2} {
+		if err := b.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Dequeue(msg.Queue); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := b.RequeueAll()
+	if err != nil || n != 2 {
+		t.Fatalf("(*Broker).RequeueAll() = %d, %v; want 2, nil", n, err)
+	}
+
+	for _, msg := range []*base.TaskMessage{m1, m2} {
+		if diff := cmp.Diff([]*base.TaskMessage{msg}, getStreamMessages(t, client, msg.Queue)); diff != "" {
+			t.Errorf("mismatch found in %q stream; (-want,+got)\n%s", msg.Queue, diff)
+		}
+		if n := countPending(t, client, msg.Queue); n != 0 {
+			t.Errorf("%q stream has %d pending entries, want 0", msg.Queue, n)
+		}
+	}
+}
+
+func TestRecoverAll(t *testing.T) {
+	minIdle := 50 * time.Millisecond
+	crashed, client := setup(t, Options{ClaimMinIdle: minIdle})
+	b := New(client, Options{ClaimMinIdle: minIdle})
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("segfault", nil)
+	m2.Recovered = 3
+	for _, msg := range []*base.TaskMessage{m1, m2} {
+		if err := crashed.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := crashed.Dequeue(base.DefaultQueueName); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// tasks are not claimed until they have been idle long enough.
+	requeued, killed, err := b.RecoverAll(3, "crashed")
+	if err != nil || requeued != 0 || killed != 0 {
+		t.Fatalf("(*Broker).RecoverAll(3, %q) = %d, %d, %v; want 0, 0, nil", "crashed", requeued, killed, err)
+	}
+
+	time.Sleep(2 * minIdle)
+	requeued, killed, err = b.RecoverAll(3, "crashed")
+	if err != nil || requeued != 1 || killed != 1 {
+		t.Fatalf("(*Broker).RecoverAll(3, %q) = %d, %d, %v; want 1, 1, nil", "crashed", requeued, killed, err)
+	}
+
+	r1 := *m1
+	r1.Recovered = 1
+	if diff := cmp.Diff([]*base.TaskMessage{&r1}, getStreamMessages(t, client, base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in stream; (-want,+got)\n%s", diff)
+	}
+	if n := countPending(t, client, base.DefaultQueueName); n != 0 {
+		t.Errorf("stream has %d pending entries, want 0", n)
+	}
+	d2 := *m2
+	d2.Recovered = 4
+	d2.ErrorMsg = "crashed"
+	if diff := cmp.Diff([]*base.TaskMessage{&d2}, h.GetDeadMessages(t, client)); diff != "" {
+		t.Errorf("mismatch found in dead queue; (-want,+got)\n%s", diff)
+	}
+	wantIndex := map[string]*base.TaskMessage{m1.ID.String(): &r1, m2.ID.String(): &d2}
+	if diff := cmp.Diff(wantIndex, h.GetTaskIndex(t, client)); diff != "" {
+		t.Errorf("mismatch found in task index; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	b, client := setup(t, Options{})
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	if err := b.Enqueue(m1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Schedule(m2, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// scheduled task is removed.
+	res, err := b.Cancel(m2.ID.String(), time.Hour)
+	if err != nil || res != base.CancelRemoved {
+		t.Errorf("(*Broker).Cancel(scheduled task) = %v, %v; want %v, nil", res, err, base.CancelRemoved)
+	}
+	if msgs := h.GetScheduledMessages(t, client); len(msgs) != 0 {
+		t.Errorf("scheduled queue has %d tasks, want 0", len(msgs))
+	}
+
+	// pending task in stream is removed.
+	res, err = b.Cancel(m1.ID.String(), time.Hour)
+	if err != nil || res != base.CancelRemoved {
+		t.Errorf("(*Broker).Cancel(pending task) = %v, %v; want %v, nil", res, err, base.CancelRemoved)
+	}
+	if msgs := getStreamMessages(t, client, base.DefaultQueueName); len(msgs) != 0 {
+		t.Errorf("stream has %d entries, want 0", len(msgs))
+	}
+	if index := h.GetTaskIndex(t, client); len(index) != 0 {
+		t.Errorf("task index has %d tasks, want 0", len(index))
+	}
+	if _, err := b.Dequeue(base.DefaultQueueName); err != base.ErrNoProcessableTask {
+		t.Errorf("(*Broker).Dequeue() after cancel returned %v, want %v", err, base.ErrNoProcessableTask)
+	}
+
+	// delivered task is skipped if it has not started.
+	m3 := h.NewTaskMessage("send_email", nil)
+	if err := b.Enqueue(m3); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := b.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = b.Cancel(m3.ID.String(), time.Hour)
+	if err != nil || res != base.CancelRunning {
+		t.Errorf("(*Broker).Cancel(delivered task) = %v, %v; want %v, nil", res, err, base.CancelRunning)
+	}
+	skipped, err := b.SkipCanceled(msg)
+	if err != nil || !skipped {
+		t.Errorf("(*Broker).SkipCanceled(msg) = %t, %v; want true, nil", skipped, err)
+	}
+	if msgs := getStreamMessages(t, client, base.DefaultQueueName); len(msgs) != 0 {
+		t.Errorf("stream has %d entries, want 0", len(msgs))
+	}
+	if n := countPending(t, client, base.DefaultQueueName); n != 0 {
+		t.Errorf("stream has %d pending entries, want 0", n)
+	}
+	if index := h.GetTaskIndex(t, client); len(index) != 0 {
+		t.Errorf("task index has %d tasks, want 0", len(index))
+	}
+}
+
+func TestWriteServerStateKeepsTasks(t *testing.T) {
+	minIdle := 50 * time.Millisecond
+	alive, client := setup(t, Options{ClaimMinIdle: minIdle})
+	b := New(client, Options{ClaimMinIdle: minIdle})
+	msg := h.NewTaskMessage("send_email", nil)
+	if err := alive.Enqueue(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alive.Dequeue(base.DefaultQueueName); err != nil {
+		t.Fatal(err)
+	}
+	ss := base.NewServerState("localhost", 1234, 10, map[string]int{"default": 1}, false)
+
+	time.Sleep(2 * minIdle)
+	// heartbeat resets the idle time of the tasks being processed.
+	if err := alive.WriteServerState(ss, 5*time.Second); err != nil {
+		t.Fatalf("(*Broker).WriteServerState() = %v, want nil", err)
+	}
+	requeued, killed, err := b.RecoverAll(3, "crashed")
+	if err != nil || requeued != 0 || killed != 0 {
+		t.Fatalf("(*Broker).RecoverAll(3, %q) = %d, %d, %v; want 0, 0, nil", "crashed", requeued, killed, err)
+	}
+
+	if err := alive.Done(msg); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPending(t, client, base.DefaultQueueName); n != 0 {
+		t.Errorf("stream has %d pending entries, want 0", n)
+	}
+	if err := alive.ClearServerState(ss); err != nil {
+		t.Fatalf("(*Broker).ClearServerState() = %v, want nil", err)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	b, client := setup(t, Options{Namespace: "myapp"})
+	msg := h.NewTaskMessage("send_email", nil)
+	if err := b.Enqueue(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	skey := base.NewKeys("myapp").StreamKey(base.DefaultQueueName)
+	if n := client.XLen(skey).Val(); n != 1 {
+		t.Errorf("XLEN %q = %d, want 1", skey, n)
+	}
+	got, err := b.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(msg, got); diff != "" {
+		t.Errorf("(*Broker).Dequeue = %v, want %v; (-want,+got)\n%s", got, msg, diff)
+	}
+}
@@ -5,12 +5,14 @@
 package asynq
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sort"
 	"strings"
 	"time"
 
+	"github.com/hibiken/asynq/broker"
 	"github.com/hibiken/asynq/internal/base"
 	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/rs/xid"
@@ -23,13 +25,64 @@ import (
 //
 // Clients are safe for concurrent use by multiple goroutines.
 type Client struct {
-	rdb *rdb.RDB
+	broker base.Broker
+
+	// keys is used to compute uniqueness lock keys.
+	keys base.Keys
+
+	// historyTTL is the retention of task history; zero if disabled.
+	historyTTL time.Duration
+
+	// tracer opens spans for enqueued tasks; nil if tracing is disabled.
+	tracer Tracer
+}
+
+// SetHistoryTTL enables recording of the lifecycle history of the tasks
+// enqueued by the client, see Config.HistoryTTL.
+// History is recorded on a best-effort basis; a failure to record an event
+// does not fail the enqueue.
+//
+// SetHistoryTTL should be called before the client enqueues any task.
+// Zero TTL disables recording, which is the default.
+func (c *Client) SetHistoryTTL(ttl time.Duration) {
+	c.historyTTL = ttl
+}
+
+// SetTracer sets the tracer to open a span when a task is enqueued.
+//
+// SetTracer should be called before the client enqueues any task.
+// Tasks carry the trace context of the context passed to EnqueueContext
+// even if no tracer is set.
+func (c *Client) SetTracer(t Tracer) {
+	c.tracer = t
 }
 
 // NewClient and returns a new Client given a redis connection option.
 func NewClient(r RedisConnOpt) *Client {
-	rdb := rdb.NewRDB(createRedisClient(r))
-	return &Client{rdb}
+	return NewClientWithNamespace(r, base.DefaultNamespace)
+}
+
+// NewClientWithNamespace returns a new Client which enqueues tasks
+// under the given namespace.
+//
+// Tasks enqueued by the client are processed only by servers
+// configured with the same namespace.
+func NewClientWithNamespace(r RedisConnOpt, ns string) *Client {
+	rdb := rdb.NewRDBWithNamespace(createRedisClient(r), ns)
+	return &Client{broker: rdb, keys: rdb.Keys()}
+}
+
+// NewClientWithBroker returns a new Client which enqueues tasks
+// to the given broker.
+//
+// If the broker has a Keys method, as the redis streams broker does,
+// uniqueness locks are created under the broker's namespace.
+func NewClientWithBroker(b broker.Broker) *Client {
+	keys := base.NewKeys(base.DefaultNamespace)
+	if kb, ok := b.(interface{ Keys() base.Keys }); ok {
+		keys = kb.Keys()
+	}
+	return &Client{broker: b, keys: keys}
 }
 
 // Option specifies the task processing behavior.
@@ -42,6 +95,7 @@ type (
 	timeoutOption  time.Duration
 	deadlineOption time.Time
 	uniqueOption   time.Duration
+	headerOption   struct{ key, value string }
 )
 
 // MaxRetry returns an option to specify the max number of times
@@ -87,6 +141,16 @@ func Unique(ttl time.Duration) Option {
 	return uniqueOption(ttl)
 }
 
+// Header returns an option to attach the metadata header to the task.
+//
+// Headers are kept separately from the payload and don't affect
+// the uniqueness of the task. The option can be given multiple times
+// to set multiple headers; a header set twice takes the last value.
+// Handlers read the headers from their context with HeadersFromContext.
+func Header(key, value string) Option {
+	return headerOption{key, value}
+}
+
 // ErrDuplicateTask indicates that the given task could not be enqueued since it's a duplicate of another task.
 //
 // ErrDuplicateTask error only applies to tasks enqueued with a Unique option.
@@ -98,6 +162,7 @@ type option struct {
 	timeout   time.Duration
 	deadline  time.Time
 	uniqueTTL time.Duration
+	headers   map[string]string
 }
 
 func composeOptions(opts ...Option) option {
@@ -119,6 +184,11 @@ func composeOptions(opts ...Option) option {
 			res.deadline = time.Time(opt)
 		case uniqueOption:
 			res.uniqueTTL = time.Duration(opt)
+		case headerOption:
+			if res.headers == nil {
+				res.headers = make(map[string]string)
+			}
+			res.headers[opt.key] = opt.value
 		default:
 			// ignore unexpected option
 		}
@@ -128,11 +198,11 @@ func composeOptions(opts ...Option) option {
 
 // uniqueKey computes the redis key used for the given task.
 // It returns an empty string if ttl is zero.
-func uniqueKey(t *Task, ttl time.Duration, qname string) string {
+func uniqueKey(keys base.Keys, t *Task, ttl time.Duration, qname string) string {
 	if ttl == 0 {
 		return ""
 	}
-	return fmt.Sprintf("%s:%s:%s", t.Type, serializePayload(t.Payload.data), qname)
+	return keys.UniqueKey(qname, t.Type, serializePayload(t.Payload.data))
 }
 
 func serializePayload(payload map[string]interface{}) string {
@@ -171,7 +241,24 @@ const (
 // The argument opts specifies the behavior of task processing.
 // If there are conflicting Option values the last one overrides others.
 func (c *Client) EnqueueAt(t time.Time, task *Task, opts ...Option) error {
+	return c.EnqueueAtContext(context.Background(), t, task, opts...)
+}
+
+// EnqueueAtContext is like EnqueueAt, but the task carries the trace
+// context of ctx to continue the trace when the task is processed.
+// See TraceContext.
+func (c *Client) EnqueueAtContext(ctx context.Context, t time.Time, task *Task, opts ...Option) (err error) {
+	if c.tracer != nil {
+		var end func(error)
+		ctx, end = c.tracer.StartEnqueue(ctx, task)
+		defer func() { end(err) }()
+	}
 	opt := composeOptions(opts...)
+	now := time.Now()
+	readyAt := t
+	if now.After(t) {
+		readyAt = now
+	}
 	msg := &base.TaskMessage{
 		ID:        xid.New(),
 		Type:      task.Type,
@@ -180,18 +267,28 @@ func (c *Client) EnqueueAt(t time.Time, task *Task, opts ...Option) error {
 		Retry:     opt.retry,
 		Timeout:   opt.timeout.String(),
 		Deadline:  opt.deadline.Format(time.RFC3339),
-		UniqueKey: uniqueKey(task, opt.uniqueTTL, opt.queue),
+		UniqueKey: uniqueKey(c.keys, task, opt.uniqueTTL, opt.queue),
+		ReadyAt:   readyAt.UnixNano(),
+		Headers:   opt.headers,
 	}
-	var err error
-	if time.Now().After(t) {
+	if tc, ok := TraceContextFromContext(ctx); ok {
+		msg.TraceParent, msg.TraceState = tc.TraceParent, tc.TraceState
+	}
+	event := &base.TaskEvent{Kind: base.EventEnqueued}
+	if now.After(t) {
 		err = c.enqueue(msg, opt.uniqueTTL)
 	} else {
 		err = c.schedule(msg, t, opt.uniqueTTL)
+		event.Kind, event.ProcessAt = base.EventScheduled, t
 	}
-	if err == rdb.ErrDuplicateTask {
+	if errors.Is(err, base.ErrDuplicateTask) {
 		return fmt.Errorf("%w", ErrDuplicateTask)
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	c.record(msg.ID.String(), msg.Queue, event)
+	return nil
 }
 
 // Enqueue enqueues task to be processed immediately.
@@ -201,7 +298,14 @@ func (c *Client) EnqueueAt(t time.Time, task *Task, opts ...Option) error {
 // The argument opts specifies the behavior of task processing.
 // If there are conflicting Option values the last one overrides others.
 func (c *Client) Enqueue(task *Task, opts ...Option) error {
-	return c.EnqueueAt(time.Now(), task, opts...)
+	return c.EnqueueAtContext(context.Background(), time.Now(), task, opts...)
+}
+
+// EnqueueContext is like Enqueue, but the task carries the trace
+// context of ctx to continue the trace when the task is processed.
+// See TraceContext.
+func (c *Client) EnqueueContext(ctx context.Context, task *Task, opts ...Option) error {
+	return c.EnqueueAtContext(ctx, time.Now(), task, opts...)
 }
 
 // EnqueueIn schedules task to be enqueued after the specified delay.
@@ -211,20 +315,107 @@ func (c *Client) Enqueue(task *Task, opts ...Option) error {
 // The argument opts specifies the behavior of task processing.
 // If there are conflicting Option values the last one overrides others.
 func (c *Client) EnqueueIn(d time.Duration, task *Task, opts ...Option) error {
-	return c.EnqueueAt(time.Now().Add(d), task, opts...)
+	return c.EnqueueAtContext(context.Background(), time.Now().Add(d), task, opts...)
+}
+
+// EnqueueInContext is like EnqueueIn, but the task carries the trace
+// context of ctx to continue the trace when the task is processed.
+// See TraceContext.
+func (c *Client) EnqueueInContext(ctx context.Context, d time.Duration, task *Task, opts ...Option) error {
+	return c.EnqueueAtContext(ctx, time.Now().Add(d), task, opts...)
 }
 
 func (c *Client) enqueue(msg *base.TaskMessage, uniqueTTL time.Duration) error {
 	if uniqueTTL > 0 {
-		return c.rdb.EnqueueUnique(msg, uniqueTTL)
+		return c.broker.EnqueueUnique(msg, uniqueTTL)
 	}
-	return c.rdb.Enqueue(msg)
+	return c.broker.Enqueue(msg)
+}
+
+// record adds the event to the history of the task if history is enabled.
+func (c *Client) record(id, qname string, e *base.TaskEvent) {
+	r, ok := c.broker.(base.HistoryRecorder)
+	if !ok || c.historyTTL <= 0 {
+		return
+	}
+	e.Time = time.Now()
+	e.Queue = qname
+	r.RecordEvent(id, e, c.historyTTL) // best effort
 }
 
 func (c *Client) schedule(msg *base.TaskMessage, t time.Time, uniqueTTL time.Duration) error {
 	if uniqueTTL > 0 {
 		ttl := t.Add(uniqueTTL).Sub(time.Now())
-		return c.rdb.ScheduleUnique(msg, t, ttl)
+		return c.broker.ScheduleUnique(msg, t, ttl)
+	}
+	return c.broker.Schedule(msg, t)
+}
+
+// CancelResult reports what Client.Cancel did to the task.
+type CancelResult int
+
+const (
+	// CancelNotFound indicates that no pending, scheduled or running task
+	// with the ID was found, e.g. the task is already done or dead.
+	CancelNotFound CancelResult = iota
+
+	// CancelRemoved indicates that the task had not started and was removed.
+	CancelRemoved
+
+	// CancelSignaled indicates that the task had been dequeued and
+	// a cancelation signal was sent to the server processing the task.
+	CancelSignaled
+)
+
+func (r CancelResult) String() string {
+	switch r {
+	case CancelNotFound:
+		return "not found"
+	case CancelRemoved:
+		return "removed"
+	case CancelSignaled:
+		return "signaled"
+	}
+	return fmt.Sprintf("CancelResult(%d)", int(r))
+}
+
+// cancelTombstoneTTL is how long servers skip a canceled task which
+// could not be removed from the broker.
+const cancelTombstoneTTL = 24 * time.Hour
+
+// Cancel cancels the task with the given ID.
+//
+// If the task is pending, scheduled or waiting to be retried, it is removed
+// along with its uniqueness lock and Cancel returns CancelRemoved.
+// Otherwise, a cancelation signal is sent to the server processing the task
+// and Cancel returns CancelSignaled. Handler implementation needs to be
+// context aware for the signal to actually stop the processing.
+// A tombstone is recorded for the task in that case, so that the server
+// skips the task if it was dequeued but not yet started.
+//
+// If the broker cannot cancel tasks by ID, Cancel only sends
+// the cancelation signal.
+func (c *Client) Cancel(id string) (CancelResult, error) {
+	cb, ok := c.broker.(base.Canceler)
+	if !ok {
+		if err := c.broker.PublishCancelation(id); err != nil {
+			return CancelNotFound, err
+		}
+		return CancelSignaled, nil
+	}
+	res, err := cb.Cancel(id, cancelTombstoneTTL)
+	if err != nil {
+		return CancelNotFound, err
+	}
+	switch res {
+	case base.CancelRemoved:
+		c.record(id, "", &base.TaskEvent{Kind: base.EventCanceled})
+		return CancelRemoved, nil
+	case base.CancelRunning:
+		if err := c.broker.PublishCancelation(id); err != nil {
+			return CancelNotFound, err
+		}
+		return CancelSignaled, nil
 	}
-	return c.rdb.Schedule(msg, t)
+	return CancelNotFound, nil
 }
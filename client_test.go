@@ -13,6 +13,8 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 	h "github.com/hibiken/asynq/internal/asynqtest"
 	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/rs/xid"
 )
 
 func TestClientEnqueueAt(t *testing.T) {
@@ -92,14 +94,14 @@ func TestClientEnqueueAt(t *testing.T) {
 
 		for qname, want := range tc.wantEnqueued {
 			gotEnqueued := h.GetEnqueuedMessages(t, r, qname)
-			if diff := cmp.Diff(want, gotEnqueued, h.IgnoreIDOpt); diff != "" {
-				t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.QueueKey(qname), diff)
+			if diff := cmp.Diff(want, gotEnqueued, h.IgnoreIDOpt, h.IgnoreReadyAtOpt); diff != "" {
+				t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, h.Keys.QueueKey(qname), diff)
 			}
 		}
 
 		gotScheduled := h.GetScheduledEntries(t, r)
-		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.IgnoreIDOpt); diff != "" {
-			t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.ScheduledQueue, diff)
+		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.IgnoreIDOpt, h.IgnoreReadyAtOpt); diff != "" {
+			t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, h.Keys.ScheduledQueue(), diff)
 		}
 	}
 }
@@ -271,8 +273,8 @@ func TestClientEnqueue(t *testing.T) {
 
 		for qname, want := range tc.wantEnqueued {
 			got := h.GetEnqueuedMessages(t, r, qname)
-			if diff := cmp.Diff(want, got, h.IgnoreIDOpt); diff != "" {
-				t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.QueueKey(qname), diff)
+			if diff := cmp.Diff(want, got, h.IgnoreIDOpt, h.IgnoreReadyAtOpt); diff != "" {
+				t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, h.Keys.QueueKey(qname), diff)
 			}
 		}
 	}
@@ -352,14 +354,14 @@ func TestClientEnqueueIn(t *testing.T) {
 
 		for qname, want := range tc.wantEnqueued {
 			gotEnqueued := h.GetEnqueuedMessages(t, r, qname)
-			if diff := cmp.Diff(want, gotEnqueued, h.IgnoreIDOpt); diff != "" {
-				t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.QueueKey(qname), diff)
+			if diff := cmp.Diff(want, gotEnqueued, h.IgnoreIDOpt, h.IgnoreReadyAtOpt); diff != "" {
+				t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, h.Keys.QueueKey(qname), diff)
 			}
 		}
 
 		gotScheduled := h.GetScheduledEntries(t, r)
-		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.IgnoreIDOpt); diff != "" {
-			t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.ScheduledQueue, diff)
+		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.IgnoreIDOpt, h.IgnoreReadyAtOpt); diff != "" {
+			t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, h.Keys.ScheduledQueue(), diff)
 		}
 	}
 }
@@ -384,14 +386,14 @@ func TestUniqueKey(t *testing.T) {
 			NewTask("email:send", map[string]interface{}{"a": 123, "b": "hello", "c": true}),
 			10 * time.Minute,
 			"default",
-			"email:send:a=123,b=hello,c=true:default",
+			"{asynq}:unique:email:send:a=123,b=hello,c=true:default",
 		},
 		{
 			"with unsorted keys",
 			NewTask("email:send", map[string]interface{}{"b": "hello", "c": true, "a": 123}),
 			10 * time.Minute,
 			"default",
-			"email:send:a=123,b=hello,c=true:default",
+			"{asynq}:unique:email:send:a=123,b=hello,c=true:default",
 		},
 		{
 			"with composite types",
@@ -401,7 +403,7 @@ func TestUniqueKey(t *testing.T) {
 					"names":   []string{"bob", "mike", "rob"}}),
 			10 * time.Minute,
 			"default",
-			"email:send:address=map[city:Boston line:123 Main St state:MA],names=[bob mike rob]:default",
+			"{asynq}:unique:email:send:address=map[city:Boston line:123 Main St state:MA],names=[bob mike rob]:default",
 		},
 		{
 			"with complex types",
@@ -411,19 +413,19 @@ func TestUniqueKey(t *testing.T) {
 					"duration": time.Hour}),
 			10 * time.Minute,
 			"default",
-			"email:send:duration=1h0m0s,time=2020-07-28 00:00:00 +0000 UTC:default",
+			"{asynq}:unique:email:send:duration=1h0m0s,time=2020-07-28 00:00:00 +0000 UTC:default",
 		},
 		{
 			"with nil payload",
 			NewTask("reindex", nil),
 			10 * time.Minute,
 			"default",
-			"reindex:nil:default",
+			"{asynq}:unique:reindex:nil:default",
 		},
 	}
 
 	for _, tc := range tests {
-		got := uniqueKey(tc.task, tc.ttl, tc.qname)
+		got := uniqueKey(h.Keys, tc.task, tc.ttl, tc.qname)
 		if got != tc.want {
 			t.Errorf("%s: uniqueKey(%v, %v, %q) = %q, want %q", tc.desc, tc.task, tc.ttl, tc.qname, got, tc.want)
 		}
@@ -456,7 +458,7 @@ func TestEnqueueUnique(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		gotTTL := r.TTL(uniqueKey(tc.task, tc.ttl, base.DefaultQueueName)).Val()
+		gotTTL := r.TTL(uniqueKey(h.Keys, tc.task, tc.ttl, base.DefaultQueueName)).Val()
 		if !cmp.Equal(tc.ttl.Seconds(), gotTTL.Seconds(), cmpopts.EquateApprox(0, 1)) {
 			t.Errorf("TTL = %v, want %v", gotTTL, tc.ttl)
 			continue
@@ -503,7 +505,7 @@ func TestEnqueueInUnique(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		gotTTL := r.TTL(uniqueKey(tc.task, tc.ttl, base.DefaultQueueName)).Val()
+		gotTTL := r.TTL(uniqueKey(h.Keys, tc.task, tc.ttl, base.DefaultQueueName)).Val()
 		wantTTL := time.Duration(tc.ttl.Seconds()+tc.d.Seconds()) * time.Second
 		if !cmp.Equal(wantTTL.Seconds(), gotTTL.Seconds(), cmpopts.EquateApprox(0, 1)) {
 			t.Errorf("TTL = %v, want %v", gotTTL, wantTTL)
@@ -551,7 +553,7 @@ func TestEnqueueAtUnique(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		gotTTL := r.TTL(uniqueKey(tc.task, tc.ttl, base.DefaultQueueName)).Val()
+		gotTTL := r.TTL(uniqueKey(h.Keys, tc.task, tc.ttl, base.DefaultQueueName)).Val()
 		wantTTL := tc.at.Add(tc.ttl).Sub(time.Now())
 		if !cmp.Equal(wantTTL.Seconds(), gotTTL.Seconds(), cmpopts.EquateApprox(0, 1)) {
 			t.Errorf("TTL = %v, want %v", gotTTL, wantTTL)
@@ -570,3 +572,130 @@ func TestEnqueueAtUnique(t *testing.T) {
 		}
 	}
 }
+
+func TestClientRecordsHistory(t *testing.T) {
+	r := setup(t)
+	client := NewClient(RedisClientOpt{
+		Addr: redisAddr,
+		DB:   redisDB,
+	})
+	client.SetHistoryTTL(time.Hour)
+	rdbClient := rdb.NewRDB(r)
+
+	processAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := client.Enqueue(NewTask("send_email", nil), Queue("critical")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.EnqueueAt(processAt, NewTask("reindex", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		msg  *base.TaskMessage
+		want []*base.TaskEvent
+	}{
+		{
+			msg:  h.GetEnqueuedMessages(t, r, "critical")[0],
+			want: []*base.TaskEvent{{Kind: base.EventEnqueued, Queue: "critical"}},
+		},
+		{
+			msg:  h.GetScheduledMessages(t, r)[0],
+			want: []*base.TaskEvent{{Kind: base.EventScheduled, Queue: "default", ProcessAt: processAt}},
+		},
+	}
+
+	ignoreOpt := cmpopts.IgnoreFields(base.TaskEvent{}, "Time")
+	for _, tc := range tests {
+		got, err := rdbClient.History(tc.msg.ID)
+		if err != nil {
+			t.Errorf("could not read history of task %s: %v", tc.msg.Type, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got, ignoreOpt); diff != "" {
+			t.Errorf("mismatch found in history of task %s; (-want, +got)\n%s", tc.msg.Type, diff)
+		}
+	}
+}
+
+func TestClientHistoryDisabledByDefault(t *testing.T) {
+	r := setup(t)
+	client := NewClient(RedisClientOpt{
+		Addr: redisAddr,
+		DB:   redisDB,
+	})
+
+	if err := client.Enqueue(NewTask("send_email", nil)); err != nil {
+		t.Fatal(err)
+	}
+	msg := h.GetEnqueuedMessages(t, r)[0]
+	if n := r.Exists(h.Keys.HistoryKey(msg.ID.String())).Val(); n != 0 {
+		t.Errorf("history of task was recorded, want no history")
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	r := setup(t)
+	client := NewClient(RedisClientOpt{
+		Addr: redisAddr,
+		DB:   redisDB,
+	})
+
+	if err := client.Enqueue(NewTask("send_email", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.EnqueueIn(time.Hour, NewTask("reindex", nil), Unique(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	pending := h.GetEnqueuedMessages(t, r)[0]
+	scheduled := h.GetScheduledMessages(t, r)[0]
+
+	// Simulates a task dequeued by a server.
+	running := h.NewTaskMessage("sync", nil)
+	h.SeedInProgressQueue(t, r, []*base.TaskMessage{running})
+	h.SeedTaskIndex(t, r, []*base.TaskMessage{running})
+	sub := r.Subscribe(h.Keys.CancelChannel())
+	defer sub.Close()
+	if _, err := sub.Receive(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id   string
+		want CancelResult
+	}{
+		{pending.ID.String(), CancelRemoved},
+		{scheduled.ID.String(), CancelRemoved},
+		{running.ID.String(), CancelSignaled},
+		{xid.New().String(), CancelNotFound},
+	}
+
+	for _, tc := range tests {
+		got, err := client.Cancel(tc.id)
+		if err != nil {
+			t.Errorf("client.Cancel(%q) returned error: %v", tc.id, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("client.Cancel(%q) = %v, want %v", tc.id, got, tc.want)
+		}
+	}
+
+	if msgs := h.GetEnqueuedMessages(t, r); len(msgs) != 0 {
+		t.Errorf("%q has %d tasks, want 0", h.Keys.DefaultQueue(), len(msgs))
+	}
+	if msgs := h.GetScheduledMessages(t, r); len(msgs) != 0 {
+		t.Errorf("%q has %d tasks, want 0", h.Keys.ScheduledQueue(), len(msgs))
+	}
+	// uniqueness lock is released so that the task can be enqueued again.
+	if err := client.EnqueueIn(time.Hour, NewTask("reindex", nil), Unique(time.Hour)); err != nil {
+		t.Errorf("could not enqueue canceled unique task again: %v", err)
+	}
+	select {
+	case m := <-sub.Channel():
+		if m.Payload != running.ID.String() {
+			t.Errorf("cancelation message = %q, want %q", m.Payload, running.ID.String())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("cancelation message was not published")
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import "context"
+
+type headersKey struct{}
+
+// ContextWithHeaders returns a copy of ctx carrying the task headers,
+// replacing the headers ctx carries.
+//
+// Middleware can modify the headers seen by the handlers it calls
+// by passing them a context returned by ContextWithHeaders.
+// The headers stored with the task are not changed.
+//
+// Example:
+//
+//	func tenantMiddleware(next asynq.Handler) asynq.Handler {
+//		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+//			headers := asynq.HeadersFromContext(ctx)
+//			if headers["tenant"] == "" {
+//				headers["tenant"] = "default"
+//			}
+//			return next.ProcessTask(asynq.ContextWithHeaders(ctx, headers), t)
+//		})
+//	}
+func ContextWithHeaders(ctx context.Context, headers map[string]string) context.Context {
+	return context.WithValue(ctx, headersKey{}, copyHeaders(headers))
+}
+
+// HeadersFromContext returns a copy of the task headers carried by ctx.
+// The returned map is never nil, so that it can be modified and passed
+// to ContextWithHeaders.
+//
+// The context passed to a handler carries the headers attached to the task
+// with the Header option.
+func HeadersFromContext(ctx context.Context) map[string]string {
+	headers, _ := ctx.Value(headersKey{}).(map[string]string)
+	return copyHeaders(headers)
+}
+
+// HeaderFromContext returns the value of the task header carried by ctx.
+// It returns false if ctx carries no header with the key.
+func HeaderFromContext(ctx context.Context, key string) (string, bool) {
+	headers, _ := ctx.Value(headersKey{}).(map[string]string)
+	v, ok := headers[key]
+	return v, ok
+}
+
+func copyHeaders(headers map[string]string) map[string]string {
+	res := make(map[string]string, len(headers))
+	for k, v := range headers {
+		res[k] = v
+	}
+	return res
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hibiken/asynq/broker/inmem"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/rs/xid"
+)
+
+func TestHeadersFromContext(t *testing.T) {
+	headers := map[string]string{"request_id": "abc123"}
+	ctx := ContextWithHeaders(context.Background(), headers)
+	headers["request_id"] = "modified"
+
+	got := HeadersFromContext(ctx)
+	want := map[string]string{"request_id": "abc123"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("HeadersFromContext returned %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+	got["tenant"] = "acme"
+	if v, ok := HeaderFromContext(ctx, "tenant"); ok {
+		t.Errorf("HeaderFromContext(ctx, %q) = %q, true after modifying the returned map; want false", "tenant", v)
+	}
+	if v, ok := HeaderFromContext(ctx, "request_id"); !ok || v != "abc123" {
+		t.Errorf("HeaderFromContext(ctx, %q) = %q, %t; want %q, true", "request_id", v, ok, "abc123")
+	}
+
+	empty := HeadersFromContext(context.Background())
+	if empty == nil || len(empty) != 0 {
+		t.Errorf("HeadersFromContext(context.Background()) = %#v, want empty non-nil map", empty)
+	}
+	if _, ok := HeaderFromContext(context.Background(), "request_id"); ok {
+		t.Errorf("HeaderFromContext(context.Background(), %q) returned true, want false", "request_id")
+	}
+}
+
+func TestCreateContextWithHeaders(t *testing.T) {
+	tests := []struct {
+		msg  *base.TaskMessage
+		want map[string]string
+	}{
+		{
+			msg:  &base.TaskMessage{Type: "something", ID: xid.New(), Headers: map[string]string{"request_id": "abc123", "tenant": "acme"}},
+			want: map[string]string{"request_id": "abc123", "tenant": "acme"},
+		},
+		{
+			msg:  &base.TaskMessage{Type: "something", ID: xid.New()},
+			want: map[string]string{},
+		},
+	}
+
+	for _, tc := range tests {
+		ctx, cancel := createContext(tc.msg)
+		got := HeadersFromContext(ctx)
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("HeadersFromContext(createContext(%+v)) = %v, want %v; (-want,+got)\n%s", tc.msg, got, tc.want, diff)
+		}
+		cancel()
+	}
+}
+
+func TestMiddlewareModifiesHeaders(t *testing.T) {
+	b := inmem.New()
+	client := NewClientWithBroker(b)
+	srv := NewServerWithBroker(b, Config{
+		Concurrency: 1,
+		Logger:      testLogger,
+	})
+
+	var got map[string]string
+	done := make(chan struct{})
+	mux := NewServeMux()
+	mux.Use(func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, task *Task) error {
+			headers := HeadersFromContext(ctx)
+			headers["tenant"] = "default"
+			delete(headers, "secret")
+			return next.ProcessTask(ContextWithHeaders(ctx, headers), task)
+		})
+	})
+	mux.HandleFunc("send_email", func(ctx context.Context, task *Task) error {
+		defer close(done)
+		got = HeadersFromContext(ctx)
+		return nil
+	})
+	if err := srv.Start(mux); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	err := client.Enqueue(NewTask("send_email", nil), Header("request_id", "abc123"), Header("secret", "s3cr3t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the task to be processed")
+	}
+
+	want := map[string]string{"request_id": "abc123", "tenant": "default"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("handler saw headers %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+}
+
+func TestClientEnqueueWithHeaders(t *testing.T) {
+	r := setup(t)
+	client := NewClient(RedisClientOpt{Addr: redisAddr, DB: redisDB})
+
+	err := client.Enqueue(NewTask("send_email", nil), Header("request_id", "abc123"), Header("tenant", "acme"), Header("tenant", "example"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Enqueue(NewTask("reindex", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]map[string]string)
+	for _, msg := range h.GetEnqueuedMessages(t, r) {
+		got[msg.Type] = msg.Headers
+	}
+	want := map[string]map[string]string{
+		"send_email": {"request_id": "abc123", "tenant": "example"},
+		"reindex":    nil,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("enqueued tasks have headers %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+}
+
+func TestClientEnqueueUniqueIgnoresHeaders(t *testing.T) {
+	setup(t)
+	client := NewClient(RedisClientOpt{Addr: redisAddr, DB: redisDB})
+	task := NewTask("send_email", map[string]interface{}{"user_id": 123})
+
+	if err := client.Enqueue(task, Unique(time.Hour), Header("request_id", "abc123")); err != nil {
+		t.Fatal(err)
+	}
+	err := client.Enqueue(task, Unique(time.Hour), Header("request_id", "def456"))
+	if !errors.Is(err, ErrDuplicateTask) {
+		t.Errorf("Enqueue of a duplicate task with different headers returned %v, want ErrDuplicateTask", err)
+	}
+}
@@ -0,0 +1,987 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/rs/xid"
+)
+
+// Inspector is a client interface to inspect and mutate the state of
+// queues and tasks.
+//
+// Inspectors are safe for concurrent use by multiple goroutines.
+type Inspector struct {
+	rdb *rdb.RDB
+}
+
+// NewInspector returns a new Inspector given a redis connection option.
+func NewInspector(r RedisConnOpt) *Inspector {
+	return NewInspectorWithNamespace(r, base.DefaultNamespace)
+}
+
+// NewInspectorWithNamespace returns a new Inspector which inspects
+// queues and tasks under the given namespace.
+func NewInspectorWithNamespace(r RedisConnOpt, ns string) *Inspector {
+	return &Inspector{rdb: rdb.NewRDBWithNamespace(createRedisClient(r), ns)}
+}
+
+// Close closes the connection with redis.
+func (i *Inspector) Close() error {
+	return i.rdb.Close()
+}
+
+var (
+	// ErrTaskNotFound indicates that the task specified by the key
+	// was not found, e.g. it has been processed or moved to another state.
+	ErrTaskNotFound = errors.New("task not found")
+
+	// ErrQueueNotFound indicates that the specified queue does not exist.
+	ErrQueueNotFound = errors.New("queue not found")
+
+	// ErrQueueNotEmpty indicates that the specified queue is not empty.
+	ErrQueueNotEmpty = errors.New("queue is not empty")
+
+	// ErrInvalidTaskKey indicates that the specified task key is malformed.
+	ErrInvalidTaskKey = errors.New("invalid task key")
+)
+
+// Stats represents a state of queues at a certain time.
+type Stats struct {
+	// Number of tasks in each state.
+	Enqueued   int
+	InProgress int
+	Scheduled  int
+	Retry      int
+	Dead       int
+
+	// Number of tasks processed and failed today.
+	Processed int
+	Failed    int
+
+	// Queues lists the queues sorted by name.
+	Queues []*QueueInfo
+
+	// Timestamp is the time the stats were taken.
+	Timestamp time.Time
+}
+
+// QueueInfo holds information about a queue.
+type QueueInfo struct {
+	// Name of the queue.
+	Name string
+
+	// Size is the number of enqueued tasks in the queue.
+	Size int
+}
+
+// CurrentStats returns the current stats of the queues.
+func (i *Inspector) CurrentStats() (*Stats, error) {
+	stats, err := i.rdb.CurrentStats()
+	if err != nil {
+		return nil, err
+	}
+	var qs []*QueueInfo
+	for qname, n := range stats.Queues {
+		qs = append(qs, &QueueInfo{Name: qname, Size: n})
+	}
+	sort.Slice(qs, func(i, j int) bool { return qs[i].Name < qs[j].Name })
+	return &Stats{
+		Enqueued:   stats.Enqueued,
+		InProgress: stats.InProgress,
+		Scheduled:  stats.Scheduled,
+		Retry:      stats.Retry,
+		Dead:       stats.Dead,
+		Processed:  stats.Processed,
+		Failed:     stats.Failed,
+		Queues:     qs,
+		Timestamp:  stats.Timestamp,
+	}, nil
+}
+
+// DailyStats holds aggregate data for a given day.
+type DailyStats struct {
+	// Number of tasks processed and failed on the day.
+	Processed int
+	Failed    int
+
+	// Date is the day in UTC.
+	Date time.Time
+}
+
+// History returns the stats of the last n days, starting from today.
+func (i *Inspector) History(n int) ([]*DailyStats, error) {
+	stats, err := i.rdb.HistoricalStats(n)
+	if err != nil {
+		return nil, err
+	}
+	var res []*DailyStats
+	for _, s := range stats {
+		res = append(res, &DailyStats{
+			Processed: s.Processed,
+			Failed:    s.Failed,
+			Date:      s.Time,
+		})
+	}
+	return res, nil
+}
+
+// EnqueuedTask is a task in a queue and is ready to be processed.
+type EnqueuedTask struct {
+	*Task
+	ID      string
+	Queue   string
+	Headers map[string]string
+}
+
+// InProgressTask is a task that's currently being processed.
+type InProgressTask struct {
+	*Task
+	ID      string
+	Queue   string
+	Headers map[string]string
+}
+
+// ScheduledTask is a task scheduled to be processed in the future.
+type ScheduledTask struct {
+	*Task
+	ID            string
+	Queue         string
+	Headers       map[string]string
+	NextEnqueueAt time.Time
+
+	score int64
+}
+
+// RetryTask is a task scheduled to be retried in the future.
+type RetryTask struct {
+	*Task
+	ID            string
+	Queue         string
+	Headers       map[string]string
+	NextEnqueueAt time.Time
+	MaxRetry      int
+	Retried       int
+	ErrorMsg      string
+
+	score int64
+}
+
+// DeadTask is a task that has exhausted all retries.
+type DeadTask struct {
+	*Task
+	ID           string
+	Queue        string
+	Headers      map[string]string
+	MaxRetry     int
+	Retried      int
+	LastFailedAt time.Time
+	ErrorMsg     string
+
+	score int64
+}
+
+// Key returns a key used to delete, enqueue, and kill the task.
+// It is the same identifier the CLI shows for the task.
+func (t *ScheduledTask) Key() string {
+	return fmt.Sprintf("s:%v:%v", t.score, t.ID)
+}
+
+// Key returns a key used to delete, enqueue, and kill the task.
+// It is the same identifier the CLI shows for the task.
+func (t *RetryTask) Key() string {
+	return fmt.Sprintf("r:%v:%v", t.score, t.ID)
+}
+
+// Key returns a key used to delete and enqueue the task.
+// It is the same identifier the CLI shows for the task.
+func (t *DeadTask) Key() string {
+	return fmt.Sprintf("d:%v:%v", t.score, t.ID)
+}
+
+// parseTaskKey parses a key string and returns each part of the key
+// with proper type if valid, otherwise it reports an error.
+func parseTaskKey(key string) (id xid.ID, score int64, qtype string, err error) {
+	parts := strings.Split(key, ":")
+	if len(parts) != 3 {
+		return xid.NilID(), 0, "", fmt.Errorf("%w: %q", ErrInvalidTaskKey, key)
+	}
+	id, err = xid.FromString(parts[2])
+	if err != nil {
+		return xid.NilID(), 0, "", fmt.Errorf("%w: %q", ErrInvalidTaskKey, key)
+	}
+	score, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return xid.NilID(), 0, "", fmt.Errorf("%w: %q", ErrInvalidTaskKey, key)
+	}
+	qtype = parts[0]
+	if len(qtype) != 1 || !strings.Contains("srd", qtype) {
+		return xid.NilID(), 0, "", fmt.Errorf("%w: %q", ErrInvalidTaskKey, key)
+	}
+	return id, score, qtype, nil
+}
+
+// ListOption specifies behavior of list operation.
+type ListOption interface{}
+
+// Internal list option representations.
+type (
+	pageSizeOpt int
+	pageNumOpt  int
+)
+
+type listOption struct {
+	pageSize int
+	pageNum  int
+}
+
+const (
+	// Page size used by default in list operation.
+	defaultPageSize = 30
+
+	// Page number used by default in list operation.
+	defaultPageNum = 1
+)
+
+func composeListOptions(opts ...ListOption) listOption {
+	res := listOption{
+		pageSize: defaultPageSize,
+		pageNum:  defaultPageNum,
+	}
+	for _, opt := range opts {
+		switch opt := opt.(type) {
+		case pageSizeOpt:
+			res.pageSize = int(opt)
+		case pageNumOpt:
+			res.pageNum = int(opt)
+		default:
+			// ignore unexpected option
+		}
+	}
+	return res
+}
+
+func (o listOption) pagination() rdb.Pagination {
+	return rdb.Pagination{Size: o.pageSize, Page: o.pageNum - 1}
+}
+
+// PageSize returns an option to specify the page size for list operation.
+//
+// Negative page size is treated as zero.
+func PageSize(n int) ListOption {
+	if n < 0 {
+		n = 0
+	}
+	return pageSizeOpt(n)
+}
+
+// Page returns an option to specify the page number for list operation.
+// The value 1 fetches the first page.
+//
+// Page number less than one is treated as one.
+func Page(n int) ListOption {
+	if n < 1 {
+		n = 1
+	}
+	return pageNumOpt(n)
+}
+
+// ListEnqueuedTasks retrieves enqueued tasks from the specified queue,
+// oldest first.
+// If the queue does not exist, it returns an error wrapping ErrQueueNotFound.
+//
+// By default, it retrieves the first 30 tasks.
+func (i *Inspector) ListEnqueuedTasks(qname string, opts ...ListOption) ([]*EnqueuedTask, error) {
+	opt := composeListOptions(opts...)
+	enqueued, err := i.rdb.ListEnqueued(qname, opt.pagination())
+	if _, ok := err.(*rdb.ErrQueueNotFound); ok {
+		return nil, fmt.Errorf("%w: %q", ErrQueueNotFound, qname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tasks []*EnqueuedTask
+	for _, t := range enqueued {
+		tasks = append(tasks, &EnqueuedTask{
+			Task:    NewTask(t.Type, t.Payload),
+			ID:      t.ID.String(),
+			Queue:   t.Queue,
+			Headers: t.Headers,
+		})
+	}
+	return tasks, nil
+}
+
+// ListInProgressTasks retrieves in-progress tasks.
+//
+// By default, it retrieves the first 30 tasks.
+func (i *Inspector) ListInProgressTasks(opts ...ListOption) ([]*InProgressTask, error) {
+	opt := composeListOptions(opts...)
+	inProgress, err := i.rdb.ListInProgress(opt.pagination())
+	if err != nil {
+		return nil, err
+	}
+	var tasks []*InProgressTask
+	for _, t := range inProgress {
+		tasks = append(tasks, &InProgressTask{
+			Task:    NewTask(t.Type, t.Payload),
+			ID:      t.ID.String(),
+			Queue:   t.Queue,
+			Headers: t.Headers,
+		})
+	}
+	return tasks, nil
+}
+
+// ListScheduledTasks retrieves scheduled tasks, sorted by NextEnqueueAt
+// field in ascending order.
+//
+// By default, it retrieves the first 30 tasks.
+func (i *Inspector) ListScheduledTasks(opts ...ListOption) ([]*ScheduledTask, error) {
+	opt := composeListOptions(opts...)
+	scheduled, err := i.rdb.ListScheduled(opt.pagination())
+	if err != nil {
+		return nil, err
+	}
+	var tasks []*ScheduledTask
+	for _, t := range scheduled {
+		tasks = append(tasks, &ScheduledTask{
+			Task:          NewTask(t.Type, t.Payload),
+			ID:            t.ID.String(),
+			Queue:         t.Queue,
+			Headers:       t.Headers,
+			NextEnqueueAt: t.ProcessAt,
+			score:         t.Score,
+		})
+	}
+	return tasks, nil
+}
+
+// ListRetryTasks retrieves retry tasks, sorted by NextEnqueueAt field
+// in ascending order.
+//
+// By default, it retrieves the first 30 tasks.
+func (i *Inspector) ListRetryTasks(opts ...ListOption) ([]*RetryTask, error) {
+	opt := composeListOptions(opts...)
+	retry, err := i.rdb.ListRetry(opt.pagination())
+	if err != nil {
+		return nil, err
+	}
+	var tasks []*RetryTask
+	for _, t := range retry {
+		tasks = append(tasks, &RetryTask{
+			Task:          NewTask(t.Type, t.Payload),
+			ID:            t.ID.String(),
+			Queue:         t.Queue,
+			Headers:       t.Headers,
+			NextEnqueueAt: t.ProcessAt,
+			MaxRetry:      t.Retry,
+			Retried:       t.Retried,
+			ErrorMsg:      t.ErrorMsg,
+			score:         t.Score,
+		})
+	}
+	return tasks, nil
+}
+
+// ListDeadTasks retrieves dead tasks, sorted by LastFailedAt field
+// in descending order.
+//
+// By default, it retrieves the first 30 tasks.
+func (i *Inspector) ListDeadTasks(opts ...ListOption) ([]*DeadTask, error) {
+	opt := composeListOptions(opts...)
+	dead, err := i.rdb.ListDead(opt.pagination())
+	if err != nil {
+		return nil, err
+	}
+	var tasks []*DeadTask
+	for _, t := range dead {
+		tasks = append(tasks, &DeadTask{
+			Task:         NewTask(t.Type, t.Payload),
+			ID:           t.ID.String(),
+			Queue:        t.Queue,
+			Headers:      t.Headers,
+			MaxRetry:     t.Retry,
+			Retried:      t.Retried,
+			LastFailedAt: t.LastFailedAt,
+			ErrorMsg:     t.ErrorMsg,
+			score:        t.Score,
+		})
+	}
+	return tasks, nil
+}
+
+// DeleteAllScheduledTasks deletes all scheduled tasks,
+// and reports the number of tasks deleted.
+func (i *Inspector) DeleteAllScheduledTasks() (int, error) {
+	n, err := i.rdb.DeleteAllScheduledTasks()
+	return int(n), err
+}
+
+// DeleteAllRetryTasks deletes all retry tasks,
+// and reports the number of tasks deleted.
+func (i *Inspector) DeleteAllRetryTasks() (int, error) {
+	n, err := i.rdb.DeleteAllRetryTasks()
+	return int(n), err
+}
+
+// DeleteAllDeadTasks deletes all dead tasks,
+// and reports the number of tasks deleted.
+func (i *Inspector) DeleteAllDeadTasks() (int, error) {
+	n, err := i.rdb.DeleteAllDeadTasks()
+	return int(n), err
+}
+
+// DeleteTaskByKey deletes a task with the given key.
+func (i *Inspector) DeleteTaskByKey(key string) error {
+	id, score, qtype, err := parseTaskKey(key)
+	if err != nil {
+		return err
+	}
+	switch qtype {
+	case "s":
+		err = i.rdb.DeleteScheduledTask(id, score)
+	case "r":
+		err = i.rdb.DeleteRetryTask(id, score)
+	case "d":
+		err = i.rdb.DeleteDeadTask(id, score)
+	}
+	return toPublicError(err)
+}
+
+// EnqueueAllScheduledTasks enqueues all scheduled tasks for immediate processing,
+// and reports the number of tasks enqueued.
+func (i *Inspector) EnqueueAllScheduledTasks() (int, error) {
+	n, err := i.rdb.EnqueueAllScheduledTasks()
+	return int(n), err
+}
+
+// EnqueueAllRetryTasks enqueues all retry tasks for immediate processing,
+// and reports the number of tasks enqueued.
+func (i *Inspector) EnqueueAllRetryTasks() (int, error) {
+	n, err := i.rdb.EnqueueAllRetryTasks()
+	return int(n), err
+}
+
+// EnqueueAllDeadTasks enqueues all dead tasks for immediate processing,
+// and reports the number of tasks enqueued.
+func (i *Inspector) EnqueueAllDeadTasks() (int, error) {
+	n, err := i.rdb.EnqueueAllDeadTasks()
+	return int(n), err
+}
+
+// EnqueueTaskByKey enqueues a task with the given key for immediate processing.
+func (i *Inspector) EnqueueTaskByKey(key string) error {
+	id, score, qtype, err := parseTaskKey(key)
+	if err != nil {
+		return err
+	}
+	switch qtype {
+	case "s":
+		err = i.rdb.EnqueueScheduledTask(id, score)
+	case "r":
+		err = i.rdb.EnqueueRetryTask(id, score)
+	case "d":
+		err = i.rdb.EnqueueDeadTask(id, score)
+	}
+	return toPublicError(err)
+}
+
+// KillAllScheduledTasks kills all scheduled tasks,
+// and reports the number of tasks killed.
+func (i *Inspector) KillAllScheduledTasks() (int, error) {
+	n, err := i.rdb.KillAllScheduledTasks()
+	return int(n), err
+}
+
+// KillAllRetryTasks kills all retry tasks,
+// and reports the number of tasks killed.
+func (i *Inspector) KillAllRetryTasks() (int, error) {
+	n, err := i.rdb.KillAllRetryTasks()
+	return int(n), err
+}
+
+// KillTaskByKey kills a task with the given key.
+// Only scheduled and retry tasks can be killed.
+func (i *Inspector) KillTaskByKey(key string) error {
+	id, score, qtype, err := parseTaskKey(key)
+	if err != nil {
+		return err
+	}
+	switch qtype {
+	case "s":
+		err = i.rdb.KillScheduledTask(id, score)
+	case "r":
+		err = i.rdb.KillRetryTask(id, score)
+	case "d":
+		return fmt.Errorf("task already dead")
+	}
+	return toPublicError(err)
+}
+
+// CancelTask cancels the task with the given ID, see Client.Cancel.
+func (i *Inspector) CancelTask(id string) (CancelResult, error) {
+	c := &Client{broker: i.rdb, keys: i.rdb.Keys()}
+	return c.Cancel(id)
+}
+
+// Task states reported by GetTask. The filtered bulk operations accept
+// StateScheduled, StateRetry and StateDead, and ExportTasks accepts
+// any state except StateInProgress and StateUnknown.
+const (
+	StateEnqueued   = "enqueued"
+	StateInProgress = "in_progress"
+	StateScheduled  = "scheduled"
+	StateRetry      = "retry"
+	StateDead       = "dead"
+
+	// StateUnknown is reported for a task which is indexed but was not found
+	// in any queue, e.g. because it is being moved between queues.
+	StateUnknown = "unknown"
+)
+
+// TaskInfo describes a task looked up by its ID.
+type TaskInfo struct {
+	*Task
+	ID      string
+	Queue   string
+	Headers map[string]string
+
+	// State is the state of the task, one of the State constants.
+	State string
+
+	MaxRetry int
+	Retried  int
+	ErrorMsg string
+
+	// Timeout and Deadline limit the processing of the task.
+	// They are zero if not specified.
+	Timeout  time.Duration
+	Deadline time.Time
+
+	// NextEnqueueAt is the time the task is scheduled to be processed,
+	// set only for scheduled and retry tasks.
+	NextEnqueueAt time.Time
+
+	// LastFailedAt is the time the task was moved to the dead queue,
+	// set only for dead tasks.
+	LastFailedAt time.Time
+
+	score int64
+}
+
+// Key returns a key used to delete, enqueue, and kill the task.
+// It is empty for enqueued and in-progress tasks.
+func (t *TaskInfo) Key() string {
+	switch t.State {
+	case StateScheduled:
+		return fmt.Sprintf("s:%v:%v", t.score, t.ID)
+	case StateRetry:
+		return fmt.Sprintf("r:%v:%v", t.score, t.ID)
+	case StateDead:
+		return fmt.Sprintf("d:%v:%v", t.score, t.ID)
+	}
+	return ""
+}
+
+// GetTask returns the task with the given ID in any state.
+//
+// If the task is not found, it returns an error wrapping ErrTaskNotFound.
+// Tasks enqueued by versions of asynq which did not index tasks by ID
+// are not found. GetTask requires redis 6.0.6 or later.
+func (i *Inspector) GetTask(id string) (*TaskInfo, error) {
+	taskID, err := parseTaskID(id)
+	if err != nil {
+		return nil, err
+	}
+	info, err := i.rdb.GetTask(taskID)
+	if err != nil {
+		return nil, toPublicError(err)
+	}
+	t := &TaskInfo{
+		Task:          NewTask(info.Type, info.Payload),
+		ID:            info.ID.String(),
+		Queue:         info.Queue,
+		Headers:       info.Headers,
+		State:         info.State,
+		MaxRetry:      info.Retry,
+		Retried:       info.Retried,
+		ErrorMsg:      info.ErrorMsg,
+		NextEnqueueAt: info.ProcessAt,
+		LastFailedAt:  info.LastFailedAt,
+		score:         info.Score,
+	}
+	if d, err := time.ParseDuration(info.Timeout); err == nil {
+		t.Timeout = d
+	}
+	if d, err := time.Parse(time.RFC3339, info.Deadline); err == nil && d.Unix() > 0 {
+		t.Deadline = d
+	}
+	return t, nil
+}
+
+// TaskEvent is an event in the lifecycle of a task.
+type TaskEvent struct {
+	// Kind is the kind of the event, one of "enqueued", "scheduled",
+	// "dequeued", "retry", "rescheduled", "dead", "done", "canceled"
+	// and "edited".
+	Kind string
+
+	// Time is the time the event happened.
+	Time time.Time
+
+	// Queue is the name of the queue the task belongs to.
+	Queue string
+
+	// Host, PID and ServerID identify the server which processed the task.
+	// They are empty for events recorded by clients and inspectors.
+	Host     string
+	PID      int
+	ServerID string
+
+	// Attempt is the number of the attempt to process the task, starting at one.
+	Attempt int
+
+	// ErrorMsg holds the error returned by the handler.
+	ErrorMsg string
+
+	// ProcessAt is the time the task is scheduled to be processed at.
+	// It is set for "scheduled", "retry" and "rescheduled" events.
+	ProcessAt time.Time
+
+	// Fields lists the names of the fields changed by an "edited" event.
+	Fields []string
+}
+
+// TaskEvents returns the recorded lifecycle events of the task with
+// the given ID, oldest first. Events are recorded only if enabled
+// with Config.HistoryTTL and Client.SetHistoryTTL.
+//
+// If no events are recorded for the task, it returns an error wrapping
+// ErrTaskNotFound.
+func (i *Inspector) TaskEvents(id string) ([]*TaskEvent, error) {
+	taskID, err := parseTaskID(id)
+	if err != nil {
+		return nil, err
+	}
+	events, err := i.rdb.History(taskID)
+	if err != nil {
+		return nil, toPublicError(err)
+	}
+	var res []*TaskEvent
+	for _, e := range events {
+		res = append(res, &TaskEvent{
+			Kind:      e.Kind,
+			Time:      e.Time,
+			Queue:     e.Queue,
+			Host:      e.Host,
+			PID:       e.PID,
+			ServerID:  e.ServerID,
+			Attempt:   e.Attempt,
+			ErrorMsg:  e.ErrorMsg,
+			ProcessAt: e.ProcessAt,
+			Fields:    e.Fields,
+		})
+	}
+	return res, nil
+}
+
+// TaskFilter selects tasks for the filtered bulk operations.
+// Zero value fields match any task.
+type TaskFilter struct {
+	// TypePattern is matched against the task type using the syntax
+	// of path.Match (e.g. "email:*").
+	TypePattern string
+
+	// Queue is the name of the queue the task belongs to.
+	Queue string
+
+	// ErrorContains is a substring of the last error message of the task.
+	ErrorContains string
+
+	// From and To restrict the time tasks are scheduled to be processed at
+	// for scheduled and retry tasks, and the time tasks died for dead tasks.
+	// Both ends are inclusive.
+	From, To time.Time
+
+	// Payload maps payload field names to the values the fields must have.
+	// Field values are compared in their fmt.Sprint format (e.g. "42").
+	Payload map[string]string
+}
+
+func (f TaskFilter) toRDB() rdb.TaskFilter {
+	return rdb.TaskFilter{
+		TypePattern:   f.TypePattern,
+		Queue:         f.Queue,
+		ErrorContains: f.ErrorContains,
+		From:          f.From,
+		To:            f.To,
+		Payload:       f.Payload,
+	}
+}
+
+// CountTasks returns the number of tasks in the given state which
+// match the filter, to preview the filtered bulk operations.
+// The state should be one of StateScheduled, StateRetry and StateDead.
+func (i *Inspector) CountTasks(state string, f TaskFilter) (int, error) {
+	n, err := i.rdb.CountTasks(state, f.toRDB())
+	return int(n), err
+}
+
+// DeleteTasks deletes the tasks in the given state which match the filter
+// and returns the number of tasks deleted.
+// The state should be one of StateScheduled, StateRetry and StateDead.
+//
+// Tasks are deleted in batches, so if it returns an error, the tasks
+// in the batches before the error are deleted.
+func (i *Inspector) DeleteTasks(state string, f TaskFilter) (int, error) {
+	n, err := i.rdb.DeleteTasks(state, f.toRDB(), rdb.DefaultBatchSize)
+	return int(n), err
+}
+
+// EnqueueTasks enqueues the tasks in the given state which match the filter
+// and returns the number of tasks enqueued.
+// The state should be one of StateScheduled, StateRetry and StateDead.
+//
+// Tasks are enqueued in batches, so if it returns an error, the tasks
+// in the batches before the error are enqueued.
+func (i *Inspector) EnqueueTasks(state string, f TaskFilter) (int, error) {
+	n, err := i.rdb.EnqueueTasks(state, f.toRDB(), rdb.DefaultBatchSize)
+	return int(n), err
+}
+
+// KillTasks kills the tasks in the given state which match the filter
+// and returns the number of tasks killed.
+// The state should be either StateScheduled or StateRetry.
+//
+// Tasks are killed in batches, so if it returns an error, the tasks
+// in the batches before the error are killed.
+func (i *Inspector) KillTasks(state string, f TaskFilter) (int, error) {
+	n, err := i.rdb.KillTasks(state, f.toRDB(), rdb.DefaultBatchSize)
+	return int(n), err
+}
+
+// MoveTasks moves the enqueued, scheduled and retry tasks in src queue
+// to dst queue and returns the number of tasks moved.
+// If typePattern is not empty, only the tasks whose type matches
+// the pattern using the syntax of path.Match are moved.
+//
+// Tasks are moved in batches, and tasks in progress are not moved.
+// Tasks enqueued into src while moving may be left in src.
+func (i *Inspector) MoveTasks(src, dst, typePattern string) (int, error) {
+	n, err := i.rdb.MoveTasks(src, dst, typePattern, rdb.DefaultBatchSize)
+	return int(n), err
+}
+
+// TaskEdit describes changes made to a task by EditTask.
+// Zero value fields leave the task unchanged.
+type TaskEdit struct {
+	// Payload maps payload field names to their new values.
+	// A nil value removes the field from the payload.
+	Payload map[string]interface{}
+
+	// Queue is the name of the queue to enqueue the task to.
+	Queue string
+
+	// MaxRetry is the new max number of retries, if not nil.
+	MaxRetry *int
+
+	// Timeout is the new timeout of the task, if positive.
+	Timeout time.Duration
+}
+
+// EditTask applies the edit to the scheduled, retry or dead task with
+// the given ID, and enqueues the task for processing. The task keeps its
+// ID and retry count, and the edit is added to the lifecycle events of
+// the task if it has any, see TaskEvents.
+//
+// EditTask returns the names of the fields changed.
+// If the task is not found, it returns an error wrapping ErrTaskNotFound.
+func (i *Inspector) EditTask(id string, edit TaskEdit) ([]string, error) {
+	taskID, err := parseTaskID(id)
+	if err != nil {
+		return nil, err
+	}
+	e := rdb.TaskEdit{Payload: edit.Payload, Queue: edit.Queue, Retry: edit.MaxRetry}
+	if edit.Timeout > 0 {
+		e.Timeout = edit.Timeout.String()
+	}
+	_, fields, err := i.rdb.EditTask(taskID, e, 0)
+	if err != nil {
+		return nil, toPublicError(err)
+	}
+	return fields, nil
+}
+
+// ExportTasks writes the tasks in the given state to w as newline delimited
+// JSON, one task per line, and returns the number of tasks written.
+// Exported tasks keep their IDs, retry counts, process times and last
+// errors, and can be added back with ImportTasks or the import command
+// of the CLI.
+//
+// Exporting enqueued tasks requires qname. For other states, a non-empty
+// qname exports only the tasks in the queue.
+// Tasks are read while they may be processed, so a task which changes
+// its state during the export may be missed or exported more than once.
+func (i *Inspector) ExportTasks(w io.Writer, state, qname string) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	n, err := i.rdb.ExportTasks(state, qname, rdb.DefaultBatchSize, func(recs []*rdb.TaskRecord) error {
+		for _, rec := range recs {
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	})
+	return int(n), err
+}
+
+// ImportTasks reads the tasks written by ExportTasks from r, adds them
+// back to their recorded states and returns the number of tasks added.
+// Tasks with the ID of a task which already exists are skipped, unless
+// regenerateIDs is true to give each task a new ID.
+//
+// Tasks are added in batches, so if it returns an error, the tasks
+// in the batches before the error are added.
+func (i *Inspector) ImportTasks(r io.Reader, regenerateIDs bool) (int, error) {
+	_, n, err := i.rdb.ImportTasksFrom(r, regenerateIDs, rdb.DefaultBatchSize)
+	return int(n), err
+}
+
+// RemoveQueue removes the queue with the given name.
+//
+// If force is false, the queue is removed only if it has no enqueued tasks,
+// otherwise it returns an error wrapping ErrQueueNotEmpty.
+// If the queue does not exist, it returns an error wrapping ErrQueueNotFound.
+func (i *Inspector) RemoveQueue(qname string, force bool) error {
+	err := i.rdb.RemoveQueue(qname, force)
+	switch err.(type) {
+	case *rdb.ErrQueueNotFound:
+		return fmt.Errorf("%w: %q", ErrQueueNotFound, qname)
+	case *rdb.ErrQueueNotEmpty:
+		return fmt.Errorf("%w: %q", ErrQueueNotEmpty, qname)
+	}
+	return err
+}
+
+// ServerInfo describes a running Server instance.
+type ServerInfo struct {
+	// Unique Identifier for the server.
+	ID string
+	// Host machine on which the server is running.
+	Host string
+	// PID of the process in which the server is running.
+	PID int
+
+	// Server configuration details.
+	// See Config doc for field descriptions.
+	Concurrency    int
+	Queues         map[string]int
+	StrictPriority bool
+
+	// Time the server started.
+	Started time.Time
+	// Status indicates the status of the server.
+	Status string
+	// ActiveWorkers is the number of tasks being processed by the server.
+	ActiveWorkers int
+}
+
+// ListServers returns a list of running servers, sorted by host and PID.
+func (i *Inspector) ListServers() ([]*ServerInfo, error) {
+	servers, err := i.rdb.ListServers()
+	if err != nil {
+		return nil, err
+	}
+	var res []*ServerInfo
+	for _, s := range servers {
+		res = append(res, &ServerInfo{
+			ID:             s.ServerID,
+			Host:           s.Host,
+			PID:            s.PID,
+			Concurrency:    s.Concurrency,
+			Queues:         s.Queues,
+			StrictPriority: s.StrictPriority,
+			Started:        s.Started,
+			Status:         s.Status,
+			ActiveWorkers:  s.ActiveWorkerCount,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Host != res[j].Host {
+			return res[i].Host < res[j].Host
+		}
+		return res[i].PID < res[j].PID
+	})
+	return res, nil
+}
+
+// WorkerInfo describes a worker processing a task.
+type WorkerInfo struct {
+	// Host and PID identify the process the worker runs in.
+	Host string
+	PID  int
+
+	// The task the worker is processing.
+	Task *Task
+	// ID of the task.
+	TaskID string
+	// Queue the task belongs to.
+	Queue string
+	// Time the worker started processing the task.
+	Started time.Time
+}
+
+// ListWorkers returns a list of workers processing tasks,
+// sorted by the time they started processing the task.
+func (i *Inspector) ListWorkers() ([]*WorkerInfo, error) {
+	workers, err := i.rdb.ListWorkers()
+	if err != nil {
+		return nil, err
+	}
+	var res []*WorkerInfo
+	for _, w := range workers {
+		res = append(res, &WorkerInfo{
+			Host:    w.Host,
+			PID:     w.PID,
+			Task:    NewTask(w.Type, w.Payload),
+			TaskID:  w.ID.String(),
+			Queue:   w.Queue,
+			Started: w.Started,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Started.Before(res[j].Started) })
+	return res, nil
+}
+
+// parseTaskID parses the ID of a task.
+func parseTaskID(id string) (xid.ID, error) {
+	taskID, err := xid.FromString(id)
+	if err != nil {
+		return xid.NilID(), fmt.Errorf("invalid task id %q", id)
+	}
+	return taskID, nil
+}
+
+// toPublicError converts errors returned by rdb to the errors
+// defined in this package.
+func toPublicError(err error) error {
+	if errors.Is(err, base.ErrTaskNotFound) {
+		return fmt.Errorf("%w", ErrTaskNotFound)
+	}
+	return err
+}
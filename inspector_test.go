@@ -0,0 +1,795 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/rs/xid"
+)
+
+func newTestInspector(t *testing.T) *Inspector {
+	t.Helper()
+	return NewInspector(RedisClientOpt{Addr: redisAddr, DB: redisDB})
+}
+
+func TestInspectorCurrentStats(t *testing.T) {
+	r := setup(t)
+	inspector := newTestInspector(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessageWithQueue("reindex", nil, "critical")
+	m3 := h.NewTaskMessage("sync", nil)
+	m4 := h.NewTaskMessage("gen_thumbnail", nil)
+	now := time.Now()
+
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m2}, "critical")
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{}, "low")
+	h.SeedScheduledQueue(t, r, []h.ZSetEntry{{Msg: m3, Score: float64(now.Add(time.Hour).Unix())}})
+	h.SeedDeadQueue(t, r, []h.ZSetEntry{{Msg: m4, Score: float64(now.Unix())}})
+	r.Set(h.Keys.ProcessedKey(now), 120, 0)
+	r.Set(h.Keys.FailureKey(now), 3, 0)
+
+	got, err := inspector.CurrentStats()
+	if err != nil {
+		t.Fatalf("CurrentStats() returned error: %v", err)
+	}
+	want := &Stats{
+		Enqueued:  2,
+		Scheduled: 1,
+		Dead:      1,
+		Processed: 120,
+		Failed:    3,
+		Queues: []*QueueInfo{
+			{Name: "critical", Size: 1},
+			{Name: "default", Size: 1},
+			{Name: "low", Size: 0},
+		},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(Stats{}, "Timestamp")); diff != "" {
+		t.Errorf("CurrentStats() = %+v, want %+v; (-want, +got)\n%s", got, want, diff)
+	}
+}
+
+func TestInspectorHistory(t *testing.T) {
+	r := setup(t)
+	inspector := newTestInspector(t)
+	now := time.Now().UTC()
+	for i := 0; i < 3; i++ {
+		ts := now.Add(-time.Duration(i) * 24 * time.Hour)
+		r.Set(h.Keys.ProcessedKey(ts), (i+1)*1000, 0)
+		r.Set(h.Keys.FailureKey(ts), (i+1)*10, 0)
+	}
+
+	got, err := inspector.History(3)
+	if err != nil {
+		t.Fatalf("History(3) returned error: %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("History(3) returned %d days, want 3", len(got))
+	}
+	for i, s := range got {
+		ts := now.Add(-time.Duration(i) * 24 * time.Hour)
+		want := &DailyStats{Processed: (i + 1) * 1000, Failed: (i + 1) * 10, Date: ts}
+		if diff := cmp.Diff(want, s, cmpopts.EquateApproxTime(24*time.Hour)); diff != "" {
+			t.Errorf("History(3)[%d] = %+v, want %+v; (-want, +got)\n%s", i, s, want, diff)
+		}
+	}
+}
+
+func TestInspectorListEnqueuedTasks(t *testing.T) {
+	r := setup(t)
+	inspector := newTestInspector(t)
+	var msgs []*base.TaskMessage
+	for i := 0; i < 50; i++ {
+		msgs = append(msgs, h.NewTaskMessage(fmt.Sprintf("task%d", i), nil))
+	}
+	h.SeedEnqueuedQueue(t, r, msgs)
+
+	tests := []struct {
+		opts      []ListOption
+		wantSize  int
+		wantFirst string
+		wantLast  string
+	}{
+		{nil, 30, "task0", "task29"},
+		{[]ListOption{Page(2)}, 20, "task30", "task49"},
+		{[]ListOption{PageSize(10), Page(3)}, 10, "task20", "task29"},
+		{[]ListOption{PageSize(10), Page(6)}, 0, "", ""},
+	}
+
+	for _, tc := range tests {
+		got, err := inspector.ListEnqueuedTasks("default", tc.opts...)
+		if err != nil {
+			t.Errorf("ListEnqueuedTasks(%v) returned error: %v", tc.opts, err)
+			continue
+		}
+		if len(got) != tc.wantSize {
+			t.Errorf("ListEnqueuedTasks(%v) returned %d tasks, want %d", tc.opts, len(got), tc.wantSize)
+			continue
+		}
+		if tc.wantSize == 0 {
+			continue
+		}
+		if first, last := got[0], got[len(got)-1]; first.Type != tc.wantFirst || last.Type != tc.wantLast {
+			t.Errorf("ListEnqueuedTasks(%v) returned tasks from %q to %q, want from %q to %q",
+				tc.opts, first.Type, last.Type, tc.wantFirst, tc.wantLast)
+		}
+	}
+
+	if _, err := inspector.ListEnqueuedTasks("nonexistent"); !errors.Is(err, ErrQueueNotFound) {
+		t.Errorf("ListEnqueuedTasks(%q) returned %v, want ErrQueueNotFound", "nonexistent", err)
+	}
+}
+
+func TestInspectorListTasks(t *testing.T) {
+	r := setup(t)
+	inspector := newTestInspector(t)
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"to": "user@example.com"})
+	m1.Headers = map[string]string{"request_id": "abc123"}
+	m2 := h.NewTaskMessageWithQueue("reindex", nil, "low")
+	m2.Retried = 3
+	m2.ErrorMsg = "search engine not responding"
+	m3 := h.NewTaskMessage("sync", nil)
+	m3.Retried = 25
+	m3.ErrorMsg = "network error"
+	m3.Headers = map[string]string{"tenant": "acme"}
+	m4 := h.NewTaskMessage("gen_thumbnail", nil)
+	processAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	diedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	h.SeedScheduledQueue(t, r, []h.ZSetEntry{{Msg: m1, Score: float64(processAt.Unix())}})
+	h.SeedRetryQueue(t, r, []h.ZSetEntry{{Msg: m2, Score: float64(processAt.Unix())}})
+	h.SeedDeadQueue(t, r, []h.ZSetEntry{{Msg: m3, Score: float64(diedAt.Unix())}})
+	h.SeedInProgressQueue(t, r, []*base.TaskMessage{m4})
+
+	scheduled, err := inspector.ListScheduledTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantScheduled := []*ScheduledTask{{
+		Task:          NewTask(m1.Type, m1.Payload),
+		ID:            m1.ID.String(),
+		Queue:         "default",
+		Headers:       m1.Headers,
+		NextEnqueueAt: processAt,
+		score:         processAt.Unix(),
+	}}
+	if diff := cmp.Diff(wantScheduled, scheduled, cmp.AllowUnexported(ScheduledTask{}, Payload{})); diff != "" {
+		t.Errorf("ListScheduledTasks() = %v, want %v; (-want, +got)\n%s", scheduled, wantScheduled, diff)
+	}
+	if want := fmt.Sprintf("s:%d:%v", processAt.Unix(), m1.ID); scheduled[0].Key() != want {
+		t.Errorf("ScheduledTask.Key() = %q, want %q", scheduled[0].Key(), want)
+	}
+
+	retry, err := inspector.ListRetryTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRetry := []*RetryTask{{
+		Task:          NewTask(m2.Type, m2.Payload),
+		ID:            m2.ID.String(),
+		Queue:         "low",
+		NextEnqueueAt: processAt,
+		MaxRetry:      m2.Retry,
+		Retried:       3,
+		ErrorMsg:      m2.ErrorMsg,
+		score:         processAt.Unix(),
+	}}
+	if diff := cmp.Diff(wantRetry, retry, cmp.AllowUnexported(RetryTask{}, Payload{})); diff != "" {
+		t.Errorf("ListRetryTasks() = %v, want %v; (-want, +got)\n%s", retry, wantRetry, diff)
+	}
+
+	dead, err := inspector.ListDeadTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDead := []*DeadTask{{
+		Task:         NewTask(m3.Type, m3.Payload),
+		ID:           m3.ID.String(),
+		Queue:        "default",
+		Headers:      m3.Headers,
+		MaxRetry:     m3.Retry,
+		Retried:      25,
+		LastFailedAt: diedAt,
+		ErrorMsg:     m3.ErrorMsg,
+		score:        diedAt.Unix(),
+	}}
+	if diff := cmp.Diff(wantDead, dead, cmp.AllowUnexported(DeadTask{}, Payload{})); diff != "" {
+		t.Errorf("ListDeadTasks() = %v, want %v; (-want, +got)\n%s", dead, wantDead, diff)
+	}
+
+	inProgress, err := inspector.ListInProgressTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantInProgress := []*InProgressTask{{Task: NewTask(m4.Type, m4.Payload), ID: m4.ID.String(), Queue: "default"}}
+	if diff := cmp.Diff(wantInProgress, inProgress, cmp.AllowUnexported(Payload{})); diff != "" {
+		t.Errorf("ListInProgressTasks() = %v, want %v; (-want, +got)\n%s", inProgress, wantInProgress, diff)
+	}
+}
+
+func TestInspectorTaskByKey(t *testing.T) {
+	r := setup(t)
+	inspector := newTestInspector(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("sync", nil)
+	score := time.Now().Add(time.Hour).Unix()
+	key := func(qtype string, msg *base.TaskMessage) string {
+		return fmt.Sprintf("%s:%d:%v", qtype, score, msg.ID)
+	}
+
+	tests := []struct {
+		desc          string
+		op            func(key string) error
+		key           string
+		wantEnqueued  []*base.TaskMessage
+		wantScheduled []*base.TaskMessage
+		wantRetry     []*base.TaskMessage
+		wantDead      []*base.TaskMessage
+	}{
+		{
+			desc:          "enqueue scheduled task",
+			op:            inspector.EnqueueTaskByKey,
+			key:           key("s", m1),
+			wantEnqueued:  []*base.TaskMessage{m1},
+			wantScheduled: nil,
+			wantRetry:     []*base.TaskMessage{m2},
+			wantDead:      []*base.TaskMessage{m3},
+		},
+		{
+			desc:          "enqueue dead task",
+			op:            inspector.EnqueueTaskByKey,
+			key:           key("d", m3),
+			wantEnqueued:  []*base.TaskMessage{m3},
+			wantScheduled: []*base.TaskMessage{m1},
+			wantRetry:     []*base.TaskMessage{m2},
+			wantDead:      nil,
+		},
+		{
+			desc:          "delete retry task",
+			op:            inspector.DeleteTaskByKey,
+			key:           key("r", m2),
+			wantEnqueued:  nil,
+			wantScheduled: []*base.TaskMessage{m1},
+			wantRetry:     nil,
+			wantDead:      []*base.TaskMessage{m3},
+		},
+		{
+			desc:          "kill scheduled task",
+			op:            inspector.KillTaskByKey,
+			key:           key("s", m1),
+			wantEnqueued:  nil,
+			wantScheduled: nil,
+			wantRetry:     []*base.TaskMessage{m2},
+			wantDead:      []*base.TaskMessage{m1, m3},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		h.SeedScheduledQueue(t, r, []h.ZSetEntry{{Msg: m1, Score: float64(score)}})
+		h.SeedRetryQueue(t, r, []h.ZSetEntry{{Msg: m2, Score: float64(score)}})
+		h.SeedDeadQueue(t, r, []h.ZSetEntry{{Msg: m3, Score: float64(score)}})
+
+		if err := tc.op(tc.key); err != nil {
+			t.Errorf("%s; returned error: %v", tc.desc, err)
+			continue
+		}
+		checks := []struct {
+			key  string
+			want []*base.TaskMessage
+			got  []*base.TaskMessage
+		}{
+			{h.Keys.DefaultQueue(), tc.wantEnqueued, h.GetEnqueuedMessages(t, r)},
+			{h.Keys.ScheduledQueue(), tc.wantScheduled, h.GetScheduledMessages(t, r)},
+			{h.Keys.RetryQueue(), tc.wantRetry, h.GetRetryMessages(t, r)},
+			{h.Keys.DeadQueue(), tc.wantDead, h.GetDeadMessages(t, r)},
+		}
+		for _, c := range checks {
+			if diff := cmp.Diff(c.want, c.got, h.SortMsgOpt); diff != "" {
+				t.Errorf("%s; mismatch found in %q; (-want, +got)\n%s", tc.desc, c.key, diff)
+			}
+		}
+	}
+}
+
+func TestInspectorTaskByKeyError(t *testing.T) {
+	setup(t)
+	inspector := newTestInspector(t)
+	m := h.NewTaskMessage("send_email", nil)
+
+	tests := []struct {
+		desc    string
+		op      func(key string) error
+		key     string
+		wantErr error // nil if any error is expected
+	}{
+		{"invalid key", inspector.EnqueueTaskByKey, "invalid", nil},
+		{"invalid state", inspector.DeleteTaskByKey, fmt.Sprintf("x:123:%v", m.ID), nil},
+		{"kill dead task", inspector.KillTaskByKey, fmt.Sprintf("d:123:%v", m.ID), nil},
+		{"task not found", inspector.EnqueueTaskByKey, fmt.Sprintf("s:123:%v", m.ID), ErrTaskNotFound},
+		{"task not found", inspector.DeleteTaskByKey, fmt.Sprintf("d:123:%v", m.ID), ErrTaskNotFound},
+		{"task not found", inspector.KillTaskByKey, fmt.Sprintf("r:123:%v", m.ID), ErrTaskNotFound},
+	}
+
+	for _, tc := range tests {
+		err := tc.op(tc.key)
+		if err == nil {
+			t.Errorf("%s; operation on %q returned nil error, want non-nil", tc.desc, tc.key)
+			continue
+		}
+		if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s; operation on %q returned %v, want %v", tc.desc, tc.key, err, tc.wantErr)
+		}
+	}
+}
+
+func TestInspectorAllTasks(t *testing.T) {
+	r := setup(t)
+	inspector := newTestInspector(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("sync", nil)
+	score := float64(time.Now().Unix())
+	entries := []h.ZSetEntry{{Msg: m1, Score: score}, {Msg: m2, Score: score}, {Msg: m3, Score: score}}
+
+	tests := []struct {
+		desc         string
+		state        string // state to seed the tasks in
+		op           func() (int, error)
+		wantEnqueued int
+		wantDead     int
+	}{
+		{"enqueue all scheduled", "scheduled", inspector.EnqueueAllScheduledTasks, 3, 0},
+		{"enqueue all retry", "retry", inspector.EnqueueAllRetryTasks, 3, 0},
+		{"enqueue all dead", "dead", inspector.EnqueueAllDeadTasks, 3, 0},
+		{"kill all scheduled", "scheduled", inspector.KillAllScheduledTasks, 0, 3},
+		{"kill all retry", "retry", inspector.KillAllRetryTasks, 0, 3},
+		{"delete all scheduled", "scheduled", inspector.DeleteAllScheduledTasks, 0, 0},
+		{"delete all retry", "retry", inspector.DeleteAllRetryTasks, 0, 0},
+		{"delete all dead", "dead", inspector.DeleteAllDeadTasks, 0, 0},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		switch tc.state {
+		case "scheduled":
+			h.SeedScheduledQueue(t, r, entries)
+		case "retry":
+			h.SeedRetryQueue(t, r, entries)
+		case "dead":
+			h.SeedDeadQueue(t, r, entries)
+		}
+
+		n, err := tc.op()
+		if err != nil || n != 3 {
+			t.Errorf("%s; returned %d, %v; want 3, nil", tc.desc, n, err)
+			continue
+		}
+		if got := len(h.GetEnqueuedMessages(t, r)); got != tc.wantEnqueued {
+			t.Errorf("%s; %q has %d tasks, want %d", tc.desc, h.Keys.DefaultQueue(), got, tc.wantEnqueued)
+		}
+		if got := len(h.GetDeadMessages(t, r)); got != tc.wantDead {
+			t.Errorf("%s; %q has %d tasks, want %d", tc.desc, h.Keys.DeadQueue(), got, tc.wantDead)
+		}
+		if got := len(h.GetScheduledMessages(t, r)) + len(h.GetRetryMessages(t, r)); got != 0 {
+			t.Errorf("%s; %d tasks are left in scheduled and retry states, want 0", tc.desc, got)
+		}
+	}
+}
+
+func TestInspectorRemoveQueue(t *testing.T) {
+	r := setup(t)
+	inspector := newTestInspector(t)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{h.NewTaskMessage("send_email", nil)}, "low")
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{}, "empty")
+
+	if err := inspector.RemoveQueue("low", false); !errors.Is(err, ErrQueueNotEmpty) {
+		t.Errorf("RemoveQueue(%q, false) = %v, want %v", "low", err, ErrQueueNotEmpty)
+	}
+	if err := inspector.RemoveQueue("nonexistent", false); !errors.Is(err, ErrQueueNotFound) {
+		t.Errorf("RemoveQueue(%q, false) = %v, want %v", "nonexistent", err, ErrQueueNotFound)
+	}
+	if err := inspector.RemoveQueue("low", true); err != nil {
+		t.Errorf("RemoveQueue(%q, true) returned error: %v", "low", err)
+	}
+	if err := inspector.RemoveQueue("empty", false); err != nil {
+		t.Errorf("RemoveQueue(%q, false) returned error: %v", "empty", err)
+	}
+	if got := r.SMembers(h.Keys.AllQueues()).Val(); len(got) != 0 {
+		t.Errorf("%q has %v, want no queues", h.Keys.AllQueues(), got)
+	}
+}
+
+func TestInspectorListServersAndWorkers(t *testing.T) {
+	r := setup(t)
+	inspector := newTestInspector(t)
+	started := time.Now().Add(-time.Hour).Truncate(time.Second)
+	ss := base.NewServerState("127.0.0.1", 9876, 10, map[string]int{"default": 1}, false)
+	ss.SetStarted(started)
+	ss.SetStatus(base.StatusRunning)
+	msg := h.NewTaskMessage("send_email", map[string]interface{}{"to": "user@example.com"})
+	ss.AddWorkerStats(msg, started.Add(time.Minute))
+	if err := rdb.NewRDB(r).WriteServerState(ss, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	servers, err := inspector.ListServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := ss.GetInfo()
+	wantServers := []*ServerInfo{{
+		ID:            info.ServerID,
+		Host:          "127.0.0.1",
+		PID:           9876,
+		Concurrency:   10,
+		Queues:        map[string]int{"default": 1},
+		Started:       started,
+		Status:        "running",
+		ActiveWorkers: 1,
+	}}
+	if diff := cmp.Diff(wantServers, servers, cmpopts.EquateApproxTime(time.Second)); diff != "" {
+		t.Errorf("ListServers() = %v, want %v; (-want, +got)\n%s", servers, wantServers, diff)
+	}
+
+	workers, err := inspector.ListWorkers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantWorkers := []*WorkerInfo{{
+		Host:    "127.0.0.1",
+		PID:     9876,
+		Task:    NewTask(msg.Type, msg.Payload),
+		TaskID:  msg.ID.String(),
+		Queue:   "default",
+		Started: started.Add(time.Minute),
+	}}
+	if diff := cmp.Diff(wantWorkers, workers, cmp.AllowUnexported(Payload{}), cmpopts.EquateApproxTime(time.Second)); diff != "" {
+		t.Errorf("ListWorkers() = %v, want %v; (-want, +got)\n%s", workers, wantWorkers, diff)
+	}
+}
+
+func TestInspectorCancelTask(t *testing.T) {
+	r := setup(t)
+	inspector := newTestInspector(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+	h.SeedTaskIndex(t, r, []*base.TaskMessage{m1})
+
+	tests := []struct {
+		id   string
+		want CancelResult
+	}{
+		{m1.ID.String(), CancelRemoved},
+		{m1.ID.String(), CancelNotFound},
+		{m2.ID.String(), CancelNotFound},
+	}
+
+	for _, tc := range tests {
+		got, err := inspector.CancelTask(tc.id)
+		if err != nil || got != tc.want {
+			t.Errorf("CancelTask(%q) = %v, %v; want %v, nil", tc.id, got, err, tc.want)
+		}
+	}
+	if got := h.GetEnqueuedMessages(t, r); len(got) != 0 {
+		t.Errorf("%q has %d tasks, want 0", h.Keys.DefaultQueue(), len(got))
+	}
+}
+
+func TestInspectorGetTask(t *testing.T) {
+	r := setup(t)
+	inspector := newTestInspector(t)
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"to": "user@example.com"})
+	m1.Timeout = "30s"
+	m1.Headers = map[string]string{"request_id": "abc123"}
+	m2 := h.NewTaskMessageWithQueue("reindex", nil, "low")
+	m2.Retried = 25
+	m2.ErrorMsg = "network error"
+	m3 := h.NewTaskMessage("sync", nil)
+	diedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+	h.SeedDeadQueue(t, r, []h.ZSetEntry{{Msg: m2, Score: float64(diedAt.Unix())}})
+	h.SeedTaskIndex(t, r, []*base.TaskMessage{m1, m2})
+
+	tests := []struct {
+		id   string
+		want *TaskInfo
+	}{
+		{
+			id: m1.ID.String(),
+			want: &TaskInfo{
+				Task:     NewTask(m1.Type, m1.Payload),
+				ID:       m1.ID.String(),
+				Queue:    "default",
+				Headers:  m1.Headers,
+				State:    StateEnqueued,
+				MaxRetry: m1.Retry,
+				Timeout:  30 * time.Second,
+			},
+		},
+		{
+			id: m2.ID.String(),
+			want: &TaskInfo{
+				Task:         NewTask(m2.Type, m2.Payload),
+				ID:           m2.ID.String(),
+				Queue:        "low",
+				State:        StateDead,
+				MaxRetry:     m2.Retry,
+				Retried:      25,
+				ErrorMsg:     m2.ErrorMsg,
+				LastFailedAt: diedAt,
+				score:        diedAt.Unix(),
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		got, err := inspector.GetTask(tc.id)
+		if err != nil {
+			t.Errorf("GetTask(%q) returned error: %v", tc.id, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(TaskInfo{}, Payload{})); diff != "" {
+			t.Errorf("GetTask(%q) = %v, want %v; (-want, +got)\n%s", tc.id, got, tc.want, diff)
+		}
+	}
+	if got, _ := inspector.GetTask(m2.ID.String()); got.Key() != fmt.Sprintf("d:%d:%v", diedAt.Unix(), m2.ID) {
+		t.Errorf("TaskInfo.Key() = %q, want the key of the dead task", got.Key())
+	}
+
+	if _, err := inspector.GetTask(m3.ID.String()); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("GetTask(%q) returned %v, want ErrTaskNotFound", m3.ID, err)
+	}
+	if _, err := inspector.GetTask("bad-id"); err == nil {
+		t.Errorf("GetTask(%q) returned nil error, want non-nil", "bad-id")
+	}
+}
+
+func TestInspectorTaskEvents(t *testing.T) {
+	r := setup(t)
+	inspector := newTestInspector(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	now := time.Now().Truncate(time.Second)
+	events := []*base.TaskEvent{
+		{Kind: base.EventEnqueued, Time: now, Queue: "default"},
+		{Kind: base.EventDequeued, Time: now, Queue: "default", Host: "host1", PID: 123, ServerID: "server1", Attempt: 1},
+		{Kind: base.EventRetry, Time: now, Queue: "default", Host: "host1", PID: 123, ServerID: "server1",
+			Attempt: 1, ErrorMsg: "network error", ProcessAt: now.Add(time.Minute)},
+	}
+	b := rdb.NewRDB(r)
+	for _, e := range events {
+		if err := b.RecordEvent(m1.ID.String(), e, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := inspector.TaskEvents(m1.ID.String())
+	if err != nil {
+		t.Fatalf("TaskEvents(%q) returned error: %v", m1.ID, err)
+	}
+	want := []*TaskEvent{
+		{Kind: "enqueued", Time: now, Queue: "default"},
+		{Kind: "dequeued", Time: now, Queue: "default", Host: "host1", PID: 123, ServerID: "server1", Attempt: 1},
+		{Kind: "retry", Time: now, Queue: "default", Host: "host1", PID: 123, ServerID: "server1",
+			Attempt: 1, ErrorMsg: "network error", ProcessAt: now.Add(time.Minute)},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.EquateApproxTime(0)); diff != "" {
+		t.Errorf("TaskEvents(%q) = %v, want %v; (-want, +got)\n%s", m1.ID, got, want, diff)
+	}
+
+	if _, err := inspector.TaskEvents(m2.ID.String()); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("TaskEvents(%q) returned %v, want ErrTaskNotFound", m2.ID, err)
+	}
+}
+
+func TestInspectorFilteredTasks(t *testing.T) {
+	r := setup(t)
+	inspector := newTestInspector(t)
+	m1 := h.NewTaskMessage("email:send", map[string]interface{}{"tenant": "42"})
+	m1.ErrorMsg = "timeout"
+	m2 := h.NewTaskMessage("email:send", map[string]interface{}{"tenant": "7"})
+	m2.ErrorMsg = "bad address"
+	m3 := h.NewTaskMessage("reindex", map[string]interface{}{"tenant": "42"})
+	m3.ErrorMsg = "timeout"
+	now := time.Now()
+
+	tests := []struct {
+		desc         string
+		op           func(state string, f TaskFilter) (int, error)
+		filter       TaskFilter
+		want         int
+		wantDead     []*base.TaskMessage
+		wantEnqueued []*base.TaskMessage
+	}{
+		{
+			desc:     "count by type",
+			op:       inspector.CountTasks,
+			filter:   TaskFilter{TypePattern: "email:*"},
+			want:     2,
+			wantDead: []*base.TaskMessage{m1, m2, m3},
+		},
+		{
+			desc:         "enqueue by type and error",
+			op:           inspector.EnqueueTasks,
+			filter:       TaskFilter{TypePattern: "email:*", ErrorContains: "timeout"},
+			want:         1,
+			wantDead:     []*base.TaskMessage{m2, m3},
+			wantEnqueued: []*base.TaskMessage{m1},
+		},
+		{
+			desc:     "delete by payload",
+			op:       inspector.DeleteTasks,
+			filter:   TaskFilter{Payload: map[string]string{"tenant": "42"}},
+			want:     2,
+			wantDead: []*base.TaskMessage{m2},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		h.SeedDeadQueue(t, r, []h.ZSetEntry{
+			{Msg: m1, Score: float64(now.Unix())},
+			{Msg: m2, Score: float64(now.Unix())},
+			{Msg: m3, Score: float64(now.Unix())},
+		})
+
+		got, err := tc.op(StateDead, tc.filter)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: got %d, %v; want %d, nil", tc.desc, got, err, tc.want)
+			continue
+		}
+		if diff := cmp.Diff(tc.wantDead, h.GetDeadMessages(t, r), h.SortMsgOpt); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want, +got)\n%s", tc.desc, h.Keys.DeadQueue(), diff)
+		}
+		if diff := cmp.Diff(tc.wantEnqueued, h.GetEnqueuedMessages(t, r), h.SortMsgOpt); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want, +got)\n%s", tc.desc, h.Keys.DefaultQueue(), diff)
+		}
+	}
+
+	if _, err := inspector.KillTasks(StateDead, TaskFilter{}); err == nil {
+		t.Errorf("KillTasks(%q) returned nil error, want non-nil", StateDead)
+	}
+}
+
+func TestInspectorMoveTasks(t *testing.T) {
+	r := setup(t)
+	inspector := newTestInspector(t)
+	m1 := h.NewTaskMessage("email:send", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("email:welcome", nil)
+	processAt := time.Now().Add(time.Hour)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1, m2})
+	h.SeedScheduledQueue(t, r, []h.ZSetEntry{{Msg: m3, Score: float64(processAt.Unix())}})
+
+	n, err := inspector.MoveTasks("default", "email", "email:*")
+	if err != nil || n != 2 {
+		t.Fatalf("MoveTasks(%q, %q, %q) = %d, %v; want 2, nil", "default", "email", "email:*", n, err)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{m2}, h.GetEnqueuedMessages(t, r)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.DefaultQueue(), diff)
+	}
+	moved := *m1
+	moved.Queue = "email"
+	if diff := cmp.Diff([]*base.TaskMessage{&moved}, h.GetEnqueuedMessages(t, r, "email")); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.QueueKey("email"), diff)
+	}
+	if got := h.GetScheduledMessages(t, r); len(got) != 1 || got[0].Queue != "email" {
+		t.Errorf("%q has %v, want the task moved to queue %q", h.Keys.ScheduledQueue(), got, "email")
+	}
+
+	if _, err := inspector.MoveTasks("default", "default", ""); err == nil {
+		t.Errorf("MoveTasks(%q, %q) returned nil error, want non-nil", "default", "default")
+	}
+}
+
+func TestInspectorEditTask(t *testing.T) {
+	r := setup(t)
+	inspector := newTestInspector(t)
+	m1 := h.NewTaskMessage("email:send", map[string]interface{}{"to": "bad@", "subject": "hello"})
+	m1.Retried = 25
+	m1.ErrorMsg = "bad address"
+	m2 := h.NewTaskMessage("reindex", nil)
+	h.SeedDeadQueue(t, r, []h.ZSetEntry{{Msg: m1, Score: float64(time.Now().Unix())}})
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m2})
+	h.SeedTaskIndex(t, r, []*base.TaskMessage{m1, m2})
+
+	maxRetry := 3
+	edit := TaskEdit{
+		Payload:  map[string]interface{}{"to": "user@example.com"},
+		Queue:    "critical",
+		MaxRetry: &maxRetry,
+		Timeout:  time.Minute,
+	}
+	fields, err := inspector.EditTask(m1.ID.String(), edit)
+	if err != nil {
+		t.Fatalf("EditTask(%q) returned error: %v", m1.ID, err)
+	}
+	if diff := cmp.Diff([]string{"payload", "queue", "retry", "timeout"}, fields); diff != "" {
+		t.Errorf("EditTask(%q) changed %v; (-want, +got)\n%s", m1.ID, fields, diff)
+	}
+	got, err := inspector.GetTask(m1.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPayload := map[string]interface{}{"to": "user@example.com", "subject": "hello"}
+	if got.State != StateEnqueued || got.Queue != "critical" || got.MaxRetry != 3 || got.Retried != 25 ||
+		got.Timeout != time.Minute || !cmp.Equal(wantPayload, got.Payload.data) {
+		t.Errorf("GetTask(%q) after EditTask = %+v, want the edited task enqueued to %q", m1.ID, got, "critical")
+	}
+
+	if _, err := inspector.EditTask(m2.ID.String(), edit); err == nil {
+		t.Errorf("EditTask(%q) of enqueued task returned nil error, want non-nil", m2.ID)
+	}
+	if _, err := inspector.EditTask(xid.New().String(), edit); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("EditTask of missing task returned %v, want ErrTaskNotFound", err)
+	}
+}
+
+func TestInspectorExportImportTasks(t *testing.T) {
+	r := setup(t)
+	inspector := newTestInspector(t)
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"to": "user@example.com"})
+	m1.Retried = 25
+	m1.ErrorMsg = "network error"
+	m1.Headers = map[string]string{"request_id": "abc123"}
+	m2 := h.NewTaskMessageWithQueue("reindex", nil, "low")
+	m2.Retried = 25
+	diedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	h.SeedDeadQueue(t, r, []h.ZSetEntry{
+		{Msg: m1, Score: float64(diedAt.Unix())},
+		{Msg: m2, Score: float64(diedAt.Unix())},
+	})
+
+	var buf bytes.Buffer
+	n, err := inspector.ExportTasks(&buf, StateDead, "")
+	if err != nil || n != 2 {
+		t.Fatalf("ExportTasks(%q) = %d, %v; want 2, nil", StateDead, n, err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 2 {
+		t.Errorf("ExportTasks(%q) wrote %d lines, want 2", StateDead, lines)
+	}
+	exported := buf.String()
+
+	h.FlushDB(t, r)
+	n, err = inspector.ImportTasks(strings.NewReader(exported), false)
+	if err != nil || n != 2 {
+		t.Fatalf("ImportTasks() = %d, %v; want 2, nil", n, err)
+	}
+	want := []h.ZSetEntry{
+		{Msg: m1, Score: float64(diedAt.Unix())},
+		{Msg: m2, Score: float64(diedAt.Unix())},
+	}
+	if diff := cmp.Diff(want, h.GetDeadEntries(t, r), h.SortZSetEntryOpt); diff != "" {
+		t.Errorf("mismatch found in %q after import; (-want, +got)\n%s", h.Keys.DeadQueue(), diff)
+	}
+	if _, err := inspector.GetTask(m1.ID.String()); err != nil {
+		t.Errorf("GetTask(%q) after import returned error: %v", m1.ID, err)
+	}
+
+	// tasks which already exist are skipped.
+	if n, err := inspector.ImportTasks(strings.NewReader(exported), false); err != nil || n != 0 {
+		t.Errorf("ImportTasks() again = %d, %v; want 0, nil", n, err)
+	}
+	if n, err := inspector.ImportTasks(strings.NewReader(exported), true); err != nil || n != 2 {
+		t.Errorf("ImportTasks() with new IDs = %d, %v; want 2, nil", n, err)
+	}
+	if _, err := inspector.ImportTasks(strings.NewReader("{not json"), false); err == nil {
+		t.Errorf("ImportTasks() of malformed input returned nil error, want non-nil")
+	}
+}
@@ -6,8 +6,11 @@
 package asynqtest
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/go-redis/redis/v7"
@@ -17,6 +20,9 @@ import (
 	"github.com/rs/xid"
 )
 
+// Keys are the redis keys in the default namespace used in tests.
+var Keys = base.NewKeys(base.DefaultNamespace)
+
 // ZSetEntry is an entry in redis sorted set.
 type ZSetEntry struct {
 	Msg   *base.TaskMessage
@@ -72,6 +78,9 @@ var SortStringSliceOpt = cmp.Transformer("SortStringSlice", func(in []string) []
 // IgnoreIDOpt is an cmp.Option to ignore ID field in task messages when comparing.
 var IgnoreIDOpt = cmpopts.IgnoreFields(base.TaskMessage{}, "ID")
 
+// IgnoreReadyAtOpt is an cmp.Option to ignore ReadyAt field in task messages when comparing.
+var IgnoreReadyAtOpt = cmpopts.IgnoreFields(base.TaskMessage{}, "ReadyAt")
+
 // NewTaskMessage returns a new instance of TaskMessage given a task type and payload.
 func NewTaskMessage(taskType string, payload map[string]interface{}) *base.TaskMessage {
 	return &base.TaskMessage{
@@ -141,7 +150,7 @@ func MustUnmarshalSlice(tb testing.TB, data []string) []*base.TaskMessage {
 }
 
 // FlushDB deletes all the keys of the currently selected DB.
-func FlushDB(tb testing.TB, r *redis.Client) {
+func FlushDB(tb testing.TB, r redis.UniversalClient) {
 	tb.Helper()
 	if err := r.FlushDB().Err(); err != nil {
 		tb.Fatal(err)
@@ -151,41 +160,51 @@ func FlushDB(tb testing.TB, r *redis.Client) {
 // SeedEnqueuedQueue initializes the specified queue with the given messages.
 //
 // If queue name option is not passed, it defaults to the default queue.
-func SeedEnqueuedQueue(tb testing.TB, r *redis.Client, msgs []*base.TaskMessage, queueOpt ...string) {
+func SeedEnqueuedQueue(tb testing.TB, r redis.UniversalClient, msgs []*base.TaskMessage, queueOpt ...string) {
 	tb.Helper()
-	queue := base.DefaultQueue
+	queue := Keys.DefaultQueue()
 	if len(queueOpt) > 0 {
-		queue = base.QueueKey(queueOpt[0])
+		queue = Keys.QueueKey(queueOpt[0])
 	}
-	r.SAdd(base.AllQueues, queue)
+	r.SAdd(Keys.AllQueues(), queue)
 	seedRedisList(tb, r, queue, msgs)
 }
 
 // SeedInProgressQueue initializes the in-progress queue with the given messages.
-func SeedInProgressQueue(tb testing.TB, r *redis.Client, msgs []*base.TaskMessage) {
+func SeedInProgressQueue(tb testing.TB, r redis.UniversalClient, msgs []*base.TaskMessage) {
 	tb.Helper()
-	seedRedisList(tb, r, base.InProgressQueue, msgs)
+	seedRedisList(tb, r, Keys.InProgressQueue(), msgs)
 }
 
 // SeedScheduledQueue initializes the scheduled queue with the given messages.
-func SeedScheduledQueue(tb testing.TB, r *redis.Client, entries []ZSetEntry) {
+func SeedScheduledQueue(tb testing.TB, r redis.UniversalClient, entries []ZSetEntry) {
 	tb.Helper()
-	seedRedisZSet(tb, r, base.ScheduledQueue, entries)
+	seedRedisZSet(tb, r, Keys.ScheduledQueue(), entries)
 }
 
 // SeedRetryQueue initializes the retry queue with the given messages.
-func SeedRetryQueue(tb testing.TB, r *redis.Client, entries []ZSetEntry) {
+func SeedRetryQueue(tb testing.TB, r redis.UniversalClient, entries []ZSetEntry) {
 	tb.Helper()
-	seedRedisZSet(tb, r, base.RetryQueue, entries)
+	seedRedisZSet(tb, r, Keys.RetryQueue(), entries)
 }
 
 // SeedDeadQueue initializes the dead queue with the given messages.
-func SeedDeadQueue(tb testing.TB, r *redis.Client, entries []ZSetEntry) {
+func SeedDeadQueue(tb testing.TB, r redis.UniversalClient, entries []ZSetEntry) {
 	tb.Helper()
-	seedRedisZSet(tb, r, base.DeadQueue, entries)
+	seedRedisZSet(tb, r, Keys.DeadQueue(), entries)
 }
 
-func seedRedisList(tb testing.TB, c *redis.Client, key string, msgs []*base.TaskMessage) {
+// SeedTaskIndex adds the given messages to the task index.
+func SeedTaskIndex(tb testing.TB, r redis.UniversalClient, msgs []*base.TaskMessage) {
+	tb.Helper()
+	for _, msg := range msgs {
+		if err := r.HSet(Keys.TaskIndex(), msg.ID.String(), MustMarshal(tb, msg)).Err(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func seedRedisList(tb testing.TB, c redis.UniversalClient, key string, msgs []*base.TaskMessage) {
 	data := MustMarshalSlice(tb, msgs)
 	for _, s := range data {
 		if err := c.LPush(key, s).Err(); err != nil {
@@ -194,7 +213,7 @@ func seedRedisList(tb testing.TB, c *redis.Client, key string, msgs []*base.Task
 	}
 }
 
-func seedRedisZSet(tb testing.TB, c *redis.Client, key string, items []ZSetEntry) {
+func seedRedisZSet(tb testing.TB, c redis.UniversalClient, key string, items []ZSetEntry) {
 	for _, item := range items {
 		z := &redis.Z{Member: MustMarshal(tb, item.Msg), Score: float64(item.Score)}
 		if err := c.ZAdd(key, z).Err(); err != nil {
@@ -206,68 +225,79 @@ func seedRedisZSet(tb testing.TB, c *redis.Client, key string, items []ZSetEntry
 // GetEnqueuedMessages returns all task messages in the specified queue.
 //
 // If queue name option is not passed, it defaults to the default queue.
-func GetEnqueuedMessages(tb testing.TB, r *redis.Client, queueOpt ...string) []*base.TaskMessage {
+func GetEnqueuedMessages(tb testing.TB, r redis.UniversalClient, queueOpt ...string) []*base.TaskMessage {
 	tb.Helper()
-	queue := base.DefaultQueue
+	queue := Keys.DefaultQueue()
 	if len(queueOpt) > 0 {
-		queue = base.QueueKey(queueOpt[0])
+		queue = Keys.QueueKey(queueOpt[0])
 	}
 	return getListMessages(tb, r, queue)
 }
 
 // GetInProgressMessages returns all task messages in the in-progress queue.
-func GetInProgressMessages(tb testing.TB, r *redis.Client) []*base.TaskMessage {
+func GetInProgressMessages(tb testing.TB, r redis.UniversalClient) []*base.TaskMessage {
 	tb.Helper()
-	return getListMessages(tb, r, base.InProgressQueue)
+	return getListMessages(tb, r, Keys.InProgressQueue())
 }
 
 // GetScheduledMessages returns all task messages in the scheduled queue.
-func GetScheduledMessages(tb testing.TB, r *redis.Client) []*base.TaskMessage {
+func GetScheduledMessages(tb testing.TB, r redis.UniversalClient) []*base.TaskMessage {
 	tb.Helper()
-	return getZSetMessages(tb, r, base.ScheduledQueue)
+	return getZSetMessages(tb, r, Keys.ScheduledQueue())
 }
 
 // GetRetryMessages returns all task messages in the retry queue.
-func GetRetryMessages(tb testing.TB, r *redis.Client) []*base.TaskMessage {
+func GetRetryMessages(tb testing.TB, r redis.UniversalClient) []*base.TaskMessage {
 	tb.Helper()
-	return getZSetMessages(tb, r, base.RetryQueue)
+	return getZSetMessages(tb, r, Keys.RetryQueue())
 }
 
 // GetDeadMessages returns all task messages in the dead queue.
-func GetDeadMessages(tb testing.TB, r *redis.Client) []*base.TaskMessage {
+func GetDeadMessages(tb testing.TB, r redis.UniversalClient) []*base.TaskMessage {
 	tb.Helper()
-	return getZSetMessages(tb, r, base.DeadQueue)
+	return getZSetMessages(tb, r, Keys.DeadQueue())
 }
 
 // GetScheduledEntries returns all task messages and its score in the scheduled queue.
-func GetScheduledEntries(tb testing.TB, r *redis.Client) []ZSetEntry {
+func GetScheduledEntries(tb testing.TB, r redis.UniversalClient) []ZSetEntry {
 	tb.Helper()
-	return getZSetEntries(tb, r, base.ScheduledQueue)
+	return getZSetEntries(tb, r, Keys.ScheduledQueue())
 }
 
 // GetRetryEntries returns all task messages and its score in the retry queue.
-func GetRetryEntries(tb testing.TB, r *redis.Client) []ZSetEntry {
+func GetRetryEntries(tb testing.TB, r redis.UniversalClient) []ZSetEntry {
 	tb.Helper()
-	return getZSetEntries(tb, r, base.RetryQueue)
+	return getZSetEntries(tb, r, Keys.RetryQueue())
 }
 
 // GetDeadEntries returns all task messages and its score in the dead queue.
-func GetDeadEntries(tb testing.TB, r *redis.Client) []ZSetEntry {
+func GetDeadEntries(tb testing.TB, r redis.UniversalClient) []ZSetEntry {
+	tb.Helper()
+	return getZSetEntries(tb, r, Keys.DeadQueue())
+}
+
+// GetTaskIndex returns all task messages in the task index keyed by task ID.
+func GetTaskIndex(tb testing.TB, r redis.UniversalClient) map[string]*base.TaskMessage {
 	tb.Helper()
-	return getZSetEntries(tb, r, base.DeadQueue)
+	data := r.HGetAll(Keys.TaskIndex()).Val()
+	index := make(map[string]*base.TaskMessage)
+	for id, s := range data {
+		index[id] = MustUnmarshal(tb, s)
+	}
+	return index
 }
 
-func getListMessages(tb testing.TB, r *redis.Client, list string) []*base.TaskMessage {
+func getListMessages(tb testing.TB, r redis.UniversalClient, list string) []*base.TaskMessage {
 	data := r.LRange(list, 0, -1).Val()
 	return MustUnmarshalSlice(tb, data)
 }
 
-func getZSetMessages(tb testing.TB, r *redis.Client, zset string) []*base.TaskMessage {
+func getZSetMessages(tb testing.TB, r redis.UniversalClient, zset string) []*base.TaskMessage {
 	data := r.ZRange(zset, 0, -1).Val()
 	return MustUnmarshalSlice(tb, data)
 }
 
-func getZSetEntries(tb testing.TB, r *redis.Client, zset string) []ZSetEntry {
+func getZSetEntries(tb testing.TB, r redis.UniversalClient, zset string) []ZSetEntry {
 	data := r.ZRangeWithScores(zset, 0, -1).Val()
 	var entries []ZSetEntry
 	for _, z := range data {
@@ -278,3 +308,75 @@ func getZSetEntries(tb testing.TB, r *redis.Client, zset string) []ZSetEntry {
 	}
 	return entries
 }
+
+// ClusterSlotHook is a redis.Hook which fails scripts with a CROSSSLOT error
+// if their keys hash to different slots, as Redis Cluster does.
+//
+// Add it to a client connected to a single redis server to check that
+// scripts can run in Redis Cluster.
+type ClusterSlotHook struct{}
+
+// BeforeProcess checks the keys of EVAL and EVALSHA commands.
+func (ClusterSlotHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, checkSlots(cmd)
+}
+
+// AfterProcess implements redis.Hook.
+func (ClusterSlotHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+// BeforeProcessPipeline checks the keys of EVAL and EVALSHA commands in the pipeline.
+func (ClusterSlotHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	for _, cmd := range cmds {
+		if err := checkSlots(cmd); err != nil {
+			return ctx, err
+		}
+	}
+	return ctx, nil
+}
+
+// AfterProcessPipeline implements redis.Hook.
+func (ClusterSlotHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func checkSlots(cmd redis.Cmder) error {
+	name := strings.ToLower(cmd.Name())
+	if name != "eval" && name != "evalsha" {
+		return nil
+	}
+	args := cmd.Args()
+	n, ok := args[2].(int)
+	if !ok {
+		return nil
+	}
+	for i := 1; i < n; i++ {
+		k0, ki := fmt.Sprint(args[3]), fmt.Sprint(args[3+i])
+		if clusterSlot(k0) != clusterSlot(ki) {
+			return fmt.Errorf("CROSSSLOT Keys in request don't hash to the same slot: %q and %q", k0, ki)
+		}
+	}
+	return nil
+}
+
+// clusterSlot returns the hash slot of the key in Redis Cluster.
+func clusterSlot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	var crc uint16 // CRC16-CCITT (XMODEM)
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return int(crc) % 16384
+}
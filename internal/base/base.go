@@ -7,59 +7,208 @@ package base
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/go-redis/redis/v7"
 	"github.com/rs/xid"
 )
 
 // DefaultQueueName is the queue name used if none are specified by user.
 const DefaultQueueName = "default"
 
-// Redis keys
-const (
-	AllServers      = "asynq:servers"                // ZSET
-	serversPrefix   = "asynq:servers:"               // STRING - asynq:ps:<host>:<pid>:<serverid>
-	AllWorkers      = "asynq:workers"                // ZSET
-	workersPrefix   = "asynq:workers:"               // HASH   - asynq:workers:<host:<pid>:<serverid>
-	processedPrefix = "asynq:processed:"             // STRING - asynq:processed:<yyyy-mm-dd>
-	failurePrefix   = "asynq:failure:"               // STRING - asynq:failure:<yyyy-mm-dd>
-	QueuePrefix     = "asynq:queues:"                // LIST   - asynq:queues:<qname>
-	AllQueues       = "asynq:queues"                 // SET
-	DefaultQueue    = QueuePrefix + DefaultQueueName // LIST
-	ScheduledQueue  = "asynq:scheduled"              // ZSET
-	RetryQueue      = "asynq:retry"                  // ZSET
-	DeadQueue       = "asynq:dead"                   // ZSET
-	InProgressQueue = "asynq:in_progress"            // LIST
-	CancelChannel   = "asynq:cancel"                 // PubSub channel
-)
+// DefaultNamespace is the namespace used if none is specified by user.
+const DefaultNamespace = "asynq"
 
-// QueueKey returns a redis key for the given queue name.
-func QueueKey(qname string) string {
-	return QueuePrefix + strings.ToLower(qname)
+// Keys constructs redis keys and pub/sub channel names under a namespace.
+//
+// Every key is prefixed with the namespace enclosed in curly braces
+// (e.g. "{asynq}:queues:default"), so that independent applications sharing
+// one redis database do not see each other's data, and all keys in
+// a namespace share the same hash tag. Sharing the hash tag places the keys
+// in the same hash slot when running against redis cluster, which allows lua
+// scripts to operate on multiple keys atomically.
+type Keys struct {
+	ns     string
+	prefix string
 }
 
-// ProcessedKey returns a redis key for processed count for the given day.
-func ProcessedKey(t time.Time) string {
-	return processedPrefix + t.UTC().Format("2006-01-02")
+// NewKeys returns Keys for the given namespace.
+// If ns is empty, DefaultNamespace is used.
+func NewKeys(ns string) Keys {
+	if ns == "" {
+		ns = DefaultNamespace
+	}
+	return Keys{ns: ns, prefix: "{" + ns + "}:"}
 }
 
-// FailureKey returns a redis key for failure count for the given day.
-func FailureKey(t time.Time) string {
-	return failurePrefix + t.UTC().Format("2006-01-02")
+// Namespace returns the namespace of the keys.
+func (k Keys) Namespace() string {
+	return k.ns
+}
+
+// Prefix returns the prefix of all keys in the namespace.
+func (k Keys) Prefix() string {
+	return k.prefix
+}
+
+// AllServers returns a redis key for the ZSET of all servers.
+func (k Keys) AllServers() string {
+	return k.prefix + "servers"
 }
 
 // ServerInfoKey returns a redis key for process info.
-func ServerInfoKey(hostname string, pid int, sid string) string {
-	return fmt.Sprintf("%s%s:%d:%s", serversPrefix, hostname, pid, sid)
+func (k Keys) ServerInfoKey(hostname string, pid int, sid string) string {
+	return fmt.Sprintf("%sservers:%s:%d:%s", k.prefix, hostname, pid, sid)
+}
+
+// AllWorkers returns a redis key for the ZSET of all workers keys.
+func (k Keys) AllWorkers() string {
+	return k.prefix + "workers"
 }
 
 // WorkersKey returns a redis key for the workers given hostname, pid, and server ID.
-func WorkersKey(hostname string, pid int, sid string) string {
-	return fmt.Sprintf("%s%s:%d:%s", workersPrefix, hostname, pid, sid)
+func (k Keys) WorkersKey(hostname string, pid int, sid string) string {
+	return fmt.Sprintf("%sworkers:%s:%d:%s", k.prefix, hostname, pid, sid)
+}
+
+// ProcessedKey returns a redis key for processed count for the given day.
+func (k Keys) ProcessedKey(t time.Time) string {
+	return k.prefix + "processed:" + t.UTC().Format("2006-01-02")
+}
+
+// FailureKey returns a redis key for failure count for the given day.
+func (k Keys) FailureKey(t time.Time) string {
+	return k.prefix + "failure:" + t.UTC().Format("2006-01-02")
+}
+
+// UniqueKey returns a redis key used for the uniqueness lock of a task
+// given its queue name, type and serialized payload.
+func (k Keys) UniqueKey(qname, tasktype, payload string) string {
+	return fmt.Sprintf("%sunique:%s:%s:%s", k.prefix, tasktype, payload, qname)
+}
+
+// AllQueues returns a redis key for the SET of all queue keys.
+func (k Keys) AllQueues() string {
+	return k.prefix + "queues"
+}
+
+// QueuePrefix returns the prefix of queue keys.
+func (k Keys) QueuePrefix() string {
+	return k.prefix + "queues:"
+}
+
+// QueueKey returns a redis key for the given queue name.
+func (k Keys) QueueKey(qname string) string {
+	return k.QueuePrefix() + strings.ToLower(qname)
+}
+
+// DefaultQueue returns a redis key for the default queue.
+func (k Keys) DefaultQueue() string {
+	return k.QueueKey(DefaultQueueName)
+}
+
+// NotificationPrefix returns the prefix of notification keys.
+func (k Keys) NotificationPrefix() string {
+	return k.prefix + "notify:"
+}
+
+// NotificationKey returns a redis key for the LIST used to notify
+// servers waiting for tasks that a task is added to the given queue.
+func (k Keys) NotificationKey(qname string) string {
+	return k.NotificationPrefix() + strings.ToLower(qname)
+}
+
+// AllStreams returns a redis key for the SET of all stream keys.
+func (k Keys) AllStreams() string {
+	return k.prefix + "streams"
+}
+
+// StreamPrefix returns the prefix of stream keys.
+func (k Keys) StreamPrefix() string {
+	return k.prefix + "streams:"
+}
+
+// StreamKey returns a redis key for the stream of the given queue name.
+func (k Keys) StreamKey(qname string) string {
+	return k.StreamPrefix() + strings.ToLower(qname)
+}
+
+// StreamEntries returns a redis key for the HASH of the stream entry IDs
+// of the tasks in streams keyed by task ID.
+func (k Keys) StreamEntries() string {
+	return k.prefix + "stream_entries"
+}
+
+// ScheduledQueue returns a redis key for the ZSET of scheduled tasks.
+func (k Keys) ScheduledQueue() string {
+	return k.prefix + "scheduled"
+}
+
+// RetryQueue returns a redis key for the ZSET of tasks to be retried.
+func (k Keys) RetryQueue() string {
+	return k.prefix + "retry"
+}
+
+// DeadQueue returns a redis key for the ZSET of dead tasks.
+func (k Keys) DeadQueue() string {
+	return k.prefix + "dead"
+}
+
+// DeadTrimLock returns a redis key for the lock held while trimming the dead queue.
+func (k Keys) DeadTrimLock() string {
+	return k.prefix + "dead:lock"
+}
+
+// DeadQueues returns a redis key for the set of names of the queues
+// which have tasks in the dead queue.
+func (k Keys) DeadQueues() string {
+	return k.prefix + "dead_queues"
+}
+
+// DeadIndexPrefix returns a prefix for the keys of the dead task indexes.
+func (k Keys) DeadIndexPrefix() string {
+	return k.prefix + "dead_index:"
+}
+
+// DeadIndexKey returns a redis key for the index of the dead tasks from
+// the given queue, a sorted set of task IDs scored by the time they died.
+// Unlike QueueKey, the queue name is not lowercased.
+func (k Keys) DeadIndexKey(qname string) string {
+	return k.DeadIndexPrefix() + qname
+}
+
+// TaskIndex returns a redis key for the HASH of task messages by task ID.
+func (k Keys) TaskIndex() string {
+	return k.prefix + "tasks"
+}
+
+// TombstoneKey returns a redis key for the tombstone of the canceled task.
+func (k Keys) TombstoneKey(id string) string {
+	return k.prefix + "canceled:" + id
+}
+
+// HistoryKey returns a redis key for the LIST of lifecycle events of the task.
+func (k Keys) HistoryKey(id string) string {
+	return k.prefix + "history:" + id
+}
+
+// InProgressQueue returns a redis key for the LIST of in-progress tasks.
+func (k Keys) InProgressQueue() string {
+	return k.prefix + "in_progress"
+}
+
+// Leases returns a redis key for the ZSET of the IDs of in-progress tasks
+// scored by the time the lease of the server processing the task expires.
+func (k Keys) Leases() string {
+	return k.prefix + "leases"
+}
+
+// CancelChannel returns the name of the pub/sub channel for cancelation messages.
+func (k Keys) CancelChannel() string {
+	return k.prefix + "cancel"
 }
 
 // TaskMessage is the internal representation of a task with additional metadata fields.
@@ -86,6 +235,10 @@ type TaskMessage struct {
 	// ErrorMsg holds the error message from the last failure.
 	ErrorMsg string
 
+	// Recovered is the number of times this task has been restored to its queue
+	// after the process running the task stopped unexpectedly.
+	Recovered int
+
 	// Timeout specifies how long a task may run.
 	// The string value should be compatible with time.Duration.ParseDuration.
 	//
@@ -103,6 +256,25 @@ type TaskMessage struct {
 	//
 	// Empty string indicates that no uniqueness lock was used.
 	UniqueKey string
+
+	// TraceParent and TraceState hold the W3C trace context of the caller
+	// which enqueued the task.
+	//
+	// Empty string indicates that the task was enqueued without trace context.
+	TraceParent string
+	TraceState  string
+
+	// ReadyAt is the time the task was first ready to be processed,
+	// i.e. when it was enqueued or scheduled to be processed, in Unix nanoseconds.
+	//
+	// Zero indicates that the time is unknown.
+	ReadyAt int64
+
+	// Headers holds metadata of the task, such as the ID of the request
+	// which enqueued the task, separately from the payload.
+	//
+	// Nil indicates that the task has no headers.
+	Headers map[string]string
 }
 
 // ServerState holds process level information.
@@ -288,6 +460,9 @@ type WorkerInfo struct {
 type Cancelations struct {
 	mu          sync.Mutex
 	cancelFuncs map[string]context.CancelFunc
+
+	// signals is the number of cancelation signals received.
+	signals uint64
 }
 
 // NewCancelations returns a Cancelations instance.
@@ -319,6 +494,30 @@ func (c *Cancelations) Get(id string) (fn context.CancelFunc, ok bool) {
 	return fn, ok
 }
 
+// Signal calls the cancel func of the task with the given id, if any,
+// and counts the signal.
+func (c *Cancelations) Signal(id string) {
+	c.mu.Lock()
+	c.signals++
+	fn, ok := c.cancelFuncs[id]
+	c.mu.Unlock()
+	if ok {
+		fn()
+	}
+}
+
+// Signals returns the number of cancelation signals received so far.
+//
+// A task dequeued before a cancelation signal may be added after the
+// signal is received, so the signal does not find its cancel func.
+// Comparing Signals before and after the cancel func is added tells
+// whether that may have happened.
+func (c *Cancelations) Signals() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.signals
+}
+
 // GetAll returns all cancel funcs.
 func (c *Cancelations) GetAll() []context.CancelFunc {
 	c.mu.Lock()
@@ -330,8 +529,197 @@ func (c *Cancelations) GetAll() []context.CancelFunc {
 	return res
 }
 
+// Errors returned by Broker implementations.
+var (
+	// ErrNoProcessableTask indicates that there are no tasks ready to be processed.
+	ErrNoProcessableTask = errors.New("no tasks are ready for processing")
+
+	// ErrTaskNotFound indicates that a task that matches the given identifier was not found.
+	ErrTaskNotFound = errors.New("could not find a task")
+
+	// ErrDuplicateTask indicates that another task with the same unique key holds the uniqueness lock.
+	ErrDuplicateTask = errors.New("task already exists")
+)
+
+// BatchDequeuer is implemented by brokers which can dequeue
+// multiple tasks in a single round trip.
+//
+// DequeueN returns up to n tasks from the given queues. It first takes up
+// to quotas[i] tasks from qnames[i] for each queue, then fills the rest of
+// the batch from the queues in order. A nil quotas takes the whole batch
+// from the queues in order.
+// Like Dequeue, it returns ErrNoProcessableTask if all of the given queues
+// are empty.
+type BatchDequeuer interface {
+	DequeueN(n int, quotas []int, qnames ...string) ([]*TaskMessage, error)
+}
+
+// Rescheduler is implemented by brokers which can move a task back to
+// the scheduled tasks without counting it as a retry.
+//
+// Reschedule moves the task from in-progress tasks to the scheduled tasks
+// without modifying the task. It does not count the task as processed or failed.
+type Rescheduler interface {
+	Reschedule(msg *TaskMessage, processAt time.Time) error
+}
+
+// Retention specifies how many dead tasks are kept and for how long.
+//
+// Non-positive values mean no limit.
+type Retention struct {
+	MaxSize int
+	MaxAge  time.Duration
+}
+
+// DeadEntry is a task in the dead queue.
+type DeadEntry struct {
+	Msg    *TaskMessage
+	DiedAt time.Time
+}
+
+// DeadTrimmer is implemented by brokers which let the server enforce
+// the retention of dead tasks instead of trimming the dead queue
+// whenever a task is killed.
+//
+// TrimDead removes dead tasks which exceed the retention limits and returns
+// the number of tasks removed. Dead tasks from the queues in perQueue are
+// subject to the limits for the queue, other tasks are subject to def.
+// Tasks to remove are passed to evict in batches before they are removed;
+// if evict returns an error, the batch is kept and TrimDead returns the error.
+type DeadTrimmer interface {
+	TrimDead(def Retention, perQueue map[string]Retention, evict func([]*DeadEntry) error) (int, error)
+}
+
+// DeadToTrim returns the entries which exceed the retention limits at now,
+// oldest first. Entries from the queues in perQueue are subject to the limits
+// for the queue, other entries are subject to def.
+// The entries must be ordered by the time the tasks died.
+func DeadToTrim(entries []*DeadEntry, def Retention, perQueue map[string]Retention, now time.Time) []*DeadEntry {
+	counts := make(map[string]int) // number of entries kept by queue; "" for entries subject to def
+	var res []*DeadEntry
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		ret, bucket := def, ""
+		if qret, ok := perQueue[e.Msg.Queue]; ok {
+			ret, bucket = qret, e.Msg.Queue
+		}
+		if (ret.MaxAge > 0 && !e.DiedAt.After(now.Add(-ret.MaxAge))) ||
+			(ret.MaxSize > 0 && counts[bucket] >= ret.MaxSize) {
+			res = append(res, e)
+			continue
+		}
+		counts[bucket]++
+	}
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
+
+// Kinds of events in the lifecycle of a task.
+const (
+	EventEnqueued    = "enqueued"
+	EventScheduled   = "scheduled"
+	EventDequeued    = "dequeued"
+	EventRetry       = "retry"
+	EventRescheduled = "rescheduled"
+	EventDead        = "dead"
+	EventDone        = "done"
+	EventCanceled    = "canceled"
+	EventEdited      = "edited"
+)
+
+// TaskEvent is an event in the lifecycle of a task.
+type TaskEvent struct {
+	// Kind is the kind of the event (e.g. "enqueued", "retry").
+	Kind string
+
+	// Time is the time the event happened.
+	Time time.Time
+
+	// Queue is the name of the queue the task belongs to.
+	Queue string
+
+	// Host, PID and ServerID identify the server which processed the task.
+	// They are empty for events recorded by clients.
+	Host     string
+	PID      int
+	ServerID string
+
+	// Attempt is the number of the attempt to process the task, starting at one.
+	Attempt int
+
+	// ErrorMsg holds the error returned by the handler.
+	ErrorMsg string
+
+	// ProcessAt is the time the task is scheduled to be processed at.
+	// It is set for "scheduled", "retry" and "rescheduled" events.
+	ProcessAt time.Time
+
+	// Fields lists the names of the fields changed by an "edited" event.
+	Fields []string
+}
+
+// HistoryRecorder is implemented by brokers which can record
+// the lifecycle history of tasks.
+//
+// RecordEvent appends the event to the history of the task with the given ID.
+// The broker keeps a bounded number of the latest events, and the history
+// expires ttl after the last event is recorded.
+type HistoryRecorder interface {
+	RecordEvent(id string, e *TaskEvent, ttl time.Duration) error
+}
+
+// Outcomes of canceling a task by ID.
+const (
+	// CancelNotFound indicates that no pending, scheduled or running task
+	// with the ID was found.
+	CancelNotFound CancelResult = iota
+
+	// CancelRemoved indicates that the task had not started and was removed.
+	CancelRemoved
+
+	// CancelRunning indicates that the task may be running and a tombstone
+	// is recorded for the task. The caller needs to publish a cancelation
+	// message to interrupt the running task.
+	CancelRunning
+)
+
+// CancelResult is the outcome of canceling a task by ID.
+type CancelResult int
+
+// Canceler is implemented by brokers which can cancel tasks by ID.
+//
+// Cancel removes the task with the given ID if it has not started yet.
+// Otherwise it records a tombstone for the task which expires after ttl,
+// so that the task is skipped if it is dequeued concurrently.
+//
+// SkipCanceled reports whether a tombstone is recorded for the dequeued task.
+// If so, the task is removed from the broker without being processed.
+type Canceler interface {
+	Cancel(id string, ttl time.Duration) (CancelResult, error)
+	SkipCanceled(msg *TaskMessage) (bool, error)
+}
+
+// Subscription is a subscription to cancelation messages published
+// by PublishCancelation.
+type Subscription interface {
+	// Channel returns a channel which receives the ID of each task to be canceled.
+	// The channel is closed when the subscription is closed.
+	Channel() <-chan string
+
+	// Close unsubscribes from cancelation messages.
+	Close() error
+}
+
 // Broker is a message broker that supports operations to manage task queues.
 //
+// Dequeue returns ErrNoProcessableTask if all of the given queues are empty.
+// Dequeue should block for a short while, e.g. a second, waiting for a task
+// before returning ErrNoProcessableTask since the server calls it in a loop.
+// EnqueueUnique and ScheduleUnique return ErrDuplicateTask if another task
+// holds the uniqueness lock.
+//
 // See rdb.RDB as a reference implementation.
 type Broker interface {
 	Enqueue(msg *TaskMessage) error
@@ -344,10 +732,11 @@ type Broker interface {
 	Retry(msg *TaskMessage, processAt time.Time, errMsg string) error
 	Kill(msg *TaskMessage, errMsg string) error
 	RequeueAll() (int64, error)
+	RecoverAll(maxRecovery int, errMsg string) (requeued, killed int64, err error)
 	CheckAndEnqueue(qnames ...string) error
 	WriteServerState(ss *ServerState, ttl time.Duration) error
 	ClearServerState(ss *ServerState) error
-	CancelationPubSub() (*redis.PubSub, error) // TODO: Need to decouple from redis to support other brokers
+	SubscribeCancelation() (Subscription, error)
 	PublishCancelation(id string) error
 	Close() error
 }
@@ -7,6 +7,7 @@ package base
 import (
 	"context"
 	"math/rand"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -16,18 +17,39 @@ import (
 	"github.com/rs/xid"
 )
 
+func TestNewKeys(t *testing.T) {
+	tests := []struct {
+		ns   string
+		want string
+	}{
+		{"", "{asynq}:queues:default"},
+		{"asynq", "{asynq}:queues:default"},
+		{"myapp", "{myapp}:queues:default"},
+	}
+
+	for _, tc := range tests {
+		got := NewKeys(tc.ns).DefaultQueue()
+		if got != tc.want {
+			t.Errorf("NewKeys(%q).DefaultQueue() = %q, want %q", tc.ns, got, tc.want)
+		}
+	}
+}
+
 func TestQueueKey(t *testing.T) {
 	tests := []struct {
+		ns    string
 		qname string
 		want  string
 	}{
-		{"custom", "asynq:queues:custom"},
+		{"asynq", "custom", "{asynq}:queues:custom"},
+		{"asynq", "Critical", "{asynq}:queues:critical"},
+		{"myapp", "custom", "{myapp}:queues:custom"},
 	}
 
 	for _, tc := range tests {
-		got := QueueKey(tc.qname)
+		got := NewKeys(tc.ns).QueueKey(tc.qname)
 		if got != tc.want {
-			t.Errorf("QueueKey(%q) = %q, want %q", tc.qname, got, tc.want)
+			t.Errorf("NewKeys(%q).QueueKey(%q) = %q, want %q", tc.ns, tc.qname, got, tc.want)
 		}
 	}
 }
@@ -37,13 +59,13 @@ func TestProcessedKey(t *testing.T) {
 		input time.Time
 		want  string
 	}{
-		{time.Date(2019, 11, 14, 10, 30, 1, 1, time.UTC), "asynq:processed:2019-11-14"},
-		{time.Date(2020, 12, 1, 1, 0, 1, 1, time.UTC), "asynq:processed:2020-12-01"},
-		{time.Date(2020, 1, 6, 15, 02, 1, 1, time.UTC), "asynq:processed:2020-01-06"},
+		{time.Date(2019, 11, 14, 10, 30, 1, 1, time.UTC), "{asynq}:processed:2019-11-14"},
+		{time.Date(2020, 12, 1, 1, 0, 1, 1, time.UTC), "{asynq}:processed:2020-12-01"},
+		{time.Date(2020, 1, 6, 15, 02, 1, 1, time.UTC), "{asynq}:processed:2020-01-06"},
 	}
 
 	for _, tc := range tests {
-		got := ProcessedKey(tc.input)
+		got := NewKeys(DefaultNamespace).ProcessedKey(tc.input)
 		if got != tc.want {
 			t.Errorf("ProcessedKey(%v) = %q, want %q", tc.input, got, tc.want)
 		}
@@ -55,13 +77,13 @@ func TestFailureKey(t *testing.T) {
 		input time.Time
 		want  string
 	}{
-		{time.Date(2019, 11, 14, 10, 30, 1, 1, time.UTC), "asynq:failure:2019-11-14"},
-		{time.Date(2020, 12, 1, 1, 0, 1, 1, time.UTC), "asynq:failure:2020-12-01"},
-		{time.Date(2020, 1, 6, 15, 02, 1, 1, time.UTC), "asynq:failure:2020-01-06"},
+		{time.Date(2019, 11, 14, 10, 30, 1, 1, time.UTC), "{asynq}:failure:2019-11-14"},
+		{time.Date(2020, 12, 1, 1, 0, 1, 1, time.UTC), "{asynq}:failure:2020-12-01"},
+		{time.Date(2020, 1, 6, 15, 02, 1, 1, time.UTC), "{asynq}:failure:2020-01-06"},
 	}
 
 	for _, tc := range tests {
-		got := FailureKey(tc.input)
+		got := NewKeys(DefaultNamespace).FailureKey(tc.input)
 		if got != tc.want {
 			t.Errorf("FailureKey(%v) = %q, want %q", tc.input, got, tc.want)
 		}
@@ -75,12 +97,12 @@ func TestServerInfoKey(t *testing.T) {
 		sid      string
 		want     string
 	}{
-		{"localhost", 9876, "server123", "asynq:servers:localhost:9876:server123"},
-		{"127.0.0.1", 1234, "server987", "asynq:servers:127.0.0.1:1234:server987"},
+		{"localhost", 9876, "server123", "{asynq}:servers:localhost:9876:server123"},
+		{"127.0.0.1", 1234, "server987", "{asynq}:servers:127.0.0.1:1234:server987"},
 	}
 
 	for _, tc := range tests {
-		got := ServerInfoKey(tc.hostname, tc.pid, tc.sid)
+		got := NewKeys(DefaultNamespace).ServerInfoKey(tc.hostname, tc.pid, tc.sid)
 		if got != tc.want {
 			t.Errorf("ServerInfoKey(%q, %d) = %q, want %q", tc.hostname, tc.pid, got, tc.want)
 		}
@@ -94,18 +116,142 @@ func TestWorkersKey(t *testing.T) {
 		sid      string
 		want     string
 	}{
-		{"localhost", 9876, "server1", "asynq:workers:localhost:9876:server1"},
-		{"127.0.0.1", 1234, "server2", "asynq:workers:127.0.0.1:1234:server2"},
+		{"localhost", 9876, "server1", "{asynq}:workers:localhost:9876:server1"},
+		{"127.0.0.1", 1234, "server2", "{asynq}:workers:127.0.0.1:1234:server2"},
 	}
 
 	for _, tc := range tests {
-		got := WorkersKey(tc.hostname, tc.pid, tc.sid)
+		got := NewKeys(DefaultNamespace).WorkersKey(tc.hostname, tc.pid, tc.sid)
 		if got != tc.want {
 			t.Errorf("WorkersKey(%q, %d) = %q, want = %q", tc.hostname, tc.pid, got, tc.want)
 		}
 	}
 }
 
+func TestUniqueKey(t *testing.T) {
+	tests := []struct {
+		ns       string
+		qname    string
+		tasktype string
+		payload  string
+		want     string
+	}{
+		{"asynq", "default", "email:send", "user_id=123", "{asynq}:unique:email:send:user_id=123:default"},
+		{"asynq", "critical", "reindex", "nil", "{asynq}:unique:reindex:nil:critical"},
+		{"myapp", "default", "email:send", "user_id=123", "{myapp}:unique:email:send:user_id=123:default"},
+	}
+
+	for _, tc := range tests {
+		got := NewKeys(tc.ns).UniqueKey(tc.qname, tc.tasktype, tc.payload)
+		if got != tc.want {
+			t.Errorf("NewKeys(%q).UniqueKey(%q, %q, %q) = %q, want %q", tc.ns, tc.qname, tc.tasktype, tc.payload, got, tc.want)
+		}
+	}
+}
+
+// Keys need to have the same hash tag to be used together in a lua script
+// when running against redis cluster.
+func TestKeysShareHashTag(t *testing.T) {
+	k := NewKeys("myapp")
+	keys := []string{
+		k.AllServers(),
+		k.AllWorkers(),
+		k.AllQueues(),
+		k.DefaultQueue(),
+		k.ScheduledQueue(),
+		k.RetryQueue(),
+		k.DeadQueue(),
+		k.DeadQueues(),
+		k.DeadIndexKey("critical"),
+		k.InProgressQueue(),
+		k.CancelChannel(),
+		k.QueueKey("critical"),
+		k.NotificationKey("critical"),
+		k.AllStreams(),
+		k.StreamKey("critical"),
+		k.StreamEntries(),
+		k.ProcessedKey(time.Now()),
+		k.FailureKey(time.Now()),
+		k.ServerInfoKey("localhost", 9876, "server1"),
+		k.WorkersKey("localhost", 9876, "server1"),
+		k.UniqueKey("default", "email:send", "user_id=123"),
+	}
+	hashTag := func(key string) string {
+		start := strings.Index(key, "{")
+		if start < 0 {
+			return key
+		}
+		end := strings.Index(key[start+1:], "}")
+		if end <= 0 {
+			return key
+		}
+		return key[start+1 : start+1+end]
+	}
+
+	want := "myapp"
+	for _, key := range keys {
+		if got := hashTag(key); got != want {
+			t.Errorf("hash tag of %q is %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestDeadToTrim(t *testing.T) {
+	now := time.Now()
+	entry := func(qname string, age time.Duration) *DeadEntry {
+		return &DeadEntry{Msg: &TaskMessage{ID: xid.New(), Type: "task", Queue: qname}, DiedAt: now.Add(-age)}
+	}
+	var (
+		e1 = entry("default", 4*time.Hour)
+		e2 = entry("critical", 3*time.Hour)
+		e3 = entry("default", 2*time.Hour)
+		e4 = entry("low", time.Hour)
+		e5 = entry("critical", time.Minute)
+	)
+	entries := []*DeadEntry{e1, e2, e3, e4, e5}
+
+	tests := []struct {
+		desc     string
+		def      Retention
+		perQueue map[string]Retention
+		want     []*DeadEntry
+	}{
+		{
+			desc: "no limits",
+			want: nil,
+		},
+		{
+			desc: "max size",
+			def:  Retention{MaxSize: 3},
+			want: []*DeadEntry{e1, e2},
+		},
+		{
+			desc: "max age",
+			def:  Retention{MaxAge: 150 * time.Minute},
+			want: []*DeadEntry{e1, e2},
+		},
+		{
+			desc:     "per-queue limits",
+			def:      Retention{MaxSize: 1},
+			perQueue: map[string]Retention{"critical": {MaxSize: 2}},
+			want:     []*DeadEntry{e1, e3},
+		},
+		{
+			desc:     "per-queue max age",
+			def:      Retention{MaxSize: 10},
+			perQueue: map[string]Retention{"critical": {MaxAge: time.Hour}},
+			want:     []*DeadEntry{e2},
+		},
+	}
+
+	for _, tc := range tests {
+		got := DeadToTrim(entries, tc.def, tc.perQueue, now)
+		if diff := cmp.Diff(tc.want, got, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("%s; DeadToTrim returned %v, want %v; (-want,+got)\n%s", tc.desc, got, tc.want, diff)
+		}
+	}
+}
+
 // Test for server state being accessed by multiple goroutines.
 // Run with -race flag to check for data race.
 func TestServerStateConcurrentAccess(t *testing.T) {
@@ -220,3 +366,18 @@ func TestCancelationsConcurrentAccess(t *testing.T) {
 		t.Errorf("(*Cancelations).GetAll() returns %d functions, want 2", len(funcs))
 	}
 }
+
+func TestCancelationsSignal(t *testing.T) {
+	c := NewCancelations()
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Add("key1", cancel)
+
+	c.Signal("key1")
+	c.Signal("key2") // not added yet
+	if ctx.Err() == nil {
+		t.Errorf("(*Cancelations).Signal(%q) did not call the cancel func", "key1")
+	}
+	if got := c.Signals(); got != 2 {
+		t.Errorf("(*Cancelations).Signals() = %d, want 2", got)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package pubsub implements in-process publish/subscribe of cancelation
+// messages for brokers which are used by a single process.
+package pubsub
+
+import (
+	"sync"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// PubSub delivers published messages to all of its subscribers.
+//
+// PubSubs are safe for concurrent use by multiple goroutines.
+type PubSub struct {
+	mu   sync.Mutex
+	subs map[*subscription]struct{}
+}
+
+// New returns a new PubSub.
+func New() *PubSub {
+	return &PubSub{subs: make(map[*subscription]struct{})}
+}
+
+// Subscribe returns a new subscription to the published messages.
+func (ps *PubSub) Subscribe() base.Subscription {
+	sub := &subscription{
+		ps:   ps,
+		ch:   make(chan string),
+		done: make(chan struct{}),
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.subs[sub] = struct{}{}
+	return sub
+}
+
+// Publish sends the message to all subscribers.
+// It blocks until each subscriber either receives the message or is closed.
+func (ps *PubSub) Publish(msg string) {
+	ps.mu.Lock()
+	var subs []*subscription
+	for sub := range ps.subs {
+		subs = append(subs, sub)
+	}
+	ps.mu.Unlock()
+	for _, sub := range subs {
+		sub.send(msg)
+	}
+}
+
+// subscription implements base.Subscription.
+type subscription struct {
+	ps *PubSub
+	ch chan string
+
+	// closed when the subscription is closed.
+	done chan struct{}
+	once sync.Once
+
+	mu     sync.Mutex // guards closed and sending to ch
+	closed bool
+}
+
+func (s *subscription) send(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.ch <- msg:
+	case <-s.done:
+	}
+}
+
+func (s *subscription) Channel() <-chan string {
+	return s.ch
+}
+
+func (s *subscription) Close() error {
+	s.ps.mu.Lock()
+	delete(s.ps.subs, s)
+	s.ps.mu.Unlock()
+
+	// Close done first to unblock a publisher holding s.mu.
+	s.once.Do(func() { close(s.done) })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPubSub(t *testing.T) {
+	ps := New()
+	sub1 := ps.Subscribe()
+	sub2 := ps.Subscribe()
+
+	var (
+		mu       sync.Mutex
+		received []string
+		wg       sync.WaitGroup
+	)
+	for _, sub := range []interface{ Channel() <-chan string }{sub1, sub2} {
+		wg.Add(1)
+		go func(ch <-chan string) {
+			defer wg.Done()
+			for msg := range ch {
+				mu.Lock()
+				received = append(received, msg)
+				mu.Unlock()
+			}
+		}(sub.Channel())
+	}
+
+	ps.Publish("one")
+	ps.Publish("two")
+	sub1.Close()
+	ps.Publish("three") // only sub2 receives the message.
+	sub2.Close()
+	ps.Publish("four") // should not block without subscribers.
+	wg.Wait()
+
+	sort.Strings(received)
+	want := []string{"one", "one", "three", "two", "two"}
+	if diff := cmp.Diff(want, received); diff != "" {
+		t.Errorf("subscribers received %v, want %v; (-want,+got)\n%s", received, want, diff)
+	}
+}
+
+func TestCloseUnblocksPublisher(t *testing.T) {
+	ps := New()
+	sub := ps.Subscribe()
+
+	done := make(chan struct{})
+	go func() {
+		ps.Publish("never received")
+		close(done)
+	}()
+
+	if err := sub.Close(); err != nil {
+		t.Fatalf("Close() = %v, want nil", err)
+	}
+	<-done
+}
@@ -33,7 +33,7 @@ func BenchmarkDone(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		b.StopTimer()
 		msg := h.NewTaskMessage("reindex", map[string]interface{}{"config": "path/to/config/file"})
-		r.LPush(base.InProgressQueue, h.MustMarshal(b, msg))
+		r.LPush(h.Keys.InProgressQueue(), h.MustMarshal(b, msg))
 		b.StartTimer()
 
 		rdb.Done(msg)
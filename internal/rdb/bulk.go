@@ -0,0 +1,361 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/spf13/cast"
+)
+
+// DefaultBatchSize is the number of tasks processed at a time by bulk
+// operations when the given batch size is not positive.
+const DefaultBatchSize = 100
+
+// TaskFilter selects tasks for bulk operations.
+// Zero value fields match any task.
+type TaskFilter struct {
+	// TypePattern is matched against the task type using the syntax
+	// of path.Match (e.g. "email:*").
+	TypePattern string
+
+	// Queue is the name of the queue the task belongs to.
+	Queue string
+
+	// ErrorContains is a substring of the last error message of the task.
+	ErrorContains string
+
+	// From and To restrict the time tasks are scheduled to be processed at
+	// for scheduled and retry tasks, and the time tasks died for dead tasks.
+	// Both ends are inclusive.
+	From, To time.Time
+
+	// Payload maps payload field names to the values the fields must have.
+	// Field values are compared in their fmt.Sprint format (e.g. "42").
+	Payload map[string]string
+}
+
+// validate reports an error if the filter is malformed.
+func (f *TaskFilter) validate() error {
+	if f.TypePattern != "" {
+		if _, err := path.Match(f.TypePattern, ""); err != nil {
+			return fmt.Errorf("invalid type pattern %q: %v", f.TypePattern, err)
+		}
+	}
+	if !f.From.IsZero() && !f.To.IsZero() && f.To.Before(f.From) {
+		return fmt.Errorf("invalid time range: %v is before %v", f.To, f.From)
+	}
+	return nil
+}
+
+// match reports whether the task message matches the filter
+// except for the time range, which is applied to scores.
+func (f *TaskFilter) match(msg *base.TaskMessage) bool {
+	if f.TypePattern != "" {
+		if ok, _ := path.Match(f.TypePattern, msg.Type); !ok {
+			return false
+		}
+	}
+	if f.Queue != "" && !strings.EqualFold(f.Queue, msg.Queue) {
+		return false
+	}
+	if f.ErrorContains != "" && !strings.Contains(msg.ErrorMsg, f.ErrorContains) {
+		return false
+	}
+	for k, want := range f.Payload {
+		v, ok := msg.Payload[k]
+		if !ok || fmt.Sprint(v) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// scoreRange returns the score range for the time range of the filter.
+func (f *TaskFilter) scoreRange() (min, max string) {
+	min, max = "-inf", "+inf"
+	if !f.From.IsZero() {
+		min = strconv.FormatInt(f.From.Unix(), 10)
+	}
+	if !f.To.IsZero() {
+		max = strconv.FormatInt(f.To.Unix(), 10)
+	}
+	return min, max
+}
+
+// zsetKey returns the key of the sorted set for the given task state.
+func (r *RDB) zsetKey(state string) (string, error) {
+	switch state {
+	case StateScheduled:
+		return r.keys.ScheduledQueue(), nil
+	case StateRetry:
+		return r.keys.RetryQueue(), nil
+	case StateDead:
+		return r.keys.DeadQueue(), nil
+	}
+	return "", fmt.Errorf("bulk operations are not supported for tasks in %q state", state)
+}
+
+// forEachMatch reads the tasks in zset with scores in the time range of the
+// filter in batches of batchSize, and calls fn with the tasks in each batch
+// which match the filter. fn returns the number of tasks it removed from zset.
+// forEachMatch returns the total number of tasks removed.
+func (r *RDB) forEachMatch(zset string, f TaskFilter, batchSize int, fn func(msgs []string, decoded []*base.TaskMessage) (int64, error)) (int64, error) {
+	if err := f.validate(); err != nil {
+		return 0, err
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	min, max := f.scoreRange()
+	var offset, total int64
+	for {
+		data, err := r.client.ZRangeByScore(zset, &redis.ZRangeBy{
+			Min:    min,
+			Max:    max,
+			Offset: offset,
+			Count:  int64(batchSize),
+		}).Result()
+		if err != nil {
+			return total, err
+		}
+		if len(data) == 0 {
+			return total, nil
+		}
+		var (
+			msgs    []string
+			decoded []*base.TaskMessage
+		)
+		for _, s := range data {
+			var msg base.TaskMessage
+			if err := json.Unmarshal([]byte(s), &msg); err != nil {
+				continue // bad data, ignore and continue
+			}
+			if f.match(&msg) {
+				msgs = append(msgs, s)
+				decoded = append(decoded, &msg)
+			}
+		}
+		var n int64
+		if len(msgs) > 0 {
+			if n, err = fn(msgs, decoded); err != nil {
+				return total, err
+			}
+		}
+		total += n
+		// Removed tasks no longer take up the range, skip the tasks kept.
+		offset += int64(len(data)) - n
+	}
+}
+
+// CountTasks returns the number of tasks in the given state which match
+// the filter. It is used to preview bulk operations.
+func (r *RDB) CountTasks(state string, f TaskFilter) (int64, error) {
+	zset, err := r.zsetKey(state)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	_, err = r.forEachMatch(zset, f, DefaultBatchSize, func(msgs []string, _ []*base.TaskMessage) (int64, error) {
+		count += int64(len(msgs))
+		return 0, nil
+	})
+	return count, err
+}
+
+// countBatchSize is the number of tasks read at a time by CountByQueue.
+const countBatchSize = 1000
+
+// CountByQueue returns the number of tasks in the given state by queue name.
+// The state should be one of in-progress, scheduled, retry and dead.
+//
+// Dead tasks are counted with the dead task indexes. Tasks in other states
+// are read countBatchSize tasks at a time, so the counts of tasks
+// which change their state while counting are approximate.
+func (r *RDB) CountByQueue(state string) (map[string]int, error) {
+	if state == StateDead {
+		sizes, err := r.syncDeadIndex()
+		if err != nil {
+			return nil, err
+		}
+		counts := make(map[string]int, len(sizes))
+		for qname, n := range sizes {
+			counts[qname] = int(n)
+		}
+		return counts, nil
+	}
+	read := func(key string, start, stop int64) ([]string, error) {
+		return r.client.ZRange(key, start, stop).Result()
+	}
+	key := r.keys.InProgressQueue()
+	if state == StateInProgress {
+		read = func(key string, start, stop int64) ([]string, error) {
+			return r.client.LRange(key, start, stop).Result()
+		}
+	} else {
+		var err error
+		if key, err = r.zsetKey(state); err != nil {
+			return nil, err
+		}
+	}
+	counts := make(map[string]int)
+	for start := int64(0); ; start += countBatchSize {
+		data, err := read(key, start, start+countBatchSize-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range data {
+			var msg base.TaskMessage
+			if err := json.Unmarshal([]byte(s), &msg); err != nil {
+				continue // bad data, ignore and continue
+			}
+			counts[msg.Queue]++
+		}
+		if len(data) < countBatchSize {
+			return counts, nil
+		}
+	}
+}
+
+// KEYS[1] -> ZSET to delete tasks from
+// KEYS[2] -> asynq:tasks
+// ARGV[1] -> dead index prefix if KEYS[1] is the dead queue, empty otherwise
+// ARGV[2:] -> List of task messages followed by their task IDs
+var deleteBatchCmd = redis.NewScript(DeadIndexScript + `
+local n = (table.getn(ARGV) - 1) / 2
+local deleted = 0
+for i = 2, n + 1 do
+	if redis.call("ZREM", KEYS[1], ARGV[i]) == 1 then
+		redis.call("HDEL", KEYS[2], ARGV[n + i])
+		unindexDead(ARGV[1], ARGV[i])
+		deleted = deleted + 1
+	end
+end
+return deleted`)
+
+// DeleteTasks deletes the tasks in the given state which match the filter,
+// batchSize tasks at a time, and returns the number of tasks deleted.
+func (r *RDB) DeleteTasks(state string, f TaskFilter, batchSize int) (int64, error) {
+	zset, err := r.zsetKey(state)
+	if err != nil {
+		return 0, err
+	}
+	return r.forEachMatch(zset, f, batchSize, func(msgs []string, decoded []*base.TaskMessage) (int64, error) {
+		args := append([]interface{}{r.deadIndexPrefix(zset)}, toInterfaces(msgs)...)
+		for _, msg := range decoded {
+			args = append(args, msg.ID.String())
+		}
+		return runBatch(deleteBatchCmd, r.client, []string{zset, r.keys.TaskIndex()}, args)
+	})
+}
+
+// KEYS[1] -> ZSET to move tasks from (e.g., retry queue)
+// KEYS[2] -> asynq:dead
+// KEYS[3] -> asynq:dead_queues
+// ARGV[1] -> current timestamp
+// ARGV[2] -> dead index prefix
+// ARGV[3:] -> List of task messages
+var killBatchCmd = redis.NewScript(DeadIndexScript + `
+local killed = 0
+for i = 3, table.getn(ARGV) do
+	if redis.call("ZREM", KEYS[1], ARGV[i]) == 1 then
+		redis.call("ZADD", KEYS[2], ARGV[1], ARGV[i])
+		indexDead(KEYS[3], ARGV[2], ARGV[i], ARGV[1])
+		killed = killed + 1
+	end
+end
+return killed`)
+
+// KillTasks moves the tasks in the given state which match the filter
+// to the dead queue, batchSize tasks at a time, and returns the number
+// of tasks moved. The state should be either scheduled or retry.
+func (r *RDB) KillTasks(state string, f TaskFilter, batchSize int) (int64, error) {
+	if state == StateDead {
+		return 0, fmt.Errorf("cannot kill tasks in %q state", state)
+	}
+	zset, err := r.zsetKey(state)
+	if err != nil {
+		return 0, err
+	}
+	return r.forEachMatch(zset, f, batchSize, func(msgs []string, _ []*base.TaskMessage) (int64, error) {
+		args := append([]interface{}{time.Now().Unix(), r.keys.DeadIndexPrefix()}, toInterfaces(msgs)...)
+		return runBatch(killBatchCmd, r.client, []string{zset, r.keys.DeadQueue(), r.keys.DeadQueues()}, args)
+	})
+}
+
+// KEYS[1] -> ZSET to move tasks from (e.g., dead queue)
+// KEYS[2] -> asynq:queues
+// KEYS[3:] -> List of (asynq:queues:<qname>, asynq:queues:<qname>:notify) pairs
+// ARGV[1] -> dead index prefix if KEYS[1] is the dead queue, empty otherwise
+// ARGV[2] -> max number of notifications
+// ARGV[3:] -> List of (task message, index of its queue key in KEYS) pairs
+var enqueueBatchCmd = redis.NewScript(DeadIndexScript + `
+local pushed = {}
+local enqueued = 0
+for i = 3, table.getn(ARGV), 2 do
+	if redis.call("ZREM", KEYS[1], ARGV[i]) == 1 then
+		unindexDead(ARGV[1], ARGV[i])
+		local k = tonumber(ARGV[i+1])
+		redis.call("LPUSH", KEYS[k], ARGV[i])
+		pushed[k] = true
+		enqueued = enqueued + 1
+	end
+end
+for k, _ in pairs(pushed) do
+	redis.call("SADD", KEYS[2], KEYS[k])
+	redis.call("LPUSH", KEYS[k+1], 1)
+	redis.call("LTRIM", KEYS[k+1], 0, ARGV[2] - 1)
+end
+return enqueued`)
+
+// EnqueueTasks moves the tasks in the given state which match the filter
+// to their queues, batchSize tasks at a time, and returns the number
+// of tasks enqueued.
+func (r *RDB) EnqueueTasks(state string, f TaskFilter, batchSize int) (int64, error) {
+	zset, err := r.zsetKey(state)
+	if err != nil {
+		return 0, err
+	}
+	return r.forEachMatch(zset, f, batchSize, func(msgs []string, decoded []*base.TaskMessage) (int64, error) {
+		keys := []string{zset, r.keys.AllQueues()}
+		idx := make(map[string]int) // queue key -> index in KEYS (1-based)
+		args := []interface{}{r.deadIndexPrefix(zset), maxNotifications}
+		for i, msg := range decoded {
+			qkey := r.keys.QueueKey(msg.Queue)
+			k, ok := idx[qkey]
+			if !ok {
+				k = len(keys) + 1
+				idx[qkey] = k
+				keys = append(keys, qkey, r.keys.NotificationKey(msg.Queue))
+			}
+			args = append(args, msgs[i], k)
+		}
+		return runBatch(enqueueBatchCmd, r.client, keys, args)
+	})
+}
+
+// runBatch runs the script which returns the number of tasks processed.
+func runBatch(script *redis.Script, c redis.UniversalClient, keys []string, args []interface{}) (int64, error) {
+	res, err := script.Run(c, keys, args...).Result()
+	if err != nil {
+		return 0, err
+	}
+	return cast.ToInt64E(res)
+}
+
+func toInterfaces(strs []string) []interface{} {
+	res := make([]interface{}, len(strs))
+	for i, s := range strs {
+		res[i] = s
+	}
+	return res
+}
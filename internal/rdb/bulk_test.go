@@ -0,0 +1,245 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestTaskFilterMatch(t *testing.T) {
+	msg := h.NewTaskMessage("email:send", map[string]interface{}{"tenant": 42.0, "to": "user@example.com"})
+	msg.Queue = "critical"
+	msg.ErrorMsg = "dial tcp: i/o timeout"
+
+	tests := []struct {
+		filter TaskFilter
+		want   bool
+	}{
+		{TaskFilter{}, true},
+		{TaskFilter{TypePattern: "email:*"}, true},
+		{TaskFilter{TypePattern: "email:send"}, true},
+		{TaskFilter{TypePattern: "email"}, false},
+		{TaskFilter{TypePattern: "sms:*"}, false},
+		{TaskFilter{Queue: "critical"}, true},
+		{TaskFilter{Queue: "default"}, false},
+		{TaskFilter{ErrorContains: "timeout"}, true},
+		{TaskFilter{ErrorContains: "refused"}, false},
+		{TaskFilter{Payload: map[string]string{"tenant": "42"}}, true},
+		{TaskFilter{Payload: map[string]string{"tenant": "42", "to": "user@example.com"}}, true},
+		{TaskFilter{Payload: map[string]string{"tenant": "43"}}, false},
+		{TaskFilter{Payload: map[string]string{"region": "us"}}, false},
+		{TaskFilter{TypePattern: "email:*", Queue: "critical", ErrorContains: "timeout"}, true},
+		{TaskFilter{TypePattern: "email:*", Queue: "low", ErrorContains: "timeout"}, false},
+	}
+
+	for _, tc := range tests {
+		if got := tc.filter.match(msg); got != tc.want {
+			t.Errorf("%+v.match(msg) = %t, want %t", tc.filter, got, tc.want)
+		}
+	}
+}
+
+func TestBulkOperations(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	newMsg := func(typename, qname, errMsg string, tenant int) *base.TaskMessage {
+		msg := h.NewTaskMessage(typename, map[string]interface{}{"tenant": float64(tenant)})
+		msg.Queue = qname
+		msg.ErrorMsg = errMsg
+		return msg
+	}
+	m1 := newMsg("email:send", "default", "i/o timeout", 42)
+	m2 := newMsg("email:send", "default", "connection refused", 42)
+	m3 := newMsg("email:digest", "low", "i/o timeout", 7)
+	m4 := newMsg("image:resize", "default", "i/o timeout", 42)
+	m5 := newMsg("email:send", "default", "i/o timeout", 7)
+	entries := []h.ZSetEntry{
+		{Msg: m1, Score: float64(now.Add(-3 * time.Hour).Unix())},
+		{Msg: m2, Score: float64(now.Add(-2 * time.Hour).Unix())},
+		{Msg: m3, Score: float64(now.Add(-1 * time.Hour).Unix())},
+		{Msg: m4, Score: float64(now.Add(-1 * time.Hour).Unix())},
+		{Msg: m5, Score: float64(now.Unix())},
+	}
+
+	tests := []struct {
+		desc   string
+		filter TaskFilter
+		want   []*base.TaskMessage // tasks matching the filter
+	}{
+		{
+			desc:   "type and error",
+			filter: TaskFilter{TypePattern: "email:*", ErrorContains: "timeout"},
+			want:   []*base.TaskMessage{m1, m3, m5},
+		},
+		{
+			desc:   "payload field",
+			filter: TaskFilter{Payload: map[string]string{"tenant": "42"}},
+			want:   []*base.TaskMessage{m1, m2, m4},
+		},
+		{
+			desc:   "queue",
+			filter: TaskFilter{Queue: "low"},
+			want:   []*base.TaskMessage{m3},
+		},
+		{
+			desc:   "time range",
+			filter: TaskFilter{From: now.Add(-150 * time.Minute), To: now.Add(-time.Minute)},
+			want:   []*base.TaskMessage{m2, m3, m4},
+		},
+		{
+			desc:   "no match",
+			filter: TaskFilter{TypePattern: "sms:*"},
+			want:   nil,
+		},
+	}
+
+	for _, tc := range tests {
+		for _, batchSize := range []int{1, 2, 100} {
+			h.FlushDB(t, r.client)
+			h.SeedDeadQueue(t, r.client, entries)
+			count, err := r.CountTasks(StateDead, tc.filter)
+			if err != nil || count != int64(len(tc.want)) {
+				t.Errorf("%s; (*RDB).CountTasks = %d, %v; want %d, nil", tc.desc, count, err, len(tc.want))
+			}
+
+			n, err := r.EnqueueTasks(StateDead, tc.filter, batchSize)
+			if err != nil || n != int64(len(tc.want)) {
+				t.Errorf("%s; (*RDB).EnqueueTasks(batch size %d) = %d, %v; want %d, nil", tc.desc, batchSize, n, err, len(tc.want))
+			}
+			var gotEnqueued []*base.TaskMessage
+			for _, qname := range []string{"default", "low"} {
+				gotEnqueued = append(gotEnqueued, h.GetEnqueuedMessages(t, r.client, qname)...)
+			}
+			if diff := cmp.Diff(tc.want, gotEnqueued, h.SortMsgOpt); diff != "" {
+				t.Errorf("%s; mismatch found in enqueued tasks with batch size %d; (-want, +got)\n%s", tc.desc, batchSize, diff)
+			}
+			if got, want := len(h.GetDeadMessages(t, r.client)), len(entries)-len(tc.want); got != want {
+				t.Errorf("%s; dead queue has %d tasks, want %d", tc.desc, got, want)
+			}
+			// servers waiting on the queues are notified.
+			for _, qname := range []string{"default", "low"} {
+				nkey := h.Keys.NotificationKey(qname)
+				queued := r.client.LLen(h.Keys.QueueKey(qname)).Val()
+				if n := r.client.LLen(nkey).Val(); (n > 0) != (queued > 0) {
+					t.Errorf("%s; %q has length %d with %d tasks in queue %q", tc.desc, nkey, n, queued, qname)
+				}
+			}
+		}
+	}
+}
+
+func TestDeleteTasks(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("email:send", map[string]interface{}{"tenant": 42.0})
+	m2 := h.NewTaskMessage("email:send", map[string]interface{}{"tenant": 7.0})
+	m3 := h.NewTaskMessage("image:resize", map[string]interface{}{"tenant": 42.0})
+	score := float64(time.Now().Add(time.Minute).Unix())
+
+	h.FlushDB(t, r.client)
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{{Msg: m1, Score: score}, {Msg: m2, Score: score}, {Msg: m3, Score: score}})
+	h.SeedTaskIndex(t, r.client, []*base.TaskMessage{m1, m2, m3})
+
+	n, err := r.DeleteTasks(StateRetry, TaskFilter{Payload: map[string]string{"tenant": "42"}}, 1)
+	if err != nil || n != 2 {
+		t.Fatalf("(*RDB).DeleteTasks = %d, %v; want 2, nil", n, err)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{m2}, h.GetRetryMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.RetryQueue(), diff)
+	}
+	wantIndex := map[string]*base.TaskMessage{m2.ID.String(): m2}
+	if diff := cmp.Diff(wantIndex, h.GetTaskIndex(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.TaskIndex(), diff)
+	}
+}
+
+func TestKillTasks(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("email:send", nil)
+	m2 := h.NewTaskMessage("image:resize", nil)
+	score := float64(time.Now().Add(time.Hour).Unix())
+
+	h.FlushDB(t, r.client)
+	h.SeedScheduledQueue(t, r.client, []h.ZSetEntry{{Msg: m1, Score: score}, {Msg: m2, Score: score}})
+
+	n, err := r.KillTasks(StateScheduled, TaskFilter{TypePattern: "email:*"}, DefaultBatchSize)
+	if err != nil || n != 1 {
+		t.Fatalf("(*RDB).KillTasks = %d, %v; want 1, nil", n, err)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{m2}, h.GetScheduledMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.ScheduledQueue(), diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{m1}, h.GetDeadMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.DeadQueue(), diff)
+	}
+
+	if _, err := r.KillTasks(StateDead, TaskFilter{}, DefaultBatchSize); err == nil {
+		t.Errorf("(*RDB).KillTasks(%q) returned nil error, want non-nil", StateDead)
+	}
+}
+
+func TestBulkOperationsInvalidFilter(t *testing.T) {
+	r := setup(t)
+	h.FlushDB(t, r.client)
+
+	tests := []struct {
+		state  string
+		filter TaskFilter
+	}{
+		{StateDead, TaskFilter{TypePattern: "email:["}},
+		{StateDead, TaskFilter{From: time.Now(), To: time.Now().Add(-time.Hour)}},
+		{StateEnqueued, TaskFilter{}},
+	}
+
+	for _, tc := range tests {
+		if _, err := r.CountTasks(tc.state, tc.filter); err == nil {
+			t.Errorf("(*RDB).CountTasks(%q, %+v) returned nil error, want non-nil", tc.state, tc.filter)
+		}
+	}
+}
+
+func TestCountByQueue(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessageWithQueue("reindex", nil, "low")
+	m3 := h.NewTaskMessageWithQueue("sync", nil, "low")
+	now := time.Now()
+	h.FlushDB(t, r.client)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{m1, m2})
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{
+		{Msg: m1, Score: float64(now.Unix())},
+		{Msg: m2, Score: float64(now.Unix())},
+		{Msg: m3, Score: float64(now.Unix())},
+	})
+	h.SeedDeadQueue(t, r.client, []h.ZSetEntry{{Msg: m3, Score: float64(now.Unix())}})
+
+	tests := []struct {
+		state string
+		want  map[string]int
+	}{
+		{StateInProgress, map[string]int{"default": 1, "low": 1}},
+		{StateRetry, map[string]int{"default": 1, "low": 2}},
+		{StateDead, map[string]int{"low": 1}},
+	}
+
+	for _, tc := range tests {
+		got, err := r.CountByQueue(tc.state)
+		if err != nil {
+			t.Errorf("(*RDB).CountByQueue(%q) returned error: %v", tc.state, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("(*RDB).CountByQueue(%q) = %v, want %v; (-want, +got)\n%s", tc.state, got, tc.want, diff)
+		}
+	}
+
+	if _, err := r.CountByQueue(StateEnqueued); err == nil {
+		t.Errorf("(*RDB).CountByQueue(%q) returned nil error, want non-nil", StateEnqueued)
+	}
+}
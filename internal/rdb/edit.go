@@ -0,0 +1,200 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/rs/xid"
+	"github.com/spf13/cast"
+)
+
+// TaskEdit describes changes to a task made by EditTask.
+// Zero value fields leave the task unchanged.
+type TaskEdit struct {
+	// Payload maps payload field names to their new values.
+	// A nil value removes the field from the payload.
+	Payload map[string]interface{}
+
+	// Queue is the name of the queue to enqueue the task to.
+	Queue string
+
+	// Retry is the new max number of retries, if not nil.
+	Retry *int
+
+	// Timeout is the new timeout of the task in the format of
+	// time.ParseDuration (e.g. "30s"), if not empty.
+	Timeout string
+}
+
+// apply changes the task message and returns the names of the fields changed.
+func (e *TaskEdit) apply(msg *base.TaskMessage) ([]string, error) {
+	var fields []string
+	if len(e.Payload) > 0 {
+		payload := make(map[string]interface{}, len(msg.Payload)+len(e.Payload))
+		for k, v := range msg.Payload {
+			payload[k] = v
+		}
+		for k, v := range e.Payload {
+			if v == nil {
+				delete(payload, k)
+			} else {
+				payload[k] = v
+			}
+		}
+		if !reflect.DeepEqual(payload, msg.Payload) {
+			msg.Payload = payload
+			fields = append(fields, "payload")
+		}
+	}
+	if qname := strings.TrimSpace(e.Queue); qname != "" && qname != msg.Queue {
+		msg.Queue = qname
+		fields = append(fields, "queue")
+	}
+	if e.Retry != nil {
+		if *e.Retry < 0 {
+			return nil, fmt.Errorf("max retry should be zero or positive: %d", *e.Retry)
+		}
+		if *e.Retry != msg.Retry {
+			msg.Retry = *e.Retry
+			fields = append(fields, "retry")
+		}
+	}
+	if e.Timeout != "" {
+		d, err := time.ParseDuration(e.Timeout)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid timeout %q", e.Timeout)
+		}
+		if d.String() != msg.Timeout {
+			msg.Timeout = d.String()
+			fields = append(fields, "timeout")
+		}
+	}
+	return fields, nil
+}
+
+// KEYS[1] -> asynq:tasks
+// KEYS[2] -> asynq:scheduled
+// KEYS[3] -> asynq:retry
+// KEYS[4] -> asynq:dead
+// KEYS[5] -> asynq:queues:<qname>
+// KEYS[6] -> asynq:queues
+// KEYS[7] -> asynq:queues:<qname>:notify
+// KEYS[8] -> asynq:history:<task_id>
+// ARGV[1] -> task ID
+// ARGV[2] -> task message to remove
+// ARGV[3] -> edited task message
+// ARGV[4] -> max number of notifications
+// ARGV[5] -> event data
+// ARGV[6] -> max number of events
+// ARGV[7] -> history expiration in seconds
+// ARGV[8] -> dead index prefix
+//
+// Returns 1 if the task is edited, 0 if the task has changed since it was read,
+// and -1 if the task is not in scheduled, retry or dead state.
+// The event is added to the history only if the history exists or ARGV[7] is positive.
+var editCmd = redis.NewScript(DeadIndexScript + `
+if redis.call("HGET", KEYS[1], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+local removed = false
+for i = 2, 4 do
+	if redis.call("ZREM", KEYS[i], ARGV[2]) == 1 then
+		if i == 4 then
+			unindexDead(ARGV[8], ARGV[2])
+		end
+		removed = true
+		break
+	end
+end
+if not removed then
+	return -1
+end
+redis.call("LPUSH", KEYS[5], ARGV[3])
+redis.call("SADD", KEYS[6], KEYS[5])
+redis.call("LPUSH", KEYS[7], 1)
+redis.call("LTRIM", KEYS[7], 0, ARGV[4] - 1)
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+local ttl = tonumber(ARGV[7])
+if ttl > 0 or redis.call("EXISTS", KEYS[8]) == 1 then
+	redis.call("RPUSH", KEYS[8], ARGV[5])
+	redis.call("LTRIM", KEYS[8], -ARGV[6], -1)
+	if ttl > 0 then
+		redis.call("EXPIRE", KEYS[8], ttl)
+	end
+end
+return 1`)
+
+// EditTask applies the edit to the scheduled, retry or dead task with
+// the given ID, and enqueues the task for processing. The task keeps its ID,
+// retry count and uniqueness lock.
+//
+// An "edited" event is added to the history of the task, which is created
+// with historyTTL if the task has no history and historyTTL is positive.
+//
+// EditTask returns the edited task message and the names of the fields changed.
+// If the task is not indexed, it returns ErrTaskNotFound.
+func (r *RDB) EditTask(id xid.ID, edit TaskEdit, historyTTL time.Duration) (*base.TaskMessage, []string, error) {
+	old, err := r.client.HGet(r.keys.TaskIndex(), id.String()).Result()
+	if err == redis.Nil {
+		return nil, nil, ErrTaskNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var msg base.TaskMessage
+	if err := json.Unmarshal([]byte(old), &msg); err != nil {
+		return nil, nil, err
+	}
+	fields, err := edit.apply(&msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	bytes, err := json.Marshal(&msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	event, err := json.Marshal(&base.TaskEvent{
+		Kind:   base.EventEdited,
+		Time:   time.Now(),
+		Queue:  msg.Queue,
+		Fields: fields,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := []string{
+		r.keys.TaskIndex(),
+		r.keys.ScheduledQueue(),
+		r.keys.RetryQueue(),
+		r.keys.DeadQueue(),
+		r.keys.QueueKey(msg.Queue),
+		r.keys.AllQueues(),
+		r.keys.NotificationKey(msg.Queue),
+		r.keys.HistoryKey(id.String()),
+	}
+	res, err := editCmd.Run(r.client, keys, id.String(), old, string(bytes),
+		maxNotifications, string(event), maxHistoryEvents, int64(historyTTL.Seconds()), r.keys.DeadIndexPrefix()).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := cast.ToInt64E(res)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch n {
+	case 0:
+		return nil, nil, fmt.Errorf("task %v was changed while editing it, try again", id)
+	case -1:
+		return nil, nil, fmt.Errorf("task %v is not in scheduled, retry or dead state", id)
+	}
+	return &msg, fields, nil
+}
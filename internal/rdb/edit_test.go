@@ -0,0 +1,214 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestEditTask(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", map[string]interface{}{"to": "invalid", "subject": "hello"})
+	t1.Retried = 25
+	t1.ErrorMsg = "invalid address"
+	t2 := h.NewTaskMessage("sync", map[string]interface{}{"user_id": 42.0})
+	t3 := h.NewTaskMessage("reindex", nil)
+	retry := 5
+	score := float64(time.Now().Unix())
+
+	tests := []struct {
+		desc        string
+		dead        []h.ZSetEntry
+		retry       []h.ZSetEntry
+		scheduled   []h.ZSetEntry
+		target      *base.TaskMessage
+		edit        TaskEdit
+		historyTTL  time.Duration
+		want        *base.TaskMessage
+		wantFields  []string
+		wantHistory bool
+	}{
+		{
+			desc:   "dead task with payload and retry edits",
+			dead:   []h.ZSetEntry{{Msg: t1, Score: score}, {Msg: t3, Score: score}},
+			target: t1,
+			edit: TaskEdit{
+				Payload: map[string]interface{}{"to": "user@example.com", "subject": nil},
+				Retry:   &retry,
+			},
+			historyTTL: time.Hour,
+			want: &base.TaskMessage{
+				ID:       t1.ID,
+				Type:     t1.Type,
+				Payload:  map[string]interface{}{"to": "user@example.com"},
+				Queue:    "default",
+				Retry:    5,
+				Retried:  25,
+				ErrorMsg: "invalid address",
+				Timeout:  t1.Timeout,
+				Deadline: t1.Deadline,
+			},
+			wantFields:  []string{"payload", "retry"},
+			wantHistory: true,
+		},
+		{
+			desc:      "retry task moved to another queue",
+			retry:     []h.ZSetEntry{{Msg: t2, Score: score}},
+			scheduled: []h.ZSetEntry{{Msg: t3, Score: score}},
+			target:    t2,
+			edit:      TaskEdit{Queue: "low", Timeout: "90s"},
+			want: &base.TaskMessage{
+				ID:       t2.ID,
+				Type:     t2.Type,
+				Payload:  t2.Payload,
+				Queue:    "low",
+				Retry:    t2.Retry,
+				Timeout:  "1m30s",
+				Deadline: t2.Deadline,
+			},
+			wantFields:  []string{"queue", "timeout"},
+			wantHistory: false, // no history and no TTL given
+		},
+		{
+			desc:        "scheduled task without changes",
+			scheduled:   []h.ZSetEntry{{Msg: t3, Score: score}},
+			target:      t3,
+			edit:        TaskEdit{},
+			historyTTL:  time.Hour,
+			want:        t3,
+			wantFields:  nil,
+			wantHistory: true,
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		h.SeedDeadQueue(t, r.client, tc.dead)
+		h.SeedRetryQueue(t, r.client, tc.retry)
+		h.SeedScheduledQueue(t, r.client, tc.scheduled)
+		var all []*base.TaskMessage
+		for _, entries := range [][]h.ZSetEntry{tc.dead, tc.retry, tc.scheduled} {
+			for _, e := range entries {
+				all = append(all, e.Msg)
+			}
+		}
+		h.SeedTaskIndex(t, r.client, all)
+
+		got, fields, err := r.EditTask(tc.target.ID, tc.edit, tc.historyTTL)
+		if err != nil {
+			t.Errorf("%s; (*RDB).EditTask returned error: %v", tc.desc, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s; (*RDB).EditTask returned %+v, want %+v; (-want, +got)\n%s", tc.desc, got, tc.want, diff)
+		}
+		if diff := cmp.Diff(tc.wantFields, fields); diff != "" {
+			t.Errorf("%s; (*RDB).EditTask returned fields %v, want %v", tc.desc, fields, tc.wantFields)
+		}
+		if diff := cmp.Diff([]*base.TaskMessage{tc.want}, h.GetEnqueuedMessages(t, r.client, tc.want.Queue)); diff != "" {
+			t.Errorf("%s; mismatch found in %q; (-want, +got)\n%s", tc.desc, h.Keys.QueueKey(tc.want.Queue), diff)
+		}
+		zsets := map[string][]*base.TaskMessage{
+			h.Keys.DeadQueue():      h.GetDeadMessages(t, r.client),
+			h.Keys.RetryQueue():     h.GetRetryMessages(t, r.client),
+			h.Keys.ScheduledQueue(): h.GetScheduledMessages(t, r.client),
+		}
+		for key, msgs := range zsets {
+			for _, msg := range msgs {
+				if msg.ID == tc.target.ID {
+					t.Errorf("%s; edited task is still in %q", tc.desc, key)
+				}
+			}
+		}
+		if diff := cmp.Diff(tc.want, h.GetTaskIndex(t, r.client)[tc.target.ID.String()]); diff != "" {
+			t.Errorf("%s; mismatch found in %q; (-want, +got)\n%s", tc.desc, h.Keys.TaskIndex(), diff)
+		}
+
+		events, err := r.History(tc.target.ID)
+		if !tc.wantHistory {
+			if err != ErrTaskNotFound {
+				t.Errorf("%s; (*RDB).History returned %v, %v; want no history", tc.desc, events, err)
+			}
+			continue
+		}
+		if err != nil || len(events) != 1 {
+			t.Errorf("%s; (*RDB).History = %v, %v; want one event", tc.desc, events, err)
+			continue
+		}
+		e := events[0]
+		if e.Kind != base.EventEdited || e.Queue != tc.want.Queue || !cmp.Equal(e.Fields, tc.wantFields) {
+			t.Errorf("%s; recorded event %+v, want %q event in queue %q with fields %v", tc.desc, e, base.EventEdited, tc.want.Queue, tc.wantFields)
+		}
+	}
+}
+
+func TestEditTaskKeepsHistoryTTL(t *testing.T) {
+	r := setup(t)
+	m := h.NewTaskMessage("send_email", nil)
+	h.FlushDB(t, r.client)
+	h.SeedDeadQueue(t, r.client, []h.ZSetEntry{{Msg: m, Score: float64(time.Now().Unix())}})
+	h.SeedTaskIndex(t, r.client, []*base.TaskMessage{m})
+	if err := r.RecordEvent(m.ID.String(), &base.TaskEvent{Kind: base.EventDead}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := r.EditTask(m.ID, TaskEdit{Queue: "low"}, 0); err != nil {
+		t.Fatalf("(*RDB).EditTask returned error: %v", err)
+	}
+	events, err := r.History(m.ID)
+	if err != nil || len(events) != 2 || events[1].Kind != base.EventEdited {
+		t.Errorf("(*RDB).History = %v, %v; want %q event appended", events, err, base.EventEdited)
+	}
+	if ttl := r.client.TTL(h.Keys.HistoryKey(m.ID.String())).Val(); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("history TTL = %v, want the TTL to be kept", ttl)
+	}
+}
+
+func TestEditTaskError(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("sync", nil)
+	m3 := h.NewTaskMessage("reindex", nil)
+	negative := -1
+
+	tests := []struct {
+		desc string
+		msg  *base.TaskMessage
+		edit TaskEdit
+	}{
+		{"enqueued task", m1, TaskEdit{}},
+		{"task not indexed", m3, TaskEdit{}},
+		{"invalid timeout", m2, TaskEdit{Timeout: "soon"}},
+		{"negative retry", m2, TaskEdit{Retry: &negative}},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m1})
+		h.SeedDeadQueue(t, r.client, []h.ZSetEntry{{Msg: m2, Score: float64(time.Now().Unix())}})
+		h.SeedTaskIndex(t, r.client, []*base.TaskMessage{m1, m2})
+
+		if _, _, err := r.EditTask(tc.msg.ID, tc.edit, time.Hour); err == nil {
+			t.Errorf("%s; (*RDB).EditTask returned nil error, want non-nil", tc.desc)
+		}
+		// tasks are unchanged.
+		if diff := cmp.Diff([]*base.TaskMessage{m1}, h.GetEnqueuedMessages(t, r.client)); diff != "" {
+			t.Errorf("%s; mismatch found in %q; (-want, +got)\n%s", tc.desc, h.Keys.DefaultQueue(), diff)
+		}
+		if diff := cmp.Diff([]*base.TaskMessage{m2}, h.GetDeadMessages(t, r.client)); diff != "" {
+			t.Errorf("%s; mismatch found in %q; (-want, +got)\n%s", tc.desc, h.Keys.DeadQueue(), diff)
+		}
+	}
+
+	h.FlushDB(t, r.client)
+	if _, _, err := r.EditTask(m3.ID, TaskEdit{}, 0); err != ErrTaskNotFound {
+		t.Errorf("(*RDB).EditTask for unknown task returned %v, want %v", err, ErrTaskNotFound)
+	}
+}
@@ -0,0 +1,338 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/rs/xid"
+)
+
+// TaskRecord is the representation of a task in exported files.
+type TaskRecord struct {
+	ID        string                 `json:"id"`
+	State     string                 `json:"state"`
+	Type      string                 `json:"type"`
+	Payload   map[string]interface{} `json:"payload"`
+	Queue     string                 `json:"queue"`
+	Retry     int                    `json:"retry"`
+	Retried   int                    `json:"retried"`
+	ErrorMsg  string                 `json:"error_msg,omitempty"`
+	Recovered int                    `json:"recovered,omitempty"`
+	Timeout   string                 `json:"timeout,omitempty"`
+	Deadline  string                 `json:"deadline,omitempty"`
+
+	Headers     map[string]string `json:"headers,omitempty"`
+	TraceParent string            `json:"trace_parent,omitempty"`
+	TraceState  string            `json:"trace_state,omitempty"`
+
+	// ReadyAt is the time the task was first ready to be processed, if known.
+	ReadyAt *time.Time `json:"ready_at,omitempty"`
+
+	// ProcessAt is set for scheduled and retry tasks.
+	ProcessAt *time.Time `json:"process_at,omitempty"`
+
+	// DiedAt is set for dead tasks.
+	DiedAt *time.Time `json:"died_at,omitempty"`
+}
+
+func newTaskRecord(msg *base.TaskMessage, state string, score float64) *TaskRecord {
+	rec := &TaskRecord{
+		ID:        msg.ID.String(),
+		State:     state,
+		Type:      msg.Type,
+		Payload:   msg.Payload,
+		Queue:     msg.Queue,
+		Retry:     msg.Retry,
+		Retried:   msg.Retried,
+		ErrorMsg:  msg.ErrorMsg,
+		Recovered: msg.Recovered,
+		Timeout:   msg.Timeout,
+		Deadline:  msg.Deadline,
+
+		Headers:     msg.Headers,
+		TraceParent: msg.TraceParent,
+		TraceState:  msg.TraceState,
+	}
+	if msg.ReadyAt != 0 {
+		readyAt := time.Unix(0, msg.ReadyAt).UTC()
+		rec.ReadyAt = &readyAt
+	}
+	t := time.Unix(int64(score), 0).UTC()
+	switch state {
+	case StateScheduled, StateRetry:
+		rec.ProcessAt = &t
+	case StateDead:
+		rec.DiedAt = &t
+	}
+	return rec
+}
+
+// ExportTasks reads the tasks in the given state, batchSize tasks at a time,
+// and passes them to fn. It returns the number of tasks exported.
+// Tasks in enqueued state are read from the given queue, oldest first.
+// For other states, tasks are read in the order of their scores and
+// qname filters the tasks by queue if not empty.
+//
+// Tasks are read while they may be processed, so a task which changes its
+// state during the export may be missed or exported more than once.
+func (r *RDB) ExportTasks(state, qname string, batchSize int, fn func([]*TaskRecord) error) (int64, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	if state == StateEnqueued {
+		if qname == "" {
+			return 0, fmt.Errorf("queue name is required to export enqueued tasks")
+		}
+		return r.exportList(r.keys.QueueKey(qname), batchSize, fn)
+	}
+	zset, err := r.zsetKey(state)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for start := int64(0); ; start += int64(batchSize) {
+		data, err := r.client.ZRangeWithScores(zset, start, start+int64(batchSize)-1).Result()
+		if err != nil {
+			return total, err
+		}
+		if len(data) == 0 {
+			return total, nil
+		}
+		var recs []*TaskRecord
+		for _, z := range data {
+			s, ok := z.Member.(string)
+			if !ok {
+				continue // bad data, ignore and continue
+			}
+			var msg base.TaskMessage
+			if err := json.Unmarshal([]byte(s), &msg); err != nil {
+				continue // bad data, ignore and continue
+			}
+			if qname != "" && !strings.EqualFold(msg.Queue, qname) {
+				continue
+			}
+			recs = append(recs, newTaskRecord(&msg, state, z.Score))
+		}
+		if len(recs) > 0 {
+			if err := fn(recs); err != nil {
+				return total, err
+			}
+		}
+		total += int64(len(recs))
+	}
+}
+
+// exportList reads the list from the tail, where the oldest task is.
+func (r *RDB) exportList(key string, batchSize int, fn func([]*TaskRecord) error) (int64, error) {
+	var total int64
+	for stop := int64(-1); ; stop -= int64(batchSize) {
+		data, err := r.client.LRange(key, stop-int64(batchSize)+1, stop).Result()
+		if err != nil {
+			return total, err
+		}
+		if len(data) == 0 {
+			return total, nil
+		}
+		var recs []*TaskRecord
+		for i := len(data) - 1; i >= 0; i-- {
+			var msg base.TaskMessage
+			if err := json.Unmarshal([]byte(data[i]), &msg); err != nil {
+				continue // bad data, ignore and continue
+			}
+			recs = append(recs, newTaskRecord(&msg, StateEnqueued, 0))
+		}
+		if len(recs) > 0 {
+			if err := fn(recs); err != nil {
+				return total, err
+			}
+		}
+		total += int64(len(recs))
+		if len(data) < batchSize {
+			return total, nil
+		}
+	}
+}
+
+// KEYS[1] -> asynq:tasks
+// KEYS[2] -> asynq:scheduled
+// KEYS[3] -> asynq:retry
+// KEYS[4] -> asynq:dead
+// KEYS[5] -> asynq:queues
+// KEYS[6] -> asynq:dead_queues
+// KEYS[7:] -> List of (asynq:queues:<qname>, asynq:queues:<qname>:notify) pairs
+// ARGV[1] -> dead index prefix
+// ARGV[2] -> max number of notifications
+// ARGV[3:] -> List of (task ID, task message, state, score, index of queue key in KEYS) tuples
+//
+// Tasks with an ID which is already in the index are skipped.
+var importCmd = redis.NewScript(DeadIndexScript + `
+local pushed = {}
+local imported = 0
+for i = 3, table.getn(ARGV), 5 do
+	local id, msg, state, score, k = ARGV[i], ARGV[i+1], ARGV[i+2], ARGV[i+3], tonumber(ARGV[i+4])
+	if redis.call("HSETNX", KEYS[1], id, msg) == 1 then
+		if state == "enqueued" then
+			redis.call("LPUSH", KEYS[k], msg)
+			pushed[k] = true
+		elseif state == "scheduled" then
+			redis.call("ZADD", KEYS[2], score, msg)
+		elseif state == "retry" then
+			redis.call("ZADD", KEYS[3], score, msg)
+		else
+			redis.call("ZADD", KEYS[4], score, msg)
+			indexDead(KEYS[6], ARGV[1], msg, score)
+		end
+		imported = imported + 1
+	end
+end
+for k, _ in pairs(pushed) do
+	redis.call("SADD", KEYS[5], KEYS[k])
+	redis.call("LPUSH", KEYS[k+1], 1)
+	redis.call("LTRIM", KEYS[k+1], 0, ARGV[2] - 1)
+end
+return imported`)
+
+// ImportTasks adds the tasks to their recorded states and returns the number
+// of tasks imported. Tasks with an ID of a task which already exists are skipped.
+// If regenerateIDs is true, each task is given a new ID instead.
+//
+// Tasks in the list are added in order, so enqueued tasks exported
+// by ExportTasks are processed in the same order as before.
+// Uniqueness locks are not imported.
+func (r *RDB) ImportTasks(recs []*TaskRecord, regenerateIDs bool) (int64, error) {
+	if len(recs) == 0 {
+		return 0, nil
+	}
+	keys := []string{
+		r.keys.TaskIndex(),
+		r.keys.ScheduledQueue(),
+		r.keys.RetryQueue(),
+		r.keys.DeadQueue(),
+		r.keys.AllQueues(),
+		r.keys.DeadQueues(),
+	}
+	idx := make(map[string]int) // queue name -> index of queue key in KEYS (1-based)
+	args := []interface{}{r.keys.DeadIndexPrefix(), maxNotifications}
+	for _, rec := range recs {
+		msg, score, err := rec.toMessage(regenerateIDs)
+		if err != nil {
+			return 0, err
+		}
+		bytes, err := json.Marshal(msg)
+		if err != nil {
+			return 0, err
+		}
+		var k int
+		if rec.State == StateEnqueued {
+			var ok bool
+			if k, ok = idx[msg.Queue]; !ok {
+				k = len(keys) + 1
+				idx[msg.Queue] = k
+				keys = append(keys, r.keys.QueueKey(msg.Queue), r.keys.NotificationKey(msg.Queue))
+			}
+		}
+		args = append(args, msg.ID.String(), string(bytes), rec.State, score, k)
+	}
+	return runBatch(importCmd, r.client, keys, args)
+}
+
+// ImportTasksFrom reads the task records written as newline delimited JSON
+// from rd and imports them batchSize tasks at a time.
+// It returns the number of records read and the number of tasks imported.
+// If it returns an error, the tasks in the batches before the error are imported.
+func (r *RDB) ImportTasksFrom(rd io.Reader, regenerateIDs bool, batchSize int) (read, imported int64, err error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	dec := json.NewDecoder(bufio.NewReader(rd))
+	var batch []*TaskRecord
+	flush := func() error {
+		n, err := r.ImportTasks(batch, regenerateIDs)
+		imported += n
+		batch = batch[:0]
+		return err
+	}
+	for {
+		var rec TaskRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return read, imported, fmt.Errorf("record %d: %v", read+1, err)
+		}
+		read++
+		batch = append(batch, &rec)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return read, imported, err
+			}
+		}
+	}
+	err = flush()
+	return read, imported, err
+}
+
+// toMessage returns the task message and the score of the task in its state.
+func (rec *TaskRecord) toMessage(regenerateID bool) (*base.TaskMessage, int64, error) {
+	if rec.Type == "" {
+		return nil, 0, fmt.Errorf("task %q has no type", rec.ID)
+	}
+	var id xid.ID
+	if regenerateID {
+		id = xid.New()
+	} else {
+		var err error
+		if id, err = xid.FromString(rec.ID); err != nil {
+			return nil, 0, fmt.Errorf("task has invalid id %q", rec.ID)
+		}
+	}
+	qname := rec.Queue
+	if qname == "" {
+		qname = base.DefaultQueueName
+	}
+	var score int64
+	switch rec.State {
+	case StateEnqueued:
+	case StateScheduled, StateRetry:
+		if rec.ProcessAt == nil {
+			return nil, 0, fmt.Errorf("%s task %q has no process_at", rec.State, rec.ID)
+		}
+		score = rec.ProcessAt.Unix()
+	case StateDead:
+		score = time.Now().Unix()
+		if rec.DiedAt != nil {
+			score = rec.DiedAt.Unix()
+		}
+	default:
+		return nil, 0, fmt.Errorf("task %q has invalid state %q", rec.ID, rec.State)
+	}
+	var readyAt int64
+	if rec.ReadyAt != nil {
+		readyAt = rec.ReadyAt.UnixNano()
+	}
+	return &base.TaskMessage{
+		ID:          id,
+		Type:        rec.Type,
+		Payload:     rec.Payload,
+		Queue:       qname,
+		Retry:       rec.Retry,
+		Retried:     rec.Retried,
+		ErrorMsg:    rec.ErrorMsg,
+		Recovered:   rec.Recovered,
+		Timeout:     rec.Timeout,
+		Deadline:    rec.Deadline,
+		TraceParent: rec.TraceParent,
+		TraceState:  rec.TraceState,
+		ReadyAt:     readyAt,
+		Headers:     rec.Headers,
+	}, score, nil
+}
@@ -0,0 +1,245 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestExportTasks(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"to": "user@example.com"})
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("gen_thumbnail", nil)
+	m4 := h.NewTaskMessage("sync", nil)
+	m4.Queue = "low"
+	m4.Retried = 3
+	m4.ErrorMsg = "network error"
+	m4.Headers = map[string]string{"request_id": "abc123"}
+	m4.TraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	m4.TraceState = "congo=t61rcWkgMzE"
+	m4.ReadyAt = time.Now().Add(-2 * time.Hour).UnixNano()
+	processAt := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	diedAt := time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+
+	h.FlushDB(t, r.client)
+	// m1 is the oldest task in the queue.
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m1, m2, m3})
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{{Msg: m4, Score: float64(processAt.Unix())}})
+	h.SeedDeadQueue(t, r.client, []h.ZSetEntry{{Msg: m2, Score: float64(diedAt.Unix())}, {Msg: m4, Score: float64(diedAt.Unix())}})
+
+	record := func(msg *base.TaskMessage, state string) *TaskRecord {
+		return &TaskRecord{
+			ID:       msg.ID.String(),
+			State:    state,
+			Type:     msg.Type,
+			Payload:  msg.Payload,
+			Queue:    msg.Queue,
+			Retry:    msg.Retry,
+			Retried:  msg.Retried,
+			ErrorMsg: msg.ErrorMsg,
+
+			Headers:     msg.Headers,
+			TraceParent: msg.TraceParent,
+			TraceState:  msg.TraceState,
+		}
+	}
+	readyAt := time.Unix(0, m4.ReadyAt).UTC()
+	retry := record(m4, StateRetry)
+	retry.ReadyAt = &readyAt
+	retry.ProcessAt = &processAt
+	dead := record(m4, StateDead)
+	dead.ReadyAt = &readyAt
+	dead.DiedAt = &diedAt
+
+	tests := []struct {
+		state string
+		qname string
+		want  []*TaskRecord
+	}{
+		{
+			state: StateEnqueued,
+			qname: "default",
+			want:  []*TaskRecord{record(m1, StateEnqueued), record(m2, StateEnqueued), record(m3, StateEnqueued)},
+		},
+		{
+			state: StateRetry,
+			want:  []*TaskRecord{retry},
+		},
+		{
+			state: StateDead,
+			qname: "low",
+			want:  []*TaskRecord{dead},
+		},
+		{
+			state: StateScheduled,
+			want:  nil,
+		},
+	}
+
+	for _, tc := range tests {
+		for _, batchSize := range []int{1, 2, 100} {
+			var got []*TaskRecord
+			n, err := r.ExportTasks(tc.state, tc.qname, batchSize, func(recs []*TaskRecord) error {
+				if len(recs) > batchSize {
+					t.Errorf("batch of %d tasks exported, want at most %d", len(recs), batchSize)
+				}
+				got = append(got, recs...)
+				return nil
+			})
+			if err != nil || n != int64(len(tc.want)) {
+				t.Errorf("(*RDB).ExportTasks(%q, %q, %d) = %d, %v; want %d, nil", tc.state, tc.qname, batchSize, n, err, len(tc.want))
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("mismatch found in tasks exported by (*RDB).ExportTasks(%q, %q, %d); (-want, +got)\n%s", tc.state, tc.qname, batchSize, diff)
+			}
+		}
+	}
+
+	if _, err := r.ExportTasks(StateEnqueued, "", 10, func([]*TaskRecord) error { return nil }); err == nil {
+		t.Errorf("(*RDB).ExportTasks(%q, \"\") returned nil error, want non-nil", StateEnqueued)
+	}
+}
+
+func TestImportTasks(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"to": "user@example.com"})
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("sync", nil)
+	m3.Retried = 3
+	m3.ErrorMsg = "network error"
+	m3.Headers = map[string]string{"request_id": "abc123"}
+	m3.TraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	m3.TraceState = "congo=t61rcWkgMzE"
+	m3.ReadyAt = time.Now().Add(-2 * time.Hour).UnixNano()
+	m4 := h.NewTaskMessage("cleanup", nil)
+	m4.Queue = "low"
+	processAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	diedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	// export tasks and import them into an empty database.
+	h.FlushDB(t, r.client)
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m1, m2})
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{{Msg: m3, Score: float64(processAt.Unix())}})
+	h.SeedDeadQueue(t, r.client, []h.ZSetEntry{{Msg: m4, Score: float64(diedAt.Unix())}})
+	var recs []*TaskRecord
+	export := func(batch []*TaskRecord) error {
+		recs = append(recs, batch...)
+		return nil
+	}
+	for _, state := range []string{StateEnqueued, StateRetry, StateDead} {
+		if _, err := r.ExportTasks(state, "default", 10, export); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.ExportTasks(StateDead, "low", 10, export); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, regenerateIDs := range []bool{false, true} {
+		h.FlushDB(t, r.client)
+		n, err := r.ImportTasks(recs, regenerateIDs)
+		if err != nil || n != 4 {
+			t.Fatalf("(*RDB).ImportTasks(recs, %t) = %d, %v; want 4, nil", regenerateIDs, n, err)
+		}
+
+		var opts []cmp.Option
+		if regenerateIDs {
+			opts = append(opts, cmpopts.IgnoreFields(base.TaskMessage{}, "ID"))
+		}
+		// enqueued tasks are imported in the same order, m1 is still the oldest.
+		if diff := cmp.Diff([]*base.TaskMessage{m2, m1}, h.GetEnqueuedMessages(t, r.client), opts...); diff != "" {
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.DefaultQueue(), diff)
+		}
+		wantRetry := []h.ZSetEntry{{Msg: m3, Score: float64(processAt.Unix())}}
+		if diff := cmp.Diff(wantRetry, h.GetRetryEntries(t, r.client), opts...); diff != "" {
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.RetryQueue(), diff)
+		}
+		wantDead := []h.ZSetEntry{{Msg: m4, Score: float64(diedAt.Unix())}}
+		if diff := cmp.Diff(wantDead, h.GetDeadEntries(t, r.client), opts...); diff != "" {
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.DeadQueue(), diff)
+		}
+		if got := len(h.GetTaskIndex(t, r.client)); got != 4 {
+			t.Errorf("%q has %d tasks, want 4", h.Keys.TaskIndex(), got)
+		}
+		// servers waiting on the queue of enqueued tasks are notified.
+		if n := r.client.LLen(h.Keys.NotificationKey("default")).Val(); n != 1 {
+			t.Errorf("%q has length %d, want 1", h.Keys.NotificationKey("default"), n)
+		}
+		if n := r.client.LLen(h.Keys.NotificationKey("low")).Val(); n != 0 {
+			t.Errorf("%q has length %d, want 0", h.Keys.NotificationKey("low"), n)
+		}
+		if regenerateIDs {
+			if _, ok := h.GetTaskIndex(t, r.client)[m1.ID.String()]; ok {
+				t.Errorf("imported task has the original id %v, want a new id", m1.ID)
+			}
+		}
+	}
+
+	// tasks which already exist are skipped.
+	h.FlushDB(t, r.client)
+	if _, err := r.ImportTasks(recs, false); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.ImportTasks(recs, false); err != nil || n != 0 {
+		t.Errorf("(*RDB).ImportTasks(recs, false) again = %d, %v; want 0, nil", n, err)
+	}
+	if got := len(h.GetEnqueuedMessages(t, r.client)); got != 2 {
+		t.Errorf("%q has %d tasks, want 2", h.Keys.DefaultQueue(), got)
+	}
+}
+
+func TestImportTasksInvalidRecord(t *testing.T) {
+	r := setup(t)
+	h.FlushDB(t, r.client)
+	id := h.NewTaskMessage("", nil).ID.String()
+
+	tests := []*TaskRecord{
+		{ID: id, State: StateEnqueued, Type: ""},
+		{ID: "invalid", State: StateEnqueued, Type: "send_email"},
+		{ID: id, State: StateScheduled, Type: "send_email"},
+		{ID: id, State: StateInProgress, Type: "send_email"},
+	}
+
+	for _, rec := range tests {
+		if _, err := r.ImportTasks([]*TaskRecord{rec}, false); err == nil {
+			t.Errorf("(*RDB).ImportTasks(%+v) returned nil error, want non-nil", rec)
+		}
+	}
+}
+
+func TestImportTasksFrom(t *testing.T) {
+	r := setup(t)
+	h.FlushDB(t, r.client)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m1})
+	h.SeedTaskIndex(t, r.client, []*base.TaskMessage{m1})
+	data := `{"id":"` + m1.ID.String() + `","state":"enqueued","type":"send_email"}
+{"id":"` + m2.ID.String() + `","state":"enqueued","type":"reindex"}
+`
+
+	read, imported, err := r.ImportTasksFrom(strings.NewReader(data), false, 1)
+	if err != nil || read != 2 || imported != 1 {
+		t.Errorf("(*RDB).ImportTasksFrom() = %d, %d, %v; want 2, 1, nil", read, imported, err)
+	}
+	if got := len(h.GetEnqueuedMessages(t, r.client)); got != 2 {
+		t.Errorf("%q has %d tasks, want 2", h.Keys.DefaultQueue(), got)
+	}
+
+	// tasks in the batches before a malformed record are imported.
+	h.FlushDB(t, r.client)
+	read, imported, err = r.ImportTasksFrom(strings.NewReader(data+"{bad"), false, 2)
+	if err == nil || !strings.Contains(err.Error(), "record 3") || read != 2 || imported != 2 {
+		t.Errorf("(*RDB).ImportTasksFrom(malformed) = %d, %d, %v; want 2, 2, error for record 3", read, imported, err)
+	}
+}
@@ -7,6 +7,7 @@ package rdb
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -41,6 +42,7 @@ type EnqueuedTask struct {
 	ID      xid.ID
 	Type    string
 	Payload map[string]interface{}
+	Headers map[string]string
 	Queue   string
 }
 
@@ -49,6 +51,8 @@ type InProgressTask struct {
 	ID      xid.ID
 	Type    string
 	Payload map[string]interface{}
+	Headers map[string]string
+	Queue   string
 }
 
 // ScheduledTask is a task that's scheduled to be processed in the future.
@@ -56,6 +60,7 @@ type ScheduledTask struct {
 	ID        xid.ID
 	Type      string
 	Payload   map[string]interface{}
+	Headers   map[string]string
 	ProcessAt time.Time
 	Score     int64
 	Queue     string
@@ -66,6 +71,7 @@ type RetryTask struct {
 	ID      xid.ID
 	Type    string
 	Payload map[string]interface{}
+	Headers map[string]string
 	// TODO(hibiken): add LastFailedAt time.Time
 	ProcessAt time.Time
 	ErrorMsg  string
@@ -80,8 +86,11 @@ type DeadTask struct {
 	ID           xid.ID
 	Type         string
 	Payload      map[string]interface{}
+	Headers      map[string]string
 	LastFailedAt time.Time
 	ErrorMsg     string
+	Retried      int
+	Retry        int
 	Score        int64
 	Queue        string
 }
@@ -128,13 +137,13 @@ return res`)
 func (r *RDB) CurrentStats() (*Stats, error) {
 	now := time.Now()
 	res, err := currentStatsCmd.Run(r.client, []string{
-		base.AllQueues,
-		base.InProgressQueue,
-		base.ScheduledQueue,
-		base.RetryQueue,
-		base.DeadQueue,
-		base.ProcessedKey(now),
-		base.FailureKey(now),
+		r.keys.AllQueues(),
+		r.keys.InProgressQueue(),
+		r.keys.ScheduledQueue(),
+		r.keys.RetryQueue(),
+		r.keys.DeadQueue(),
+		r.keys.ProcessedKey(now),
+		r.keys.FailureKey(now),
 	}).Result()
 	if err != nil {
 		return nil, err
@@ -152,16 +161,16 @@ func (r *RDB) CurrentStats() (*Stats, error) {
 		val := cast.ToInt(data[i+1])
 
 		switch {
-		case strings.HasPrefix(key, base.QueuePrefix):
+		case strings.HasPrefix(key, r.keys.QueuePrefix()):
 			stats.Enqueued += val
-			stats.Queues[strings.TrimPrefix(key, base.QueuePrefix)] = val
-		case key == base.InProgressQueue:
+			stats.Queues[strings.TrimPrefix(key, r.keys.QueuePrefix())] = val
+		case key == r.keys.InProgressQueue():
 			stats.InProgress = val
-		case key == base.ScheduledQueue:
+		case key == r.keys.ScheduledQueue():
 			stats.Scheduled = val
-		case key == base.RetryQueue:
+		case key == r.keys.RetryQueue():
 			stats.Retry = val
-		case key == base.DeadQueue:
+		case key == r.keys.DeadQueue():
 			stats.Dead = val
 		case key == "processed":
 			stats.Processed = val
@@ -195,8 +204,8 @@ func (r *RDB) HistoricalStats(n int) ([]*DailyStats, error) {
 	for i := 0; i < n; i++ {
 		ts := now.Add(-time.Duration(i) * day)
 		days = append(days, ts)
-		keys = append(keys, base.ProcessedKey(ts))
-		keys = append(keys, base.FailureKey(ts))
+		keys = append(keys, r.keys.ProcessedKey(ts))
+		keys = append(keys, r.keys.FailureKey(ts))
 	}
 	res, err := historicalStatsCmd.Run(r.client, keys, len(keys)).Result()
 	if err != nil {
@@ -261,9 +270,13 @@ func (p Pagination) stop() int64 {
 
 // ListEnqueued returns enqueued tasks that are ready to be processed.
 func (r *RDB) ListEnqueued(qname string, pgn Pagination) ([]*EnqueuedTask, error) {
-	qkey := base.QueueKey(qname)
-	if !r.client.SIsMember(base.AllQueues, qkey).Val() {
-		return nil, fmt.Errorf("queue %q does not exist", qname)
+	qkey := r.keys.QueueKey(qname)
+	exists, err := r.client.SIsMember(r.keys.AllQueues(), qkey).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, &ErrQueueNotFound{qname}
 	}
 	// Note: Because we use LPUSH to redis list, we need to calculate the
 	// correct range and reverse the list to get the tasks with pagination.
@@ -285,6 +298,7 @@ func (r *RDB) ListEnqueued(qname string, pgn Pagination) ([]*EnqueuedTask, error
 			ID:      msg.ID,
 			Type:    msg.Type,
 			Payload: msg.Payload,
+			Headers: msg.Headers,
 			Queue:   msg.Queue,
 		})
 	}
@@ -297,7 +311,7 @@ func (r *RDB) ListInProgress(pgn Pagination) ([]*InProgressTask, error) {
 	// correct range and reverse the list to get the tasks with pagination.
 	stop := -pgn.start() - 1
 	start := -pgn.stop() - 1
-	data, err := r.client.LRange(base.InProgressQueue, start, stop).Result()
+	data, err := r.client.LRange(r.keys.InProgressQueue(), start, stop).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -313,6 +327,8 @@ func (r *RDB) ListInProgress(pgn Pagination) ([]*InProgressTask, error) {
 			ID:      msg.ID,
 			Type:    msg.Type,
 			Payload: msg.Payload,
+			Headers: msg.Headers,
+			Queue:   msg.Queue,
 		})
 	}
 	return tasks, nil
@@ -321,7 +337,7 @@ func (r *RDB) ListInProgress(pgn Pagination) ([]*InProgressTask, error) {
 // ListScheduled returns all tasks that are scheduled to be processed
 // in the future.
 func (r *RDB) ListScheduled(pgn Pagination) ([]*ScheduledTask, error) {
-	data, err := r.client.ZRangeWithScores(base.ScheduledQueue, pgn.start(), pgn.stop()).Result()
+	data, err := r.client.ZRangeWithScores(r.keys.ScheduledQueue(), pgn.start(), pgn.stop()).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -341,6 +357,7 @@ func (r *RDB) ListScheduled(pgn Pagination) ([]*ScheduledTask, error) {
 			ID:        msg.ID,
 			Type:      msg.Type,
 			Payload:   msg.Payload,
+			Headers:   msg.Headers,
 			Queue:     msg.Queue,
 			ProcessAt: processAt,
 			Score:     int64(z.Score),
@@ -352,7 +369,7 @@ func (r *RDB) ListScheduled(pgn Pagination) ([]*ScheduledTask, error) {
 // ListRetry returns all tasks that have failed before and willl be retried
 // in the future.
 func (r *RDB) ListRetry(pgn Pagination) ([]*RetryTask, error) {
-	data, err := r.client.ZRangeWithScores(base.RetryQueue, pgn.start(), pgn.stop()).Result()
+	data, err := r.client.ZRangeWithScores(r.keys.RetryQueue(), pgn.start(), pgn.stop()).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -372,6 +389,7 @@ func (r *RDB) ListRetry(pgn Pagination) ([]*RetryTask, error) {
 			ID:        msg.ID,
 			Type:      msg.Type,
 			Payload:   msg.Payload,
+			Headers:   msg.Headers,
 			ErrorMsg:  msg.ErrorMsg,
 			Retry:     msg.Retry,
 			Retried:   msg.Retried,
@@ -385,7 +403,7 @@ func (r *RDB) ListRetry(pgn Pagination) ([]*RetryTask, error) {
 
 // ListDead returns all tasks that have exhausted its retry limit.
 func (r *RDB) ListDead(pgn Pagination) ([]*DeadTask, error) {
-	data, err := r.client.ZRangeWithScores(base.DeadQueue, pgn.start(), pgn.stop()).Result()
+	data, err := r.client.ZRangeWithScores(r.keys.DeadQueue(), pgn.start(), pgn.stop()).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -405,7 +423,10 @@ func (r *RDB) ListDead(pgn Pagination) ([]*DeadTask, error) {
 			ID:           msg.ID,
 			Type:         msg.Type,
 			Payload:      msg.Payload,
+			Headers:      msg.Headers,
 			ErrorMsg:     msg.ErrorMsg,
+			Retried:      msg.Retried,
+			Retry:        msg.Retry,
 			Queue:        msg.Queue,
 			LastFailedAt: lastFailedAt,
 			Score:        int64(z.Score),
@@ -414,11 +435,158 @@ func (r *RDB) ListDead(pgn Pagination) ([]*DeadTask, error) {
 	return tasks, nil
 }
 
+// Task states reported by GetTask.
+const (
+	StateEnqueued   = "enqueued"
+	StateInProgress = "in_progress"
+	StateScheduled  = "scheduled"
+	StateRetry      = "retry"
+	StateDead       = "dead"
+	StateUnknown    = "unknown"
+)
+
+// TaskInfo describes a task looked up by its ID.
+type TaskInfo struct {
+	*base.TaskMessage
+
+	// State is the state of the task, one of the State constants.
+	State string
+
+	// ProcessAt is the time the task is scheduled to be processed,
+	// set only for scheduled and retry tasks.
+	ProcessAt time.Time
+
+	// LastFailedAt is the time the task was moved to the dead queue,
+	// set only for dead tasks.
+	LastFailedAt time.Time
+
+	// Score is the score of the task in the scheduled, retry or dead queue.
+	// It is zero for enqueued and in-progress tasks.
+	Score int64
+}
+
+// getTaskSearchLen is the max number of entries GetTask compares
+// from each end of a list.
+const getTaskSearchLen = 1000
+
+// KEYS[1] -> asynq:tasks
+// KEYS[2] -> asynq:scheduled
+// KEYS[3] -> asynq:retry
+// KEYS[4] -> asynq:dead
+// KEYS[5] -> asynq:in_progress
+// KEYS[6] -> asynq:leases
+// ARGV[1] -> task ID
+// ARGV[2] -> queue key prefix
+// ARGV[3] -> max number of entries to compare from each end of a list
+//
+// The index holds the message as it is stored in its current state,
+// so the sorted sets are looked up by member without scanning them.
+// In-progress tasks are found by their lease, or near the head of
+// the in-progress list for tasks without a lease.
+// The queue of the task is searched last from both ends, so that
+// a stale index entry is not reported as enqueued. If the queue is too long
+// to be searched entirely, the task is assumed to be in the middle of it.
+var getTaskCmd = redis.NewScript(`
+local msg = redis.call("HGET", KEYS[1], ARGV[1])
+if not msg then
+	return nil
+end
+local states = {"scheduled", "retry", "dead"}
+for i, state in ipairs(states) do
+	local score = redis.call("ZSCORE", KEYS[i+1], msg)
+	if score then
+		return {msg, state, score}
+	end
+end
+if redis.call("ZSCORE", KEYS[6], ARGV[1]) or redis.call("LPOS", KEYS[5], msg, "MAXLEN", ARGV[3]) then
+	return {msg, "in_progress", "0"}
+end
+local ok, decoded = pcall(cjson.decode, msg)
+if ok and type(decoded) == "table" and type(decoded["Queue"]) == "string" then
+	local qkey = ARGV[2] .. string.lower(decoded["Queue"])
+	if redis.call("LPOS", qkey, msg, "MAXLEN", ARGV[3]) or
+	   redis.call("LPOS", qkey, msg, "RANK", -1, "MAXLEN", ARGV[3]) or
+	   redis.call("LLEN", qkey) > 2 * tonumber(ARGV[3]) then
+		return {msg, "enqueued", "0"}
+	end
+end
+return {msg, "unknown", "0"}`)
+
+// GetTask returns the task with the given id in any state, looking it up
+// in the task index. If the task is not indexed, it returns ErrTaskNotFound.
+// If the task is indexed but is not in any of the queues, e.g. because it
+// is being moved between queues, its state is StateUnknown.
+//
+// GetTask reads a bounded number of list entries, so it doesn't detect
+// stale index entries of tasks from queues longer than 2*getTaskSearchLen.
+//
+// Tasks enqueued by a version without the index are not found.
+// GetTask requires redis 6.0.6 or later.
+func (r *RDB) GetTask(id xid.ID) (*TaskInfo, error) {
+	keys := []string{
+		r.keys.TaskIndex(),
+		r.keys.ScheduledQueue(),
+		r.keys.RetryQueue(),
+		r.keys.DeadQueue(),
+		r.keys.InProgressQueue(),
+		r.keys.Leases(),
+	}
+	res, err := getTaskCmd.Run(r.client, keys, id.String(), r.keys.QueuePrefix(), getTaskSearchLen).Result()
+	if err == redis.Nil {
+		return nil, ErrTaskNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	vals, err := cast.ToStringSliceE(res)
+	if err != nil || len(vals) != 3 {
+		return nil, fmt.Errorf("could not cast %v to []string", res)
+	}
+	var msg base.TaskMessage
+	if err := json.Unmarshal([]byte(vals[0]), &msg); err != nil {
+		return nil, err
+	}
+	f, err := strconv.ParseFloat(vals[2], 64)
+	if err != nil {
+		return nil, err
+	}
+	score := int64(f)
+	info := &TaskInfo{TaskMessage: &msg, State: vals[1], Score: score}
+	switch info.State {
+	case StateScheduled, StateRetry:
+		info.ProcessAt = time.Unix(score, 0)
+	case StateDead:
+		info.LastFailedAt = time.Unix(score, 0)
+	}
+	return info, nil
+}
+
+// History returns the recorded lifecycle events of the task with the given id,
+// oldest first. If no events are recorded for the task, it returns ErrTaskNotFound.
+func (r *RDB) History(id xid.ID) ([]*base.TaskEvent, error) {
+	data, err := r.client.LRange(r.keys.HistoryKey(id.String()), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrTaskNotFound
+	}
+	var events []*base.TaskEvent
+	for _, s := range data {
+		var e base.TaskEvent
+		if err := json.Unmarshal([]byte(s), &e); err != nil {
+			continue // bad data, ignore and continue
+		}
+		events = append(events, &e)
+	}
+	return events, nil
+}
+
 // EnqueueDeadTask finds a task that matches the given id and score from dead queue
 // and enqueues it for processing. If a task that matches the id and score
 // does not exist, it returns ErrTaskNotFound.
 func (r *RDB) EnqueueDeadTask(id xid.ID, score int64) error {
-	n, err := r.removeAndEnqueue(base.DeadQueue, id.String(), float64(score))
+	n, err := r.removeAndEnqueue(r.keys.DeadQueue(), id.String(), float64(score))
 	if err != nil {
 		return err
 	}
@@ -432,7 +600,7 @@ func (r *RDB) EnqueueDeadTask(id xid.ID, score int64) error {
 // and enqueues it for processing. If a task that matches the id and score
 // does not exist, it returns ErrTaskNotFound.
 func (r *RDB) EnqueueRetryTask(id xid.ID, score int64) error {
-	n, err := r.removeAndEnqueue(base.RetryQueue, id.String(), float64(score))
+	n, err := r.removeAndEnqueue(r.keys.RetryQueue(), id.String(), float64(score))
 	if err != nil {
 		return err
 	}
@@ -446,7 +614,7 @@ func (r *RDB) EnqueueRetryTask(id xid.ID, score int64) error {
 // and enqueues it for processing. If a task that matches the id and score does not
 // exist, it returns ErrTaskNotFound.
 func (r *RDB) EnqueueScheduledTask(id xid.ID, score int64) error {
-	n, err := r.removeAndEnqueue(base.ScheduledQueue, id.String(), float64(score))
+	n, err := r.removeAndEnqueue(r.keys.ScheduledQueue(), id.String(), float64(score))
 	if err != nil {
 		return err
 	}
@@ -459,36 +627,48 @@ func (r *RDB) EnqueueScheduledTask(id xid.ID, score int64) error {
 // EnqueueAllScheduledTasks enqueues all tasks from scheduled queue
 // and returns the number of tasks enqueued.
 func (r *RDB) EnqueueAllScheduledTasks() (int64, error) {
-	return r.removeAndEnqueueAll(base.ScheduledQueue)
+	return r.removeAndEnqueueAll(r.keys.ScheduledQueue())
 }
 
 // EnqueueAllRetryTasks enqueues all tasks from retry queue
 // and returns the number of tasks enqueued.
 func (r *RDB) EnqueueAllRetryTasks() (int64, error) {
-	return r.removeAndEnqueueAll(base.RetryQueue)
+	return r.removeAndEnqueueAll(r.keys.RetryQueue())
 }
 
 // EnqueueAllDeadTasks enqueues all tasks from dead queue
 // and returns the number of tasks enqueued.
 func (r *RDB) EnqueueAllDeadTasks() (int64, error) {
-	return r.removeAndEnqueueAll(base.DeadQueue)
+	return r.removeAndEnqueueAll(r.keys.DeadQueue())
 }
 
-var removeAndEnqueueCmd = redis.NewScript(`
+// KEYS[1] -> source zset (e.g. scheduled, retry or dead queue)
+// ARGV[1] -> score of the task
+// ARGV[2] -> task ID
+// ARGV[3] -> queue prefix
+// ARGV[4] -> notification key prefix
+// ARGV[5] -> max number of pending notifications
+// ARGV[6] -> dead index prefix if KEYS[1] is the dead queue, empty otherwise
+var removeAndEnqueueCmd = redis.NewScript(DeadIndexScript + `
 local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], ARGV[1], ARGV[1])
 for _, msg in ipairs(msgs) do
 	local decoded = cjson.decode(msg)
 	if decoded["ID"] == ARGV[2] then
 		local qkey = ARGV[3] .. decoded["Queue"]
+		local nkey = ARGV[4] .. decoded["Queue"]
 		redis.call("LPUSH", qkey, msg)
 		redis.call("ZREM", KEYS[1], msg)
+		unindexDead(ARGV[6], msg)
+		redis.call("LPUSH", nkey, 1)
+		redis.call("LTRIM", nkey, 0, ARGV[5] - 1)
 		return 1
 	end
 end
 return 0`)
 
 func (r *RDB) removeAndEnqueue(zset, id string, score float64) (int64, error) {
-	res, err := removeAndEnqueueCmd.Run(r.client, []string{zset}, score, id, base.QueuePrefix).Result()
+	res, err := removeAndEnqueueCmd.Run(r.client, []string{zset},
+		score, id, r.keys.QueuePrefix(), r.keys.NotificationPrefix(), maxNotifications, r.deadIndexPrefix(zset)).Result()
 	if err != nil {
 		return 0, err
 	}
@@ -499,18 +679,28 @@ func (r *RDB) removeAndEnqueue(zset, id string, score float64) (int64, error) {
 	return n, nil
 }
 
-var removeAndEnqueueAllCmd = redis.NewScript(`
+// KEYS[1] -> source zset (e.g. scheduled, retry or dead queue)
+// ARGV[1] -> queue prefix
+// ARGV[2] -> notification key prefix
+// ARGV[3] -> max number of pending notifications
+// ARGV[4] -> dead index prefix if KEYS[1] is the dead queue, empty otherwise
+var removeAndEnqueueAllCmd = redis.NewScript(DeadIndexScript + `
 local msgs = redis.call("ZRANGE", KEYS[1], 0, -1)
 for _, msg in ipairs(msgs) do
 	local decoded = cjson.decode(msg)
 	local qkey = ARGV[1] .. decoded["Queue"]
+	local nkey = ARGV[2] .. decoded["Queue"]
 	redis.call("LPUSH", qkey, msg)
 	redis.call("ZREM", KEYS[1], msg)
+	unindexDead(ARGV[4], msg)
+	redis.call("LPUSH", nkey, 1)
+	redis.call("LTRIM", nkey, 0, ARGV[3] - 1)
 end
 return table.getn(msgs)`)
 
 func (r *RDB) removeAndEnqueueAll(zset string) (int64, error) {
-	res, err := removeAndEnqueueAllCmd.Run(r.client, []string{zset}, base.QueuePrefix).Result()
+	res, err := removeAndEnqueueAllCmd.Run(r.client, []string{zset},
+		r.keys.QueuePrefix(), r.keys.NotificationPrefix(), maxNotifications, r.deadIndexPrefix(zset)).Result()
 	if err != nil {
 		return 0, err
 	}
@@ -525,7 +715,7 @@ func (r *RDB) removeAndEnqueueAll(zset string) (int64, error) {
 // and moves it to dead queue. If a task that maches the id and score does not exist,
 // it returns ErrTaskNotFound.
 func (r *RDB) KillRetryTask(id xid.ID, score int64) error {
-	n, err := r.removeAndKill(base.RetryQueue, id.String(), float64(score))
+	n, err := r.removeAndKill(r.keys.RetryQueue(), id.String(), float64(score))
 	if err != nil {
 		return err
 	}
@@ -539,7 +729,7 @@ func (r *RDB) KillRetryTask(id xid.ID, score int64) error {
 // and moves it to dead queue. If a task that maches the id and score does not exist,
 // it returns ErrTaskNotFound.
 func (r *RDB) KillScheduledTask(id xid.ID, score int64) error {
-	n, err := r.removeAndKill(base.ScheduledQueue, id.String(), float64(score))
+	n, err := r.removeAndKill(r.keys.ScheduledQueue(), id.String(), float64(score))
 	if err != nil {
 		return err
 	}
@@ -552,31 +742,30 @@ func (r *RDB) KillScheduledTask(id xid.ID, score int64) error {
 // KillAllRetryTasks moves all tasks from retry queue to dead queue and
 // returns the number of tasks that were moved.
 func (r *RDB) KillAllRetryTasks() (int64, error) {
-	return r.removeAndKillAll(base.RetryQueue)
+	return r.removeAndKillAll(r.keys.RetryQueue())
 }
 
 // KillAllScheduledTasks moves all tasks from scheduled queue to dead queue and
 // returns the number of tasks that were moved.
 func (r *RDB) KillAllScheduledTasks() (int64, error) {
-	return r.removeAndKillAll(base.ScheduledQueue)
+	return r.removeAndKillAll(r.keys.ScheduledQueue())
 }
 
 // KEYS[1] -> ZSET to move task from (e.g., retry queue)
 // KEYS[2] -> asynq:dead
+// KEYS[3] -> asynq:dead_queues
 // ARGV[1] -> score of the task to kill
 // ARGV[2] -> id of the task to kill
 // ARGV[3] -> current timestamp
-// ARGV[4] -> cutoff timestamp (e.g., 90 days ago)
-// ARGV[5] -> max number of tasks in dead queue (e.g., 100)
-var removeAndKillCmd = redis.NewScript(`
+// ARGV[4] -> dead index prefix
+var removeAndKillCmd = redis.NewScript(DeadIndexScript + `
 local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], ARGV[1], ARGV[1])
 for _, msg in ipairs(msgs) do
 	local decoded = cjson.decode(msg)
 	if decoded["ID"] == ARGV[2] then
 		redis.call("ZREM", KEYS[1], msg)
 		redis.call("ZADD", KEYS[2], ARGV[3], msg)
-		redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[4])
-		redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -ARGV[5])
+		indexDead(KEYS[3], ARGV[4], msg, ARGV[3])
 		return 1
 	end
 end
@@ -584,10 +773,9 @@ return 0`)
 
 func (r *RDB) removeAndKill(zset, id string, score float64) (int64, error) {
 	now := time.Now()
-	limit := now.AddDate(0, 0, -deadExpirationInDays).Unix() // 90 days ago
 	res, err := removeAndKillCmd.Run(r.client,
-		[]string{zset, base.DeadQueue},
-		score, id, now.Unix(), limit, maxDeadTasks).Result()
+		[]string{zset, r.keys.DeadQueue(), r.keys.DeadQueues()},
+		score, id, now.Unix(), r.keys.DeadIndexPrefix()).Result()
 	if err != nil {
 		return 0, err
 	}
@@ -600,24 +788,22 @@ func (r *RDB) removeAndKill(zset, id string, score float64) (int64, error) {
 
 // KEYS[1] -> ZSET to move task from (e.g., retry queue)
 // KEYS[2] -> asynq:dead
+// KEYS[3] -> asynq:dead_queues
 // ARGV[1] -> current timestamp
-// ARGV[2] -> cutoff timestamp (e.g., 90 days ago)
-// ARGV[3] -> max number of tasks in dead queue (e.g., 100)
-var removeAndKillAllCmd = redis.NewScript(`
+// ARGV[2] -> dead index prefix
+var removeAndKillAllCmd = redis.NewScript(DeadIndexScript + `
 local msgs = redis.call("ZRANGE", KEYS[1], 0, -1)
 for _, msg in ipairs(msgs) do
 	redis.call("ZADD", KEYS[2], ARGV[1], msg)
+	indexDead(KEYS[3], ARGV[2], msg, ARGV[1])
 	redis.call("ZREM", KEYS[1], msg)
-	redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[2])
-	redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -ARGV[3])
 end
 return table.getn(msgs)`)
 
 func (r *RDB) removeAndKillAll(zset string) (int64, error) {
 	now := time.Now()
-	limit := now.AddDate(0, 0, -deadExpirationInDays).Unix() // 90 days ago
-	res, err := removeAndKillAllCmd.Run(r.client, []string{zset, base.DeadQueue},
-		now.Unix(), limit, maxDeadTasks).Result()
+	res, err := removeAndKillAllCmd.Run(r.client, []string{zset, r.keys.DeadQueue(), r.keys.DeadQueues()},
+		now.Unix(), r.keys.DeadIndexPrefix()).Result()
 	if err != nil {
 		return 0, err
 	}
@@ -632,36 +818,43 @@ func (r *RDB) removeAndKillAll(zset string) (int64, error) {
 // and deletes it. If a task that matches the id and score does not exist,
 // it returns ErrTaskNotFound.
 func (r *RDB) DeleteDeadTask(id xid.ID, score int64) error {
-	return r.deleteTask(base.DeadQueue, id.String(), float64(score))
+	return r.deleteTask(r.keys.DeadQueue(), id.String(), float64(score))
 }
 
 // DeleteRetryTask finds a task that matches the given id and score from retry queue
 // and deletes it. If a task that matches the id and score does not exist,
 // it returns ErrTaskNotFound.
 func (r *RDB) DeleteRetryTask(id xid.ID, score int64) error {
-	return r.deleteTask(base.RetryQueue, id.String(), float64(score))
+	return r.deleteTask(r.keys.RetryQueue(), id.String(), float64(score))
 }
 
 // DeleteScheduledTask finds a task that matches the given id and score from
 // scheduled queue  and deletes it. If a task that matches the id and score
 //does not exist, it returns ErrTaskNotFound.
 func (r *RDB) DeleteScheduledTask(id xid.ID, score int64) error {
-	return r.deleteTask(base.ScheduledQueue, id.String(), float64(score))
+	return r.deleteTask(r.keys.ScheduledQueue(), id.String(), float64(score))
 }
 
-var deleteTaskCmd = redis.NewScript(`
+// KEYS[1] -> ZSET to delete the task from
+// KEYS[2] -> asynq:tasks
+// ARGV[1] -> score of the task
+// ARGV[2] -> task ID
+// ARGV[3] -> dead index prefix if KEYS[1] is the dead queue, empty otherwise
+var deleteTaskCmd = redis.NewScript(DeadIndexScript + `
 local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], ARGV[1], ARGV[1])
 for _, msg in ipairs(msgs) do
 	local decoded = cjson.decode(msg)
 	if decoded["ID"] == ARGV[2] then
 		redis.call("ZREM", KEYS[1], msg)
+		redis.call("HDEL", KEYS[2], ARGV[2])
+		unindexDead(ARGV[3], msg)
 		return 1
 	end
 end
 return 0`)
 
 func (r *RDB) deleteTask(zset, id string, score float64) error {
-	res, err := deleteTaskCmd.Run(r.client, []string{zset}, score, id).Result()
+	res, err := deleteTaskCmd.Run(r.client, []string{zset, r.keys.TaskIndex()}, score, id, r.deadIndexPrefix(zset)).Result()
 	if err != nil {
 		return err
 	}
@@ -675,19 +868,47 @@ func (r *RDB) deleteTask(zset, id string, score float64) error {
 	return nil
 }
 
-// DeleteAllDeadTasks deletes all tasks from the dead queue.
-func (r *RDB) DeleteAllDeadTasks() error {
-	return r.client.Del(base.DeadQueue).Err()
+// DeleteAllDeadTasks deletes all tasks from the dead queue,
+// and reports the number of tasks deleted.
+func (r *RDB) DeleteAllDeadTasks() (int64, error) {
+	return r.deleteAll(r.keys.DeadQueue())
 }
 
-// DeleteAllRetryTasks deletes all tasks from the dead queue.
-func (r *RDB) DeleteAllRetryTasks() error {
-	return r.client.Del(base.RetryQueue).Err()
+// DeleteAllRetryTasks deletes all tasks from the retry queue,
+// and reports the number of tasks deleted.
+func (r *RDB) DeleteAllRetryTasks() (int64, error) {
+	return r.deleteAll(r.keys.RetryQueue())
 }
 
-// DeleteAllScheduledTasks deletes all tasks from the dead queue.
-func (r *RDB) DeleteAllScheduledTasks() error {
-	return r.client.Del(base.ScheduledQueue).Err()
+// DeleteAllScheduledTasks deletes all tasks from the scheduled queue,
+// and reports the number of tasks deleted.
+func (r *RDB) DeleteAllScheduledTasks() (int64, error) {
+	return r.deleteAll(r.keys.ScheduledQueue())
+}
+
+// KEYS[1] -> ZSET to delete
+// KEYS[2] -> asynq:tasks
+// ARGV[1] -> dead index prefix if KEYS[1] is the dead queue, empty otherwise
+var deleteAllCmd = redis.NewScript(DeadIndexScript + `
+local msgs = redis.call("ZRANGE", KEYS[1], 0, -1)
+for _, msg in ipairs(msgs) do
+	local decoded = cjson.decode(msg)
+	redis.call("HDEL", KEYS[2], decoded["ID"])
+	unindexDead(ARGV[1], msg)
+end
+redis.call("DEL", KEYS[1])
+return table.getn(msgs)`)
+
+func (r *RDB) deleteAll(zset string) (int64, error) {
+	res, err := deleteAllCmd.Run(r.client, []string{zset, r.keys.TaskIndex()}, r.deadIndexPrefix(zset)).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("could not cast %v to int64", res)
+	}
+	return n, nil
 }
 
 // ErrQueueNotFound indicates specified queue does not exist.
@@ -714,6 +935,11 @@ local n = redis.call("SREM", KEYS[1], KEYS[2])
 if n == 0 then
 	return redis.error_reply("LIST NOT FOUND")
 end
+local msgs = redis.call("LRANGE", KEYS[2], 0, -1)
+for _, msg in ipairs(msgs) do
+	local decoded = cjson.decode(msg)
+	redis.call("HDEL", KEYS[3], decoded["ID"])
+end
 redis.call("DEL", KEYS[2])
 return redis.status_reply("OK")`)
 
@@ -743,7 +969,7 @@ func (r *RDB) RemoveQueue(qname string, force bool) error {
 		script = removeQueueCmd
 	}
 	err := script.Run(r.client,
-		[]string{base.AllQueues, base.QueueKey(qname)},
+		[]string{r.keys.AllQueues(), r.keys.QueueKey(qname), r.keys.TaskIndex()},
 		force).Err()
 	if err != nil {
 		switch err.Error() {
@@ -775,7 +1001,7 @@ return res`)
 // ListServers returns the list of server info.
 func (r *RDB) ListServers() ([]*base.ServerInfo, error) {
 	res, err := listServersCmd.Run(r.client,
-		[]string{base.AllServers}, time.Now().UTC().Unix()).Result()
+		[]string{r.keys.AllServers()}, time.Now().UTC().Unix()).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -811,7 +1037,7 @@ return res`)
 
 // ListWorkers returns the list of worker stats.
 func (r *RDB) ListWorkers() ([]*base.WorkerInfo, error) {
-	res, err := listWorkersCmd.Run(r.client, []string{base.AllWorkers}, time.Now().UTC().Unix()).Result()
+	res, err := listWorkersCmd.Run(r.client, []string{r.keys.AllWorkers()}, time.Now().UTC().Unix()).Result()
 	if err != nil {
 		return nil, err
 	}
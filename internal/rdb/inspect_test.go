@@ -10,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/go-redis/redis/v7"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	h "github.com/hibiken/asynq/internal/asynqtest"
@@ -54,7 +55,7 @@ func TestCurrentStats(t *testing.T) {
 			dead:      []h.ZSetEntry{},
 			processed: 120,
 			failed:    2,
-			allQueues: []interface{}{base.DefaultQueue, base.QueueKey("critical"), base.QueueKey("low")},
+			allQueues: []interface{}{h.Keys.DefaultQueue(), h.Keys.QueueKey("critical"), h.Keys.QueueKey("low")},
 			want: &Stats{
 				Enqueued:   3,
 				InProgress: 1,
@@ -81,7 +82,7 @@ func TestCurrentStats(t *testing.T) {
 				{Msg: m2, Score: float64(now.Add(-time.Hour).Unix())}},
 			processed: 90,
 			failed:    10,
-			allQueues: []interface{}{base.DefaultQueue},
+			allQueues: []interface{}{h.Keys.DefaultQueue()},
 			want: &Stats{
 				Enqueued:   0,
 				InProgress: 0,
@@ -105,11 +106,11 @@ func TestCurrentStats(t *testing.T) {
 		h.SeedScheduledQueue(t, r.client, tc.scheduled)
 		h.SeedRetryQueue(t, r.client, tc.retry)
 		h.SeedDeadQueue(t, r.client, tc.dead)
-		processedKey := base.ProcessedKey(now)
-		failedKey := base.FailureKey(now)
+		processedKey := h.Keys.ProcessedKey(now)
+		failedKey := h.Keys.FailureKey(now)
 		r.client.Set(processedKey, tc.processed, 0)
 		r.client.Set(failedKey, tc.failed, 0)
-		r.client.SAdd(base.AllQueues, tc.allQueues...)
+		r.client.SAdd(h.Keys.AllQueues(), tc.allQueues...)
 
 		got, err := r.CurrentStats()
 		if err != nil {
@@ -167,8 +168,8 @@ func TestHistoricalStats(t *testing.T) {
 		// populate last n days data
 		for i := 0; i < tc.n; i++ {
 			ts := now.Add(-time.Duration(i) * 24 * time.Hour)
-			processedKey := base.ProcessedKey(ts)
-			failedKey := base.FailureKey(ts)
+			processedKey := h.Keys.ProcessedKey(ts)
+			failedKey := h.Keys.FailureKey(ts)
 			r.client.Set(processedKey, (i+1)*1000, 0)
 			r.client.Set(failedKey, (i+1)*10, 0)
 		}
@@ -226,10 +227,11 @@ func TestListEnqueued(t *testing.T) {
 	r := setup(t)
 
 	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "hello"})
+	m1.Headers = map[string]string{"request_id": "abc123"}
 	m2 := h.NewTaskMessage("reindex", nil)
 	m3 := h.NewTaskMessageWithQueue("important_notification", nil, "critical")
 	m4 := h.NewTaskMessageWithQueue("minor_notification", nil, "low")
-	t1 := &EnqueuedTask{ID: m1.ID, Type: m1.Type, Payload: m1.Payload, Queue: m1.Queue}
+	t1 := &EnqueuedTask{ID: m1.ID, Type: m1.Type, Payload: m1.Payload, Headers: m1.Headers, Queue: m1.Queue}
 	t2 := &EnqueuedTask{ID: m2.ID, Type: m2.Type, Payload: m2.Payload, Queue: m2.Queue}
 	t3 := &EnqueuedTask{ID: m3.ID, Type: m3.Type, Payload: m3.Payload, Queue: m3.Queue}
 	tests := []struct {
@@ -367,8 +369,8 @@ func TestListInProgress(t *testing.T) {
 
 	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "hello"})
 	m2 := h.NewTaskMessage("reindex", nil)
-	t1 := &InProgressTask{ID: m1.ID, Type: m1.Type, Payload: m1.Payload}
-	t2 := &InProgressTask{ID: m2.ID, Type: m2.Type, Payload: m2.Payload}
+	t1 := &InProgressTask{ID: m1.ID, Type: m1.Type, Payload: m1.Payload, Queue: m1.Queue}
+	t2 := &InProgressTask{ID: m2.ID, Type: m2.Type, Payload: m2.Payload, Queue: m2.Queue}
 	tests := []struct {
 		inProgress []*base.TaskMessage
 		want       []*InProgressTask
@@ -719,6 +721,8 @@ func TestListDead(t *testing.T) {
 		Queue:    "default",
 		Payload:  map[string]interface{}{"subject": "hello"},
 		ErrorMsg: "email server not responding",
+		Retry:    25,
+		Retried:  25,
 	}
 	m2 := &base.TaskMessage{
 		ID:       xid.New(),
@@ -735,6 +739,8 @@ func TestListDead(t *testing.T) {
 		Payload:      m1.Payload,
 		LastFailedAt: f1,
 		ErrorMsg:     m1.ErrorMsg,
+		Retried:      m1.Retried,
+		Retry:        m1.Retry,
 		Score:        f1.Unix(),
 		Queue:        m1.Queue,
 	}
@@ -919,13 +925,13 @@ func TestEnqueueDeadTask(t *testing.T) {
 		for qname, want := range tc.wantEnqueued {
 			gotEnqueued := h.GetEnqueuedMessages(t, r.client, qname)
 			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
-				t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.QueueKey(qname), diff)
+				t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.QueueKey(qname), diff)
 			}
 		}
 
 		gotDead := h.GetDeadMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q, (-want, +got)\n%s", base.DeadQueue, diff)
+			t.Errorf("mismatch found in %q, (-want, +got)\n%s", h.Keys.DeadQueue(), diff)
 		}
 	}
 }
@@ -1003,13 +1009,13 @@ func TestEnqueueRetryTask(t *testing.T) {
 		for qname, want := range tc.wantEnqueued {
 			gotEnqueued := h.GetEnqueuedMessages(t, r.client, qname)
 			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
-				t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.QueueKey(qname), diff)
+				t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.QueueKey(qname), diff)
 			}
 		}
 
 		gotRetry := h.GetRetryMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q, (-want, +got)\n%s", base.RetryQueue, diff)
+			t.Errorf("mismatch found in %q, (-want, +got)\n%s", h.Keys.RetryQueue(), diff)
 		}
 	}
 }
@@ -1087,13 +1093,13 @@ func TestEnqueueScheduledTask(t *testing.T) {
 		for qname, want := range tc.wantEnqueued {
 			gotEnqueued := h.GetEnqueuedMessages(t, r.client, qname)
 			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
-				t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.QueueKey(qname), diff)
+				t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.QueueKey(qname), diff)
 			}
 		}
 
 		gotScheduled := h.GetScheduledMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q, (-want, +got)\n%s", base.ScheduledQueue, diff)
+			t.Errorf("mismatch found in %q, (-want, +got)\n%s", h.Keys.ScheduledQueue(), diff)
 		}
 	}
 }
@@ -1171,7 +1177,7 @@ func TestEnqueueAllScheduledTasks(t *testing.T) {
 		for qname, want := range tc.wantEnqueued {
 			gotEnqueued := h.GetEnqueuedMessages(t, r.client, qname)
 			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
-				t.Errorf("%s; mismatch found in %q; (-want, +got)\n%s", tc.desc, base.QueueKey(qname), diff)
+				t.Errorf("%s; mismatch found in %q; (-want, +got)\n%s", tc.desc, h.Keys.QueueKey(qname), diff)
 			}
 		}
 	}
@@ -1250,7 +1256,7 @@ func TestEnqueueAllRetryTasks(t *testing.T) {
 		for qname, want := range tc.wantEnqueued {
 			gotEnqueued := h.GetEnqueuedMessages(t, r.client, qname)
 			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
-				t.Errorf("%s; mismatch found in %q; (-want, +got)\n%s", tc.desc, base.QueueKey(qname), diff)
+				t.Errorf("%s; mismatch found in %q; (-want, +got)\n%s", tc.desc, h.Keys.QueueKey(qname), diff)
 			}
 		}
 	}
@@ -1329,7 +1335,7 @@ func TestEnqueueAllDeadTasks(t *testing.T) {
 		for qname, want := range tc.wantEnqueued {
 			gotEnqueued := h.GetEnqueuedMessages(t, r.client, qname)
 			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
-				t.Errorf("%s; mismatch found in %q; (-want, +got)\n%s", tc.desc, base.QueueKey(qname), diff)
+				t.Errorf("%s; mismatch found in %q; (-want, +got)\n%s", tc.desc, h.Keys.QueueKey(qname), diff)
 			}
 		}
 	}
@@ -1401,13 +1407,13 @@ func TestKillRetryTask(t *testing.T) {
 		gotRetry := h.GetRetryEntries(t, r.client)
 		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortZSetEntryOpt, timeCmpOpt); diff != "" {
 			t.Errorf("mismatch found in %q; (-want,+got)\n%s",
-				base.RetryQueue, diff)
+				h.Keys.RetryQueue(), diff)
 		}
 
 		gotDead := h.GetDeadEntries(t, r.client)
 		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortZSetEntryOpt, timeCmpOpt); diff != "" {
 			t.Errorf("mismatch found in %q; (-want,+got)\n%s",
-				base.DeadQueue, diff)
+				h.Keys.DeadQueue(), diff)
 		}
 	}
 }
@@ -1478,13 +1484,13 @@ func TestKillScheduledTask(t *testing.T) {
 		gotScheduled := h.GetScheduledEntries(t, r.client)
 		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.SortZSetEntryOpt, timeCmpOpt); diff != "" {
 			t.Errorf("mismatch found in %q; (-want,+got)\n%s",
-				base.ScheduledQueue, diff)
+				h.Keys.ScheduledQueue(), diff)
 		}
 
 		gotDead := h.GetDeadEntries(t, r.client)
 		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortZSetEntryOpt, timeCmpOpt); diff != "" {
 			t.Errorf("mismatch found in %q; (-want,+got)\n%s",
-				base.DeadQueue, diff)
+				h.Keys.DeadQueue(), diff)
 		}
 	}
 }
@@ -1560,13 +1566,13 @@ func TestKillAllRetryTasks(t *testing.T) {
 		gotRetry := h.GetRetryEntries(t, r.client)
 		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortZSetEntryOpt, timeCmpOpt); diff != "" {
 			t.Errorf("mismatch found in %q; (-want,+got)\n%s",
-				base.RetryQueue, diff)
+				h.Keys.RetryQueue(), diff)
 		}
 
 		gotDead := h.GetDeadEntries(t, r.client)
 		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortZSetEntryOpt, timeCmpOpt); diff != "" {
 			t.Errorf("mismatch found in %q; (-want,+got)\n%s",
-				base.DeadQueue, diff)
+				h.Keys.DeadQueue(), diff)
 		}
 	}
 }
@@ -1642,13 +1648,13 @@ func TestKillAllScheduledTasks(t *testing.T) {
 		gotScheduled := h.GetScheduledEntries(t, r.client)
 		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.SortZSetEntryOpt, timeCmpOpt); diff != "" {
 			t.Errorf("mismatch found in %q; (-want,+got)\n%s",
-				base.ScheduledQueue, diff)
+				h.Keys.ScheduledQueue(), diff)
 		}
 
 		gotDead := h.GetDeadEntries(t, r.client)
 		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortZSetEntryOpt, timeCmpOpt); diff != "" {
 			t.Errorf("mismatch found in %q; (-want,+got)\n%s",
-				base.DeadQueue, diff)
+				h.Keys.DeadQueue(), diff)
 		}
 	}
 }
@@ -1708,7 +1714,7 @@ func TestDeleteDeadTask(t *testing.T) {
 
 		gotDead := h.GetDeadMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.DeadQueue, diff)
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.DeadQueue(), diff)
 		}
 	}
 }
@@ -1760,7 +1766,7 @@ func TestDeleteRetryTask(t *testing.T) {
 
 		gotRetry := h.GetRetryMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.RetryQueue, diff)
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.RetryQueue(), diff)
 		}
 	}
 }
@@ -1812,7 +1818,7 @@ func TestDeleteScheduledTask(t *testing.T) {
 
 		gotScheduled := h.GetScheduledMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.ScheduledQueue, diff)
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.ScheduledQueue(), diff)
 		}
 	}
 }
@@ -1841,14 +1847,17 @@ func TestDeleteAllDeadTasks(t *testing.T) {
 		h.FlushDB(t, r.client) // clean up db before each test case
 		h.SeedDeadQueue(t, r.client, tc.dead)
 
-		err := r.DeleteAllDeadTasks()
+		n, err := r.DeleteAllDeadTasks()
 		if err != nil {
 			t.Errorf("r.DeleteAllDeaadTasks = %v, want nil", err)
 		}
+		if want := int64(len(tc.dead)); n != want {
+			t.Errorf("r.DeleteAllDeadTasks deleted %d tasks, want %d", n, want)
+		}
 
 		gotDead := h.GetDeadMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.DeadQueue, diff)
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.DeadQueue(), diff)
 		}
 	}
 }
@@ -1877,14 +1886,17 @@ func TestDeleteAllRetryTasks(t *testing.T) {
 		h.FlushDB(t, r.client) // clean up db before each test case
 		h.SeedRetryQueue(t, r.client, tc.retry)
 
-		err := r.DeleteAllRetryTasks()
+		n, err := r.DeleteAllRetryTasks()
 		if err != nil {
 			t.Errorf("r.DeleteAllDeaadTasks = %v, want nil", err)
 		}
+		if want := int64(len(tc.retry)); n != want {
+			t.Errorf("r.DeleteAllRetryTasks deleted %d tasks, want %d", n, want)
+		}
 
 		gotRetry := h.GetRetryMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.RetryQueue, diff)
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.RetryQueue(), diff)
 		}
 	}
 }
@@ -1913,18 +1925,176 @@ func TestDeleteAllScheduledTasks(t *testing.T) {
 		h.FlushDB(t, r.client) // clean up db before each test case
 		h.SeedScheduledQueue(t, r.client, tc.scheduled)
 
-		err := r.DeleteAllScheduledTasks()
+		n, err := r.DeleteAllScheduledTasks()
 		if err != nil {
 			t.Errorf("r.DeleteAllDeaadTasks = %v, want nil", err)
 		}
+		if want := int64(len(tc.scheduled)); n != want {
+			t.Errorf("r.DeleteAllScheduledTasks deleted %d tasks, want %d", n, want)
+		}
 
 		gotScheduled := h.GetScheduledMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.ScheduledQueue, diff)
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.ScheduledQueue(), diff)
 		}
 	}
 }
 
+func TestHistory(t *testing.T) {
+	r := setup(t)
+	id := xid.New()
+	now := time.Now().Truncate(time.Second)
+	events := []*base.TaskEvent{
+		{Kind: base.EventEnqueued, Time: now, Queue: "default"},
+		{Kind: base.EventDequeued, Time: now.Add(time.Second), Queue: "default", Host: "localhost", PID: 1234, ServerID: "abc", Attempt: 1},
+		{Kind: base.EventRetry, Time: now.Add(2 * time.Second), Queue: "default", Host: "localhost", PID: 1234, ServerID: "abc", Attempt: 1, ErrorMsg: "oops", ProcessAt: now.Add(time.Minute)},
+	}
+
+	h.FlushDB(t, r.client)
+	for _, e := range events {
+		if err := r.RecordEvent(id.String(), e, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := r.History(id)
+	if err != nil {
+		t.Fatalf("(*RDB).History(%v) returned error: %v", id, err)
+	}
+	if diff := cmp.Diff(events, got); diff != "" {
+		t.Errorf("(*RDB).History(%v) = %v, want %v; (-want, +got)\n%s", id, got, events, diff)
+	}
+
+	if _, err := r.History(xid.New()); err != ErrTaskNotFound {
+		t.Errorf("(*RDB).History(unknown id) returned error %v, want %v", err, ErrTaskNotFound)
+	}
+}
+
+func TestGetTask(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "hello"})
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("gen_thumbnail", nil)
+	m3.Queue = "low"
+	m4 := h.NewTaskMessage("sync", nil)
+	m4.Retried = 2
+	m4.ErrorMsg = "network error"
+	m5 := h.NewTaskMessage("cleanup", nil)
+	m5.Retried = 25
+	m5.ErrorMsg = "fatal error"
+	m6 := h.NewTaskMessage("stale", nil) // indexed but not in any queue
+	m7 := h.NewTaskMessage("leased", nil)
+	m8 := h.NewTaskMessageWithQueue("oldest", nil, "big")
+	big := []*base.TaskMessage{m8} // m8 is dequeued first
+	for i := 0; i < getTaskSearchLen; i++ {
+		big = append(big, h.NewTaskMessageWithQueue("filler", nil, "big"))
+	}
+	processAt := now.Add(time.Hour).Unix()
+	retryAt := now.Add(time.Minute).Unix()
+	diedAt := now.Add(-time.Minute).Unix()
+
+	h.FlushDB(t, r.client)
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m1})
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{m2})
+	h.SeedScheduledQueue(t, r.client, []h.ZSetEntry{{Msg: m3, Score: float64(processAt)}})
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{{Msg: m4, Score: float64(retryAt)}})
+	h.SeedDeadQueue(t, r.client, []h.ZSetEntry{{Msg: m5, Score: float64(diedAt)}})
+	h.SeedEnqueuedQueue(t, r.client, big, "big")
+	h.SeedTaskIndex(t, r.client, []*base.TaskMessage{m1, m2, m3, m4, m5, m6, m7, m8})
+	// in-progress task found by its lease.
+	r.client.ZAdd(h.Keys.Leases(), &redis.Z{Score: float64(now.Add(time.Minute).Unix()), Member: m7.ID.String()})
+
+	tests := []struct {
+		id   xid.ID
+		want *TaskInfo
+	}{
+		{
+			id:   m1.ID,
+			want: &TaskInfo{TaskMessage: m1, State: StateEnqueued},
+		},
+		{
+			id:   m2.ID,
+			want: &TaskInfo{TaskMessage: m2, State: StateInProgress},
+		},
+		{
+			id:   m3.ID,
+			want: &TaskInfo{TaskMessage: m3, State: StateScheduled, ProcessAt: time.Unix(processAt, 0), Score: processAt},
+		},
+		{
+			id:   m4.ID,
+			want: &TaskInfo{TaskMessage: m4, State: StateRetry, ProcessAt: time.Unix(retryAt, 0), Score: retryAt},
+		},
+		{
+			id:   m5.ID,
+			want: &TaskInfo{TaskMessage: m5, State: StateDead, LastFailedAt: time.Unix(diedAt, 0), Score: diedAt},
+		},
+		{
+			id:   m6.ID,
+			want: &TaskInfo{TaskMessage: m6, State: StateUnknown},
+		},
+		{
+			id:   m7.ID,
+			want: &TaskInfo{TaskMessage: m7, State: StateInProgress},
+		},
+		{
+			id:   m8.ID,
+			want: &TaskInfo{TaskMessage: m8, State: StateEnqueued},
+		},
+	}
+
+	for _, tc := range tests {
+		got, err := r.GetTask(tc.id)
+		if err != nil {
+			t.Errorf("(*RDB).GetTask(%v) returned error: %v", tc.id, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("(*RDB).GetTask(%v) = %v, want %v; (-want, +got)\n%s", tc.id, got, tc.want, diff)
+		}
+	}
+
+	if _, err := r.GetTask(xid.New()); err != ErrTaskNotFound {
+		t.Errorf("(*RDB).GetTask(unknown id) returned error %v, want %v", err, ErrTaskNotFound)
+	}
+}
+
+func TestDeleteTasksRemovesIndex(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("gen_thumbnail", nil)
+	m4 := h.NewTaskMessage("sync", nil)
+	m4.Queue = "low"
+	m5 := h.NewTaskMessage("cleanup", nil)
+	score := time.Now().Unix()
+
+	h.FlushDB(t, r.client)
+	h.SeedDeadQueue(t, r.client, []h.ZSetEntry{{Msg: m1, Score: float64(score)}, {Msg: m2, Score: float64(score)}})
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{{Msg: m3, Score: float64(score)}})
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m4}, "low")
+	h.SeedScheduledQueue(t, r.client, []h.ZSetEntry{{Msg: m5, Score: float64(score)}})
+	h.SeedTaskIndex(t, r.client, []*base.TaskMessage{m1, m2, m3, m4, m5})
+
+	if err := r.DeleteDeadTask(m1.ID, score); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.DeleteAllRetryTasks(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RemoveQueue("low", true); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]*base.TaskMessage{
+		m2.ID.String(): m2,
+		m5.ID.String(): m5,
+	}
+	if diff := cmp.Diff(want, h.GetTaskIndex(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.TaskIndex(), diff)
+	}
+}
+
 func TestRemoveQueue(t *testing.T) {
 	r := setup(t)
 	m1 := h.NewTaskMessage("send_email", nil)
@@ -1977,9 +2147,9 @@ func TestRemoveQueue(t *testing.T) {
 			continue
 		}
 
-		qkey := base.QueueKey(tc.qname)
-		if r.client.SIsMember(base.AllQueues, qkey).Val() {
-			t.Errorf("%q is a member of %q", qkey, base.AllQueues)
+		qkey := h.Keys.QueueKey(tc.qname)
+		if r.client.SIsMember(h.Keys.AllQueues(), qkey).Val() {
+			t.Errorf("%q is a member of %q", qkey, h.Keys.AllQueues())
 		}
 
 		if r.client.LLen(qkey).Val() != 0 {
@@ -1989,7 +2159,7 @@ func TestRemoveQueue(t *testing.T) {
 		for qname, want := range tc.wantEnqueued {
 			gotEnqueued := h.GetEnqueuedMessages(t, r.client, qname)
 			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
-				t.Errorf("mismatch found in %q; (-want,+got):\n%s", base.QueueKey(qname), diff)
+				t.Errorf("mismatch found in %q; (-want,+got):\n%s", h.Keys.QueueKey(qname), diff)
 			}
 		}
 	}
@@ -2045,7 +2215,7 @@ func TestRemoveQueueError(t *testing.T) {
 		for qname, want := range tc.enqueued {
 			gotEnqueued := h.GetEnqueuedMessages(t, r.client, qname)
 			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
-				t.Errorf("%s;mismatch found in %q; (-want,+got):\n%s", tc.desc, base.QueueKey(qname), diff)
+				t.Errorf("%s;mismatch found in %q; (-want,+got):\n%s", tc.desc, h.Keys.QueueKey(qname), diff)
 			}
 		}
 	}
@@ -2188,3 +2358,32 @@ func TestListWorkers(t *testing.T) {
 		}
 	}
 }
+
+func TestEnqueueTasksNotifiesQueues(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessageWithQueue("reindex", nil, "critical")
+	t3 := h.NewTaskMessageWithQueue("sync", nil, "low")
+	score := time.Now().Add(time.Hour).Unix()
+
+	h.FlushDB(t, r.client)
+	h.SeedDeadQueue(t, r.client, []h.ZSetEntry{{Msg: t1, Score: float64(score)}})
+	h.SeedScheduledQueue(t, r.client, []h.ZSetEntry{{Msg: t2, Score: float64(score)}})
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{{Msg: t3, Score: float64(score)}})
+
+	if err := r.EnqueueDeadTask(t1.ID, score); err != nil {
+		t.Fatalf("(*RDB).EnqueueDeadTask() returned error: %v", err)
+	}
+	if _, err := r.EnqueueAllScheduledTasks(); err != nil {
+		t.Fatalf("(*RDB).EnqueueAllScheduledTasks() returned error: %v", err)
+	}
+	if _, err := r.EnqueueAllRetryTasks(); err != nil {
+		t.Fatalf("(*RDB).EnqueueAllRetryTasks() returned error: %v", err)
+	}
+	for _, qname := range []string{base.DefaultQueueName, "critical", "low"} {
+		nkey := h.Keys.NotificationKey(qname)
+		if n := r.client.LLen(nkey).Val(); n != 1 {
+			t.Errorf("%q has length %d, want 1", nkey, n)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// legacyPrefix is the prefix of the keys written by the versions of asynq
+// which did not enclose the namespace in a hash tag.
+const legacyPrefix = "asynq:"
+
+// KEYS[1] -> legacy key
+// KEYS[2] -> new key
+// KEYS[3] -> asynq:tasks
+// KEYS[4] -> asynq:notify:<qname>, if the key is a queue
+// ARGV[1] -> legacy key prefix
+// ARGV[2] -> new key prefix
+// ARGV[3] -> max number of pending notifications
+//
+// Tasks in lists and sorted sets are appended to the tasks in the new key
+// so that the legacy tasks, which are older, are processed first, and are
+// indexed by ID. Counters are added to the new counters. Members of the set
+// of queues are the keys of the queues and are rewritten with the new prefix.
+var migrateKeyCmd = redis.NewScript(`
+local function index(msg)
+	local ok, decoded = pcall(cjson.decode, msg)
+	if ok and type(decoded) == "table" and type(decoded["ID"]) == "string" then
+		redis.call("HSET", KEYS[3], decoded["ID"], msg)
+	end
+end
+local t = redis.call("TYPE", KEYS[1])["ok"]
+if t == "none" then
+	return 0
+elseif t == "list" then
+	for _, msg in ipairs(redis.call("LRANGE", KEYS[1], 0, -1)) do
+		redis.call("RPUSH", KEYS[2], msg)
+		index(msg)
+	end
+	if KEYS[4] then
+		redis.call("LPUSH", KEYS[4], 1)
+		redis.call("LTRIM", KEYS[4], 0, ARGV[3] - 1)
+	end
+elseif t == "zset" then
+	local entries = redis.call("ZRANGE", KEYS[1], 0, -1, "WITHSCORES")
+	for i = 1, #entries, 2 do
+		redis.call("ZADD", KEYS[2], entries[i+1], entries[i])
+		index(entries[i])
+	end
+elseif t == "set" then
+	for _, member in ipairs(redis.call("SMEMBERS", KEYS[1])) do
+		if string.sub(member, 1, string.len(ARGV[1])) == ARGV[1] then
+			member = ARGV[2] .. string.sub(member, string.len(ARGV[1]) + 1)
+		end
+		redis.call("SADD", KEYS[2], member)
+	end
+elseif t == "string" then
+	redis.call("INCRBY", KEYS[2], redis.call("GET", KEYS[1]))
+	local ttl = redis.call("TTL", KEYS[1])
+	if ttl > 0 then
+		redis.call("EXPIRE", KEYS[2], ttl)
+	end
+else
+	return redis.error_reply("unexpected type " .. t .. " of key " .. KEYS[1])
+end
+redis.call("DEL", KEYS[1])
+return 1`)
+
+// MigrateLegacyKeys moves the queues, tasks and stats stored in the keys
+// written by the versions of asynq which prefixed keys with "asynq:" to the
+// keys of the namespace, and returns the number of keys migrated.
+// Tasks in the legacy keys are indexed by ID as they are moved.
+//
+// Server and worker keys are not migrated since running servers write them
+// periodically, and legacy uniqueness locks are left to expire.
+//
+// It is safe to run MigrateLegacyKeys more than once, and while servers are
+// running, although legacy tasks are not processed until they are migrated.
+// The legacy keys have no hash tag, so MigrateLegacyKeys needs to run against
+// the single redis server used by the previous version.
+func (r *RDB) MigrateLegacyKeys() (int, error) {
+	queues, err := r.client.SMembers(legacyPrefix + "queues").Result()
+	if err != nil {
+		return 0, err
+	}
+	keys := []string{legacyPrefix + "queues"}
+	for _, q := range queues {
+		if strings.HasPrefix(q, legacyPrefix+"queues:") {
+			keys = append(keys, q)
+		}
+	}
+	keys = append(keys,
+		legacyPrefix+"scheduled", legacyPrefix+"retry", legacyPrefix+"dead", legacyPrefix+"in_progress")
+	for _, pattern := range []string{"processed:*", "failure:*"} {
+		var cursor uint64
+		for {
+			var ks []string
+			ks, cursor, err = r.client.Scan(cursor, legacyPrefix+pattern, 100).Result()
+			if err != nil {
+				return 0, err
+			}
+			keys = append(keys, ks...)
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+
+	prefix := r.keys.Prefix()
+	n := 0
+	for _, key := range keys {
+		newKey := prefix + strings.TrimPrefix(key, legacyPrefix)
+		ks := []string{key, newKey, r.keys.TaskIndex()}
+		if strings.HasPrefix(key, legacyPrefix+"queues:") {
+			ks = append(ks, r.keys.NotificationKey(strings.TrimPrefix(key, legacyPrefix+"queues:")))
+		}
+		res, err := migrateKeyCmd.Run(r.client, ks, legacyPrefix, prefix, maxNotifications).Int()
+		if err != nil {
+			return n, err
+		}
+		n += res
+	}
+	return n, nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	e1 := h.NewTaskMessage("send_email", nil)
+	e2 := h.NewTaskMessage("send_email", nil)
+	e3 := h.NewTaskMessageWithQueue("reindex", nil, "low")
+	s1 := h.NewTaskMessage("sync", nil)
+	d1 := h.NewTaskMessage("export", nil)
+	e0 := h.NewTaskMessage("send_email", nil) // enqueued by an upgraded client
+
+	// Seed keys the way the previous versions wrote them: tasks are pushed
+	// to the left of the lists, e1 before e2.
+	for _, msg := range []*base.TaskMessage{e2, e1} {
+		r.client.RPush(legacyPrefix+"queues:default", h.MustMarshal(t, msg))
+	}
+	r.client.RPush(legacyPrefix+"queues:low", h.MustMarshal(t, e3))
+	r.client.SAdd(legacyPrefix+"queues", legacyPrefix+"queues:default", legacyPrefix+"queues:low")
+	r.client.ZAdd(legacyPrefix+"scheduled", &redis.Z{Member: h.MustMarshal(t, s1), Score: float64(now.Unix())})
+	r.client.ZAdd(legacyPrefix+"dead", &redis.Z{Member: h.MustMarshal(t, d1), Score: float64(now.Unix())})
+	processedKey := legacyPrefix + "processed:" + now.UTC().Format("2006-01-02")
+	r.client.Set(processedKey, 10, time.Hour)
+	r.client.Set(legacyPrefix+"servers", 1, 0) // not migrated
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{e0})
+	r.client.Set(h.Keys.ProcessedKey(now), 5, 0)
+
+	n, err := r.MigrateLegacyKeys()
+	if err != nil {
+		t.Fatalf("(*RDB).MigrateLegacyKeys() returned error: %v", err)
+	}
+	if want := 6; n != want {
+		t.Errorf("(*RDB).MigrateLegacyKeys() = %d, want %d", n, want)
+	}
+
+	// Legacy tasks are dequeued before the tasks enqueued after the upgrade.
+	var dequeued []*base.TaskMessage
+	for {
+		msg, err := r.Dequeue("default")
+		if err == ErrNoProcessableTask {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		dequeued = append(dequeued, msg)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{e1, e2, e0}, dequeued); diff != "" {
+		t.Errorf("dequeued tasks mismatch after migration; (-want,+got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{e3}, h.GetEnqueuedMessages(t, r.client, "low")); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", h.Keys.QueueKey("low"), diff)
+	}
+	if n := r.client.LLen(h.Keys.NotificationKey("low")).Val(); n != 1 {
+		t.Errorf("%q has length %d, want 1", h.Keys.NotificationKey("low"), n)
+	}
+	wantQueues := []string{h.Keys.QueueKey("default"), h.Keys.QueueKey("low")}
+	if diff := cmp.Diff(wantQueues, r.client.SMembers(h.Keys.AllQueues()).Val(), h.SortStringSliceOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", h.Keys.AllQueues(), diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{s1}, h.GetScheduledMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", h.Keys.ScheduledQueue(), diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{d1}, h.GetDeadMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", h.Keys.DeadQueue(), diff)
+	}
+	for _, msg := range []*base.TaskMessage{e3, s1, d1} {
+		if _, err := r.GetTask(msg.ID); err != nil {
+			t.Errorf("(*RDB).GetTask(%q) after migration returned error: %v", msg.ID, err)
+		}
+	}
+	if got := r.client.Get(h.Keys.ProcessedKey(now)).Val(); got != "15" {
+		t.Errorf("GET %q = %q, want %q", h.Keys.ProcessedKey(now), got, "15")
+	}
+	if ttl := r.client.TTL(h.Keys.ProcessedKey(now)).Val(); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("TTL %q = %v, want the TTL of the legacy key", h.Keys.ProcessedKey(now), ttl)
+	}
+	for _, key := range []string{legacyPrefix + "queues", legacyPrefix + "queues:default", legacyPrefix + "dead", processedKey} {
+		if r.client.Exists(key).Val() != 0 {
+			t.Errorf("legacy key %q still exists after migration", key)
+		}
+	}
+	if r.client.Exists(legacyPrefix+"servers").Val() == 0 {
+		t.Errorf("legacy key %q is migrated, want it left as is", legacyPrefix+"servers")
+	}
+
+	// Running the migration again is a no-op.
+	if n, err := r.MigrateLegacyKeys(); n != 0 || err != nil {
+		t.Errorf("second (*RDB).MigrateLegacyKeys() = %d, %v; want 0, nil", n, err)
+	}
+}
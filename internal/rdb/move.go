@@ -0,0 +1,185 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// KEYS[1] -> asynq:queues:<src>
+// KEYS[2] -> asynq:queues:<dst>
+// KEYS[3] -> asynq:queues
+// KEYS[4] -> asynq:queues:<dst>:notify
+// KEYS[5] -> asynq:tasks
+// ARGV[1] -> max number of notifications
+// ARGV[2:] -> List of (old task message, new task message, task ID) tuples,
+// oldest task first
+var moveListCmd = redis.NewScript(`
+local moved = 0
+for i = 2, table.getn(ARGV), 3 do
+	if redis.call("LREM", KEYS[1], 1, ARGV[i]) == 1 then
+		redis.call("LPUSH", KEYS[2], ARGV[i+1])
+		redis.call("HSET", KEYS[5], ARGV[i+2], ARGV[i+1])
+		moved = moved + 1
+	end
+end
+if moved > 0 then
+	redis.call("SADD", KEYS[3], KEYS[2])
+	redis.call("LPUSH", KEYS[4], 1)
+	redis.call("LTRIM", KEYS[4], 0, ARGV[1] - 1)
+end
+return moved`)
+
+// KEYS[1] -> ZSET to move tasks in (e.g., retry queue)
+// KEYS[2] -> asynq:tasks
+// ARGV    -> List of (old task message, new task message, task ID) tuples
+var moveZSetCmd = redis.NewScript(`
+local moved = 0
+for i = 1, table.getn(ARGV), 3 do
+	local score = redis.call("ZSCORE", KEYS[1], ARGV[i])
+	if score then
+		redis.call("ZREM", KEYS[1], ARGV[i])
+		redis.call("ZADD", KEYS[1], score, ARGV[i+1])
+		redis.call("HSET", KEYS[2], ARGV[i+2], ARGV[i+1])
+		moved = moved + 1
+	end
+end
+return moved`)
+
+// MoveTasks moves the tasks in src queue to dst queue, batchSize tasks
+// at a time, and returns the number of tasks moved.
+// Enqueued tasks are moved to dst in the same order, and scheduled and
+// retry tasks are rewritten to be processed in dst at the same time.
+// If typePattern is not empty, only the tasks whose type matches the
+// pattern using the syntax of path.Match are moved.
+//
+// Each batch is moved atomically. Tasks in progress are not moved, and
+// tasks enqueued into src while moving may be left in src.
+func (r *RDB) MoveTasks(src, dst, typePattern string, batchSize int) (int64, error) {
+	if src == "" || dst == "" {
+		return 0, fmt.Errorf("queue names must not be empty")
+	}
+	if strings.EqualFold(src, dst) {
+		return 0, fmt.Errorf("cannot move tasks from queue %q to itself", src)
+	}
+	f := TaskFilter{TypePattern: typePattern, Queue: src}
+	if err := f.validate(); err != nil {
+		return 0, err
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	total, err := r.moveList(src, dst, f, batchSize)
+	if err != nil {
+		return total, err
+	}
+	for _, zset := range []string{r.keys.ScheduledQueue(), r.keys.RetryQueue()} {
+		n, err := r.moveZSet(zset, dst, f, batchSize)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// moveList moves the matching tasks in the src list, reading it from the tail
+// where the oldest task is. Tasks kept in src stay at the tail and are skipped.
+func (r *RDB) moveList(src, dst string, f TaskFilter, batchSize int) (int64, error) {
+	keys := []string{
+		r.keys.QueueKey(src),
+		r.keys.QueueKey(dst),
+		r.keys.AllQueues(),
+		r.keys.NotificationKey(dst),
+		r.keys.TaskIndex(),
+	}
+	var total, kept int64
+	for {
+		data, err := r.client.LRange(keys[0], -kept-int64(batchSize), -kept-1).Result()
+		if err != nil {
+			return total, err
+		}
+		if len(data) == 0 {
+			return total, nil
+		}
+		args := []interface{}{maxNotifications}
+		for i := len(data) - 1; i >= 0; i-- {
+			old, updated, id, ok := rewriteQueue(data[i], dst, f)
+			if !ok {
+				kept++
+				continue
+			}
+			args = append(args, old, updated, id)
+		}
+		if len(args) > 1 {
+			n, err := runBatch(moveListCmd, r.client, keys, args)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+		if len(data) < batchSize {
+			return total, nil
+		}
+	}
+}
+
+// moveZSet rewrites the matching tasks in zset to be processed in dst.
+// Members are read with ZSCAN, which returns every member present during
+// the whole scan; rewritten members no longer match the filter.
+func (r *RDB) moveZSet(zset, dst string, f TaskFilter, batchSize int) (int64, error) {
+	var (
+		total  int64
+		cursor uint64
+	)
+	for {
+		data, next, err := r.client.ZScan(zset, cursor, "", int64(batchSize)).Result()
+		if err != nil {
+			return total, err
+		}
+		var args []interface{}
+		// data is a list of member and score pairs.
+		for i := 0; i < len(data); i += 2 {
+			if old, updated, id, ok := rewriteQueue(data[i], dst, f); ok {
+				args = append(args, old, updated, id)
+			}
+		}
+		if len(args) > 0 {
+			n, err := runBatch(moveZSetCmd, r.client, []string{zset, r.keys.TaskIndex()}, args)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+		if next == 0 {
+			return total, nil
+		}
+		cursor = next
+	}
+}
+
+// rewriteQueue decodes the task message and returns the message with its
+// queue set to qname along with the task ID, if the task matches the filter.
+// The uniqueness lock of the task is kept, so the task releases it when done.
+func rewriteQueue(s, qname string, f TaskFilter) (old, updated, id string, ok bool) {
+	var msg base.TaskMessage
+	if err := json.Unmarshal([]byte(s), &msg); err != nil {
+		return "", "", "", false // bad data, leave it in place
+	}
+	if !f.match(&msg) {
+		return "", "", "", false
+	}
+	msg.Queue = qname
+	bytes, err := json.Marshal(&msg)
+	if err != nil {
+		return "", "", "", false
+	}
+	return s, string(bytes), msg.ID.String(), true
+}
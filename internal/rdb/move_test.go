@@ -0,0 +1,139 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestMoveTasks(t *testing.T) {
+	r := setup(t)
+	newMsg := func(typename, qname string) *base.TaskMessage {
+		msg := h.NewTaskMessage(typename, nil)
+		msg.Queue = qname
+		return msg
+	}
+	moved := func(msg *base.TaskMessage, qname string) *base.TaskMessage {
+		copy := *msg
+		copy.Queue = qname
+		return &copy
+	}
+	e1 := newMsg("email:send", "hot")
+	e2 := newMsg("image:resize", "hot")
+	e3 := newMsg("email:digest", "hot")
+	s1 := newMsg("email:send", "hot")
+	s2 := newMsg("email:send", "default")
+	r1 := newMsg("image:resize", "hot")
+	now := time.Now()
+	scheduled := []h.ZSetEntry{
+		{Msg: s1, Score: float64(now.Add(time.Hour).Unix())},
+		{Msg: s2, Score: float64(now.Add(time.Hour).Unix())},
+	}
+	retry := []h.ZSetEntry{{Msg: r1, Score: float64(now.Add(time.Minute).Unix())}}
+
+	tests := []struct {
+		desc          string
+		typePattern   string
+		want          int64
+		wantSrc       []*base.TaskMessage // newest first
+		wantDst       []*base.TaskMessage // newest first
+		wantScheduled []h.ZSetEntry
+		wantRetry     []h.ZSetEntry
+	}{
+		{
+			desc:    "all tasks",
+			want:    5,
+			wantSrc: nil,
+			wantDst: []*base.TaskMessage{moved(e3, "cold"), moved(e2, "cold"), moved(e1, "cold")},
+			wantScheduled: []h.ZSetEntry{
+				{Msg: moved(s1, "cold"), Score: scheduled[0].Score},
+				{Msg: s2, Score: scheduled[1].Score},
+			},
+			wantRetry: []h.ZSetEntry{{Msg: moved(r1, "cold"), Score: retry[0].Score}},
+		},
+		{
+			desc:        "tasks matching type pattern",
+			typePattern: "email:*",
+			want:        3,
+			wantSrc:     []*base.TaskMessage{e2},
+			wantDst:     []*base.TaskMessage{moved(e3, "cold"), moved(e1, "cold")},
+			wantScheduled: []h.ZSetEntry{
+				{Msg: moved(s1, "cold"), Score: scheduled[0].Score},
+				{Msg: s2, Score: scheduled[1].Score},
+			},
+			wantRetry: retry,
+		},
+		{
+			desc:          "no match",
+			typePattern:   "sms:*",
+			want:          0,
+			wantSrc:       []*base.TaskMessage{e3, e2, e1},
+			wantDst:       nil,
+			wantScheduled: scheduled,
+			wantRetry:     retry,
+		},
+	}
+
+	for _, tc := range tests {
+		for _, batchSize := range []int{1, 2, 100} {
+			h.FlushDB(t, r.client)
+			// e1 is the oldest task in the queue.
+			h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{e1, e2, e3}, "hot")
+			h.SeedScheduledQueue(t, r.client, scheduled)
+			h.SeedRetryQueue(t, r.client, retry)
+
+			n, err := r.MoveTasks("hot", "cold", tc.typePattern, batchSize)
+			if err != nil || n != tc.want {
+				t.Errorf("%s; (*RDB).MoveTasks(batch size %d) = %d, %v; want %d, nil", tc.desc, batchSize, n, err, tc.want)
+				continue
+			}
+			if diff := cmp.Diff(tc.wantSrc, h.GetEnqueuedMessages(t, r.client, "hot")); diff != "" {
+				t.Errorf("%s; mismatch found in %q with batch size %d; (-want, +got)\n%s", tc.desc, h.Keys.QueueKey("hot"), batchSize, diff)
+			}
+			if diff := cmp.Diff(tc.wantDst, h.GetEnqueuedMessages(t, r.client, "cold")); diff != "" {
+				t.Errorf("%s; mismatch found in %q with batch size %d; (-want, +got)\n%s", tc.desc, h.Keys.QueueKey("cold"), batchSize, diff)
+			}
+			if diff := cmp.Diff(tc.wantScheduled, h.GetScheduledEntries(t, r.client), h.SortZSetEntryOpt); diff != "" {
+				t.Errorf("%s; mismatch found in %q with batch size %d; (-want, +got)\n%s", tc.desc, h.Keys.ScheduledQueue(), batchSize, diff)
+			}
+			if diff := cmp.Diff(tc.wantRetry, h.GetRetryEntries(t, r.client), h.SortZSetEntryOpt); diff != "" {
+				t.Errorf("%s; mismatch found in %q with batch size %d; (-want, +got)\n%s", tc.desc, h.Keys.RetryQueue(), batchSize, diff)
+			}
+			// moved tasks are indexed with their new queue.
+			index := h.GetTaskIndex(t, r.client)
+			for _, msg := range tc.wantDst {
+				if got := index[msg.ID.String()]; got == nil || got.Queue != "cold" {
+					t.Errorf("%s; task %v is not indexed in queue %q", tc.desc, msg.ID, "cold")
+				}
+			}
+		}
+	}
+}
+
+func TestMoveTasksError(t *testing.T) {
+	r := setup(t)
+	h.FlushDB(t, r.client)
+
+	tests := []struct {
+		src, dst    string
+		typePattern string
+	}{
+		{"hot", "hot", ""},
+		{"hot", "HOT", ""},
+		{"", "cold", ""},
+		{"hot", "cold", "email:["},
+	}
+
+	for _, tc := range tests {
+		if _, err := r.MoveTasks(tc.src, tc.dst, tc.typePattern, DefaultBatchSize); err == nil {
+			t.Errorf("(*RDB).MoveTasks(%q, %q, %q) returned nil error, want non-nil", tc.src, tc.dst, tc.typePattern)
+		}
+	}
+}
@@ -7,36 +7,70 @@ package rdb
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v7"
 	"github.com/hibiken/asynq/internal/base"
+	"github.com/rs/xid"
 	"github.com/spf13/cast"
 )
 
+// Errors returned by RDB are the broker-level errors defined in package base.
 var (
 	// ErrNoProcessableTask indicates that there are no tasks ready to be processed.
-	ErrNoProcessableTask = errors.New("no tasks are ready for processing")
+	ErrNoProcessableTask = base.ErrNoProcessableTask
 
 	// ErrTaskNotFound indicates that a task that matches the given identifier was not found.
-	ErrTaskNotFound = errors.New("could not find a task")
+	ErrTaskNotFound = base.ErrTaskNotFound
 
 	// ErrDuplicateTask indicates that another task with the same unique key holds the uniqueness lock.
-	ErrDuplicateTask = errors.New("task already exists")
+	ErrDuplicateTask = base.ErrDuplicateTask
 )
 
 const statsTTL = 90 * 24 * time.Hour // 90 days
 
 // RDB is a client interface to query and mutate task queues.
 type RDB struct {
-	client *redis.Client
+	client redis.UniversalClient
+	keys   base.Keys
+
+	mu sync.Mutex // guards all fields below
+
+	// IDs of the tasks dequeued by r and not yet finished.
+	// Their leases are renewed by WriteServerState.
+	leased map[string]struct{}
+
+	// crash recovery limit set by RecoverAll.
+	recovering  bool
+	maxRecovery int
+	errMsg      string
+
+	// number of dead tasks which could not be decoded, and hence not indexed,
+	// when the dead task indexes were last rebuilt.
+	unindexedDead int64
 }
 
-// NewRDB returns a new instance of RDB.
-func NewRDB(client *redis.Client) *RDB {
-	return &RDB{client}
+// NewRDB returns a new instance of RDB using the default namespace.
+//
+// The client may be connected to a single redis server, to redis sentinels,
+// or to redis cluster nodes.
+func NewRDB(client redis.UniversalClient) *RDB {
+	return NewRDBWithNamespace(client, base.DefaultNamespace)
+}
+
+// NewRDBWithNamespace returns a new instance of RDB which stores
+// all of its keys under the given namespace.
+func NewRDBWithNamespace(client redis.UniversalClient, ns string) *RDB {
+	return &RDB{client: client, keys: base.NewKeys(ns), leased: make(map[string]struct{})}
+}
+
+// Keys returns the keys used by r.
+func (r *RDB) Keys() base.Keys {
+	return r.keys
 }
 
 // Close closes the connection with redis server.
@@ -44,12 +78,24 @@ func (r *RDB) Close() error {
 	return r.client.Close()
 }
 
+// maxNotifications is the max number of notifications kept for a queue.
+// A notification wakes up one server waiting for tasks; extra notifications
+// are not needed since servers query the queue until it is empty.
+const maxNotifications = 1000
+
 // KEYS[1] -> asynq:queues:<qname>
 // KEYS[2] -> asynq:queues
+// KEYS[3] -> asynq:notify:<qname>
+// KEYS[4] -> asynq:tasks
 // ARGV[1] -> task message data
+// ARGV[2] -> max number of pending notifications
+// ARGV[3] -> task ID
 var enqueueCmd = redis.NewScript(`
 redis.call("LPUSH", KEYS[1], ARGV[1])
 redis.call("SADD", KEYS[2], KEYS[1])
+redis.call("LPUSH", KEYS[3], 1)
+redis.call("LTRIM", KEYS[3], 0, ARGV[2] - 1)
+redis.call("HSET", KEYS[4], ARGV[3], ARGV[1])
 return 1`)
 
 // Enqueue inserts the given task to the tail of the queue.
@@ -58,16 +104,24 @@ func (r *RDB) Enqueue(msg *base.TaskMessage) error {
 	if err != nil {
 		return err
 	}
-	key := base.QueueKey(msg.Queue)
-	return enqueueCmd.Run(r.client, []string{key, base.AllQueues}, bytes).Err()
+	keys := []string{
+		r.keys.QueueKey(msg.Queue),
+		r.keys.AllQueues(),
+		r.keys.NotificationKey(msg.Queue),
+		r.keys.TaskIndex(),
+	}
+	return enqueueCmd.Run(r.client, keys, bytes, maxNotifications, msg.ID.String()).Err()
 }
 
 // KEYS[1] -> unique key in the form <type>:<payload>:<qname>
 // KEYS[2] -> asynq:queues:<qname>
-// KEYS[2] -> asynq:queues
+// KEYS[3] -> asynq:queues
+// KEYS[4] -> asynq:notify:<qname>
+// KEYS[5] -> asynq:tasks
 // ARGV[1] -> task ID
 // ARGV[2] -> uniqueness lock TTL
 // ARGV[3] -> task message data
+// ARGV[4] -> max number of pending notifications
 var enqueueUniqueCmd = redis.NewScript(`
 local ok = redis.call("SET", KEYS[1], ARGV[1], "NX", "EX", ARGV[2])
 if not ok then
@@ -75,6 +129,9 @@ if not ok then
 end
 redis.call("LPUSH", KEYS[2], ARGV[3])
 redis.call("SADD", KEYS[3], KEYS[2])
+redis.call("LPUSH", KEYS[4], 1)
+redis.call("LTRIM", KEYS[4], 0, ARGV[4] - 1)
+redis.call("HSET", KEYS[5], ARGV[1], ARGV[3])
 return 1
 `)
 
@@ -85,10 +142,15 @@ func (r *RDB) EnqueueUnique(msg *base.TaskMessage, ttl time.Duration) error {
 	if err != nil {
 		return err
 	}
-	key := base.QueueKey(msg.Queue)
-	res, err := enqueueUniqueCmd.Run(r.client,
-		[]string{msg.UniqueKey, key, base.AllQueues},
-		msg.ID.String(), int(ttl.Seconds()), bytes).Result()
+	keys := []string{
+		msg.UniqueKey,
+		r.keys.QueueKey(msg.Queue),
+		r.keys.AllQueues(),
+		r.keys.NotificationKey(msg.Queue),
+		r.keys.TaskIndex(),
+	}
+	res, err := enqueueUniqueCmd.Run(r.client, keys,
+		msg.ID.String(), int(ttl.Seconds()), bytes, maxNotifications).Result()
 	if err != nil {
 		return err
 	}
@@ -102,19 +164,24 @@ func (r *RDB) EnqueueUnique(msg *base.TaskMessage, ttl time.Duration) error {
 	return nil
 }
 
+// leaseTTL is how long a task stays leased to the server which dequeued it
+// without a heartbeat from the server. Servers renew the leases of their tasks
+// on every heartbeat, so the value is larger than the heartbeat interval.
+const leaseTTL = 30 * time.Second
+
 // Dequeue queries given queues in order and pops a task message if there is one and returns it.
-// If all queues are empty, ErrNoProcessableTask error is returned.
+// If all queues are empty, it blocks for up to a second waiting for a task to be
+// added to one of the queues. If no task is added, ErrNoProcessableTask error is returned.
+//
+// The task is leased to r until it is finished, see RecoverAll.
 func (r *RDB) Dequeue(qnames ...string) (*base.TaskMessage, error) {
-	var data string
-	var err error
-	if len(qnames) == 1 {
-		data, err = r.dequeueSingle(base.QueueKey(qnames[0]))
-	} else {
-		var keys []string
-		for _, q := range qnames {
-			keys = append(keys, base.QueueKey(q))
+	data, err := r.dequeue(qnames...)
+	if err == redis.Nil {
+		// all queues are empty; wait for a notification and query
+		// the queues in the same order to keep the priority.
+		if err = r.wait(qnames...); err == nil {
+			data, err = r.dequeue(qnames...)
 		}
-		data, err = r.dequeue(keys...)
 	}
 	if err == redis.Nil {
 		return nil, ErrNoProcessableTask
@@ -127,53 +194,195 @@ func (r *RDB) Dequeue(qnames ...string) (*base.TaskMessage, error) {
 	if err != nil {
 		return nil, err
 	}
+	r.lease(msg.ID.String())
 	return &msg, nil
 }
 
-func (r *RDB) dequeueSingle(queue string) (data string, err error) {
-	// timeout needed to avoid blocking forever
-	return r.client.BRPopLPush(queue, base.InProgressQueue, time.Second).Result()
-}
+// leaseScript is the part of the dequeue scripts which leases a task
+// to the server dequeuing it.
+const leaseScript = `
+local function lease(msg)
+	local ok, decoded = pcall(cjson.decode, msg)
+	if ok and type(decoded) == "table" and type(decoded["ID"]) == "string" then
+		redis.call("ZADD", KEYS[2], ARGV[1], decoded["ID"])
+	end
+end
+`
 
-// KEYS[1] -> asynq:in_progress
-// ARGV    -> List of queues to query in order
-var dequeueCmd = redis.NewScript(`
-local res
-for _, qkey in ipairs(ARGV) do
-	res = redis.call("RPOPLPUSH", qkey, KEYS[1])
+// KEYS[1]  -> asynq:in_progress
+// KEYS[2]  -> asynq:leases
+// KEYS[3:] -> List of queues to query in order followed by
+//             the list of their notification keys
+// ARGV[1]  -> lease expiration timestamp
+// Note: Pending notifications are deleted if all queues are empty
+// since they are for tasks already taken by other servers.
+var dequeueCmd = redis.NewScript(leaseScript + `
+local n = (table.getn(KEYS) - 2) / 2
+for i = 3, n + 2 do
+	local res = redis.call("RPOPLPUSH", KEYS[i], KEYS[1])
 	if res then
+		lease(res)
 		return res
 	end
 end
-return res`)
+for i = n + 3, 2 * n + 2 do
+	redis.call("DEL", KEYS[i])
+end
+return nil`)
 
-func (r *RDB) dequeue(queues ...string) (data string, err error) {
-	var args []interface{}
-	for _, qkey := range queues {
-		args = append(args, qkey)
-	}
-	res, err := dequeueCmd.Run(r.client, []string{base.InProgressQueue}, args...).Result()
+func (r *RDB) dequeue(qnames ...string) (data string, err error) {
+	res, err := dequeueCmd.Run(r.client, r.dequeueKeys(qnames), time.Now().Add(leaseTTL).Unix()).Result()
 	if err != nil {
 		return "", err
 	}
 	return cast.ToStringE(res)
 }
 
+// dequeueKeys returns the keys of the dequeue scripts for the given queues.
+func (r *RDB) dequeueKeys(qnames []string) []string {
+	keys := []string{r.keys.InProgressQueue(), r.keys.Leases()}
+	for _, qname := range qnames {
+		keys = append(keys, r.keys.QueueKey(qname))
+	}
+	for _, qname := range qnames {
+		keys = append(keys, r.keys.NotificationKey(qname))
+	}
+	return keys
+}
+
+// KEYS[1]  -> asynq:in_progress
+// KEYS[2]  -> asynq:leases
+// KEYS[3:] -> List of queues to query in order followed by
+//             the list of their notification keys
+// ARGV[1]  -> lease expiration timestamp
+// ARGV[2]  -> max number of tasks to dequeue
+// ARGV[3:] -> number of tasks to take from each queue first
+var dequeueNCmd = redis.NewScript(leaseScript + `
+local n = tonumber(ARGV[2])
+local nq = (table.getn(KEYS) - 2) / 2
+local res = {}
+local function take(qkey, limit)
+	local taken = 0
+	while taken < limit and table.getn(res) < n do
+		local msg = redis.call("RPOPLPUSH", qkey, KEYS[1])
+		if not msg then
+			break
+		end
+		lease(msg)
+		table.insert(res, msg)
+		taken = taken + 1
+	end
+end
+for i = 1, nq do
+	take(KEYS[i + 2], tonumber(ARGV[i + 2]))
+end
+for i = 1, nq do
+	take(KEYS[i + 2], n)
+end
+if table.getn(res) < n then
+	for i = nq + 3, 2 * nq + 2 do
+		redis.call("DEL", KEYS[i])
+	end
+end
+return res`)
+
+// DequeueN pops up to n task messages from the given queues.
+// It first takes up to quotas[i] tasks from qnames[i] so that the batch is
+// split among the queues, then fills the rest of the batch from the queues
+// in order. If quotas is nil, tasks are taken from the first queue until it is
+// empty before moving on to the next queue.
+// If all queues are empty, it blocks for up to a second waiting for a task to be
+// added to one of the queues. If no task is added, ErrNoProcessableTask error is returned.
+//
+// The tasks are leased to r until they are finished, see RecoverAll.
+func (r *RDB) DequeueN(n int, quotas []int, qnames ...string) ([]*base.TaskMessage, error) {
+	if quotas != nil && len(quotas) != len(qnames) {
+		return nil, fmt.Errorf("got %d quotas for %d queues", len(quotas), len(qnames))
+	}
+	data, err := r.dequeueN(n, quotas, qnames...)
+	if err == nil && len(data) == 0 {
+		if err = r.wait(qnames...); err == nil {
+			data, err = r.dequeueN(n, quotas, qnames...)
+		}
+	}
+	if err == redis.Nil || (err == nil && len(data) == 0) {
+		return nil, ErrNoProcessableTask
+	}
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*base.TaskMessage
+	for _, s := range data {
+		var msg base.TaskMessage
+		if err := json.Unmarshal([]byte(s), &msg); err != nil {
+			return nil, err
+		}
+		r.lease(msg.ID.String())
+		msgs = append(msgs, &msg)
+	}
+	return msgs, nil
+}
+
+func (r *RDB) dequeueN(n int, quotas []int, qnames ...string) ([]string, error) {
+	args := []interface{}{time.Now().Add(leaseTTL).Unix(), n}
+	for i := range qnames {
+		quota := 0
+		if quotas != nil {
+			quota = quotas[i]
+		}
+		args = append(args, quota)
+	}
+	res, err := dequeueNCmd.Run(r.client, r.dequeueKeys(qnames), args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	return cast.ToStringSliceE(res)
+}
+
+// lease records that the task with the given id is leased to r.
+func (r *RDB) lease(id string) {
+	r.mu.Lock()
+	r.leased[id] = struct{}{}
+	r.mu.Unlock()
+}
+
+// release records that the task with the given id is no longer leased to r.
+func (r *RDB) release(id string) {
+	r.mu.Lock()
+	delete(r.leased, id)
+	r.mu.Unlock()
+}
+
+// wait blocks until a task is added to one of the queues or
+// the timeout expires. It returns redis.Nil on timeout.
+func (r *RDB) wait(qnames ...string) error {
+	var keys []string
+	for _, qname := range qnames {
+		keys = append(keys, r.keys.NotificationKey(qname))
+	}
+	// timeout needed to avoid blocking forever
+	return r.client.BRPop(time.Second, keys...).Err()
+}
+
 // KEYS[1] -> asynq:in_progress
 // KEYS[2] -> asynq:processed:<yyyy-mm-dd>
-// KEYS[3] -> unique key in the format <type>:<payload>:<qname>
+// KEYS[3] -> asynq:tasks
+// KEYS[4] -> asynq:leases
+// KEYS[5] -> unique key in the format <type>:<payload>:<qname>, if any
 // ARGV[1] -> base.TaskMessage value
 // ARGV[2] -> stats expiration timestamp
 // ARGV[3] -> task ID
 // Note: LREM count ZERO means "remove all elements equal to val"
 var doneCmd = redis.NewScript(`
 redis.call("LREM", KEYS[1], 0, ARGV[1]) 
+redis.call("HDEL", KEYS[3], ARGV[3])
+redis.call("ZREM", KEYS[4], ARGV[3])
 local n = redis.call("INCR", KEYS[2])
 if tonumber(n) == 1 then
 	redis.call("EXPIREAT", KEYS[2], ARGV[2])
 end
-if string.len(KEYS[3]) > 0 and redis.call("GET", KEYS[3]) == ARGV[3] then
-  redis.call("DEL", KEYS[3])
+if KEYS[5] and redis.call("GET", KEYS[5]) == ARGV[3] then
+  redis.call("DEL", KEYS[5])
 end
 return redis.status_reply("OK")
 `)
@@ -186,20 +395,37 @@ func (r *RDB) Done(msg *base.TaskMessage) error {
 		return err
 	}
 	now := time.Now()
-	processedKey := base.ProcessedKey(now)
+	processedKey := r.keys.ProcessedKey(now)
 	expireAt := now.Add(statsTTL)
-	return doneCmd.Run(r.client,
-		[]string{base.InProgressQueue, processedKey, msg.UniqueKey},
-		bytes, expireAt.Unix(), msg.ID.String()).Err()
+	keys := withUniqueKey([]string{r.keys.InProgressQueue(), processedKey, r.keys.TaskIndex(), r.keys.Leases()}, msg)
+	defer r.release(msg.ID.String())
+	return doneCmd.Run(r.client, keys, bytes, expireAt.Unix(), msg.ID.String()).Err()
+}
+
+// withUniqueKey appends the unique key of the task to the keys of a script
+// if the task has one. An empty key would hash to a different slot than the
+// other keys in Redis Cluster, failing the script with CROSSSLOT.
+func withUniqueKey(keys []string, msg *base.TaskMessage) []string {
+	if msg.UniqueKey == "" {
+		return keys
+	}
+	return append(keys, msg.UniqueKey)
 }
 
 // KEYS[1] -> asynq:in_progress
 // KEYS[2] -> asynq:queues:<qname>
+// KEYS[3] -> asynq:notify:<qname>
+// KEYS[4] -> asynq:leases
 // ARGV[1] -> base.TaskMessage value
+// ARGV[2] -> max number of pending notifications
+// ARGV[3] -> task ID
 // Note: Use RPUSH to push to the head of the queue.
 var requeueCmd = redis.NewScript(`
 redis.call("LREM", KEYS[1], 0, ARGV[1])
+redis.call("ZREM", KEYS[4], ARGV[3])
 redis.call("RPUSH", KEYS[2], ARGV[1])
+redis.call("LPUSH", KEYS[3], 1)
+redis.call("LTRIM", KEYS[3], 0, ARGV[2] - 1)
 return redis.status_reply("OK")`)
 
 // Requeue moves the task from in-progress queue to the specified queue.
@@ -208,19 +434,23 @@ func (r *RDB) Requeue(msg *base.TaskMessage) error {
 	if err != nil {
 		return err
 	}
+	defer r.release(msg.ID.String())
 	return requeueCmd.Run(r.client,
-		[]string{base.InProgressQueue, base.QueueKey(msg.Queue)},
-		string(bytes)).Err()
+		[]string{r.keys.InProgressQueue(), r.keys.QueueKey(msg.Queue), r.keys.NotificationKey(msg.Queue), r.keys.Leases()},
+		string(bytes), maxNotifications, msg.ID.String()).Err()
 }
 
 // KEYS[1] -> asynq:scheduled
 // KEYS[2] -> asynq:queues
+// KEYS[3] -> asynq:tasks
 // ARGV[1] -> score (process_at timestamp)
 // ARGV[2] -> task message
 // ARGV[3] -> queue key
+// ARGV[4] -> task ID
 var scheduleCmd = redis.NewScript(`
 redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
 redis.call("SADD", KEYS[2], ARGV[3])
+redis.call("HSET", KEYS[3], ARGV[4], ARGV[2])
 return 1
 `)
 
@@ -230,16 +460,17 @@ func (r *RDB) Schedule(msg *base.TaskMessage, processAt time.Time) error {
 	if err != nil {
 		return err
 	}
-	qkey := base.QueueKey(msg.Queue)
+	qkey := r.keys.QueueKey(msg.Queue)
 	score := float64(processAt.Unix())
 	return scheduleCmd.Run(r.client,
-		[]string{base.ScheduledQueue, base.AllQueues},
-		score, bytes, qkey).Err()
+		[]string{r.keys.ScheduledQueue(), r.keys.AllQueues(), r.keys.TaskIndex()},
+		score, bytes, qkey, msg.ID.String()).Err()
 }
 
 // KEYS[1] -> unique key in the format <type>:<payload>:<qname>
 // KEYS[2] -> asynq:scheduled
 // KEYS[3] -> asynq:queues
+// KEYS[4] -> asynq:tasks
 // ARGV[1] -> task ID
 // ARGV[2] -> uniqueness lock TTL
 // ARGV[3] -> score (process_at timestamp)
@@ -252,6 +483,7 @@ if not ok then
 end
 redis.call("ZADD", KEYS[2], ARGV[3], ARGV[4])
 redis.call("SADD", KEYS[3], ARGV[5])
+redis.call("HSET", KEYS[4], ARGV[1], ARGV[4])
 return 1
 `)
 
@@ -262,10 +494,10 @@ func (r *RDB) ScheduleUnique(msg *base.TaskMessage, processAt time.Time, ttl tim
 	if err != nil {
 		return err
 	}
-	qkey := base.QueueKey(msg.Queue)
+	qkey := r.keys.QueueKey(msg.Queue)
 	score := float64(processAt.Unix())
 	res, err := scheduleUniqueCmd.Run(r.client,
-		[]string{msg.UniqueKey, base.ScheduledQueue, base.AllQueues},
+		[]string{msg.UniqueKey, r.keys.ScheduledQueue(), r.keys.AllQueues(), r.keys.TaskIndex()},
 		msg.ID.String(), int(ttl.Seconds()), score, bytes, qkey).Result()
 	if err != nil {
 		return err
@@ -284,13 +516,18 @@ func (r *RDB) ScheduleUnique(msg *base.TaskMessage, processAt time.Time, ttl tim
 // KEYS[2] -> asynq:retry
 // KEYS[3] -> asynq:processed:<yyyy-mm-dd>
 // KEYS[4] -> asynq:failure:<yyyy-mm-dd>
-// ARGV[1] -> base.TaskMessage value to remove from base.InProgressQueue queue
+// KEYS[5] -> asynq:tasks
+// KEYS[6] -> asynq:leases
+// ARGV[1] -> base.TaskMessage value to remove from r.keys.InProgressQueue() queue
 // ARGV[2] -> base.TaskMessage value to add to Retry queue
 // ARGV[3] -> retry_at UNIX timestamp
 // ARGV[4] -> stats expiration timestamp
+// ARGV[5] -> task ID
 var retryCmd = redis.NewScript(`
 redis.call("LREM", KEYS[1], 0, ARGV[1])
+redis.call("ZREM", KEYS[6], ARGV[5])
 redis.call("ZADD", KEYS[2], ARGV[3], ARGV[2])
+redis.call("HSET", KEYS[5], ARGV[5], ARGV[2])
 local n = redis.call("INCR", KEYS[3])
 if tonumber(n) == 1 then
 	redis.call("EXPIREAT", KEYS[3], ARGV[4])
@@ -316,47 +553,74 @@ func (r *RDB) Retry(msg *base.TaskMessage, processAt time.Time, errMsg string) e
 		return err
 	}
 	now := time.Now()
-	processedKey := base.ProcessedKey(now)
-	failureKey := base.FailureKey(now)
+	processedKey := r.keys.ProcessedKey(now)
+	failureKey := r.keys.FailureKey(now)
 	expireAt := now.Add(statsTTL)
+	defer r.release(msg.ID.String())
 	return retryCmd.Run(r.client,
-		[]string{base.InProgressQueue, base.RetryQueue, processedKey, failureKey},
-		string(bytesToRemove), string(bytesToAdd), processAt.Unix(), expireAt.Unix()).Err()
+		[]string{r.keys.InProgressQueue(), r.keys.RetryQueue(), processedKey, failureKey, r.keys.TaskIndex(), r.keys.Leases()},
+		string(bytesToRemove), string(bytesToAdd), processAt.Unix(), expireAt.Unix(), msg.ID.String()).Err()
 }
 
-const (
-	maxDeadTasks         = 10000
-	deadExpirationInDays = 90
-)
+// KEYS[1] -> asynq:in_progress
+// KEYS[2] -> asynq:scheduled
+// KEYS[3] -> asynq:leases
+// ARGV[1] -> base.TaskMessage value
+// ARGV[2] -> process_at UNIX timestamp
+// ARGV[3] -> task ID
+var rescheduleCmd = redis.NewScript(`
+redis.call("LREM", KEYS[1], 0, ARGV[1])
+redis.call("ZREM", KEYS[3], ARGV[3])
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+return redis.status_reply("OK")`)
+
+// Reschedule moves the task from in-progress to scheduled queue
+// without modifying the task.
+// It does not count the task as processed or failed.
+func (r *RDB) Reschedule(msg *base.TaskMessage, processAt time.Time) error {
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	defer r.release(msg.ID.String())
+	return rescheduleCmd.Run(r.client,
+		[]string{r.keys.InProgressQueue(), r.keys.ScheduledQueue(), r.keys.Leases()},
+		string(bytes), processAt.Unix(), msg.ID.String()).Err()
+}
 
 // KEYS[1] -> asynq:in_progress
 // KEYS[2] -> asynq:dead
 // KEYS[3] -> asynq:processed:<yyyy-mm-dd>
 // KEYS[4] -> asynq.failure:<yyyy-mm-dd>
-// ARGV[1] -> base.TaskMessage value to remove from base.InProgressQueue queue
+// KEYS[5] -> asynq:tasks
+// KEYS[6] -> asynq:leases
+// KEYS[7] -> asynq:dead_queues
+// ARGV[1] -> base.TaskMessage value to remove from r.keys.InProgressQueue() queue
 // ARGV[2] -> base.TaskMessage value to add to Dead queue
 // ARGV[3] -> died_at UNIX timestamp
-// ARGV[4] -> cutoff timestamp (e.g., 90 days ago)
-// ARGV[5] -> max number of tasks in dead queue (e.g., 100)
-// ARGV[6] -> stats expiration timestamp
-var killCmd = redis.NewScript(`
+// ARGV[4] -> stats expiration timestamp
+// ARGV[5] -> task ID
+// ARGV[6] -> dead index prefix
+var killCmd = redis.NewScript(DeadIndexScript + `
 redis.call("LREM", KEYS[1], 0, ARGV[1])
+redis.call("ZREM", KEYS[6], ARGV[5])
 redis.call("ZADD", KEYS[2], ARGV[3], ARGV[2])
-redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[4])
-redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -ARGV[5])
+indexDead(KEYS[7], ARGV[6], ARGV[2], ARGV[3])
+redis.call("HSET", KEYS[5], ARGV[5], ARGV[2])
 local n = redis.call("INCR", KEYS[3])
 if tonumber(n) == 1 then
-	redis.call("EXPIREAT", KEYS[3], ARGV[6])
+	redis.call("EXPIREAT", KEYS[3], ARGV[4])
 end
 local m = redis.call("INCR", KEYS[4])
 if tonumber(m) == 1 then
-	redis.call("EXPIREAT", KEYS[4], ARGV[6])
+	redis.call("EXPIREAT", KEYS[4], ARGV[4])
 end
 return redis.status_reply("OK")`)
 
 // Kill sends the task to "dead" queue from in-progress queue, assigning
 // the error message to the task.
-// It also trims the set by timestamp and set size.
+//
+// The dead queue is not trimmed, servers trim it periodically with TrimDead.
 func (r *RDB) Kill(msg *base.TaskMessage, errMsg string) error {
 	bytesToRemove, err := json.Marshal(msg)
 	if err != nil {
@@ -368,35 +632,540 @@ func (r *RDB) Kill(msg *base.TaskMessage, errMsg string) error {
 	if err != nil {
 		return err
 	}
+	defer r.release(msg.ID.String())
+	return r.kill(msg.ID.String(), string(bytesToRemove), string(bytesToAdd))
+}
+
+func (r *RDB) kill(id, msgToRemove, msgToAdd string) error {
 	now := time.Now()
-	limit := now.AddDate(0, 0, -deadExpirationInDays).Unix() // 90 days ago
-	processedKey := base.ProcessedKey(now)
-	failureKey := base.FailureKey(now)
+	processedKey := r.keys.ProcessedKey(now)
+	failureKey := r.keys.FailureKey(now)
 	expireAt := now.Add(statsTTL)
 	return killCmd.Run(r.client,
-		[]string{base.InProgressQueue, base.DeadQueue, processedKey, failureKey},
-		string(bytesToRemove), string(bytesToAdd), now.Unix(), limit, maxDeadTasks, expireAt.Unix()).Err()
+		[]string{r.keys.InProgressQueue(), r.keys.DeadQueue(), processedKey, failureKey, r.keys.TaskIndex(), r.keys.Leases(), r.keys.DeadQueues()},
+		msgToRemove, msgToAdd, now.Unix(), expireAt.Unix(), id, r.keys.DeadIndexPrefix()).Err()
+}
+
+// DeadIndexScript is the part of the scripts which add tasks to or remove
+// tasks from the dead queue. It keeps the per-queue indexes of dead tasks
+// used by TrimDead, see base.Keys.DeadIndexKey.
+//
+// indexDead(queues, prefix, msg, score) indexes the message added to the dead
+// queue, given the asynq:dead_queues key and the dead index prefix.
+// unindexDead(prefix, msg) removes the message from its index;
+// it does nothing if prefix is empty.
+const DeadIndexScript = `
+local function deadEntry(msg)
+	local ok, decoded = pcall(cjson.decode, msg)
+	if ok and type(decoded) == "table" and type(decoded["ID"]) == "string" and type(decoded["Queue"]) == "string" then
+		return decoded["ID"], decoded["Queue"]
+	end
+	return nil, nil
+end
+local function indexDead(queues, prefix, msg, score)
+	local id, qname = deadEntry(msg)
+	if id then
+		redis.call("ZADD", prefix .. qname, score, id)
+		redis.call("SADD", queues, qname)
+	end
+end
+local function unindexDead(prefix, msg)
+	if prefix == "" then
+		return
+	end
+	local id, qname = deadEntry(msg)
+	if id then
+		redis.call("ZREM", prefix .. qname, id)
+	end
+end
+`
+
+// deadIndexPrefix returns the dead index prefix for the scripts which take
+// any sorted set of tasks, or an empty string if zset is not the dead queue.
+func (r *RDB) deadIndexPrefix(zset string) string {
+	if zset == r.keys.DeadQueue() {
+		return r.keys.DeadIndexPrefix()
+	}
+	return ""
+}
+
+const (
+	// trimBatchSize is the max number of dead tasks evicted at once.
+	trimBatchSize = 100
+
+	// deadScanSize is the number of dead tasks read at once
+	// when rebuilding the dead task indexes.
+	deadScanSize = 1000
+
+	// trimLockTTL is the max duration the dead queue is locked for trimming.
+	trimLockTTL = time.Minute
+)
+
+// KEYS[1] -> asynq:dead:lock
+// ARGV[1] -> lock token
+var releaseLockCmd = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// TrimDead removes dead tasks which exceed the given retention limits
+// and returns the number of tasks removed.
+//
+// Dead tasks from the queues in perQueue are subject to the limits for the
+// queue, other dead tasks are subject to def. The oldest tasks are removed
+// first. Tasks are passed to evict in batches before they are removed;
+// if evict returns an error, the batch is kept in the dead queue.
+//
+// Only one caller trims the dead queue at a time. If another caller is
+// trimming it, TrimDead returns immediately. Callers trimming with different
+// limits don't coordinate, so the dead queue ends up trimmed to the strictest
+// limits used by any of them.
+//
+// Tasks are not trimmed as they are killed, so tasks killed while no caller
+// runs TrimDead, e.g. from the CLI with no server running, stay in the dead
+// queue until the next call.
+//
+// The tasks to remove for per-queue limits are found through the per-queue
+// indexes of the dead queue, so only the tasks removed are read. The indexes
+// are rebuilt if they don't match the dead queue, e.g. after upgrading from
+// a version which didn't index dead tasks.
+func (r *RDB) TrimDead(def base.Retention, perQueue map[string]base.Retention, evict func([]*base.DeadEntry) error) (int, error) {
+	token := xid.New().String()
+	ok, err := r.client.SetNX(r.keys.DeadTrimLock(), token, trimLockTTL).Result()
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, nil
+	}
+	defer releaseLockCmd.Run(r.client, []string{r.keys.DeadTrimLock()}, token)
+
+	if len(perQueue) == 0 {
+		return r.trimDead(def, evict)
+	}
+	sizes, err := r.syncDeadIndex()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		n     int
+		other []string // queues subject to def
+		size  int64    // number of dead tasks from other
+	)
+	for qname, sz := range sizes {
+		ret, ok := perQueue[qname]
+		if !ok {
+			other = append(other, qname)
+			size += sz
+			continue
+		}
+		removed, err := r.trimDeadIndex([]string{qname}, sz, ret, evict)
+		n += removed
+		if err != nil {
+			return n, err
+		}
+	}
+	removed, err := r.trimDeadIndex(other, size, def, evict)
+	return n + removed, err
+}
+
+// trimDead removes the oldest dead tasks which exceed the limits.
+func (r *RDB) trimDead(ret base.Retention, evict func([]*base.DeadEntry) error) (int, error) {
+	var k int64 // number of tasks to remove
+	if ret.MaxSize > 0 {
+		size, err := r.client.ZCard(r.keys.DeadQueue()).Result()
+		if err != nil {
+			return 0, err
+		}
+		if excess := size - int64(ret.MaxSize); excess > k {
+			k = excess
+		}
+	}
+	if ret.MaxAge > 0 {
+		cutoff := time.Now().Add(-ret.MaxAge).Unix()
+		expired, err := r.client.ZCount(r.keys.DeadQueue(), "-inf", strconv.FormatInt(cutoff, 10)).Result()
+		if err != nil {
+			return 0, err
+		}
+		if expired > k {
+			k = expired
+		}
+	}
+	var n int
+	for k > 0 {
+		size := k
+		if size > trimBatchSize {
+			size = trimBatchSize
+		}
+		batch, err := r.client.ZRangeWithScores(r.keys.DeadQueue(), 0, size-1).Result()
+		if err != nil {
+			return n, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		k -= int64(len(batch))
+		removed, err := r.evictDead(batch, evict)
+		n += removed
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// trimDeadIndex removes the oldest dead tasks from the given queues which
+// exceed the limits, given the number of dead tasks from the queues.
+func (r *RDB) trimDeadIndex(qnames []string, size int64, ret base.Retention, evict func([]*base.DeadEntry) error) (int, error) {
+	if len(qnames) == 0 {
+		return 0, nil
+	}
+	var k int64 // number of tasks to remove
+	if ret.MaxSize > 0 {
+		if excess := size - int64(ret.MaxSize); excess > k {
+			k = excess
+		}
+	}
+	if ret.MaxAge > 0 {
+		cutoff := strconv.FormatInt(time.Now().Add(-ret.MaxAge).Unix(), 10)
+		pipe := r.client.Pipeline()
+		counts := make([]*redis.IntCmd, len(qnames))
+		for i, qname := range qnames {
+			counts[i] = pipe.ZCount(r.keys.DeadIndexKey(qname), "-inf", cutoff)
+		}
+		if _, err := pipe.Exec(); err != nil {
+			return 0, err
+		}
+		var expired int64
+		for _, c := range counts {
+			expired += c.Val()
+		}
+		if expired > k {
+			k = expired
+		}
+	}
+	var n int
+	for k > 0 {
+		size := k
+		if size > trimBatchSize {
+			size = trimBatchSize
+		}
+		batch, stale, err := r.oldestDead(qnames, size)
+		if err != nil {
+			return n, err
+		}
+		if len(batch)+stale == 0 {
+			break
+		}
+		k -= int64(len(batch) + stale)
+		removed, err := r.evictDead(batch, evict)
+		n += removed
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// deadIndexEntry is a task in a dead task index.
+type deadIndexEntry struct {
+	qname string
+	id    string
+	score float64
+}
+
+// oldestDead returns up to limit oldest dead tasks from the given queues
+// according to the dead task indexes. Index entries of tasks which are
+// no longer in the dead queue are removed, and their number is returned.
+func (r *RDB) oldestDead(qnames []string, limit int64) ([]redis.Z, int, error) {
+	pipe := r.client.Pipeline()
+	ranges := make([]*redis.ZSliceCmd, len(qnames))
+	for i, qname := range qnames {
+		ranges[i] = pipe.ZRangeWithScores(r.keys.DeadIndexKey(qname), 0, limit-1)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, 0, err
+	}
+	var entries []deadIndexEntry
+	for i, c := range ranges {
+		for _, z := range c.Val() {
+			entries = append(entries, deadIndexEntry{qnames[i], cast.ToString(z.Member), z.Score})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].score < entries[j].score })
+	if int64(len(entries)) > limit {
+		entries = entries[:limit]
+	}
+	return r.lookupDead(entries)
+}
+
+// lookupDead returns the dead tasks of the index entries. Index entries of
+// tasks which are no longer in the dead queue are removed, and their number
+// is returned.
+func (r *RDB) lookupDead(entries []deadIndexEntry) ([]redis.Z, int, error) {
+	if len(entries) == 0 {
+		return nil, 0, nil
+	}
+	ids := make([]string, len(entries))
+	for i, e := range entries {
+		ids[i] = e.id
+	}
+	msgs, err := r.client.HMGet(r.keys.TaskIndex(), ids...).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	pipe := r.client.Pipeline()
+	scores := make([]*redis.FloatCmd, len(entries))
+	for i, m := range msgs {
+		if s, ok := m.(string); ok {
+			scores[i] = pipe.ZScore(r.keys.DeadQueue(), s)
+		}
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, 0, err
+	}
+	var batch []redis.Z
+	pipe = r.client.Pipeline()
+	for i, e := range entries {
+		if scores[i] != nil && scores[i].Err() == nil {
+			batch = append(batch, redis.Z{Score: scores[i].Val(), Member: msgs[i]})
+			continue
+		}
+		pipe.ZRem(r.keys.DeadIndexKey(e.qname), e.id)
+	}
+	stale := len(entries) - len(batch)
+	if _, err := pipe.Exec(); err != nil {
+		return nil, 0, err
+	}
+	return batch, stale, nil
+}
+
+// KEYS[1] -> asynq:dead
+// KEYS[2] -> asynq:dead_queues
+// ARGV[1] -> dead index prefix
+//
+// Returns the size of the dead queue followed by the names of the queues
+// with dead tasks and the size of their index. Queues with an empty index
+// are removed from KEYS[2].
+var deadIndexSizesCmd = redis.NewScript(`
+local res = {redis.call("ZCARD", KEYS[1])}
+for _, qname in ipairs(redis.call("SMEMBERS", KEYS[2])) do
+	local n = redis.call("ZCARD", ARGV[1] .. qname)
+	if n == 0 then
+		redis.call("SREM", KEYS[2], qname)
+	else
+		table.insert(res, qname)
+		table.insert(res, n)
+	end
+end
+return res`)
+
+// deadIndexSizes returns the size of the dead queue and the size of
+// the dead task index of each queue.
+func (r *RDB) deadIndexSizes() (int64, map[string]int64, error) {
+	res, err := deadIndexSizesCmd.Run(r.client,
+		[]string{r.keys.DeadQueue(), r.keys.DeadQueues()}, r.keys.DeadIndexPrefix()).Result()
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := cast.ToSliceE(res)
+	if err != nil || len(data) == 0 {
+		return 0, nil, fmt.Errorf("unexpected return value from lua script: %v", res)
+	}
+	total, err := cast.ToInt64E(data[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	sizes := make(map[string]int64)
+	for i := 1; i+1 < len(data); i += 2 {
+		n, err := cast.ToInt64E(data[i+1])
+		if err != nil {
+			return 0, nil, err
+		}
+		sizes[cast.ToString(data[i])] = n
+	}
+	return total, sizes, nil
+}
+
+// syncDeadIndex returns the number of dead tasks by queue according to
+// the dead task indexes. It rebuilds the indexes first if they don't match
+// the dead queue.
+func (r *RDB) syncDeadIndex() (map[string]int64, error) {
+	total, sizes, err := r.deadIndexSizes()
+	if err != nil {
+		return nil, err
+	}
+	indexed := int64(0)
+	for _, n := range sizes {
+		indexed += n
+	}
+	r.mu.Lock()
+	unindexed := r.unindexedDead
+	r.mu.Unlock()
+	if indexed+unindexed == total {
+		return sizes, nil
+	}
+	if err := r.rebuildDeadIndex(sizes); err != nil {
+		return nil, err
+	}
+	_, sizes, err = r.deadIndexSizes()
+	return sizes, err
+}
+
+// rebuildDeadIndex indexes all dead tasks and removes the index entries of
+// tasks which are not in the dead queue from the given indexes.
+// Dead tasks missing from the task index, e.g. tasks killed before the task
+// index was added, are added to it.
+//
+// Tasks added to or removed from the dead queue while rebuilding the indexes
+// update the indexes themselves, so the indexes are not locked.
+func (r *RDB) rebuildDeadIndex(sizes map[string]int64) error {
+	var unindexed int64
+	for start := int64(0); ; start += deadScanSize {
+		page, err := r.client.ZRangeWithScores(r.keys.DeadQueue(), start, start+deadScanSize-1).Result()
+		if err != nil {
+			return err
+		}
+		pipe := r.client.Pipeline()
+		for _, z := range page {
+			var msg base.TaskMessage
+			if err := json.Unmarshal([]byte(cast.ToString(z.Member)), &msg); err != nil {
+				unindexed++
+				continue
+			}
+			pipe.HSetNX(r.keys.TaskIndex(), msg.ID.String(), z.Member)
+			pipe.ZAdd(r.keys.DeadIndexKey(msg.Queue), &redis.Z{Score: z.Score, Member: msg.ID.String()})
+			pipe.SAdd(r.keys.DeadQueues(), msg.Queue)
+		}
+		if _, err := pipe.Exec(); err != nil {
+			return err
+		}
+		if len(page) < deadScanSize {
+			break
+		}
+	}
+	r.mu.Lock()
+	r.unindexedDead = unindexed
+	r.mu.Unlock()
+	for qname := range sizes {
+		key := r.keys.DeadIndexKey(qname)
+		for start := int64(0); ; start += deadScanSize {
+			page, err := r.client.ZRangeWithScores(key, start, start+deadScanSize-1).Result()
+			if err != nil {
+				return err
+			}
+			entries := make([]deadIndexEntry, len(page))
+			for i, z := range page {
+				entries[i] = deadIndexEntry{qname, cast.ToString(z.Member), z.Score}
+			}
+			_, stale, err := r.lookupDead(entries)
+			if err != nil {
+				return err
+			}
+			if len(page) < deadScanSize {
+				break
+			}
+			start -= int64(stale) // removed entries shift the rest of the index
+		}
+	}
+	return nil
+}
+
+// evictDead passes the given dead tasks to evict and removes them
+// from the dead queue. Tasks which cannot be decoded are kept.
+func (r *RDB) evictDead(batch []redis.Z, evict func([]*base.DeadEntry) error) (int, error) {
+	var (
+		entries []*base.DeadEntry
+		members []interface{}
+		ids     []string
+		qnames  []string
+	)
+	for _, z := range batch {
+		var msg base.TaskMessage
+		if err := json.Unmarshal([]byte(cast.ToString(z.Member)), &msg); err != nil {
+			continue
+		}
+		entries = append(entries, &base.DeadEntry{Msg: &msg, DiedAt: time.Unix(int64(z.Score), 0)})
+		members = append(members, z.Member)
+		ids = append(ids, msg.ID.String())
+		qnames = append(qnames, msg.Queue)
+	}
+	if len(members) == 0 {
+		return 0, nil
+	}
+	if evict != nil {
+		if err := evict(entries); err != nil {
+			return 0, err
+		}
+	}
+	pipe := r.client.TxPipeline()
+	zrem := pipe.ZRem(r.keys.DeadQueue(), members...)
+	pipe.HDel(r.keys.TaskIndex(), ids...)
+	for i, id := range ids {
+		pipe.ZRem(r.keys.DeadIndexKey(qnames[i]), id)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return 0, err
+	}
+	return int(zrem.Val()), nil
+}
+
+// maxHistoryEvents is the max number of events kept in the history of a task.
+const maxHistoryEvents = 100
+
+// KEYS[1] -> asynq:history:<task_id>
+// ARGV[1] -> event data
+// ARGV[2] -> max number of events
+// ARGV[3] -> history expiration in seconds
+var recordEventCmd = redis.NewScript(`
+redis.call("RPUSH", KEYS[1], ARGV[1])
+redis.call("LTRIM", KEYS[1], -ARGV[2], -1)
+redis.call("EXPIRE", KEYS[1], ARGV[3])
+return redis.status_reply("OK")`)
+
+// RecordEvent appends the event to the history of the task with the given ID.
+// Only the latest events are kept, and the history expires ttl after
+// the last event.
+func (r *RDB) RecordEvent(id string, e *base.TaskEvent, ttl time.Duration) error {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return recordEventCmd.Run(r.client, []string{r.keys.HistoryKey(id)},
+		string(bytes), maxHistoryEvents, int64(ttl.Seconds())).Err()
 }
 
 // KEYS[1] -> asynq:in_progress
+// KEYS[2] -> asynq:leases
 // ARGV[1] -> queue prefix
+// ARGV[2] -> notification key prefix
+// ARGV[3] -> max number of pending notifications
 var requeueAllCmd = redis.NewScript(`
 local msgs = redis.call("LRANGE", KEYS[1], 0, -1)
 for _, msg in ipairs(msgs) do
 	local decoded = cjson.decode(msg)
 	local qkey = ARGV[1] .. decoded["Queue"]
+	local nkey = ARGV[2] .. decoded["Queue"]
 	redis.call("RPUSH", qkey, msg)
 	redis.call("LREM", KEYS[1], 0, msg)
+	redis.call("ZREM", KEYS[2], decoded["ID"])
+	redis.call("LPUSH", nkey, 1)
+	redis.call("LTRIM", nkey, 0, ARGV[3] - 1)
 end
 return table.getn(msgs)`)
 
 // RequeueAll moves all tasks from in-progress list to the queue
 // and reports the number of tasks restored.
 func (r *RDB) RequeueAll() (int64, error) {
-	res, err := requeueAllCmd.Run(r.client, []string{base.InProgressQueue}, base.QueuePrefix).Result()
+	res, err := requeueAllCmd.Run(r.client, []string{r.keys.InProgressQueue(), r.keys.Leases()},
+		r.keys.QueuePrefix(), r.keys.NotificationPrefix(), maxNotifications).Result()
 	if err != nil {
 		return 0, err
 	}
+	r.mu.Lock()
+	r.leased = make(map[string]struct{})
+	r.mu.Unlock()
 	n, ok := res.(int64)
 	if !ok {
 		return 0, fmt.Errorf("could not cast %v to int64", res)
@@ -404,16 +1173,186 @@ func (r *RDB) RequeueAll() (int64, error) {
 	return n, nil
 }
 
+// KEYS[1] -> asynq:in_progress
+// KEYS[2] -> asynq:leases
+// KEYS[3] -> asynq:tasks
+// KEYS[4] -> asynq:queues:<qname>
+// KEYS[5] -> asynq:notify:<qname>
+// KEYS[6] -> asynq:dead
+// KEYS[7] -> asynq:processed:<yyyy-mm-dd>
+// KEYS[8] -> asynq:failure:<yyyy-mm-dd>
+// KEYS[9] -> asynq:dead_queues
+// ARGV[1] -> base.TaskMessage value to remove from r.keys.InProgressQueue() queue
+// ARGV[2] -> base.TaskMessage value to push back to the queue or to add to the dead queue
+// ARGV[3] -> task ID
+// ARGV[4] -> current unix time
+// ARGV[5] -> "dead" to move the task to the dead queue
+// ARGV[6] -> max number of pending notifications
+// ARGV[7] -> stats expiration timestamp
+// ARGV[8] -> dead index prefix
+// Note: The task is recovered only if it is still in the in-progress queue
+// and its lease has not been renewed in the meantime.
+var recoverCmd = redis.NewScript(DeadIndexScript + `
+local exp = redis.call("ZSCORE", KEYS[2], ARGV[3])
+if exp and tonumber(exp) > tonumber(ARGV[4]) then
+	return 0
+end
+if redis.call("LREM", KEYS[1], 0, ARGV[1]) == 0 then
+	return 0
+end
+redis.call("ZREM", KEYS[2], ARGV[3])
+redis.call("HSET", KEYS[3], ARGV[3], ARGV[2])
+if ARGV[5] == "dead" then
+	redis.call("ZADD", KEYS[6], ARGV[4], ARGV[2])
+	indexDead(KEYS[9], ARGV[8], ARGV[2], ARGV[4])
+	for i = 7, 8 do
+		if redis.call("INCR", KEYS[i]) == 1 then
+			redis.call("EXPIREAT", KEYS[i], ARGV[7])
+		end
+	end
+	return 1
+end
+redis.call("RPUSH", KEYS[4], ARGV[2])
+redis.call("LPUSH", KEYS[5], 1)
+redis.call("LTRIM", KEYS[5], 0, ARGV[6] - 1)
+return 1`)
+
+// RecoverAll moves the tasks left in in-progress list by crashed servers back
+// to their queues, incrementing the number of times each task has been recovered.
+// A task that has been recovered more than maxRecovery times is moved
+// to the dead queue with the given error message instead.
+// Negative maxRecovery means no limit.
+//
+// A task is left by a crashed server if its lease has expired, that is if the
+// server which dequeued the task has not sent a heartbeat for a while.
+// Tasks still processed by running servers are not recovered.
+//
+// r keeps recovering tasks from crashed servers periodically in CheckAndEnqueue
+// using the limit and the error message given to the last call to RecoverAll.
+//
+// It reports the number of tasks requeued and the number of tasks killed.
+func (r *RDB) RecoverAll(maxRecovery int, errMsg string) (requeued, killed int64, err error) {
+	r.mu.Lock()
+	r.recovering = true
+	r.maxRecovery = maxRecovery
+	r.errMsg = errMsg
+	r.mu.Unlock()
+	return r.recover(maxRecovery, errMsg)
+}
+
+func (r *RDB) recover(maxRecovery int, errMsg string) (requeued, killed int64, err error) {
+	data, err := r.client.LRange(r.keys.InProgressQueue(), 0, -1).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	leases, err := r.client.ZRangeWithScores(r.keys.Leases(), 0, -1).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	now := time.Now()
+	expireAt := make(map[string]int64)
+	for _, z := range leases {
+		if id, ok := z.Member.(string); ok {
+			expireAt[id] = int64(z.Score)
+		}
+	}
+	inProgress := make(map[string]bool)
+	for _, s := range data {
+		var msg base.TaskMessage
+		if err := json.Unmarshal([]byte(s), &msg); err != nil {
+			continue // bad data, ignore and continue
+		}
+		id := msg.ID.String()
+		inProgress[id] = true
+		if exp, ok := expireAt[id]; ok && exp > now.Unix() {
+			continue // processed by a running server
+		}
+		msg.Recovered++
+		dead := maxRecovery >= 0 && msg.Recovered > maxRecovery
+		if dead {
+			msg.ErrorMsg = errMsg
+		}
+		bytes, err := json.Marshal(&msg)
+		if err != nil {
+			return requeued, killed, err
+		}
+		var dst string
+		if dead {
+			dst = "dead"
+		}
+		keys := []string{
+			r.keys.InProgressQueue(),
+			r.keys.Leases(),
+			r.keys.TaskIndex(),
+			r.keys.QueueKey(msg.Queue),
+			r.keys.NotificationKey(msg.Queue),
+			r.keys.DeadQueue(),
+			r.keys.ProcessedKey(now),
+			r.keys.FailureKey(now),
+			r.keys.DeadQueues(),
+		}
+		res, err := recoverCmd.Run(r.client, keys,
+			s, string(bytes), id, now.Unix(), dst, maxNotifications, now.Add(statsTTL).Unix(), r.keys.DeadIndexPrefix()).Result()
+		if err != nil {
+			return requeued, killed, err
+		}
+		if n, ok := res.(int64); !ok || n != 1 {
+			continue
+		}
+		if dead {
+			killed++
+		} else {
+			requeued++
+		}
+	}
+	// Remove the expired leases of the tasks which are no longer in progress.
+	var stale []interface{}
+	for id, exp := range expireAt {
+		if !inProgress[id] && exp <= now.Unix() {
+			stale = append(stale, id)
+		}
+	}
+	if len(stale) > 0 {
+		if err := r.client.ZRem(r.keys.Leases(), stale...).Err(); err != nil {
+			return requeued, killed, err
+		}
+	}
+	return requeued, killed, nil
+}
+
+// needsRecovery reports whether there may be tasks left in in-progress list
+// by crashed servers, that is tasks with no lease or with an expired lease.
+func (r *RDB) needsRecovery() (bool, error) {
+	n, err := r.client.LLen(r.keys.InProgressQueue()).Result()
+	if err != nil {
+		return false, err
+	}
+	leases, err := r.client.ZCard(r.keys.Leases()).Result()
+	if err != nil {
+		return false, err
+	}
+	if n > leases {
+		return true, nil
+	}
+	expired, err := r.client.ZCount(r.keys.Leases(), "-inf", strconv.FormatInt(time.Now().Unix(), 10)).Result()
+	if err != nil {
+		return false, err
+	}
+	return expired > 0, nil
+}
+
 // CheckAndEnqueue checks for all scheduled tasks and enqueues any tasks that
 // have to be processed.
 //
 // qnames specifies to which queues to send tasks.
+//
+// It also recovers tasks from crashed servers once RecoverAll has been called.
 func (r *RDB) CheckAndEnqueue(qnames ...string) error {
-	delayed := []string{base.ScheduledQueue, base.RetryQueue}
+	delayed := []string{r.keys.ScheduledQueue(), r.keys.RetryQueue()}
 	for _, zset := range delayed {
 		var err error
 		if len(qnames) == 1 {
-			err = r.forwardSingle(zset, base.QueueKey(qnames[0]))
+			err = r.forwardSingle(zset, qnames[0])
 		} else {
 			err = r.forward(zset)
 		}
@@ -421,19 +1360,35 @@ func (r *RDB) CheckAndEnqueue(qnames ...string) error {
 			return err
 		}
 	}
-	return nil
+	r.mu.Lock()
+	recovering, maxRecovery, errMsg := r.recovering, r.maxRecovery, r.errMsg
+	r.mu.Unlock()
+	if !recovering {
+		return nil
+	}
+	ok, err := r.needsRecovery()
+	if err != nil || !ok {
+		return err
+	}
+	_, _, err = r.recover(maxRecovery, errMsg)
+	return err
 }
 
 // KEYS[1] -> source queue (e.g. scheduled or retry queue)
 // ARGV[1] -> current unix time
 // ARGV[2] -> queue prefix
+// ARGV[3] -> notification key prefix
+// ARGV[4] -> max number of pending notifications
 var forwardCmd = redis.NewScript(`
 local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
 for _, msg in ipairs(msgs) do
 	local decoded = cjson.decode(msg)
 	local qkey = ARGV[2] .. decoded["Queue"]
+	local nkey = ARGV[3] .. decoded["Queue"]
 	redis.call("LPUSH", qkey, msg)
 	redis.call("ZREM", KEYS[1], msg)
+	redis.call("LPUSH", nkey, 1)
+	redis.call("LTRIM", nkey, 0, ARGV[4] - 1)
 end
 return msgs`)
 
@@ -442,25 +1397,30 @@ return msgs`)
 func (r *RDB) forward(src string) error {
 	now := float64(time.Now().Unix())
 	return forwardCmd.Run(r.client,
-		[]string{src}, now, base.QueuePrefix).Err()
+		[]string{src}, now, r.keys.QueuePrefix(), r.keys.NotificationPrefix(), maxNotifications).Err()
 }
 
 // KEYS[1] -> source queue (e.g. scheduled or retry queue)
 // KEYS[2] -> destination queue
+// KEYS[3] -> notification key of the destination queue
+// ARGV[1] -> current unix time
+// ARGV[2] -> max number of pending notifications
 var forwardSingleCmd = redis.NewScript(`
 local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
 for _, msg in ipairs(msgs) do
 	redis.call("LPUSH", KEYS[2], msg)
 	redis.call("ZREM", KEYS[1], msg)
+	redis.call("LPUSH", KEYS[3], 1)
 end
+redis.call("LTRIM", KEYS[3], 0, ARGV[2] - 1)
 return msgs`)
 
 // forwardSingle moves all tasks with a score less than the current unix time
-// from the src zset to dst list.
-func (r *RDB) forwardSingle(src, dst string) error {
+// from the src zset to the queue.
+func (r *RDB) forwardSingle(src, qname string) error {
 	now := float64(time.Now().Unix())
 	return forwardSingleCmd.Run(r.client,
-		[]string{src, dst}, now).Err()
+		[]string{src, r.keys.QueueKey(qname), r.keys.NotificationKey(qname)}, now, maxNotifications).Err()
 }
 
 // KEYS[1]  -> asynq:servers:<host:pid:sid>
@@ -485,6 +1445,7 @@ redis.call("ZADD", KEYS[4], ARGV[1], KEYS[3])
 return redis.status_reply("OK")`)
 
 // WriteServerState writes server state data to redis with expiration  set to the value ttl.
+// It also renews the leases of the tasks dequeued by r.
 func (r *RDB) WriteServerState(ss *base.ServerState, ttl time.Duration) error {
 	info := ss.GetInfo()
 	bytes, err := json.Marshal(info)
@@ -502,11 +1463,31 @@ func (r *RDB) WriteServerState(ss *base.ServerState, ttl time.Duration) error {
 		}
 		args = append(args, w.ID.String(), bytes)
 	}
-	skey := base.ServerInfoKey(info.Host, info.PID, info.ServerID)
-	wkey := base.WorkersKey(info.Host, info.PID, info.ServerID)
-	return writeProcessInfoCmd.Run(r.client,
-		[]string{skey, base.AllServers, wkey, base.AllWorkers},
+	skey := r.keys.ServerInfoKey(info.Host, info.PID, info.ServerID)
+	wkey := r.keys.WorkersKey(info.Host, info.PID, info.ServerID)
+	err = writeProcessInfoCmd.Run(r.client,
+		[]string{skey, r.keys.AllServers(), wkey, r.keys.AllWorkers()},
 		args...).Err()
+	if err != nil {
+		return err
+	}
+	return r.renewLeases()
+}
+
+// renewLeases extends the leases of the tasks dequeued by r.
+// Leases removed in the meantime, e.g. by RecoverAll, are not renewed.
+func (r *RDB) renewLeases() error {
+	r.mu.Lock()
+	var leases []*redis.Z
+	exp := float64(time.Now().Add(leaseTTL).Unix())
+	for id := range r.leased {
+		leases = append(leases, &redis.Z{Member: id, Score: exp})
+	}
+	r.mu.Unlock()
+	if len(leases) == 0 {
+		return nil
+	}
+	return r.client.ZAddXX(r.keys.Leases(), leases...).Err()
 }
 
 // KEYS[1] -> asynq:servers
@@ -524,24 +1505,169 @@ return redis.status_reply("OK")`)
 func (r *RDB) ClearServerState(ss *base.ServerState) error {
 	info := ss.GetInfo()
 	host, pid, id := info.Host, info.PID, info.ServerID
-	skey := base.ServerInfoKey(host, pid, id)
-	wkey := base.WorkersKey(host, pid, id)
+	skey := r.keys.ServerInfoKey(host, pid, id)
+	wkey := r.keys.WorkersKey(host, pid, id)
 	return clearProcessInfoCmd.Run(r.client,
-		[]string{base.AllServers, skey, base.AllWorkers, wkey}).Err()
+		[]string{r.keys.AllServers(), skey, r.keys.AllWorkers(), wkey}).Err()
 }
 
-// CancelationPubSub returns a pubsub for cancelation messages.
-func (r *RDB) CancelationPubSub() (*redis.PubSub, error) {
-	pubsub := r.client.Subscribe(base.CancelChannel)
+// SubscribeCancelation returns a subscription to cancelation messages.
+func (r *RDB) SubscribeCancelation() (base.Subscription, error) {
+	pubsub := r.client.Subscribe(r.keys.CancelChannel())
 	_, err := pubsub.Receive()
 	if err != nil {
 		return nil, err
 	}
-	return pubsub, nil
+	sub := &subscription{
+		pubsub: pubsub,
+		ch:     make(chan string),
+		done:   make(chan struct{}),
+	}
+	go sub.forward()
+	return sub, nil
+}
+
+// subscription implements base.Subscription on top of redis pub/sub.
+type subscription struct {
+	pubsub *redis.PubSub
+	ch     chan string
+
+	// closed when the subscription is closed.
+	done chan struct{}
+	once sync.Once
+}
+
+// forward sends the payload of each pub/sub message to the channel
+// until the subscription is closed.
+func (s *subscription) forward() {
+	defer close(s.ch)
+	msgs := s.pubsub.Channel()
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			select {
+			case s.ch <- msg.Payload:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+func (s *subscription) Channel() <-chan string {
+	return s.ch
+}
+
+func (s *subscription) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return s.pubsub.Close()
 }
 
 // PublishCancelation publish cancelation message to all subscribers.
 // The message is the ID for the task to be canceled.
 func (r *RDB) PublishCancelation(id string) error {
-	return r.client.Publish(base.CancelChannel, id).Err()
+	return r.client.Publish(r.keys.CancelChannel(), id).Err()
+}
+
+// KEYS[1] -> asynq:tasks
+// KEYS[2] -> asynq:scheduled
+// KEYS[3] -> asynq:retry
+// KEYS[4] -> asynq:dead
+// KEYS[5] -> asynq:canceled:<task_id>
+// ARGV[1] -> task ID
+// ARGV[2] -> tombstone TTL in seconds
+// ARGV[3] -> queue key prefix
+//
+// Returns 0 if the task is not found or already dead, 1 if the task is
+// removed, and 2 if the task is not waiting to be processed and a tombstone
+// is recorded.
+var cancelCmd = redis.NewScript(`
+local msg = redis.call("HGET", KEYS[1], ARGV[1])
+if not msg or redis.call("ZSCORE", KEYS[4], msg) then
+	return 0
+end
+local decoded = cjson.decode(msg)
+local qkey = ARGV[3] .. string.lower(decoded["Queue"])
+if redis.call("ZREM", KEYS[2], msg) == 1 or
+   redis.call("ZREM", KEYS[3], msg) == 1 or
+   redis.call("LREM", qkey, 0, msg) > 0 then
+	redis.call("HDEL", KEYS[1], ARGV[1])
+	local ukey = decoded["UniqueKey"]
+	if type(ukey) == "string" and string.len(ukey) > 0 and redis.call("GET", ukey) == ARGV[1] then
+		redis.call("DEL", ukey)
+	end
+	return 1
+end
+redis.call("SET", KEYS[5], 1, "EX", ARGV[2])
+return 2`)
+
+// Cancel removes the task with the given id from its queue or the scheduled
+// or retry queue, releasing its uniqueness lock.
+// If the task is not waiting to be processed, it records a tombstone
+// for the task which expires after ttl so that the task is skipped if it
+// has been dequeued but not yet started.
+func (r *RDB) Cancel(id string, ttl time.Duration) (base.CancelResult, error) {
+	keys := []string{
+		r.keys.TaskIndex(),
+		r.keys.ScheduledQueue(),
+		r.keys.RetryQueue(),
+		r.keys.DeadQueue(),
+		r.keys.TombstoneKey(id),
+	}
+	res, err := cancelCmd.Run(r.client, keys, id, int(ttl.Seconds()), r.keys.QueuePrefix()).Result()
+	if err != nil {
+		return base.CancelNotFound, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return base.CancelNotFound, fmt.Errorf("could not cast %v to int64", res)
+	}
+	return base.CancelResult(n), nil
+}
+
+// KEYS[1] -> asynq:canceled:<task_id>
+// KEYS[2] -> asynq:in_progress
+// KEYS[3] -> asynq:tasks
+// KEYS[4] -> asynq:leases
+// KEYS[5] -> unique key, if any
+// ARGV[1] -> base.TaskMessage value
+// ARGV[2] -> task ID
+var skipCanceledCmd = redis.NewScript(`
+if redis.call("DEL", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("LREM", KEYS[2], 0, ARGV[1])
+redis.call("HDEL", KEYS[3], ARGV[2])
+redis.call("ZREM", KEYS[4], ARGV[2])
+if KEYS[5] and redis.call("GET", KEYS[5]) == ARGV[2] then
+	redis.call("DEL", KEYS[5])
+end
+return 1`)
+
+// SkipCanceled reports whether a tombstone is recorded for the task.
+// If so, it removes the task from in-progress queue along with the tombstone.
+func (r *RDB) SkipCanceled(msg *base.TaskMessage) (bool, error) {
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return false, err
+	}
+	id := msg.ID.String()
+	keys := withUniqueKey([]string{r.keys.TombstoneKey(id), r.keys.InProgressQueue(), r.keys.TaskIndex(), r.keys.Leases()}, msg)
+	res, err := skipCanceledCmd.Run(r.client, keys, string(bytes), id).Result()
+	if err != nil {
+		return false, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return false, fmt.Errorf("could not cast %v to int64", res)
+	}
+	if n == 1 {
+		r.release(id)
+	}
+	return n == 1, nil
 }
@@ -55,7 +55,7 @@ func TestEnqueue(t *testing.T) {
 			t.Errorf("(*RDB).Enqueue(msg) = %v, want nil", err)
 		}
 
-		qkey := base.QueueKey(tc.msg.Queue)
+		qkey := h.Keys.QueueKey(tc.msg.Queue)
 		gotEnqueued := h.GetEnqueuedMessages(t, r.client, tc.msg.Queue)
 		if len(gotEnqueued) != 1 {
 			t.Errorf("%q has length %d, want 1", qkey, len(gotEnqueued))
@@ -64,8 +64,12 @@ func TestEnqueue(t *testing.T) {
 		if diff := cmp.Diff(tc.msg, gotEnqueued[0]); diff != "" {
 			t.Errorf("persisted data differed from the original input (-want, +got)\n%s", diff)
 		}
-		if !r.client.SIsMember(base.AllQueues, qkey).Val() {
-			t.Errorf("%q is not a member of SET %q", qkey, base.AllQueues)
+		if !r.client.SIsMember(h.Keys.AllQueues(), qkey).Val() {
+			t.Errorf("%q is not a member of SET %q", qkey, h.Keys.AllQueues())
+		}
+		nkey := h.Keys.NotificationKey(tc.msg.Queue)
+		if n := r.client.LLen(nkey).Val(); n != 1 {
+			t.Errorf("%q has length %d, want 1", nkey, n)
 		}
 	}
 }
@@ -77,7 +81,7 @@ func TestEnqueueUnique(t *testing.T) {
 		Type:      "email",
 		Payload:   map[string]interface{}{"user_id": 123},
 		Queue:     base.DefaultQueueName,
-		UniqueKey: "email:user_id=123:default",
+		UniqueKey: h.Keys.UniqueKey(base.DefaultQueueName, "email", "user_id=123"),
 	}
 
 	tests := []struct {
@@ -112,6 +116,53 @@ func TestEnqueueUnique(t *testing.T) {
 	}
 }
 
+func TestNamespace(t *testing.T) {
+	r := setup(t)
+	r1 := NewRDBWithNamespace(r.client, "app1")
+	r2 := NewRDBWithNamespace(r.client, "app2")
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("reindex", nil)
+
+	if err := r1.Enqueue(t1); err != nil {
+		t.Fatalf("(*RDB).Enqueue(t1) = %v, want nil", err)
+	}
+	if err := r2.Enqueue(t2); err != nil {
+		t.Fatalf("(*RDB).Enqueue(t2) = %v, want nil", err)
+	}
+
+	wantKey := "{app1}:queues:default"
+	if n := r.client.LLen(wantKey).Val(); n != 1 {
+		t.Errorf("%q has length %d, want 1", wantKey, n)
+	}
+	if n := r.client.LLen(h.Keys.DefaultQueue()).Val(); n != 0 {
+		t.Errorf("%q has length %d, want 0", h.Keys.DefaultQueue(), n)
+	}
+
+	tests := []struct {
+		r    *RDB
+		want *base.TaskMessage
+	}{
+		{r1, t1},
+		{r2, t2},
+	}
+
+	for _, tc := range tests {
+		got, err := tc.r.Dequeue(base.DefaultQueueName)
+		if err != nil {
+			t.Errorf("(*RDB).Dequeue(%q) in namespace %q returned error: %v", base.DefaultQueueName, tc.r.Keys().Namespace(), err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("(*RDB).Dequeue(%q) in namespace %q = %v, want %v; (-want,+got):\n%s",
+				base.DefaultQueueName, tc.r.Keys().Namespace(), got, tc.want, diff)
+		}
+		if _, err := tc.r.Dequeue(base.DefaultQueueName); err != ErrNoProcessableTask {
+			t.Errorf("second (*RDB).Dequeue(%q) in namespace %q returned %v, want %v",
+				base.DefaultQueueName, tc.r.Keys().Namespace(), err, ErrNoProcessableTask)
+		}
+	}
+}
+
 func TestDequeue(t *testing.T) {
 	r := setup(t)
 	t1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "hello!"})
@@ -216,13 +267,229 @@ func TestDequeue(t *testing.T) {
 		for queue, want := range tc.wantEnqueued {
 			gotEnqueued := h.GetEnqueuedMessages(t, r.client, queue)
 			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
-				t.Errorf("mismatch found in %q: (-want,+got):\n%s", base.QueueKey(queue), diff)
+				t.Errorf("mismatch found in %q: (-want,+got):\n%s", h.Keys.QueueKey(queue), diff)
+			}
+		}
+
+		gotInProgress := h.GetInProgressMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q: (-want,+got):\n%s", h.Keys.InProgressQueue(), diff)
+		}
+	}
+}
+
+func TestDequeueWaitsForTask(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t1.Queue = "low"
+	t2 := h.NewTaskMessage("reindex", nil)
+	t2.Queue = "critical"
+	qnames := []string{"critical", "default", "low"}
+
+	tests := []struct {
+		enqueued []*base.TaskMessage // tasks enqueued while waiting
+		want     *base.TaskMessage
+	}{
+		{
+			enqueued: []*base.TaskMessage{t1},
+			want:     t1,
+		},
+		{
+			// higher priority queue is still queried first.
+			enqueued: []*base.TaskMessage{t1, t2},
+			want:     t2,
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+
+		// stale notification for a task taken by another server.
+		if err := r.client.LPush(h.Keys.NotificationKey("default"), 1).Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		go func(msgs []*base.TaskMessage) {
+			time.Sleep(100 * time.Millisecond)
+			// enqueue atomically so that all tasks are visible when the server wakes up.
+			pipe := r.client.TxPipeline()
+			for _, msg := range msgs {
+				bytes, _ := json.Marshal(msg)
+				pipe.LPush(h.Keys.QueueKey(msg.Queue), bytes)
+			}
+			pipe.LPush(h.Keys.NotificationKey(msgs[0].Queue), 1)
+			pipe.Exec()
+		}(tc.enqueued)
+
+		start := time.Now()
+		got, err := r.Dequeue(qnames...)
+		if err != nil {
+			t.Errorf("(*RDB).Dequeue(%v) returned error: %v", qnames, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("(*RDB).Dequeue(%v) = %v, want %v; (-want,+got)\n%s", qnames, got, tc.want, diff)
+		}
+		if elapsed := time.Since(start); elapsed >= time.Second {
+			t.Errorf("(*RDB).Dequeue(%v) took %v, want less than 1s", qnames, elapsed)
+		}
+	}
+}
+
+func TestDequeueTimeout(t *testing.T) {
+	r := setup(t)
+	qnames := []string{"critical", "default"}
+
+	// stale notification for a task taken by another server.
+	if err := r.client.LPush(h.Keys.NotificationKey("critical"), 1).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	got, err := r.Dequeue(qnames...)
+	if got != nil || err != ErrNoProcessableTask {
+		t.Fatalf("(*RDB).Dequeue(%v) = %v, %v; want nil, %v", qnames, got, err, ErrNoProcessableTask)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("(*RDB).Dequeue(%v) returned after %v, want it to wait for 1s", qnames, elapsed)
+	}
+	for _, qname := range qnames {
+		nkey := h.Keys.NotificationKey(qname)
+		if n := r.client.LLen(nkey).Val(); n != 0 {
+			t.Errorf("%q has length %d, want 0", nkey, n)
+		}
+	}
+}
+
+func TestDequeueN(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("export_csv", nil)
+	t3 := h.NewTaskMessage("reindex", nil)
+	t3.Queue = "critical"
+	t4 := h.NewTaskMessage("sync", nil)
+	t4.Queue = "low"
+
+	tests := []struct {
+		enqueued       map[string][]*base.TaskMessage
+		n              int
+		quotas         []int
+		args           []string // list of queues to query
+		want           []*base.TaskMessage
+		err            error
+		wantEnqueued   map[string][]*base.TaskMessage
+		wantInProgress []*base.TaskMessage
+	}{
+		{
+			enqueued: map[string][]*base.TaskMessage{
+				"default":  {t1, t2},
+				"critical": {t3},
+				"low":      {t4},
+			},
+			n:    3,
+			args: []string{"critical", "default", "low"},
+			want: []*base.TaskMessage{t3, t1, t2},
+			err:  nil,
+			wantEnqueued: map[string][]*base.TaskMessage{
+				"default":  {},
+				"critical": {},
+				"low":      {t4},
+			},
+			wantInProgress: []*base.TaskMessage{t1, t2, t3},
+		},
+		{
+			enqueued: map[string][]*base.TaskMessage{
+				"default":  {t1, t2},
+				"critical": {t3},
+				"low":      {t4},
+			},
+			n:    10,
+			args: []string{"low", "critical"},
+			want: []*base.TaskMessage{t4, t3},
+			err:  nil,
+			wantEnqueued: map[string][]*base.TaskMessage{
+				"default":  {t1, t2},
+				"critical": {},
+				"low":      {},
+			},
+			wantInProgress: []*base.TaskMessage{t3, t4},
+		},
+		{
+			enqueued: map[string][]*base.TaskMessage{
+				"default":  {t1, t2},
+				"critical": {t3},
+				"low":      {t4},
+			},
+			n:      3,
+			quotas: []int{1, 1, 1},
+			args:   []string{"default", "critical", "low"},
+			want:   []*base.TaskMessage{t1, t3, t4},
+			err:    nil,
+			wantEnqueued: map[string][]*base.TaskMessage{
+				"default":  {t2},
+				"critical": {},
+				"low":      {},
+			},
+			wantInProgress: []*base.TaskMessage{t1, t3, t4},
+		},
+		{
+			enqueued: map[string][]*base.TaskMessage{
+				"default":  {t1, t2},
+				"critical": {t3},
+				"low":      {},
+			},
+			n:      3,
+			quotas: []int{0, 1, 2},
+			args:   []string{"default", "critical", "low"},
+			want:   []*base.TaskMessage{t3, t1, t2},
+			err:    nil,
+			wantEnqueued: map[string][]*base.TaskMessage{
+				"default":  {},
+				"critical": {},
+				"low":      {},
+			},
+			wantInProgress: []*base.TaskMessage{t1, t2, t3},
+		},
+		{
+			enqueued: map[string][]*base.TaskMessage{
+				"default": {},
+				"low":     {},
+			},
+			n:    5,
+			args: []string{"default", "low"},
+			want: nil,
+			err:  ErrNoProcessableTask,
+			wantEnqueued: map[string][]*base.TaskMessage{
+				"default": {},
+				"low":     {},
+			},
+			wantInProgress: []*base.TaskMessage{},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+		for queue, msgs := range tc.enqueued {
+			h.SeedEnqueuedQueue(t, r.client, msgs, queue)
+		}
+
+		got, err := r.DequeueN(tc.n, tc.quotas, tc.args...)
+		if !cmp.Equal(got, tc.want) || err != tc.err {
+			t.Errorf("(*RDB).DequeueN(%d, %v, %v) = %v, %v; want %v, %v",
+				tc.n, tc.quotas, tc.args, got, err, tc.want, tc.err)
+			continue
+		}
+
+		for queue, want := range tc.wantEnqueued {
+			gotEnqueued := h.GetEnqueuedMessages(t, r.client, queue)
+			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
+				t.Errorf("mismatch found in %q: (-want,+got):\n%s", h.Keys.QueueKey(queue), diff)
 			}
 		}
 
 		gotInProgress := h.GetInProgressMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q: (-want,+got):\n%s", base.InProgressQueue, diff)
+			t.Errorf("mismatch found in %q: (-want,+got):\n%s", h.Keys.InProgressQueue(), diff)
 		}
 	}
 }
@@ -235,7 +502,7 @@ func TestDone(t *testing.T) {
 		ID:        xid.New(),
 		Type:      "reindex",
 		Payload:   nil,
-		UniqueKey: "reindex:nil:default",
+		UniqueKey: h.Keys.UniqueKey(base.DefaultQueueName, "reindex", "nil"),
 		Queue:     "default",
 	}
 
@@ -282,11 +549,11 @@ func TestDone(t *testing.T) {
 
 		gotInProgress := h.GetInProgressMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressQueue, diff)
+			t.Errorf("mismatch found in %q: (-want, +got):\n%s", h.Keys.InProgressQueue(), diff)
 			continue
 		}
 
-		processedKey := base.ProcessedKey(time.Now())
+		processedKey := h.Keys.ProcessedKey(time.Now())
 		gotProcessed := r.client.Get(processedKey).Val()
 		if gotProcessed != "1" {
 			t.Errorf("GET %q = %q, want 1", processedKey, gotProcessed)
@@ -303,6 +570,34 @@ func TestDone(t *testing.T) {
 	}
 }
 
+// TestClusterSlots checks that scripts called with tasks with and without
+// a unique key only access keys in the same slot, as Redis Cluster requires.
+func TestClusterSlots(t *testing.T) {
+	client := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+		DB:   13,
+	})
+	client.AddHook(h.ClusterSlotHook{})
+	r := NewRDB(client)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("reindex", nil)
+	t2.UniqueKey = h.Keys.UniqueKey(base.DefaultQueueName, "reindex", "nil")
+
+	for _, msg := range []*base.TaskMessage{t1, t2} {
+		h.FlushDB(t, r.client)
+		h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{msg})
+		if _, err := r.SkipCanceled(msg); err != nil {
+			t.Errorf("(*RDB).SkipCanceled(%+v) returned error: %v", msg, err)
+		}
+		if err := r.Done(msg); err != nil {
+			t.Errorf("(*RDB).Done(%+v) returned error: %v", msg, err)
+		}
+		if got := h.GetInProgressMessages(t, r.client); len(got) != 0 {
+			t.Errorf("%q has %d tasks after (*RDB).Done, want 0", h.Keys.InProgressQueue(), len(got))
+		}
+	}
+}
+
 func TestRequeue(t *testing.T) {
 	r := setup(t)
 	t1 := h.NewTaskMessage("send_email", nil)
@@ -369,13 +664,13 @@ func TestRequeue(t *testing.T) {
 		for qname, want := range tc.wantEnqueued {
 			gotEnqueued := h.GetEnqueuedMessages(t, r.client, qname)
 			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
-				t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.QueueKey(qname), diff)
+				t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.QueueKey(qname), diff)
 			}
 		}
 
 		gotInProgress := h.GetInProgressMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressQueue, diff)
+			t.Errorf("mismatch found in %q: (-want, +got):\n%s", h.Keys.InProgressQueue(), diff)
 		}
 	}
 }
@@ -402,7 +697,7 @@ func TestSchedule(t *testing.T) {
 
 		gotScheduled := h.GetScheduledEntries(t, r.client)
 		if len(gotScheduled) != 1 {
-			t.Errorf("%s inserted %d items to %q, want 1 items inserted", desc, len(gotScheduled), base.ScheduledQueue)
+			t.Errorf("%s inserted %d items to %q, want 1 items inserted", desc, len(gotScheduled), h.Keys.ScheduledQueue())
 			continue
 		}
 		if int64(gotScheduled[0].Score) != tc.processAt.Unix() {
@@ -419,7 +714,7 @@ func TestScheduleUnique(t *testing.T) {
 		Type:      "email",
 		Payload:   map[string]interface{}{"user_id": 123},
 		Queue:     base.DefaultQueueName,
-		UniqueKey: "email:user_id=123:default",
+		UniqueKey: h.Keys.UniqueKey(base.DefaultQueueName, "email", "user_id=123"),
 	}
 
 	tests := []struct {
@@ -442,7 +737,7 @@ func TestScheduleUnique(t *testing.T) {
 
 		gotScheduled := h.GetScheduledEntries(t, r.client)
 		if len(gotScheduled) != 1 {
-			t.Errorf("%s inserted %d items to %q, want 1 items inserted", desc, len(gotScheduled), base.ScheduledQueue)
+			t.Errorf("%s inserted %d items to %q, want 1 items inserted", desc, len(gotScheduled), h.Keys.ScheduledQueue())
 			continue
 		}
 		if int64(gotScheduled[0].Score) != tc.processAt.Unix() {
@@ -529,15 +824,15 @@ func TestRetry(t *testing.T) {
 
 		gotInProgress := h.GetInProgressMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.InProgressQueue, diff)
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.InProgressQueue(), diff)
 		}
 
 		gotRetry := h.GetRetryEntries(t, r.client)
 		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortZSetEntryOpt); diff != "" {
-			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.RetryQueue, diff)
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.RetryQueue(), diff)
 		}
 
-		processedKey := base.ProcessedKey(time.Now())
+		processedKey := h.Keys.ProcessedKey(time.Now())
 		gotProcessed := r.client.Get(processedKey).Val()
 		if gotProcessed != "1" {
 			t.Errorf("GET %q = %q, want 1", processedKey, gotProcessed)
@@ -547,7 +842,7 @@ func TestRetry(t *testing.T) {
 			t.Errorf("TTL %q = %v, want less than or equal to %v", processedKey, gotTTL, statsTTL)
 		}
 
-		failureKey := base.FailureKey(time.Now())
+		failureKey := h.Keys.FailureKey(time.Now())
 		gotFailure := r.client.Get(failureKey).Val()
 		if gotFailure != "1" {
 			t.Errorf("GET %q = %q, want 1", failureKey, gotFailure)
@@ -559,6 +854,76 @@ func TestRetry(t *testing.T) {
 	}
 }
 
+func TestReschedule(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "Hola!"})
+	t1.Retried = 10
+	t2 := h.NewTaskMessage("gen_thumbnail", map[string]interface{}{"path": "some/path/to/image.jpg"})
+	t3 := h.NewTaskMessage("reindex", nil)
+	now := time.Now()
+
+	tests := []struct {
+		inProgress     []*base.TaskMessage
+		scheduled      []h.ZSetEntry
+		msg            *base.TaskMessage
+		processAt      time.Time
+		wantInProgress []*base.TaskMessage
+		wantScheduled  []h.ZSetEntry
+	}{
+		{
+			inProgress: []*base.TaskMessage{t1, t2},
+			scheduled: []h.ZSetEntry{
+				{
+					Msg:   t3,
+					Score: float64(now.Add(time.Minute).Unix()),
+				},
+			},
+			msg:            t1,
+			processAt:      now.Add(5 * time.Minute),
+			wantInProgress: []*base.TaskMessage{t2},
+			wantScheduled: []h.ZSetEntry{
+				{
+					Msg:   t1, // retry count is not modified
+					Score: float64(now.Add(5 * time.Minute).Unix()),
+				},
+				{
+					Msg:   t3,
+					Score: float64(now.Add(time.Minute).Unix()),
+				},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		h.SeedInProgressQueue(t, r.client, tc.inProgress)
+		h.SeedScheduledQueue(t, r.client, tc.scheduled)
+
+		err := r.Reschedule(tc.msg, tc.processAt)
+		if err != nil {
+			t.Errorf("(*RDB).Reschedule = %v, want nil", err)
+			continue
+		}
+
+		gotInProgress := h.GetInProgressMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.InProgressQueue(), diff)
+		}
+
+		gotScheduled := h.GetScheduledEntries(t, r.client)
+		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.SortZSetEntryOpt); diff != "" {
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.ScheduledQueue(), diff)
+		}
+
+		// rescheduled task is counted as neither processed nor failed.
+		for _, key := range []string{h.Keys.ProcessedKey(now), h.Keys.FailureKey(now)} {
+			if n := r.client.Exists(key).Val(); n != 0 {
+				t.Errorf("EXISTS %q = %d, want 0", key, n)
+			}
+		}
+	}
+}
+
 func TestKill(t *testing.T) {
 	r := setup(t)
 	t1 := h.NewTaskMessage("send_email", nil)
@@ -576,7 +941,6 @@ func TestKill(t *testing.T) {
 	}
 	now := time.Now()
 
-	// TODO(hibiken): add test cases for trimming
 	tests := []struct {
 		inProgress     []*base.TaskMessage
 		dead           []h.ZSetEntry
@@ -632,15 +996,15 @@ func TestKill(t *testing.T) {
 
 		gotInProgress := h.GetInProgressMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q: (-want, +got)\n%s", base.InProgressQueue, diff)
+			t.Errorf("mismatch found in %q: (-want, +got)\n%s", h.Keys.InProgressQueue(), diff)
 		}
 
 		gotDead := h.GetDeadEntries(t, r.client)
 		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortZSetEntryOpt); diff != "" {
-			t.Errorf("mismatch found in %q after calling (*RDB).Kill: (-want, +got):\n%s", base.DeadQueue, diff)
+			t.Errorf("mismatch found in %q after calling (*RDB).Kill: (-want, +got):\n%s", h.Keys.DeadQueue(), diff)
 		}
 
-		processedKey := base.ProcessedKey(time.Now())
+		processedKey := h.Keys.ProcessedKey(time.Now())
 		gotProcessed := r.client.Get(processedKey).Val()
 		if gotProcessed != "1" {
 			t.Errorf("GET %q = %q, want 1", processedKey, gotProcessed)
@@ -650,7 +1014,7 @@ func TestKill(t *testing.T) {
 			t.Errorf("TTL %q = %v, want less than or equal to %v", processedKey, gotTTL, statsTTL)
 		}
 
-		failureKey := base.FailureKey(time.Now())
+		failureKey := h.Keys.FailureKey(time.Now())
 		gotFailure := r.client.Get(failureKey).Val()
 		if gotFailure != "1" {
 			t.Errorf("GET %q = %q, want 1", failureKey, gotFailure)
@@ -662,58 +1026,430 @@ func TestKill(t *testing.T) {
 	}
 }
 
-func TestRequeueAll(t *testing.T) {
+func TestTrimDead(t *testing.T) {
 	r := setup(t)
-	t1 := h.NewTaskMessage("send_email", nil)
-	t2 := h.NewTaskMessage("export_csv", nil)
-	t3 := h.NewTaskMessage("sync_stuff", nil)
-	t4 := h.NewTaskMessageWithQueue("important", nil, "critical")
-	t5 := h.NewTaskMessageWithQueue("minor", nil, "low")
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("generate_csv", nil)
+	m4 := h.NewTaskMessageWithQueue("sync", nil, "critical")
+	m5 := h.NewTaskMessageWithQueue("sync", nil, "critical")
+	now := time.Now()
+	e1 := h.ZSetEntry{Msg: m1, Score: float64(now.Add(-100 * 24 * time.Hour).Unix())}
+	e2 := h.ZSetEntry{Msg: m2, Score: float64(now.Add(-2 * time.Hour).Unix())}
+	e3 := h.ZSetEntry{Msg: m3, Score: float64(now.Add(-time.Hour).Unix())}
+	e4 := h.ZSetEntry{Msg: m4, Score: float64(now.Add(-3 * time.Hour).Unix())}
+	e5 := h.ZSetEntry{Msg: m5, Score: float64(now.Add(-30 * time.Minute).Unix())}
 
 	tests := []struct {
-		inProgress     []*base.TaskMessage
-		enqueued       map[string][]*base.TaskMessage
-		want           int64
-		wantInProgress []*base.TaskMessage
-		wantEnqueued   map[string][]*base.TaskMessage
+		desc        string
+		dead        []h.ZSetEntry
+		def         base.Retention
+		perQueue    map[string]base.Retention
+		wantN       int
+		wantEvicted []*base.TaskMessage
+		wantDead    []h.ZSetEntry
 	}{
 		{
-			inProgress: []*base.TaskMessage{t1, t2, t3},
-			enqueued: map[string][]*base.TaskMessage{
-				base.DefaultQueueName: {},
-			},
-			want:           3,
-			wantInProgress: []*base.TaskMessage{},
-			wantEnqueued: map[string][]*base.TaskMessage{
-				base.DefaultQueueName: {t1, t2, t3},
-			},
+			desc:        "trims by age",
+			dead:        []h.ZSetEntry{e1, e2, e3},
+			def:         base.Retention{MaxSize: 10, MaxAge: 90 * 24 * time.Hour},
+			wantN:       1,
+			wantEvicted: []*base.TaskMessage{m1},
+			wantDead:    []h.ZSetEntry{e2, e3},
 		},
 		{
-			inProgress: []*base.TaskMessage{},
-			enqueued: map[string][]*base.TaskMessage{
-				base.DefaultQueueName: {t1, t2, t3},
-			},
-			want:           0,
-			wantInProgress: []*base.TaskMessage{},
-			wantEnqueued: map[string][]*base.TaskMessage{
-				base.DefaultQueueName: {t1, t2, t3},
-			},
+			desc:        "trims by size",
+			dead:        []h.ZSetEntry{e1, e2, e3},
+			def:         base.Retention{MaxSize: 1, MaxAge: 365 * 24 * time.Hour},
+			wantN:       2,
+			wantEvicted: []*base.TaskMessage{m1, m2},
+			wantDead:    []h.ZSetEntry{e3},
 		},
 		{
-			inProgress: []*base.TaskMessage{t2, t3},
-			enqueued: map[string][]*base.TaskMessage{
-				base.DefaultQueueName: {t1},
-			},
-			want:           2,
-			wantInProgress: []*base.TaskMessage{},
-			wantEnqueued: map[string][]*base.TaskMessage{
-				base.DefaultQueueName: {t1, t2, t3},
-			},
+			desc:        "no limits",
+			dead:        []h.ZSetEntry{e1, e2, e3},
+			def:         base.Retention{},
+			wantN:       0,
+			wantEvicted: nil,
+			wantDead:    []h.ZSetEntry{e1, e2, e3},
 		},
 		{
-			inProgress: []*base.TaskMessage{t2, t3, t4, t5},
-			enqueued: map[string][]*base.TaskMessage{
-				base.DefaultQueueName: {t1},
+			desc:        "trims by queue",
+			dead:        []h.ZSetEntry{e1, e2, e3, e4, e5},
+			def:         base.Retention{MaxSize: 2},
+			perQueue:    map[string]base.Retention{"critical": {MaxAge: time.Hour}},
+			wantN:       2,
+			wantEvicted: []*base.TaskMessage{m1, m4},
+			wantDead:    []h.ZSetEntry{e2, e3, e5},
+		},
+		{
+			desc:        "queue without limits",
+			dead:        []h.ZSetEntry{e1, e2, e3, e4, e5},
+			def:         base.Retention{MaxSize: 1},
+			perQueue:    map[string]base.Retention{"critical": {}},
+			wantN:       2,
+			wantEvicted: []*base.TaskMessage{m1, m2},
+			wantDead:    []h.ZSetEntry{e3, e4, e5},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+		h.SeedDeadQueue(t, r.client, tc.dead)
+
+		var evicted []*base.TaskMessage
+		evict := func(entries []*base.DeadEntry) error {
+			for _, e := range entries {
+				evicted = append(evicted, e.Msg)
+			}
+			return nil
+		}
+		n, err := r.TrimDead(tc.def, tc.perQueue, evict)
+		if err != nil {
+			t.Errorf("%s: (*RDB).TrimDead returned error: %v", tc.desc, err)
+			continue
+		}
+		if n != tc.wantN {
+			t.Errorf("%s: (*RDB).TrimDead = %d, want %d", tc.desc, n, tc.wantN)
+		}
+		if diff := cmp.Diff(tc.wantEvicted, evicted, h.SortMsgOpt); diff != "" {
+			t.Errorf("%s: mismatch found in evicted tasks: (-want, +got):\n%s", tc.desc, diff)
+		}
+		gotDead := h.GetDeadEntries(t, r.client)
+		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortZSetEntryOpt); diff != "" {
+			t.Errorf("%s: mismatch found in %q after calling (*RDB).TrimDead: (-want, +got):\n%s", tc.desc, h.Keys.DeadQueue(), diff)
+		}
+		if l := r.client.Exists(h.Keys.DeadTrimLock()).Val(); l != 0 {
+			t.Errorf("%s: %q was not released", tc.desc, h.Keys.DeadTrimLock())
+		}
+	}
+}
+
+// getDeadIndex returns the IDs of the dead tasks in the dead task index
+// of each queue, oldest first.
+func getDeadIndex(t *testing.T, c redis.UniversalClient) map[string][]string {
+	t.Helper()
+	res := make(map[string][]string)
+	for _, qname := range c.SMembers(h.Keys.DeadQueues()).Val() {
+		if ids := c.ZRange(h.Keys.DeadIndexKey(qname), 0, -1).Val(); len(ids) > 0 {
+			res[qname] = ids
+		}
+	}
+	return res
+}
+
+func TestDeadIndex(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessageWithQueue("sync", nil, "critical")
+	m3 := h.NewTaskMessageWithQueue("sync", nil, "critical")
+	m4 := h.NewTaskMessage("reindex", nil)
+	now := time.Now()
+	h.FlushDB(t, r.client)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{m1})
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{{Msg: m2, Score: float64(now.Unix())}})
+	h.SeedScheduledQueue(t, r.client, []h.ZSetEntry{
+		{Msg: m3, Score: float64(now.Add(time.Hour).Unix())},
+		{Msg: m4, Score: float64(now.Add(time.Hour).Unix())},
+	})
+	h.SeedTaskIndex(t, r.client, []*base.TaskMessage{m2, m3, m4})
+
+	if err := r.Kill(m1, "error"); err != nil {
+		t.Fatalf("(*RDB).Kill returned error: %v", err)
+	}
+	if err := r.KillRetryTask(m2.ID, now.Unix()); err != nil {
+		t.Fatalf("(*RDB).KillRetryTask returned error: %v", err)
+	}
+	if _, err := r.KillAllScheduledTasks(); err != nil {
+		t.Fatalf("(*RDB).KillAllScheduledTasks returned error: %v", err)
+	}
+	want := map[string][]string{
+		"default":  {m1.ID.String(), m4.ID.String()},
+		"critical": {m2.ID.String(), m3.ID.String()},
+	}
+	if diff := cmp.Diff(want, getDeadIndex(t, r.client), h.SortStringSliceOpt); diff != "" {
+		t.Errorf("mismatch found in dead task index after killing tasks: (-want, +got):\n%s", diff)
+	}
+
+	score := r.client.ZScore(h.Keys.DeadQueue(), h.MustMarshal(t, m2)).Val()
+	if err := r.DeleteDeadTask(m2.ID, int64(score)); err != nil {
+		t.Fatalf("(*RDB).DeleteDeadTask returned error: %v", err)
+	}
+	score = r.client.ZScore(h.Keys.DeadQueue(), h.MustMarshal(t, m4)).Val()
+	if err := r.EnqueueDeadTask(m4.ID, int64(score)); err != nil {
+		t.Fatalf("(*RDB).EnqueueDeadTask returned error: %v", err)
+	}
+	want = map[string][]string{
+		"default":  {m1.ID.String()},
+		"critical": {m3.ID.String()},
+	}
+	if diff := cmp.Diff(want, getDeadIndex(t, r.client), h.SortStringSliceOpt); diff != "" {
+		t.Errorf("mismatch found in dead task index after removing tasks: (-want, +got):\n%s", diff)
+	}
+
+	if _, err := r.DeleteAllDeadTasks(); err != nil {
+		t.Fatalf("(*RDB).DeleteAllDeadTasks returned error: %v", err)
+	}
+	if got := getDeadIndex(t, r.client); len(got) != 0 {
+		t.Errorf("dead task index = %v after deleting all dead tasks, want empty", got)
+	}
+}
+
+func TestTrimDeadRebuildsIndex(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessageWithQueue("sync", nil, "critical")
+	m3 := h.NewTaskMessageWithQueue("sync", nil, "critical")
+	gone := h.NewTaskMessageWithQueue("sync", nil, "critical")
+	now := time.Now()
+	h.FlushDB(t, r.client)
+	// tasks killed by a version which didn't index dead tasks.
+	h.SeedDeadQueue(t, r.client, []h.ZSetEntry{
+		{Msg: m1, Score: float64(now.Add(-3 * time.Hour).Unix())},
+		{Msg: m2, Score: float64(now.Add(-2 * time.Hour).Unix())},
+		{Msg: m3, Score: float64(now.Add(-time.Hour).Unix())},
+	})
+	// index entry of a task no longer in the dead queue.
+	r.client.ZAdd(h.Keys.DeadIndexKey("critical"), &redis.Z{Score: float64(now.Add(-4 * time.Hour).Unix()), Member: gone.ID.String()})
+	r.client.SAdd(h.Keys.DeadQueues(), "critical")
+
+	n, err := r.TrimDead(base.Retention{}, map[string]base.Retention{"critical": {MaxSize: 1}}, nil)
+	if err != nil {
+		t.Fatalf("(*RDB).TrimDead returned error: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("(*RDB).TrimDead = %d, want 1", n)
+	}
+	want := map[string][]string{
+		"default":  {m1.ID.String()},
+		"critical": {m3.ID.String()},
+	}
+	if diff := cmp.Diff(want, getDeadIndex(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in dead task index: (-want, +got):\n%s", diff)
+	}
+	wantIndex := map[string]*base.TaskMessage{m1.ID.String(): m1, m3.ID.String(): m3}
+	if diff := cmp.Diff(wantIndex, h.GetTaskIndex(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", h.Keys.TaskIndex(), diff)
+	}
+}
+
+func TestTrimDeadEvictError(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	now := time.Now()
+	dead := []h.ZSetEntry{
+		{Msg: m1, Score: float64(now.Add(-2 * time.Hour).Unix())},
+		{Msg: m2, Score: float64(now.Add(-time.Hour).Unix())},
+	}
+	h.FlushDB(t, r.client)
+	h.SeedDeadQueue(t, r.client, dead)
+
+	evict := func(entries []*base.DeadEntry) error {
+		return fmt.Errorf("disk full")
+	}
+	n, err := r.TrimDead(base.Retention{MaxSize: 1}, nil, evict)
+	if err == nil || n != 0 {
+		t.Errorf("(*RDB).TrimDead = %d, %v; want 0, error", n, err)
+	}
+	// tasks are kept if they could not be evicted.
+	gotDead := h.GetDeadEntries(t, r.client)
+	if diff := cmp.Diff(dead, gotDead, h.SortZSetEntryOpt); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", h.Keys.DeadQueue(), diff)
+	}
+}
+
+func TestTrimDeadLocked(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	dead := []h.ZSetEntry{{Msg: m1, Score: float64(time.Now().Add(-time.Hour).Unix())}}
+	h.FlushDB(t, r.client)
+	h.SeedDeadQueue(t, r.client, dead)
+	// another server is trimming the dead queue.
+	if err := r.client.Set(h.Keys.DeadTrimLock(), "token", time.Minute).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := r.TrimDead(base.Retention{MaxAge: time.Minute}, nil, nil)
+	if n != 0 || err != nil {
+		t.Errorf("(*RDB).TrimDead = %d, %v; want 0, nil", n, err)
+	}
+	gotDead := h.GetDeadEntries(t, r.client)
+	if diff := cmp.Diff(dead, gotDead, h.SortZSetEntryOpt); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", h.Keys.DeadQueue(), diff)
+	}
+	if got := r.client.Get(h.Keys.DeadTrimLock()).Val(); got != "token" {
+		t.Errorf("GET %q = %q, want %q", h.Keys.DeadTrimLock(), got, "token")
+	}
+}
+
+func TestRecordEvent(t *testing.T) {
+	r := setup(t)
+	id := xid.New().String()
+	now := time.Now().Truncate(time.Second)
+
+	h.FlushDB(t, r.client)
+	var want []*base.TaskEvent
+	for i := 0; i < maxHistoryEvents+5; i++ {
+		e := &base.TaskEvent{
+			Kind:     base.EventRetry,
+			Time:     now.Add(time.Duration(i) * time.Second),
+			Queue:    "default",
+			Host:     "localhost",
+			PID:      1234,
+			Attempt:  i + 1,
+			ErrorMsg: "oops",
+		}
+		if err := r.RecordEvent(id, e, time.Hour); err != nil {
+			t.Fatalf("(*RDB).RecordEvent returned error: %v", err)
+		}
+		want = append(want, e)
+	}
+	// only the latest events are kept.
+	want = want[len(want)-maxHistoryEvents:]
+
+	key := h.Keys.HistoryKey(id)
+	var got []*base.TaskEvent
+	for _, data := range r.client.LRange(key, 0, -1).Val() {
+		var e base.TaskEvent
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, &e)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", key, diff)
+	}
+	if ttl := r.client.TTL(key).Val(); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("TTL %q = %v, want positive duration less than or equal to %v", key, ttl, time.Hour)
+	}
+}
+
+func TestTaskIndex(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "hello"})
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("gen_thumbnail", nil)
+	m4 := h.NewTaskMessage("sync", nil)
+	m4.UniqueKey = h.Keys.UniqueKey("default", "sync", "{}")
+
+	h.FlushDB(t, r.client)
+	if err := r.Enqueue(m1); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Schedule(m2, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Enqueue(m3); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.EnqueueUnique(m4, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]*base.TaskMessage{
+		m1.ID.String(): m1,
+		m2.ID.String(): m2,
+		m3.ID.String(): m3,
+		m4.ID.String(): m4,
+	}
+	if diff := cmp.Diff(want, h.GetTaskIndex(t, r.client)); diff != "" {
+		t.Fatalf("mismatch found in %q after enqueueing; (-want, +got)\n%s", h.Keys.TaskIndex(), diff)
+	}
+
+	if _, err := r.Dequeue("default"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Dequeue("default"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Dequeue("default"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Retry(m1, time.Now().Add(time.Minute), "network error"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Kill(m3, "fatal error"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Done(m4); err != nil {
+		t.Fatal(err)
+	}
+	retried := *m1
+	retried.Retried++
+	retried.ErrorMsg = "network error"
+	killed := *m3
+	killed.ErrorMsg = "fatal error"
+	want = map[string]*base.TaskMessage{
+		m1.ID.String(): &retried,
+		m2.ID.String(): m2,
+		m3.ID.String(): &killed,
+	}
+	if diff := cmp.Diff(want, h.GetTaskIndex(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q after processing; (-want, +got)\n%s", h.Keys.TaskIndex(), diff)
+	}
+
+	// evicted dead tasks are removed from the index.
+	if _, err := r.TrimDead(base.Retention{MaxSize: 0, MaxAge: time.Nanosecond}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, m3.ID.String())
+	if diff := cmp.Diff(want, h.GetTaskIndex(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q after trimming; (-want, +got)\n%s", h.Keys.TaskIndex(), diff)
+	}
+}
+
+func TestRequeueAll(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("export_csv", nil)
+	t3 := h.NewTaskMessage("sync_stuff", nil)
+	t4 := h.NewTaskMessageWithQueue("important", nil, "critical")
+	t5 := h.NewTaskMessageWithQueue("minor", nil, "low")
+
+	tests := []struct {
+		inProgress     []*base.TaskMessage
+		enqueued       map[string][]*base.TaskMessage
+		want           int64
+		wantInProgress []*base.TaskMessage
+		wantEnqueued   map[string][]*base.TaskMessage
+	}{
+		{
+			inProgress: []*base.TaskMessage{t1, t2, t3},
+			enqueued: map[string][]*base.TaskMessage{
+				base.DefaultQueueName: {},
+			},
+			want:           3,
+			wantInProgress: []*base.TaskMessage{},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				base.DefaultQueueName: {t1, t2, t3},
+			},
+		},
+		{
+			inProgress: []*base.TaskMessage{},
+			enqueued: map[string][]*base.TaskMessage{
+				base.DefaultQueueName: {t1, t2, t3},
+			},
+			want:           0,
+			wantInProgress: []*base.TaskMessage{},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				base.DefaultQueueName: {t1, t2, t3},
+			},
+		},
+		{
+			inProgress: []*base.TaskMessage{t2, t3},
+			enqueued: map[string][]*base.TaskMessage{
+				base.DefaultQueueName: {t1},
+			},
+			want:           2,
+			wantInProgress: []*base.TaskMessage{},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				base.DefaultQueueName: {t1, t2, t3},
+			},
+		},
+		{
+			inProgress: []*base.TaskMessage{t2, t3, t4, t5},
+			enqueued: map[string][]*base.TaskMessage{
+				base.DefaultQueueName: {t1},
 				"critical":            {},
 				"low":                 {},
 			},
@@ -742,15 +1478,218 @@ func TestRequeueAll(t *testing.T) {
 
 		gotInProgress := h.GetInProgressMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressQueue, diff)
+			t.Errorf("mismatch found in %q: (-want, +got):\n%s", h.Keys.InProgressQueue(), diff)
+		}
+
+		for qname, want := range tc.wantEnqueued {
+			gotEnqueued := h.GetEnqueuedMessages(t, r.client, qname)
+			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
+				t.Errorf("mismatch found in %q: (-want, +got):\n%s", h.Keys.QueueKey(qname), diff)
+			}
 		}
+	}
+}
+
+func TestRecoverAll(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("export_csv", nil)
+	t2.Recovered = 2
+	t3 := h.NewTaskMessageWithQueue("important", nil, "critical")
+	t3.Recovered = 3
+	errMsg := "process crashed"
+
+	// t* is t* after recovery
+	t1Recovered := *t1
+	t1Recovered.Recovered = 1
+	t2Recovered := *t2
+	t2Recovered.Recovered = 3
+	t3Killed := *t3
+	t3Killed.Recovered = 4
+	t3Killed.ErrorMsg = errMsg
+	t3Recovered := *t3
+	t3Recovered.Recovered = 4
+	now := time.Now()
 
+	tests := []struct {
+		inProgress     []*base.TaskMessage
+		leases         map[string]time.Time // lease expiration by task ID
+		maxRecovery    int
+		wantRequeued   int64
+		wantKilled     int64
+		wantInProgress []*base.TaskMessage
+		wantEnqueued   map[string][]*base.TaskMessage
+		wantDead       []h.ZSetEntry
+	}{
+		{
+			inProgress:     []*base.TaskMessage{t1, t2, t3},
+			maxRecovery:    3,
+			wantRequeued:   2,
+			wantKilled:     1,
+			wantInProgress: []*base.TaskMessage{},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				base.DefaultQueueName: {&t1Recovered, &t2Recovered},
+				"critical":            {},
+			},
+			wantDead: []h.ZSetEntry{
+				{Msg: &t3Killed, Score: float64(now.Unix())},
+			},
+		},
+		{
+			inProgress:     []*base.TaskMessage{t1},
+			maxRecovery:    3,
+			wantRequeued:   1,
+			wantKilled:     0,
+			wantInProgress: []*base.TaskMessage{},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				base.DefaultQueueName: {&t1Recovered},
+			},
+			wantDead: []h.ZSetEntry{},
+		},
+		{
+			inProgress:     []*base.TaskMessage{},
+			maxRecovery:    3,
+			wantRequeued:   0,
+			wantKilled:     0,
+			wantInProgress: []*base.TaskMessage{},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				base.DefaultQueueName: {},
+			},
+			wantDead: []h.ZSetEntry{},
+		},
+		{
+			// tasks leased to running servers are not recovered.
+			inProgress: []*base.TaskMessage{t1, t2, t3},
+			leases: map[string]time.Time{
+				t1.ID.String(): now.Add(time.Minute),
+				t2.ID.String(): now.Add(-time.Minute),
+				t3.ID.String(): now.Add(time.Minute),
+			},
+			maxRecovery:    3,
+			wantRequeued:   1,
+			wantKilled:     0,
+			wantInProgress: []*base.TaskMessage{t1, t3},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				base.DefaultQueueName: {&t2Recovered},
+				"critical":            {},
+			},
+			wantDead: []h.ZSetEntry{},
+		},
+		{
+			// negative maxRecovery never kills tasks.
+			inProgress:     []*base.TaskMessage{t3},
+			maxRecovery:    -1,
+			wantRequeued:   1,
+			wantKilled:     0,
+			wantInProgress: []*base.TaskMessage{},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				"critical": {&t3Recovered},
+			},
+			wantDead: []h.ZSetEntry{},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+		h.SeedInProgressQueue(t, r.client, tc.inProgress)
+		for id, exp := range tc.leases {
+			r.client.ZAdd(h.Keys.Leases(), &redis.Z{Member: id, Score: float64(exp.Unix())})
+		}
+
+		requeued, killed, err := r.RecoverAll(tc.maxRecovery, errMsg)
+		if requeued != tc.wantRequeued || killed != tc.wantKilled || err != nil {
+			t.Errorf("(*RDB).RecoverAll(%d, %q) = %v, %v, %v, want %v, %v, nil",
+				tc.maxRecovery, errMsg, requeued, killed, err, tc.wantRequeued, tc.wantKilled)
+			continue
+		}
+
+		gotInProgress := h.GetInProgressMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q: (-want, +got):\n%s", h.Keys.InProgressQueue(), diff)
+		}
 		for qname, want := range tc.wantEnqueued {
 			gotEnqueued := h.GetEnqueuedMessages(t, r.client, qname)
 			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
-				t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.QueueKey(qname), diff)
+				t.Errorf("mismatch found in %q: (-want, +got):\n%s", h.Keys.QueueKey(qname), diff)
+			}
+		}
+		gotDead := h.GetDeadEntries(t, r.client)
+		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortZSetEntryOpt, cmpopts.EquateApprox(0, 1)); diff != "" {
+			t.Errorf("mismatch found in %q: (-want, +got):\n%s", h.Keys.DeadQueue(), diff)
+		}
+		for _, msg := range tc.wantInProgress {
+			if _, err := r.client.ZScore(h.Keys.Leases(), msg.ID.String()).Result(); err != nil {
+				t.Errorf("lease of in-progress task %v is removed: %v", msg.ID, err)
 			}
 		}
+		if n := r.client.ZCard(h.Keys.Leases()).Val(); n != int64(len(tc.wantInProgress)) {
+			t.Errorf("ZCARD %q = %d, want %d", h.Keys.Leases(), n, len(tc.wantInProgress))
+		}
+	}
+}
+
+func TestLeases(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("export_csv", nil)
+	h.FlushDB(t, r.client)
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t1, t2})
+
+	leaseOf := func(msg *base.TaskMessage) (float64, error) {
+		return r.client.ZScore(h.Keys.Leases(), msg.ID.String()).Result()
+	}
+
+	// Dequeued tasks are leased to the server.
+	msg1, err := r.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("(*RDB).Dequeue() returned error: %v", err)
+	}
+	msg2, err := r.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("(*RDB).Dequeue() returned error: %v", err)
+	}
+	for _, msg := range []*base.TaskMessage{msg1, msg2} {
+		if exp, err := leaseOf(msg); err != nil || int64(exp) <= time.Now().Unix() {
+			t.Errorf("lease of dequeued task %v = %v, %v; want a lease expiring in the future", msg.ID, exp, err)
+		}
+	}
+
+	// RecoverAll leaves the leased tasks alone.
+	if requeued, killed, err := r.RecoverAll(3, "crashed"); requeued != 0 || killed != 0 || err != nil {
+		t.Errorf("(*RDB).RecoverAll() = %d, %d, %v; want 0, 0, nil", requeued, killed, err)
+	}
+
+	// Heartbeats renew the leases of the tasks not yet finished.
+	if err := r.Done(msg1); err != nil {
+		t.Fatalf("(*RDB).Done() returned error: %v", err)
+	}
+	if _, err := leaseOf(msg1); err != redis.Nil {
+		t.Errorf("lease of finished task %v is not removed", msg1.ID)
+	}
+	r.client.ZAdd(h.Keys.Leases(), &redis.Z{Member: msg2.ID.String(), Score: 0})
+	ss := base.NewServerState("localhost", 1234, 10, map[string]int{base.DefaultQueueName: 1}, false)
+	if err := r.WriteServerState(ss, 10*time.Second); err != nil {
+		t.Fatalf("(*RDB).WriteServerState() returned error: %v", err)
+	}
+	if exp, err := leaseOf(msg2); err != nil || int64(exp) <= time.Now().Unix() {
+		t.Errorf("lease of task %v after heartbeat = %v, %v; want a renewed lease", msg2.ID, exp, err)
+	}
+	if _, err := leaseOf(msg1); err != redis.Nil {
+		t.Errorf("lease of finished task %v is renewed", msg1.ID)
+	}
+
+	// CheckAndEnqueue recovers the task once its lease expires.
+	r.client.ZAdd(h.Keys.Leases(), &redis.Z{Member: msg2.ID.String(), Score: 0})
+	if err := r.CheckAndEnqueue(base.DefaultQueueName); err != nil {
+		t.Fatalf("(*RDB).CheckAndEnqueue() returned error: %v", err)
+	}
+	if got := h.GetInProgressMessages(t, r.client); len(got) != 0 {
+		t.Errorf("in-progress tasks after lease expired = %v, want none", got)
+	}
+	want := *msg2
+	want.Recovered = 1
+	if diff := cmp.Diff([]*base.TaskMessage{&want}, h.GetEnqueuedMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", h.Keys.DefaultQueue(), diff)
 	}
 }
 
@@ -846,18 +1785,18 @@ func TestCheckAndEnqueue(t *testing.T) {
 		for qname, want := range tc.wantEnqueued {
 			gotEnqueued := h.GetEnqueuedMessages(t, r.client, qname)
 			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
-				t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.QueueKey(qname), diff)
+				t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.QueueKey(qname), diff)
 			}
 		}
 
 		gotScheduled := h.GetScheduledMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.ScheduledQueue, diff)
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.ScheduledQueue(), diff)
 		}
 
 		gotRetry := h.GetRetryMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.RetryQueue, diff)
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.RetryQueue(), diff)
 		}
 	}
 }
@@ -881,7 +1820,7 @@ func TestWriteServerState(t *testing.T) {
 
 	// Check ServerInfo was written correctly
 	info := ss.GetInfo()
-	skey := base.ServerInfoKey(info.Host, info.PID, info.ServerID)
+	skey := h.Keys.ServerInfoKey(info.Host, info.PID, info.ServerID)
 	data := r.client.Get(skey).Val()
 	var got base.ServerInfo
 	err = json.Unmarshal([]byte(data), &got)
@@ -909,23 +1848,23 @@ func TestWriteServerState(t *testing.T) {
 		t.Errorf("TTL of %q was %v, want %v", skey, gotTTL, ttl)
 	}
 	// Check ServerInfo key was added to the set correctly
-	gotProcesses := r.client.ZRange(base.AllServers, 0, -1).Val()
+	gotProcesses := r.client.ZRange(h.Keys.AllServers(), 0, -1).Val()
 	wantProcesses := []string{skey}
 	if diff := cmp.Diff(wantProcesses, gotProcesses); diff != "" {
-		t.Errorf("%q contained %v, want %v", base.AllServers, gotProcesses, wantProcesses)
+		t.Errorf("%q contained %v, want %v", h.Keys.AllServers(), gotProcesses, wantProcesses)
 	}
 
 	// Check WorkersInfo was written correctly
-	wkey := base.WorkersKey(info.Host, info.PID, info.ServerID)
+	wkey := h.Keys.WorkersKey(info.Host, info.PID, info.ServerID)
 	workerExist := r.client.Exists(wkey).Val()
 	if workerExist != 0 {
 		t.Errorf("%q key exists", wkey)
 	}
 	// Check WorkersInfo key was added to the set correctly
-	gotWorkerKeys := r.client.ZRange(base.AllWorkers, 0, -1).Val()
+	gotWorkerKeys := r.client.ZRange(h.Keys.AllWorkers(), 0, -1).Val()
 	wantWorkerKeys := []string{wkey}
 	if diff := cmp.Diff(wantWorkerKeys, gotWorkerKeys); diff != "" {
-		t.Errorf("%q contained %v, want %v", base.AllWorkers, gotWorkerKeys, wantWorkerKeys)
+		t.Errorf("%q contained %v, want %v", h.Keys.AllWorkers(), gotWorkerKeys, wantWorkerKeys)
 	}
 }
 
@@ -955,7 +1894,7 @@ func TestWriteServerStateWithWorkers(t *testing.T) {
 
 	// Check ServerInfo was written correctly
 	info := ss.GetInfo()
-	skey := base.ServerInfoKey(info.Host, info.PID, info.ServerID)
+	skey := h.Keys.ServerInfoKey(info.Host, info.PID, info.ServerID)
 	data := r.client.Get(skey).Val()
 	var got base.ServerInfo
 	err = json.Unmarshal([]byte(data), &got)
@@ -983,14 +1922,14 @@ func TestWriteServerStateWithWorkers(t *testing.T) {
 		t.Errorf("TTL of %q was %v, want %v", skey, gotTTL, ttl)
 	}
 	// Check ServerInfo key was added to the set correctly
-	gotProcesses := r.client.ZRange(base.AllServers, 0, -1).Val()
+	gotProcesses := r.client.ZRange(h.Keys.AllServers(), 0, -1).Val()
 	wantProcesses := []string{skey}
 	if diff := cmp.Diff(wantProcesses, gotProcesses); diff != "" {
-		t.Errorf("%q contained %v, want %v", base.AllServers, gotProcesses, wantProcesses)
+		t.Errorf("%q contained %v, want %v", h.Keys.AllServers(), gotProcesses, wantProcesses)
 	}
 
 	// Check WorkersInfo was written correctly
-	wkey := base.WorkersKey(info.Host, info.PID, info.ServerID)
+	wkey := h.Keys.WorkersKey(info.Host, info.PID, info.ServerID)
 	wdata := r.client.HGetAll(wkey).Val()
 	if len(wdata) != 2 {
 		t.Fatalf("HGETALL %q returned a hash of size %d, want 2", wkey, len(wdata))
@@ -1034,10 +1973,10 @@ func TestWriteServerStateWithWorkers(t *testing.T) {
 		t.Errorf("TTL of %q was %v, want %v", wkey, gotTTL, ttl)
 	}
 	// Check WorkersInfo key was added to the set correctly
-	gotWorkerKeys := r.client.ZRange(base.AllWorkers, 0, -1).Val()
+	gotWorkerKeys := r.client.ZRange(h.Keys.AllWorkers(), 0, -1).Val()
 	wantWorkerKeys := []string{wkey}
 	if diff := cmp.Diff(wantWorkerKeys, gotWorkerKeys); diff != "" {
-		t.Errorf("%q contained %v, want %v", base.AllWorkers, gotWorkerKeys, wantWorkerKeys)
+		t.Errorf("%q contained %v, want %v", h.Keys.AllWorkers(), gotWorkerKeys, wantWorkerKeys)
 	}
 }
 
@@ -1048,10 +1987,10 @@ func TestClearServerState(t *testing.T) {
 
 	h.FlushDB(t, r.client)
 
-	skey := base.ServerInfoKey(info.Host, info.PID, info.ServerID)
-	wkey := base.WorkersKey(info.Host, info.PID, info.ServerID)
-	otherSKey := base.ServerInfoKey("otherhost", 12345, "server98")
-	otherWKey := base.WorkersKey("otherhost", 12345, "server98")
+	skey := h.Keys.ServerInfoKey(info.Host, info.PID, info.ServerID)
+	wkey := h.Keys.WorkersKey(info.Host, info.PID, info.ServerID)
+	otherSKey := h.Keys.ServerInfoKey("otherhost", 12345, "server98")
+	otherWKey := h.Keys.WorkersKey("otherhost", 12345, "server98")
 	// Populate the keys.
 	if err := r.client.Set(skey, "process-info", 0).Err(); err != nil {
 		t.Fatal(err)
@@ -1059,16 +1998,16 @@ func TestClearServerState(t *testing.T) {
 	if err := r.client.HSet(wkey, "worker-key", "worker-info").Err(); err != nil {
 		t.Fatal(err)
 	}
-	if err := r.client.ZAdd(base.AllServers, &redis.Z{Member: skey}).Err(); err != nil {
+	if err := r.client.ZAdd(h.Keys.AllServers(), &redis.Z{Member: skey}).Err(); err != nil {
 		t.Fatal(err)
 	}
-	if err := r.client.ZAdd(base.AllServers, &redis.Z{Member: otherSKey}).Err(); err != nil {
+	if err := r.client.ZAdd(h.Keys.AllServers(), &redis.Z{Member: otherSKey}).Err(); err != nil {
 		t.Fatal(err)
 	}
-	if err := r.client.ZAdd(base.AllWorkers, &redis.Z{Member: wkey}).Err(); err != nil {
+	if err := r.client.ZAdd(h.Keys.AllWorkers(), &redis.Z{Member: wkey}).Err(); err != nil {
 		t.Fatal(err)
 	}
-	if err := r.client.ZAdd(base.AllWorkers, &redis.Z{Member: otherWKey}).Err(); err != nil {
+	if err := r.client.ZAdd(h.Keys.AllWorkers(), &redis.Z{Member: otherWKey}).Err(); err != nil {
 		t.Fatal(err)
 	}
 
@@ -1084,24 +2023,24 @@ func TestClearServerState(t *testing.T) {
 	if r.client.Exists(wkey).Val() != 0 {
 		t.Errorf("Redis key %q exists", wkey)
 	}
-	gotProcessKeys := r.client.ZRange(base.AllServers, 0, -1).Val()
+	gotProcessKeys := r.client.ZRange(h.Keys.AllServers(), 0, -1).Val()
 	wantProcessKeys := []string{otherSKey}
 	if diff := cmp.Diff(wantProcessKeys, gotProcessKeys); diff != "" {
-		t.Errorf("%q contained %v, want %v", base.AllServers, gotProcessKeys, wantProcessKeys)
+		t.Errorf("%q contained %v, want %v", h.Keys.AllServers(), gotProcessKeys, wantProcessKeys)
 	}
-	gotWorkerKeys := r.client.ZRange(base.AllWorkers, 0, -1).Val()
+	gotWorkerKeys := r.client.ZRange(h.Keys.AllWorkers(), 0, -1).Val()
 	wantWorkerKeys := []string{otherWKey}
 	if diff := cmp.Diff(wantWorkerKeys, gotWorkerKeys); diff != "" {
-		t.Errorf("%q contained %v, want %v", base.AllWorkers, gotWorkerKeys, wantWorkerKeys)
+		t.Errorf("%q contained %v, want %v", h.Keys.AllWorkers(), gotWorkerKeys, wantWorkerKeys)
 	}
 }
 
-func TestCancelationPubSub(t *testing.T) {
+func TestSubscribeCancelation(t *testing.T) {
 	r := setup(t)
 
-	pubsub, err := r.CancelationPubSub()
+	pubsub, err := r.SubscribeCancelation()
 	if err != nil {
-		t.Fatalf("(*RDB).CancelationPubSub() returned an error: %v", err)
+		t.Fatalf("(*RDB).SubscribeCancelation() returned an error: %v", err)
 	}
 
 	cancelCh := pubsub.Channel()
@@ -1114,7 +2053,7 @@ func TestCancelationPubSub(t *testing.T) {
 	go func() {
 		for msg := range cancelCh {
 			mu.Lock()
-			received = append(received, msg.Payload)
+			received = append(received, msg)
 			mu.Unlock()
 		}
 	}()
@@ -1136,3 +2075,177 @@ func TestCancelationPubSub(t *testing.T) {
 	}
 	mu.Unlock()
 }
+
+func TestCancel(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := &base.TaskMessage{
+		ID:        xid.New(),
+		Type:      "reindex",
+		UniqueKey: h.Keys.UniqueKey(base.DefaultQueueName, "reindex", "nil"),
+		Queue:     base.DefaultQueueName,
+	}
+	m3 := h.NewTaskMessage("gen_thumbnail", nil)
+	m3.Queue = "low"
+	m4 := h.NewTaskMessage("sync", nil)
+	m5 := h.NewTaskMessage("cleanup", nil)
+	score := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		desc          string
+		enqueued      map[string][]*base.TaskMessage
+		inProgress    []*base.TaskMessage
+		scheduled     []h.ZSetEntry
+		retry         []h.ZSetEntry
+		dead          []h.ZSetEntry
+		target        *base.TaskMessage
+		want          base.CancelResult
+		wantEnqueued  map[string][]*base.TaskMessage
+		wantScheduled []*base.TaskMessage
+		wantRetry     []*base.TaskMessage
+		wantIndexed   bool
+		wantTombstone bool
+	}{
+		{
+			desc:         "removes enqueued task",
+			enqueued:     map[string][]*base.TaskMessage{"default": {m1, m4}, "low": {m3}},
+			target:       m3,
+			want:         base.CancelRemoved,
+			wantEnqueued: map[string][]*base.TaskMessage{"default": {m1, m4}, "low": {}},
+		},
+		{
+			desc:          "removes scheduled task and releases uniqueness lock",
+			scheduled:     []h.ZSetEntry{{Msg: m1, Score: float64(score)}, {Msg: m2, Score: float64(score)}},
+			target:        m2,
+			want:          base.CancelRemoved,
+			wantScheduled: []*base.TaskMessage{m1},
+		},
+		{
+			desc:      "removes retry task",
+			retry:     []h.ZSetEntry{{Msg: m4, Score: float64(score)}},
+			target:    m4,
+			want:      base.CancelRemoved,
+			wantRetry: nil,
+		},
+		{
+			desc:          "records tombstone for in-progress task",
+			inProgress:    []*base.TaskMessage{m1},
+			target:        m1,
+			want:          base.CancelRunning,
+			wantIndexed:   true,
+			wantTombstone: true,
+		},
+		{
+			desc:        "ignores dead task",
+			dead:        []h.ZSetEntry{{Msg: m5, Score: float64(time.Now().Unix())}},
+			target:      m5,
+			want:        base.CancelNotFound,
+			wantIndexed: true,
+		},
+		{
+			desc:   "ignores unknown task",
+			target: m5,
+			want:   base.CancelNotFound,
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+		var all []*base.TaskMessage
+		for qname, msgs := range tc.enqueued {
+			h.SeedEnqueuedQueue(t, r.client, msgs, qname)
+			all = append(all, msgs...)
+		}
+		h.SeedInProgressQueue(t, r.client, tc.inProgress)
+		h.SeedScheduledQueue(t, r.client, tc.scheduled)
+		h.SeedRetryQueue(t, r.client, tc.retry)
+		h.SeedDeadQueue(t, r.client, tc.dead)
+		all = append(all, tc.inProgress...)
+		for _, entries := range [][]h.ZSetEntry{tc.scheduled, tc.retry, tc.dead} {
+			for _, e := range entries {
+				all = append(all, e.Msg)
+			}
+		}
+		h.SeedTaskIndex(t, r.client, all)
+		for _, msg := range all {
+			if len(msg.UniqueKey) > 0 {
+				if err := r.client.SetNX(msg.UniqueKey, msg.ID.String(), time.Hour).Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		got, err := r.Cancel(tc.target.ID.String(), time.Hour)
+		if err != nil {
+			t.Errorf("%s; (*RDB).Cancel returned error: %v", tc.desc, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s; (*RDB).Cancel = %v, want %v", tc.desc, got, tc.want)
+		}
+		for qname, want := range tc.wantEnqueued {
+			gotEnqueued := h.GetEnqueuedMessages(t, r.client, qname)
+			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
+				t.Errorf("%s; mismatch found in %q; (-want, +got)\n%s", tc.desc, h.Keys.QueueKey(qname), diff)
+			}
+		}
+		gotScheduled := h.GetScheduledMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.SortMsgOpt); diff != "" {
+			t.Errorf("%s; mismatch found in %q; (-want, +got)\n%s", tc.desc, h.Keys.ScheduledQueue(), diff)
+		}
+		gotRetry := h.GetRetryMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortMsgOpt); diff != "" {
+			t.Errorf("%s; mismatch found in %q; (-want, +got)\n%s", tc.desc, h.Keys.RetryQueue(), diff)
+		}
+		_, indexed := h.GetTaskIndex(t, r.client)[tc.target.ID.String()]
+		if indexed != tc.wantIndexed {
+			t.Errorf("%s; task indexed = %t, want %t", tc.desc, indexed, tc.wantIndexed)
+		}
+		if len(tc.target.UniqueKey) > 0 && tc.want == base.CancelRemoved && r.client.Exists(tc.target.UniqueKey).Val() != 0 {
+			t.Errorf("%s; uniqueness lock %q still exists", tc.desc, tc.target.UniqueKey)
+		}
+		tombstone := h.Keys.TombstoneKey(tc.target.ID.String())
+		if got := r.client.Exists(tombstone).Val() == 1; got != tc.wantTombstone {
+			t.Errorf("%s; tombstone %q exists = %t, want %t", tc.desc, tombstone, got, tc.wantTombstone)
+		}
+	}
+}
+
+func TestSkipCanceled(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+
+	h.FlushDB(t, r.client)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{m1, m2})
+	h.SeedTaskIndex(t, r.client, []*base.TaskMessage{m1, m2})
+	if _, err := r.Cancel(m1.ID.String(), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		msg  *base.TaskMessage
+		want bool
+	}{
+		{m1, true},
+		{m2, false},
+		{m1, false}, // tombstone is removed once the task is skipped
+	} {
+		got, err := r.SkipCanceled(tc.msg)
+		if err != nil {
+			t.Fatalf("(*RDB).SkipCanceled(%v) returned error: %v", tc.msg.ID, err)
+		}
+		if got != tc.want {
+			t.Errorf("(*RDB).SkipCanceled(%v) = %t, want %t", tc.msg.ID, got, tc.want)
+		}
+	}
+
+	wantInProgress := []*base.TaskMessage{m2}
+	if diff := cmp.Diff(wantInProgress, h.GetInProgressMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.InProgressQueue(), diff)
+	}
+	wantIndex := map[string]*base.TaskMessage{m2.ID.String(): m2}
+	if diff := cmp.Diff(wantIndex, h.GetTaskIndex(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.TaskIndex(), diff)
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/go-redis/redis/v7"
 	"github.com/hibiken/asynq/internal/base"
 )
 
@@ -132,6 +131,15 @@ func (tb *TestBroker) RequeueAll() (int64, error) {
 	return tb.real.RequeueAll()
 }
 
+func (tb *TestBroker) RecoverAll(maxRecovery int, errMsg string) (requeued, killed int64, err error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return 0, 0, errRedisDown
+	}
+	return tb.real.RecoverAll(maxRecovery, errMsg)
+}
+
 func (tb *TestBroker) CheckAndEnqueue(qnames ...string) error {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
@@ -159,13 +167,13 @@ func (tb *TestBroker) ClearServerState(ss *base.ServerState) error {
 	return tb.real.ClearServerState(ss)
 }
 
-func (tb *TestBroker) CancelationPubSub() (*redis.PubSub, error) {
+func (tb *TestBroker) SubscribeCancelation() (base.Subscription, error) {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
 	if tb.sleeping {
 		return nil, errRedisDown
 	}
-	return tb.real.CancelationPubSub()
+	return tb.real.SubscribeCancelation()
 }
 
 func (tb *TestBroker) PublishCancelation(id string) error {
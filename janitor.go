@@ -0,0 +1,118 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// janitor is responsible for trimming the dead queue periodically
+// according to the retention limits.
+type janitor struct {
+	logger Logger
+
+	// trimmer is nil if the broker trims the dead queue by itself.
+	trimmer base.DeadTrimmer
+
+	// channel to communicate back to the long running "janitor" goroutine.
+	done chan struct{}
+
+	// interval between trimming the dead queue.
+	interval time.Duration
+
+	retention      base.Retention
+	queueRetention map[string]base.Retention
+
+	// sink receives evicted tasks; may be nil.
+	sink DeadTaskSink
+}
+
+type newJanitorParams struct {
+	logger         Logger
+	broker         base.Broker
+	interval       time.Duration
+	retention      base.Retention
+	queueRetention map[string]base.Retention
+	sink           DeadTaskSink
+}
+
+func newJanitor(params newJanitorParams) *janitor {
+	trimmer, _ := params.broker.(base.DeadTrimmer)
+	return &janitor{
+		logger:         params.logger,
+		trimmer:        trimmer,
+		done:           make(chan struct{}),
+		interval:       params.interval,
+		retention:      params.retention,
+		queueRetention: params.queueRetention,
+		sink:           params.sink,
+	}
+}
+
+func (j *janitor) terminate() {
+	j.logger.Info("Janitor shutting down...")
+	// Signal the janitor goroutine to stop.
+	j.done <- struct{}{}
+}
+
+// start starts the "janitor" goroutine.
+func (j *janitor) start(wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		j.exec()
+		for {
+			select {
+			case <-j.done:
+				j.logger.Info("Janitor done")
+				return
+			case <-time.After(j.interval):
+				j.exec()
+			}
+		}
+	}()
+}
+
+func (j *janitor) exec() {
+	if j.trimmer == nil {
+		return
+	}
+	var evict func([]*base.DeadEntry) error
+	if j.sink != nil {
+		evict = j.evict
+	}
+	n, err := j.trimmer.TrimDead(j.retention, j.queueRetention, evict)
+	if err != nil {
+		j.logger.Error("Could not trim dead queue: %v", err)
+	}
+	if n > 0 {
+		j.logger.Info("Evicted %d tasks from dead queue", n)
+	}
+}
+
+func (j *janitor) evict(entries []*base.DeadEntry) error {
+	tasks := make([]*EvictedTask, len(entries))
+	for i, e := range entries {
+		tasks[i] = &EvictedTask{
+			ID:          e.Msg.ID.String(),
+			Type:        e.Msg.Type,
+			Payload:     e.Msg.Payload,
+			Queue:       e.Msg.Queue,
+			Retry:       e.Msg.Retry,
+			Retried:     e.Msg.Retried,
+			ErrorMsg:    e.Msg.ErrorMsg,
+			Timeout:     e.Msg.Timeout,
+			Deadline:    e.Msg.Deadline,
+			Headers:     e.Msg.Headers,
+			TraceParent: e.Msg.TraceParent,
+			TraceState:  e.Msg.TraceState,
+			DiedAt:      e.DiedAt,
+		}
+	}
+	return j.sink.Archive(tasks)
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+func TestJanitor(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessageWithQueue("sync", nil, "critical")
+	now := time.Now()
+	e1 := h.ZSetEntry{Msg: m1, Score: float64(now.Add(-3 * time.Hour).Unix())}
+	e2 := h.ZSetEntry{Msg: m2, Score: float64(now.Add(-time.Hour).Unix())}
+	e3 := h.ZSetEntry{Msg: m3, Score: float64(now.Add(-2 * time.Hour).Unix())}
+
+	tests := []struct {
+		dead           []h.ZSetEntry
+		retention      base.Retention
+		queueRetention map[string]base.Retention
+		sinkErr        error
+		wantArchived   []string // IDs of archived tasks
+		wantDead       []h.ZSetEntry
+	}{
+		{
+			dead:         []h.ZSetEntry{e1, e2, e3},
+			retention:    base.Retention{MaxSize: 10, MaxAge: 2 * time.Hour},
+			wantArchived: []string{m1.ID.String(), m3.ID.String()},
+			wantDead:     []h.ZSetEntry{e2},
+		},
+		{
+			dead:           []h.ZSetEntry{e1, e2, e3},
+			retention:      base.Retention{MaxSize: 10, MaxAge: 2 * time.Hour},
+			queueRetention: map[string]base.Retention{"critical": {MaxSize: 10, MaxAge: 24 * time.Hour}},
+			wantArchived:   []string{m1.ID.String()},
+			wantDead:       []h.ZSetEntry{e2, e3},
+		},
+		{
+			dead:         []h.ZSetEntry{e1, e2, e3},
+			retention:    base.Retention{MaxSize: 10, MaxAge: 2 * time.Hour},
+			sinkErr:      errors.New("disk full"),
+			wantArchived: nil,
+			wantDead:     []h.ZSetEntry{e1, e2, e3},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		h.SeedDeadQueue(t, r, tc.dead)
+
+		var (
+			mu       sync.Mutex // guards archived
+			archived []string
+		)
+		sink := DeadTaskSinkFunc(func(tasks []*EvictedTask) error {
+			if tc.sinkErr != nil {
+				return tc.sinkErr
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, t := range tasks {
+				archived = append(archived, t.ID)
+			}
+			return nil
+		})
+		j := newJanitor(newJanitorParams{
+			logger:         testLogger,
+			broker:         rdbClient,
+			interval:       time.Minute,
+			retention:      tc.retention,
+			queueRetention: tc.queueRetention,
+			sink:           sink,
+		})
+
+		var wg sync.WaitGroup
+		j.start(&wg)
+		time.Sleep(time.Second) // allow janitor to trim the dead queue
+		j.terminate()
+		wg.Wait()
+
+		mu.Lock()
+		if diff := cmp.Diff(tc.wantArchived, archived); diff != "" {
+			t.Errorf("mismatch found in archived tasks; (-want, +got)\n%s", diff)
+		}
+		mu.Unlock()
+		gotDead := h.GetDeadEntries(t, r)
+		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortZSetEntryOpt); diff != "" {
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.DeadQueue(), diff)
+		}
+	}
+}
+
+func TestJanitorEvictedTask(t *testing.T) {
+	r := setup(t)
+	msg := h.NewTaskMessageWithQueue("send_email", map[string]interface{}{"user_id": 42.0}, "low")
+	msg.Retried = 25
+	msg.ErrorMsg = "SMTP server not responding"
+	msg.Timeout = "30s"
+	msg.Headers = map[string]string{"request_id": "abc123"}
+	msg.TraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	msg.TraceState = "congo=t61rcWkgMzE"
+	diedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	h.FlushDB(t, r)
+	h.SeedDeadQueue(t, r, []h.ZSetEntry{{Msg: msg, Score: float64(diedAt.Unix())}})
+
+	var got []*EvictedTask
+	j := newJanitor(newJanitorParams{
+		logger:    testLogger,
+		broker:    rdb.NewRDB(r),
+		interval:  time.Minute,
+		retention: base.Retention{MaxAge: time.Minute},
+		sink: DeadTaskSinkFunc(func(tasks []*EvictedTask) error {
+			got = append(got, tasks...)
+			return nil
+		}),
+	})
+	j.exec()
+
+	want := []*EvictedTask{
+		{
+			ID:          msg.ID.String(),
+			Type:        "send_email",
+			Payload:     map[string]interface{}{"user_id": 42.0},
+			Queue:       "low",
+			Retry:       msg.Retry,
+			Retried:     25,
+			ErrorMsg:    "SMTP server not responding",
+			Timeout:     "30s",
+			Deadline:    msg.Deadline,
+			Headers:     map[string]string{"request_id": "abc123"},
+			TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			TraceState:  "congo=t61rcWkgMzE",
+			DiedAt:      diedAt,
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch found in evicted tasks; (-want, +got)\n%s", diff)
+	}
+}
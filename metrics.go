@@ -0,0 +1,311 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// metricsContentType is the content type of the Prometheus text exposition format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// durationBuckets are the upper bounds, in seconds, of the buckets of
+// the task processing duration histogram.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// queueCountsInterval is the minimum interval between counting the tasks
+// which are kept across queues by queue.
+const queueCountsInterval = 15 * time.Second
+
+// NewMetricsHandler returns an http.Handler exposing metrics of the queues
+// and servers in Prometheus text format, read from redis with the inspector.
+//
+// The metrics are:
+//
+//	asynq_tasks{queue,state}                      number of tasks in the queue and state
+//	asynq_tasks_processed_today                   number of tasks processed today (UTC)
+//	asynq_tasks_failed_today                      number of tasks failed today (UTC)
+//	asynq_server_concurrency{host,pid,server}     concurrency of the server
+//	asynq_server_active_workers{host,pid,server}  number of workers processing tasks
+//
+// Scheduled, retry and in-progress tasks are kept across queues and are read
+// to count them by queue, so they are counted at most once every 15 seconds
+// and the counts of tasks which change their state meanwhile are approximate.
+// Dead tasks are counted with the dead task index of each queue.
+//
+// The metrics are the same whichever process serves them, so serve them
+// from a single process, e.g. with the metrics command of the CLI, and use
+// Server.MetricsHandler to expose task processing durations of each server.
+func NewMetricsHandler(inspector *Inspector) http.Handler {
+	qc := &queueCounts{inspector: inspector}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats, err := inspector.CurrentStats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cached, err := qc.get(time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		counts := map[string]map[string]int{StateEnqueued: make(map[string]int)}
+		for _, q := range stats.Queues {
+			counts[StateEnqueued][q.Name] = q.Size
+		}
+		for state, byQueue := range cached {
+			counts[state] = byQueue
+		}
+		servers, err := inspector.ListServers()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var mw metricsWriter
+		mw.writeStats(stats, counts)
+		mw.writeServers(servers)
+		mw.writeTo(w)
+	})
+}
+
+// queueCounts caches the number of tasks by state and queue name for
+// the states whose tasks are kept across queues.
+type queueCounts struct {
+	inspector *Inspector
+
+	mu      sync.Mutex
+	counts  map[string]map[string]int // must not be modified once cached
+	updated time.Time
+}
+
+// get returns the cached counts, counting the tasks again if they were
+// counted queueCountsInterval or longer before now.
+func (qc *queueCounts) get(now time.Time) (map[string]map[string]int, error) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	if qc.counts != nil && now.Sub(qc.updated) < queueCountsInterval {
+		return qc.counts, nil
+	}
+	counts := make(map[string]map[string]int)
+	for _, state := range []string{StateInProgress, StateScheduled, StateRetry, StateDead} {
+		byQueue, err := qc.inspector.rdb.CountByQueue(state)
+		if err != nil {
+			return nil, err
+		}
+		counts[state] = byQueue
+	}
+	qc.counts, qc.updated = counts, now
+	return counts, nil
+}
+
+// MetricsHandler returns an http.Handler exposing metrics of the server
+// in Prometheus text format:
+//
+//	asynq_server_concurrency{host,pid,server}           concurrency of the server
+//	asynq_server_active_workers{host,pid,server}        number of workers processing tasks
+//	asynq_server_tasks_processed_total{type,queue}      number of tasks processed
+//	asynq_server_tasks_failed_total{type,queue}         number of tasks failed
+//	asynq_task_processing_duration_seconds{type,queue}  histogram of processing durations
+//
+// Only the tasks processed by this server are reported, so that the metrics
+// of multiple servers can be summed up. Metrics of the queues are not reported
+// since every server would report the same numbers; serve them from a single
+// process with NewMetricsHandler.
+//
+// Set Config.MetricsAddr to serve the handler without an HTTP server of your own.
+func (srv *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var mw metricsWriter
+		info := srv.ss.GetInfo()
+		mw.writeServers([]*ServerInfo{{
+			ID:            info.ServerID,
+			Host:          info.Host,
+			PID:           info.PID,
+			Concurrency:   info.Concurrency,
+			ActiveWorkers: info.ActiveWorkerCount,
+		}})
+		srv.metrics.writeTo(&mw)
+		mw.writeTo(w)
+	})
+}
+
+type taskMetricsKey struct {
+	taskType string
+	qname    string
+}
+
+type taskMetrics struct {
+	processed uint64
+	failed    uint64
+	// buckets holds the number of observations in each bucket,
+	// with the last one for the observations above the largest bound.
+	buckets []uint64
+	sum     float64
+}
+
+// metrics records the tasks processed by a server.
+type metrics struct {
+	mu    sync.Mutex
+	tasks map[taskMetricsKey]*taskMetrics
+}
+
+func newMetrics() *metrics {
+	return &metrics{tasks: make(map[taskMetricsKey]*taskMetrics)}
+}
+
+// observe records that the task finished processing in d,
+// either successfully or not. It's a no-op on a nil metrics.
+func (m *metrics) observe(msg *base.TaskMessage, d time.Duration, failed bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := taskMetricsKey{msg.Type, msg.Queue}
+	tm, ok := m.tasks[key]
+	if !ok {
+		tm = &taskMetrics{buckets: make([]uint64, len(durationBuckets)+1)}
+		m.tasks[key] = tm
+	}
+	tm.processed++
+	if failed {
+		tm.failed++
+	}
+	secs := d.Seconds()
+	tm.buckets[sort.SearchFloat64s(durationBuckets, secs)]++
+	tm.sum += secs
+}
+
+// writeTo writes the recorded metrics, sorted by task type and queue.
+func (m *metrics) writeTo(mw *metricsWriter) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]taskMetricsKey, 0, len(m.tasks))
+	for k := range m.tasks {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].taskType != keys[j].taskType {
+			return keys[i].taskType < keys[j].taskType
+		}
+		return keys[i].qname < keys[j].qname
+	})
+
+	mw.header("asynq_server_tasks_processed_total", "counter", "Number of tasks processed by the server.")
+	for _, k := range keys {
+		mw.sample("asynq_server_tasks_processed_total", float64(m.tasks[k].processed), "type", k.taskType, "queue", k.qname)
+	}
+	mw.header("asynq_server_tasks_failed_total", "counter", "Number of tasks failed in the server.")
+	for _, k := range keys {
+		mw.sample("asynq_server_tasks_failed_total", float64(m.tasks[k].failed), "type", k.taskType, "queue", k.qname)
+	}
+	const name = "asynq_task_processing_duration_seconds"
+	mw.header(name, "histogram", "Duration of processing tasks in seconds.")
+	for _, k := range keys {
+		tm := m.tasks[k]
+		var n uint64
+		for i, c := range tm.buckets {
+			n += c
+			le := math.Inf(1)
+			if i < len(durationBuckets) {
+				le = durationBuckets[i]
+			}
+			mw.sample(name+"_bucket", float64(n), "type", k.taskType, "queue", k.qname, "le", formatFloat(le))
+		}
+		mw.sample(name+"_sum", tm.sum, "type", k.taskType, "queue", k.qname)
+		mw.sample(name+"_count", float64(n), "type", k.taskType, "queue", k.qname)
+	}
+}
+
+// metricsWriter writes metrics in Prometheus text exposition format.
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+func (mw *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(&mw.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample of the metric with the labels given as name-value pairs.
+func (mw *metricsWriter) sample(name string, v float64, labels ...string) {
+	mw.buf.WriteString(name)
+	if len(labels) > 0 {
+		mw.buf.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				mw.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&mw.buf, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		mw.buf.WriteByte('}')
+	}
+	mw.buf.WriteByte(' ')
+	mw.buf.WriteString(formatFloat(v))
+	mw.buf.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeStats writes the stats along with the number of tasks in each
+// queue and state, given as counts by state and queue name.
+func (mw *metricsWriter) writeStats(stats *Stats, counts map[string]map[string]int) {
+	seen := make(map[string]bool)
+	var qnames []string
+	for _, byQueue := range counts {
+		for qname := range byQueue {
+			if !seen[qname] {
+				seen[qname] = true
+				qnames = append(qnames, qname)
+			}
+		}
+	}
+	sort.Strings(qnames)
+	mw.header("asynq_tasks", "gauge", "Number of tasks in each queue and state.")
+	for _, qname := range qnames {
+		for _, state := range []string{StateEnqueued, StateInProgress, StateScheduled, StateRetry, StateDead} {
+			mw.sample("asynq_tasks", float64(counts[state][qname]), "queue", qname, "state", state)
+		}
+	}
+	mw.header("asynq_tasks_processed_today", "gauge", "Number of tasks processed today (UTC).")
+	mw.sample("asynq_tasks_processed_today", float64(stats.Processed))
+	mw.header("asynq_tasks_failed_today", "gauge", "Number of tasks failed today (UTC).")
+	mw.sample("asynq_tasks_failed_today", float64(stats.Failed))
+}
+
+func (mw *metricsWriter) writeServers(servers []*ServerInfo) {
+	mw.header("asynq_server_concurrency", "gauge", "Maximum number of tasks processed concurrently by each server.")
+	for _, s := range servers {
+		mw.sample("asynq_server_concurrency", float64(s.Concurrency), "host", s.Host, "pid", strconv.Itoa(s.PID), "server", s.ID)
+	}
+	mw.header("asynq_server_active_workers", "gauge", "Number of workers processing tasks in each server.")
+	for _, s := range servers {
+		mw.sample("asynq_server_active_workers", float64(s.ActiveWorkers), "host", s.Host, "pid", strconv.Itoa(s.PID), "server", s.ID)
+	}
+}
+
+func (mw *metricsWriter) writeTo(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", metricsContentType)
+	w.Write(mw.buf.Bytes())
+}
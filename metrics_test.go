@@ -0,0 +1,234 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+func TestMetricsWriteTo(t *testing.T) {
+	m := newMetrics()
+	m.observe(h.NewTaskMessage("send_email", nil), 20*time.Millisecond, false)
+	m.observe(h.NewTaskMessage("send_email", nil), 3*time.Second, true)
+	m.observe(h.NewTaskMessageWithQueue("reindex", nil, "low"), time.Hour, false)
+
+	var mw metricsWriter
+	m.writeTo(&mw)
+
+	want := `# HELP asynq_server_tasks_processed_total Number of tasks processed by the server.
+# TYPE asynq_server_tasks_processed_total counter
+asynq_server_tasks_processed_total{type="reindex",queue="low"} 1
+asynq_server_tasks_processed_total{type="send_email",queue="default"} 2
+# HELP asynq_server_tasks_failed_total Number of tasks failed in the server.
+# TYPE asynq_server_tasks_failed_total counter
+asynq_server_tasks_failed_total{type="reindex",queue="low"} 0
+asynq_server_tasks_failed_total{type="send_email",queue="default"} 1
+# HELP asynq_task_processing_duration_seconds Duration of processing tasks in seconds.
+# TYPE asynq_task_processing_duration_seconds histogram
+`
+	for _, tc := range []struct {
+		labels string
+		counts []int
+		sum    float64
+	}{
+		{`type="reindex",queue="low"`, []int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 3600},
+		{`type="send_email",queue="default"`, []int{0, 0, 1, 1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 2}, 3.02},
+	} {
+		for i, n := range tc.counts {
+			le := "+Inf"
+			if i < len(durationBuckets) {
+				le = formatFloat(durationBuckets[i])
+			}
+			want += fmt.Sprintf("asynq_task_processing_duration_seconds_bucket{%s,le=\"%s\"} %d\n", tc.labels, le, n)
+		}
+		want += fmt.Sprintf("asynq_task_processing_duration_seconds_sum{%s} %s\n", tc.labels, formatFloat(tc.sum))
+		want += fmt.Sprintf("asynq_task_processing_duration_seconds_count{%s} %d\n", tc.labels, tc.counts[len(tc.counts)-1])
+	}
+	if diff := cmp.Diff(want, mw.buf.String()); diff != "" {
+		t.Errorf("writeTo wrote:\n%s\nwant:\n%s\n(-want, +got)\n%s", mw.buf.String(), want, diff)
+	}
+}
+
+func TestMetricsWriterEscapesLabels(t *testing.T) {
+	var mw metricsWriter
+	mw.sample("asynq_queue_size", 1, "queue", "a\"b\\c\nd")
+	want := `asynq_queue_size{queue="a\"b\\c\nd"} 1` + "\n"
+	if got := mw.buf.String(); got != want {
+		t.Errorf("sample wrote %q, want %q", got, want)
+	}
+}
+
+func TestNewMetricsHandler(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{h.NewTaskMessage("send_email", nil)})
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{h.NewTaskMessageWithQueue("reindex", nil, "critical")}, "critical")
+	h.SeedRetryQueue(t, r, []h.ZSetEntry{{Msg: h.NewTaskMessage("sync", nil), Score: float64(now.Unix())}})
+	h.SeedDeadQueue(t, r, []h.ZSetEntry{{Msg: h.NewTaskMessageWithQueue("export", nil, "low"), Score: float64(now.Unix())}})
+	r.Set(h.Keys.ProcessedKey(now), 120, 0)
+	r.Set(h.Keys.FailureKey(now), 3, 0)
+	ss := base.NewServerState("127.0.0.1", 9876, 10, map[string]int{"default": 1}, false)
+	ss.AddWorkerStats(h.NewTaskMessage("send_email", nil), now)
+	if err := rdb.NewRDB(r).WriteServerState(ss, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	NewMetricsHandler(newTestInspector(t)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics returned %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Content-Type"); got != metricsContentType {
+		t.Errorf("GET /metrics returned Content-Type %q, want %q", got, metricsContentType)
+	}
+	serverLabels := fmt.Sprintf(`host="127.0.0.1",pid="9876",server="%s"`, ss.GetInfo().ServerID)
+	// Dead tasks are counted in their queue which has no enqueued tasks.
+	want := `# HELP asynq_tasks Number of tasks in each queue and state.
+# TYPE asynq_tasks gauge
+asynq_tasks{queue="critical",state="enqueued"} 1
+asynq_tasks{queue="critical",state="in_progress"} 0
+asynq_tasks{queue="critical",state="scheduled"} 0
+asynq_tasks{queue="critical",state="retry"} 0
+asynq_tasks{queue="critical",state="dead"} 0
+asynq_tasks{queue="default",state="enqueued"} 1
+asynq_tasks{queue="default",state="in_progress"} 0
+asynq_tasks{queue="default",state="scheduled"} 0
+asynq_tasks{queue="default",state="retry"} 1
+asynq_tasks{queue="default",state="dead"} 0
+asynq_tasks{queue="low",state="enqueued"} 0
+asynq_tasks{queue="low",state="in_progress"} 0
+asynq_tasks{queue="low",state="scheduled"} 0
+asynq_tasks{queue="low",state="retry"} 0
+asynq_tasks{queue="low",state="dead"} 1
+# HELP asynq_tasks_processed_today Number of tasks processed today (UTC).
+# TYPE asynq_tasks_processed_today gauge
+asynq_tasks_processed_today 120
+# HELP asynq_tasks_failed_today Number of tasks failed today (UTC).
+# TYPE asynq_tasks_failed_today gauge
+asynq_tasks_failed_today 3
+# HELP asynq_server_concurrency Maximum number of tasks processed concurrently by each server.
+# TYPE asynq_server_concurrency gauge
+asynq_server_concurrency{` + serverLabels + `} 10
+# HELP asynq_server_active_workers Number of workers processing tasks in each server.
+# TYPE asynq_server_active_workers gauge
+asynq_server_active_workers{` + serverLabels + `} 1
+`
+	if diff := cmp.Diff(want, rec.Body.String()); diff != "" {
+		t.Errorf("GET /metrics returned:\n%s\nwant:\n%s\n(-want, +got)\n%s", rec.Body.String(), want, diff)
+	}
+}
+
+func TestQueueCountsCached(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	h.SeedRetryQueue(t, r, []h.ZSetEntry{{Msg: h.NewTaskMessage("sync", nil), Score: float64(now.Unix())}})
+	qc := &queueCounts{inspector: newTestInspector(t)}
+	if _, err := qc.get(now); err != nil {
+		t.Fatal(err)
+	}
+	h.SeedRetryQueue(t, r, []h.ZSetEntry{{Msg: h.NewTaskMessage("reindex", nil), Score: float64(now.Unix())}})
+
+	tests := []struct {
+		at   time.Time
+		want int
+	}{
+		{now.Add(queueCountsInterval - time.Second), 1}, // cached
+		{now.Add(queueCountsInterval), 2},
+	}
+	for _, tc := range tests {
+		counts, err := qc.get(tc.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := counts[StateRetry][base.DefaultQueueName]; got != tc.want {
+			t.Errorf("retry tasks counted %v after the first count = %d, want %d", tc.at.Sub(now), got, tc.want)
+		}
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	setup(t)
+	redisConnOpt := RedisClientOpt{Addr: redisAddr, DB: redisDB}
+	const metricsAddr = "localhost:19091"
+	srv := NewServer(redisConnOpt, Config{Concurrency: 2, MetricsAddr: metricsAddr})
+	done := make(chan struct{}, 3)
+	handler := func(ctx context.Context, task *Task) error {
+		defer func() { done <- struct{}{} }()
+		switch task.Type {
+		case "fail":
+			return errors.New("failed")
+		case "later":
+			return Reschedule(time.Hour)
+		}
+		return nil
+	}
+	if err := srv.Start(HandlerFunc(handler)); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	c := NewClient(redisConnOpt)
+	if err := c.Enqueue(NewTask("ok", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Enqueue(NewTask("fail", nil), MaxRetry(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Enqueue(NewTask("later", nil)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the tasks to be processed")
+		}
+	}
+	time.Sleep(100 * time.Millisecond) // let the workers record the results
+
+	res, err := http.Get("http://" + metricsAddr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(data)
+	for _, want := range []string{
+		`asynq_server_tasks_processed_total{type="fail",queue="default"} 1`,
+		`asynq_server_tasks_failed_total{type="fail",queue="default"} 1`,
+		`asynq_server_tasks_processed_total{type="ok",queue="default"} 1`,
+		`asynq_server_tasks_failed_total{type="ok",queue="default"} 0`,
+		`asynq_task_processing_duration_seconds_count{type="ok",queue="default"} 1`,
+		// rescheduled tasks are processed without failing.
+		`asynq_server_tasks_processed_total{type="later",queue="default"} 1`,
+		`asynq_server_tasks_failed_total{type="later",queue="default"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("GET /metrics returned body without %q:\n%s", want, body)
+		}
+	}
+	if n := strings.Count(body, "asynq_server_active_workers{"); n != 1 {
+		t.Errorf("GET /metrics reported %d servers, want 1", n)
+	}
+	// Metrics of the queues are the same for all servers and are not reported.
+	if strings.Contains(body, "asynq_tasks") {
+		t.Errorf("GET /metrics returned body with the metrics of the queues:\n%s", body)
+	}
+}
@@ -5,6 +5,7 @@
 package asynq
 
 import (
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -24,6 +25,11 @@ func (e *errKeyNotFound) Error() string {
 	return fmt.Sprintf("key %q does not exist", e.key)
 }
 
+// MarshalJSON encodes the payload data as a JSON object.
+func (p Payload) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.data)
+}
+
 // Has reports whether key exists.
 func (p Payload) Has(key string) bool {
 	_, ok := p.data[key]
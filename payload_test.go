@@ -649,3 +649,18 @@ func TestPayloadHas(t *testing.T) {
 		t.Errorf("Payload.Has(%q) = true, want false", "name")
 	}
 }
+
+func TestPayloadMarshalJSON(t *testing.T) {
+	payload := Payload{map[string]interface{}{
+		"user_id": 123,
+		"name":    "gopher",
+	}}
+
+	got, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("json.Marshal(payload) returned error: %v", err)
+	}
+	if want := `{"name":"gopher","user_id":123}`; string(got) != want {
+		t.Errorf("json.Marshal(payload) = %s, want %s", got, want)
+	}
+}
@@ -6,6 +6,7 @@ package asynq
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"sort"
@@ -13,7 +14,6 @@ import (
 	"time"
 
 	"github.com/hibiken/asynq/internal/base"
-	"github.com/hibiken/asynq/internal/rdb"
 	"golang.org/x/time/rate"
 )
 
@@ -32,6 +32,13 @@ type processor struct {
 
 	retryDelayFunc retryDelayFunc
 
+	// retryPolicies is consulted before retryDelayFunc; may be nil.
+	retryPolicies *RetryPolicyMux
+
+	// maxCrashRecovery is the number of times a task can be recovered
+	// after a crash before it gets moved to the dead queue.
+	maxCrashRecovery int
+
 	errHandler ErrorHandler
 
 	shutdownTimeout time.Duration
@@ -59,19 +66,59 @@ type processor struct {
 
 	// cancelations is a set of cancel functions for all in-progress tasks.
 	cancelations *base.Cancelations
+
+	// prefetchCount is the max number of tasks to dequeue at once.
+	prefetchCount int
+
+	// prefetched holds tasks dequeued but not yet started, and
+	// prefetchedSignals the number of cancelation signals received
+	// before they were dequeued.
+	// They are accessed only by the "processor" goroutine until the goroutine stops.
+	prefetched        []*base.TaskMessage
+	prefetchedSignals uint64
+
+	// recorder records task history; nil if history is disabled
+	// or the broker does not support it.
+	recorder   base.HistoryRecorder
+	historyTTL time.Duration
+
+	// host, pid and serverID identify the server in task history.
+	host     string
+	pid      int
+	serverID string
+
+	// canceler is used to skip tasks canceled by clients; nil if the broker
+	// does not support it.
+	canceler base.Canceler
+
+	// rescheduler is used to reschedule tasks; nil if the broker
+	// does not support it.
+	rescheduler base.Rescheduler
+
+	// metrics records the processed tasks; may be nil.
+	metrics *metrics
+
+	// tracer opens spans for processed tasks; nil if tracing is disabled.
+	tracer Tracer
 }
 
 type retryDelayFunc func(n int, err error, task *Task) time.Duration
 
 type newProcessorParams struct {
-	logger          Logger
-	broker          base.Broker
-	ss              *base.ServerState
-	retryDelayFunc  retryDelayFunc
-	syncCh          chan<- *syncRequest
-	cancelations    *base.Cancelations
-	errHandler      ErrorHandler
-	shutdownTimeout time.Duration
+	logger           Logger
+	broker           base.Broker
+	ss               *base.ServerState
+	retryDelayFunc   retryDelayFunc
+	retryPolicies    *RetryPolicyMux
+	maxCrashRecovery int
+	syncCh           chan<- *syncRequest
+	cancelations     *base.Cancelations
+	errHandler       ErrorHandler
+	shutdownTimeout  time.Duration
+	prefetchCount    int
+	historyTTL       time.Duration
+	metrics          *metrics
+	tracer           Tracer
 }
 
 // newProcessor constructs a new processor.
@@ -82,22 +129,40 @@ func newProcessor(params newProcessorParams) *processor {
 	if info.StrictPriority {
 		orderedQueues = sortByPriority(qcfg)
 	}
+	var recorder base.HistoryRecorder
+	if params.historyTTL > 0 {
+		recorder, _ = params.broker.(base.HistoryRecorder)
+	}
+	canceler, _ := params.broker.(base.Canceler)
+	rescheduler, _ := params.broker.(base.Rescheduler)
 	return &processor{
-		logger:         params.logger,
-		broker:         params.broker,
-		ss:             params.ss,
-		queueConfig:    qcfg,
-		orderedQueues:  orderedQueues,
-		retryDelayFunc: params.retryDelayFunc,
-		syncRequestCh:  params.syncCh,
-		cancelations:   params.cancelations,
-		errLogLimiter:  rate.NewLimiter(rate.Every(3*time.Second), 1),
-		sema:           make(chan struct{}, info.Concurrency),
-		done:           make(chan struct{}),
-		abort:          make(chan struct{}),
-		quit:           make(chan struct{}),
-		errHandler:     params.errHandler,
-		handler:        HandlerFunc(func(ctx context.Context, t *Task) error { return fmt.Errorf("handler not set") }),
+		logger:           params.logger,
+		broker:           params.broker,
+		ss:               params.ss,
+		queueConfig:      qcfg,
+		orderedQueues:    orderedQueues,
+		retryDelayFunc:   params.retryDelayFunc,
+		retryPolicies:    params.retryPolicies,
+		maxCrashRecovery: params.maxCrashRecovery,
+		syncRequestCh:    params.syncCh,
+		cancelations:     params.cancelations,
+		errLogLimiter:    rate.NewLimiter(rate.Every(3*time.Second), 1),
+		sema:             make(chan struct{}, info.Concurrency),
+		done:             make(chan struct{}),
+		abort:            make(chan struct{}),
+		quit:             make(chan struct{}),
+		errHandler:       params.errHandler,
+		prefetchCount:    params.prefetchCount,
+		recorder:         recorder,
+		historyTTL:       params.historyTTL,
+		host:             info.Host,
+		pid:              info.PID,
+		serverID:         info.ServerID,
+		canceler:         canceler,
+		rescheduler:      rescheduler,
+		metrics:          params.metrics,
+		tracer:           params.tracer,
+		handler:          HandlerFunc(func(ctx context.Context, t *Task) error { return fmt.Errorf("handler not set") }),
 	}
 }
 
@@ -111,6 +176,12 @@ func (p *processor) stop() {
 		// Signal the processor goroutine to stop processing tasks
 		// from the queue.
 		p.done <- struct{}{}
+		// The goroutine no longer touches the buffer; return
+		// prefetched tasks to the queue.
+		for _, msg := range p.prefetched {
+			p.requeue(msg)
+		}
+		p.prefetched = nil
 	})
 }
 
@@ -135,9 +206,9 @@ func (p *processor) terminate() {
 }
 
 func (p *processor) start(wg *sync.WaitGroup) {
-	// NOTE: The call to "restore" needs to complete before starting
+	// NOTE: The call to "recover" needs to complete before starting
 	// the processor goroutine.
-	p.restore()
+	p.recover()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -156,16 +227,11 @@ func (p *processor) start(wg *sync.WaitGroup) {
 // exec pulls a task out of the queue and starts a worker goroutine to
 // process the task.
 func (p *processor) exec() {
-	qnames := p.queues()
-	msg, err := p.broker.Dequeue(qnames...)
-	if err == rdb.ErrNoProcessableTask { // TODO: Need to decouple this error from rdb to support other brokers
+	msg, signals, err := p.dequeue()
+	if errors.Is(err, base.ErrNoProcessableTask) {
 		// queues are empty, this is a normal behavior.
-		if len(p.queueConfig) > 1 {
-			// sleep to avoid slamming redis and let scheduler move tasks into queues.
-			// Note: With multiple queues, we are not using blocking pop operation and
-			// polling queues instead. This adds significant load to redis.
-			time.Sleep(time.Second)
-		}
+		// Note: Dequeue blocks for a while waiting for a task,
+		// so there is no need to sleep here.
 		return
 	}
 	if err != nil {
@@ -187,11 +253,29 @@ func (p *processor) exec() {
 				p.ss.DeleteWorkerStats(msg)
 				<-p.sema /* release token */
 			}()
+			p.record(msg, &base.TaskEvent{Kind: base.EventDequeued, Attempt: msg.Retried + 1})
 
 			resCh := make(chan error, 1)
 			task := NewTask(msg.Type, msg.Payload)
 			ctx, cancel := createContext(msg)
 			p.cancelations.Add(msg.ID.String(), cancel)
+			// Note: The tombstone is checked after the cancel function is added
+			// so that a task canceled concurrently is either skipped here or
+			// interrupted by the cancelation message.
+			if p.skipCanceled(msg, signals) {
+				p.cancelations.Delete(msg.ID.String())
+				cancel()
+				return
+			}
+			start := time.Now()
+			end := func(error) {}
+			if p.tracer != nil {
+				// Retried and recovered tasks were ready earlier than they were queued again.
+				if msg.Retried == 0 && msg.Recovered == 0 && msg.ReadyAt > 0 {
+					p.tracer.QueueWait(ctx, task, time.Unix(0, msg.ReadyAt), start)
+				}
+				ctx, end = p.tracer.StartProcess(ctx, task)
+			}
 			go func() {
 				resCh <- perform(ctx, task, p.handler)
 				p.cancelations.Delete(msg.ID.String())
@@ -201,29 +285,68 @@ func (p *processor) exec() {
 			case <-p.quit:
 				// time is up, quit this worker goroutine.
 				p.logger.Warn("Quitting worker. task id=%s", msg.ID)
+				end(ctx.Err())
 				return
 			case resErr := <-resCh:
-				// Note: One of three things should happen.
-				// 1) Done  -> Removes the message from InProgress
-				// 2) Retry -> Removes the message from InProgress & Adds the message to Retry
-				// 3) Kill  -> Removes the message from InProgress & Adds the message to Dead
+				end(resErr)
+				// Note: One of four things should happen.
+				// 1) Done       -> Removes the message from InProgress
+				// 2) Retry      -> Removes the message from InProgress & Adds the message to Retry
+				// 3) Kill       -> Removes the message from InProgress & Adds the message to Dead
+				// 4) Reschedule -> Removes the message from InProgress & Adds the message to Scheduled
 				if resErr != nil {
+					var re *rescheduleError
+					if errors.As(resErr, &re) {
+						p.metrics.observe(msg, time.Since(start), false)
+						p.reschedule(msg, re)
+						return
+					}
+					p.metrics.observe(msg, time.Since(start), true)
 					if p.errHandler != nil {
 						p.errHandler.HandleError(task, resErr, msg.Retried, msg.Retry)
 					}
-					if msg.Retried >= msg.Retry {
+					if msg.Retried >= msg.Retry || errors.Is(resErr, SkipRetry) {
 						p.kill(msg, resErr)
 					} else {
 						p.retry(msg, resErr)
 					}
 					return
 				}
+				p.metrics.observe(msg, time.Since(start), false)
 				p.markAsDone(msg)
 			}
 		}()
 	}
 }
 
+// dequeue returns the next task to process along with the number of
+// cancelation signals received before the task was dequeued.
+//
+// If prefetching is enabled and the broker supports it, it dequeues
+// multiple tasks at once and keeps the extra tasks in the local buffer.
+// Buffered tasks are started in order as workers become available.
+func (p *processor) dequeue() (*base.TaskMessage, uint64, error) {
+	if len(p.prefetched) > 0 {
+		msg := p.prefetched[0]
+		p.prefetched = p.prefetched[1:]
+		return msg, p.prefetchedSignals, nil
+	}
+	signals := p.cancelations.Signals()
+	qnames := p.queues()
+	bd, ok := p.broker.(base.BatchDequeuer)
+	if !ok || p.prefetchCount <= 1 {
+		msg, err := p.broker.Dequeue(qnames...)
+		return msg, signals, err
+	}
+	msgs, err := bd.DequeueN(p.prefetchCount, p.quotas(qnames, p.prefetchCount), qnames...)
+	if err != nil {
+		return nil, signals, err
+	}
+	p.prefetched = msgs[1:]
+	p.prefetchedSignals = signals
+	return msgs[0], signals, nil
+}
+
 // restore moves all tasks from "in-progress" back to queue
 // to restore all unfinished tasks.
 func (p *processor) restore() {
@@ -236,6 +359,26 @@ func (p *processor) restore() {
 	}
 }
 
+// errMsgCrashed is the error message assigned to a task which was moved to
+// the dead queue because it kept crashing the process running it.
+const errMsgCrashed = "process crashed while running the task"
+
+// recover moves all tasks left in "in-progress" by a crashed process
+// back to queue. Tasks that have crashed the process too many times are
+// moved to the dead queue instead.
+func (p *processor) recover() {
+	requeued, killed, err := p.broker.RecoverAll(p.maxCrashRecovery, errMsgCrashed)
+	if err != nil {
+		p.logger.Error("Could not recover unfinished tasks: %v", err)
+	}
+	if requeued > 0 {
+		p.logger.Info("Restored %d unfinished tasks back to queue", requeued)
+	}
+	if killed > 0 {
+		p.logger.Warn("Moved %d tasks to dead queue after exceeding crash recovery limit", killed)
+	}
+}
+
 func (p *processor) requeue(msg *base.TaskMessage) {
 	err := p.broker.Requeue(msg)
 	if err != nil {
@@ -244,9 +387,10 @@ func (p *processor) requeue(msg *base.TaskMessage) {
 }
 
 func (p *processor) markAsDone(msg *base.TaskMessage) {
+	p.record(msg, &base.TaskEvent{Kind: base.EventDone, Attempt: msg.Retried + 1})
 	err := p.broker.Done(msg)
 	if err != nil {
-		errMsg := fmt.Sprintf("Could not remove task id=%s from %q", msg.ID, base.InProgressQueue)
+		errMsg := fmt.Sprintf("Could not remove task id=%s from %q", msg.ID, "in-progress")
 		p.logger.Warn("%s; Will retry syncing", errMsg)
 		p.syncRequestCh <- &syncRequest{
 			fn: func() error {
@@ -258,11 +402,16 @@ func (p *processor) markAsDone(msg *base.TaskMessage) {
 }
 
 func (p *processor) retry(msg *base.TaskMessage, e error) {
-	d := p.retryDelayFunc(msg.Retried, e, NewTask(msg.Type, msg.Payload))
+	d, ok := p.retryDelay(msg, e)
+	if !ok {
+		p.kill(msg, e)
+		return
+	}
 	retryAt := time.Now().Add(d)
+	p.record(msg, &base.TaskEvent{Kind: base.EventRetry, Attempt: msg.Retried + 1, ErrorMsg: e.Error(), ProcessAt: retryAt})
 	err := p.broker.Retry(msg, retryAt, e.Error())
 	if err != nil {
-		errMsg := fmt.Sprintf("Could not move task id=%s from %q to %q", msg.ID, base.InProgressQueue, base.RetryQueue)
+		errMsg := fmt.Sprintf("Could not move task id=%s from %q to %q", msg.ID, "in-progress", "retry")
 		p.logger.Warn("%s; Will retry syncing", errMsg)
 		p.syncRequestCh <- &syncRequest{
 			fn: func() error {
@@ -273,11 +422,62 @@ func (p *processor) retry(msg *base.TaskMessage, e error) {
 	}
 }
 
+// retryDelay returns the delay before retrying the task which failed with e.
+// It returns false if the retry policy for the task gives up on the task.
+func (p *processor) retryDelay(msg *base.TaskMessage, e error) (time.Duration, bool) {
+	var ra *retryAfterError
+	if errors.As(e, &ra) {
+		return ra.delay, true
+	}
+	if p.retryPolicies != nil {
+		if policy, _ := p.retryPolicies.Policy(msg.Type); policy != nil {
+			return policy.delay(msg.Retried, e, readyAt(msg))
+		}
+	}
+	return p.retryDelayFunc(msg.Retried, e, NewTask(msg.Type, msg.Payload)), true
+}
+
+// readyAt returns the time the task was first ready to be processed.
+// It falls back to the time the task was created if the time is unknown,
+// e.g. for tasks enqueued by previous versions. The ID of a task imported
+// with a new ID tells the time of the import, not of the original task.
+func readyAt(msg *base.TaskMessage) time.Time {
+	if msg.ReadyAt != 0 {
+		return time.Unix(0, msg.ReadyAt)
+	}
+	return msg.ID.Time()
+}
+
+// reschedule moves the task to the scheduled tasks. If the broker does not
+// support rescheduling, the task is retried at the time instead, which
+// counts as a retry.
+func (p *processor) reschedule(msg *base.TaskMessage, e *rescheduleError) {
+	processAt := time.Now().Add(e.delay)
+	p.record(msg, &base.TaskEvent{Kind: base.EventRescheduled, Attempt: msg.Retried + 1, ProcessAt: processAt})
+	fn, dst := func() error { return p.broker.Retry(msg, processAt, e.Error()) }, "retry"
+	if p.rescheduler != nil {
+		fn, dst = func() error { return p.rescheduler.Reschedule(msg, processAt) }, "scheduled"
+	}
+	if err := fn(); err != nil {
+		errMsg := fmt.Sprintf("Could not move task id=%s from %q to %q", msg.ID, "in-progress", dst)
+		p.logger.Warn("%s; Will retry syncing", errMsg)
+		p.syncRequestCh <- &syncRequest{
+			fn:     fn,
+			errMsg: errMsg,
+		}
+	}
+}
+
 func (p *processor) kill(msg *base.TaskMessage, e error) {
-	p.logger.Warn("Retry exhausted for task id=%s", msg.ID)
+	if errors.Is(e, SkipRetry) {
+		p.logger.Warn("Retry skipped for task id=%s", msg.ID)
+	} else {
+		p.logger.Warn("Retry exhausted for task id=%s", msg.ID)
+	}
+	p.record(msg, &base.TaskEvent{Kind: base.EventDead, Attempt: msg.Retried + 1, ErrorMsg: e.Error()})
 	err := p.broker.Kill(msg, e.Error())
 	if err != nil {
-		errMsg := fmt.Sprintf("Could not move task id=%s from %q to %q", msg.ID, base.InProgressQueue, base.DeadQueue)
+		errMsg := fmt.Sprintf("Could not move task id=%s from %q to %q", msg.ID, "in-progress", "dead")
 		p.logger.Warn("%s; Will retry syncing", errMsg)
 		p.syncRequestCh <- &syncRequest{
 			fn: func() error {
@@ -288,6 +488,47 @@ func (p *processor) kill(msg *base.TaskMessage, e error) {
 	}
 }
 
+// record adds the event to the history of the task if history is enabled.
+func (p *processor) record(msg *base.TaskMessage, e *base.TaskEvent) {
+	if p.recorder == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Queue = msg.Queue
+	e.Host, e.PID, e.ServerID = p.host, p.pid, p.serverID
+	if err := p.recorder.RecordEvent(msg.ID.String(), e, p.historyTTL); err != nil {
+		p.logger.Warn("Could not record %s event for task id=%s: %v", e.Kind, msg.ID, err)
+	}
+}
+
+// skipCanceled reports whether the task has been canceled by a client
+// and removes the task from the broker if so.
+//
+// Clients record the tombstone of a dequeued task before publishing the
+// cancelation signal, so the tombstone is checked only if a signal was
+// received since the task was dequeued, i.e. if the signal may have been
+// received before the cancel func of the task was added. Tasks recovered
+// from a crashed server are always checked since they may have been
+// canceled before they were dequeued again.
+func (p *processor) skipCanceled(msg *base.TaskMessage, signals uint64) bool {
+	if p.canceler == nil {
+		return false
+	}
+	if msg.Recovered == 0 && p.cancelations.Signals() == signals {
+		return false
+	}
+	skipped, err := p.canceler.SkipCanceled(msg)
+	if err != nil {
+		p.logger.Warn("Could not check whether task id=%s is canceled: %v", msg.ID, err)
+		return false
+	}
+	if skipped {
+		p.logger.Info("Skipped canceled task id=%s", msg.ID)
+		p.record(msg, &base.TaskEvent{Kind: base.EventCanceled})
+	}
+	return skipped
+}
+
 // queues returns a list of queues to query.
 // Order of the queue names is based on the priority of each queue.
 // Queue names is sorted by their priority level if strict-priority is true.
@@ -315,6 +556,37 @@ func (p *processor) queues() []string {
 	return uniq(names, len(p.queueConfig))
 }
 
+// quotas returns the number of tasks to take from each of the given queues
+// in a batch of n tasks. The queue of each task is picked at random based on
+// the priority of each queue, so that a batch is split among the queues the
+// same way as n calls to Dequeue would be.
+// It returns nil if strict-priority is true or if we are processing one queue.
+func (p *processor) quotas(qnames []string, n int) []int {
+	if p.orderedQueues != nil || len(qnames) == 1 {
+		return nil
+	}
+	total := 0
+	for _, qname := range qnames {
+		total += p.queueConfig[qname]
+	}
+	quotas := make([]int, len(qnames))
+	if total == 0 {
+		return quotas
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for k := 0; k < n; k++ {
+		x := r.Intn(total)
+		for i, qname := range qnames {
+			if x < p.queueConfig[qname] {
+				quotas[i]++
+				break
+			}
+			x -= p.queueConfig[qname]
+		}
+	}
+	return quotas
+}
+
 // perform calls the handler with the given task.
 // If the call returns without panic, it simply returns the value,
 // otherwise, it recovers from panic and returns an error.
@@ -403,6 +675,7 @@ func gcd(xs ...int) int {
 }
 
 // createContext returns a context and cancel function for a given task message.
+// The context carries the trace context and headers of the task, if any.
 func createContext(msg *base.TaskMessage) (ctx context.Context, cancel context.CancelFunc) {
 	ctx = context.Background()
 	timeout, err := time.ParseDuration(msg.Timeout)
@@ -416,5 +689,11 @@ func createContext(msg *base.TaskMessage) (ctx context.Context, cancel context.C
 	if cancel == nil {
 		ctx, cancel = context.WithCancel(ctx)
 	}
+	if msg.TraceParent != "" {
+		ctx = ContextWithTraceContext(ctx, TraceContext{TraceParent: msg.TraceParent, TraceState: msg.TraceState})
+	}
+	if len(msg.Headers) > 0 {
+		ctx = ContextWithHeaders(ctx, msg.Headers)
+	}
 	return ctx, cancel
 }
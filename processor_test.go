@@ -6,9 +6,11 @@ package asynq
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -21,9 +23,6 @@ import (
 )
 
 func TestProcessorSuccess(t *testing.T) {
-	r := setup(t)
-	rdbClient := rdb.NewRDB(r)
-
 	m1 := h.NewTaskMessage("send_email", nil)
 	m2 := h.NewTaskMessage("gen_thumbnail", nil)
 	m3 := h.NewTaskMessage("reindex", nil)
@@ -54,59 +53,58 @@ func TestProcessorSuccess(t *testing.T) {
 		},
 	}
 
-	for _, tc := range tests {
-		h.FlushDB(t, r)                        // clean up db before each test case.
-		h.SeedEnqueuedQueue(t, r, tc.enqueued) // initialize default queue.
+	for _, f := range brokerFixtures(t) {
+		for _, tc := range tests {
+			f.flush(t)                                            // clean up db before each test case.
+			f.seedEnqueued(t, tc.enqueued, base.DefaultQueueName) // initialize default queue.
 
-		// instantiate a new processor
-		var mu sync.Mutex
-		var processed []*Task
-		handler := func(ctx context.Context, task *Task) error {
-			mu.Lock()
-			defer mu.Unlock()
-			processed = append(processed, task)
-			return nil
-		}
-		ss := base.NewServerState("localhost", 1234, 10, defaultQueueConfig, false)
-		cancelations := base.NewCancelations()
-		p := newProcessor(newProcessorParams{
-			logger:          testLogger,
-			broker:          rdbClient,
-			ss:              ss,
-			retryDelayFunc:  defaultDelayFunc,
-			syncCh:          nil,
-			cancelations:    cancelations,
-			errHandler:      nil,
-			shutdownTimeout: defaultShutdownTimeout,
-		})
-		p.handler = HandlerFunc(handler)
+			// instantiate a new processor
+			var mu sync.Mutex
+			var processed []*Task
+			handler := func(ctx context.Context, task *Task) error {
+				mu.Lock()
+				defer mu.Unlock()
+				processed = append(processed, task)
+				return nil
+			}
+			ss := base.NewServerState("localhost", 1234, 10, defaultQueueConfig, false)
+			cancelations := base.NewCancelations()
+			p := newProcessor(newProcessorParams{
+				logger:          testLogger,
+				broker:          f.broker(),
+				ss:              ss,
+				retryDelayFunc:  defaultDelayFunc,
+				syncCh:          nil,
+				cancelations:    cancelations,
+				errHandler:      nil,
+				shutdownTimeout: defaultShutdownTimeout,
+			})
+			p.handler = HandlerFunc(handler)
 
-		var wg sync.WaitGroup
-		p.start(&wg)
-		for _, msg := range tc.incoming {
-			err := rdbClient.Enqueue(msg)
-			if err != nil {
-				p.terminate()
-				t.Fatal(err)
+			var wg sync.WaitGroup
+			p.start(&wg)
+			for _, msg := range tc.incoming {
+				err := f.broker().Enqueue(msg)
+				if err != nil {
+					p.terminate()
+					t.Fatal(err)
+				}
 			}
-		}
-		time.Sleep(tc.wait)
-		p.terminate()
+			time.Sleep(tc.wait)
+			p.terminate()
 
-		if diff := cmp.Diff(tc.wantProcessed, processed, sortTaskOpt, cmp.AllowUnexported(Payload{})); diff != "" {
-			t.Errorf("mismatch found in processed tasks; (-want, +got)\n%s", diff)
-		}
+			if diff := cmp.Diff(tc.wantProcessed, processed, sortTaskOpt, cmp.AllowUnexported(Payload{})); diff != "" {
+				t.Errorf("%s: mismatch found in processed tasks; (-want, +got)\n%s", f.name(), diff)
+			}
 
-		if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
-			t.Errorf("%q has %d tasks, want 0", base.InProgressQueue, l)
+			if l := len(f.getInProgress(t)); l != 0 {
+				t.Errorf("%s: in-progress queue has %d tasks, want 0", f.name(), l)
+			}
 		}
 	}
 }
 
 func TestProcessorRetry(t *testing.T) {
-	r := setup(t)
-	rdbClient := rdb.NewRDB(r)
-
 	m1 := h.NewTaskMessage("send_email", nil)
 	m1.Retried = m1.Retry // m1 has reached its max retry count
 	m2 := h.NewTaskMessage("gen_thumbnail", nil)
@@ -127,17 +125,25 @@ func TestProcessorRetry(t *testing.T) {
 	r4.ErrorMsg = errMsg
 	r4.Retried = m4.Retried + 1
 
+	skipMsg := errMsg + ": " + SkipRetry.Error()
+	// s* is m* after skipping retry
+	s1 := *m1
+	s1.ErrorMsg = skipMsg
+	s2 := *m2
+	s2.ErrorMsg = skipMsg
+
 	now := time.Now()
 
 	tests := []struct {
-		enqueued     []*base.TaskMessage // initial default queue state
-		incoming     []*base.TaskMessage // tasks to be enqueued during run
-		delay        time.Duration       // retry delay duration
-		handler      Handler             // task handler
-		wait         time.Duration       // wait duration between starting and stopping processor for this test case
-		wantRetry    []h.ZSetEntry       // tasks in retry queue at the end
-		wantDead     []*base.TaskMessage // tasks in dead queue at the end
-		wantErrCount int                 // number of times error handler should be called
+		enqueued      []*base.TaskMessage // initial default queue state
+		incoming      []*base.TaskMessage // tasks to be enqueued during run
+		delay         time.Duration       // retry delay duration
+		handler       Handler             // task handler
+		wait          time.Duration       // wait duration between starting and stopping processor for this test case
+		wantScheduled []h.ZSetEntry       // tasks in scheduled queue at the end
+		wantRetry     []h.ZSetEntry       // tasks in retry queue at the end
+		wantDead      []*base.TaskMessage // tasks in dead queue at the end
+		wantErrCount  int                 // number of times error handler should be called
 	}{
 		{
 			enqueued: []*base.TaskMessage{m1, m2},
@@ -155,70 +161,734 @@ func TestProcessorRetry(t *testing.T) {
 			wantDead:     []*base.TaskMessage{&r1},
 			wantErrCount: 4,
 		},
+		{
+			enqueued: []*base.TaskMessage{m1, m2},
+			incoming: []*base.TaskMessage{},
+			delay:    time.Minute,
+			handler: HandlerFunc(func(ctx context.Context, task *Task) error {
+				return fmt.Errorf("%s: %w", errMsg, SkipRetry)
+			}),
+			wait:         time.Second,
+			wantRetry:    nil,
+			wantDead:     []*base.TaskMessage{&s1, &s2},
+			wantErrCount: 2,
+		},
+		{
+			enqueued: []*base.TaskMessage{m1, m2},
+			incoming: []*base.TaskMessage{m3},
+			delay:    time.Minute,
+			handler: HandlerFunc(func(ctx context.Context, task *Task) error {
+				return RetryAfter(time.Hour, errors.New(errMsg))
+			}),
+			wait: time.Second,
+			wantRetry: []h.ZSetEntry{
+				{Msg: &r2, Score: float64(now.Add(time.Hour).Unix())},
+				{Msg: &r3, Score: float64(now.Add(time.Hour).Unix())},
+			},
+			wantDead:     []*base.TaskMessage{&r1},
+			wantErrCount: 3,
+		},
+		{
+			enqueued: []*base.TaskMessage{m1, m2},
+			incoming: []*base.TaskMessage{},
+			delay:    time.Minute,
+			handler: HandlerFunc(func(ctx context.Context, task *Task) error {
+				return Reschedule(time.Hour)
+			}),
+			wait: time.Second,
+			// rescheduled tasks don't consume a retry, even if retry is exhausted.
+			wantScheduled: []h.ZSetEntry{
+				{Msg: m1, Score: float64(now.Add(time.Hour).Unix())},
+				{Msg: m2, Score: float64(now.Add(time.Hour).Unix())},
+			},
+			wantRetry:    nil,
+			wantDead:     nil,
+			wantErrCount: 0,
+		},
+	}
+
+	for _, f := range brokerFixtures(t) {
+		for _, tc := range tests {
+			f.flush(t)                                            // clean up db before each test case.
+			f.seedEnqueued(t, tc.enqueued, base.DefaultQueueName) // initialize default queue.
+
+			// instantiate a new processor
+			delayFunc := func(n int, e error, t *Task) time.Duration {
+				return tc.delay
+			}
+			var (
+				mu sync.Mutex // guards n
+				n  int        // number of times error handler is called
+			)
+			errHandler := func(t *Task, err error, retried, maxRetry int) {
+				mu.Lock()
+				defer mu.Unlock()
+				n++
+			}
+			ss := base.NewServerState("localhost", 1234, 10, defaultQueueConfig, false)
+			cancelations := base.NewCancelations()
+			p := newProcessor(newProcessorParams{
+				logger:          testLogger,
+				broker:          f.broker(),
+				ss:              ss,
+				retryDelayFunc:  delayFunc,
+				syncCh:          nil,
+				cancelations:    cancelations,
+				errHandler:      ErrorHandlerFunc(errHandler),
+				shutdownTimeout: defaultShutdownTimeout,
+			})
+			p.handler = tc.handler
+
+			var wg sync.WaitGroup
+			p.start(&wg)
+			for _, msg := range tc.incoming {
+				err := f.broker().Enqueue(msg)
+				if err != nil {
+					p.terminate()
+					t.Fatal(err)
+				}
+			}
+			time.Sleep(tc.wait)
+			p.terminate()
+
+			cmpOpt := cmpopts.EquateApprox(0, float64(time.Second)) // allow up to second difference in zset score
+			gotScheduled := f.getScheduledEntries(t)
+			if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.SortZSetEntryOpt, cmpOpt); diff != "" {
+				t.Errorf("%s: mismatch found in scheduled queue after running processor; (-want, +got)\n%s", f.name(), diff)
+			}
+
+			gotRetry := f.getRetryEntries(t)
+			if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortZSetEntryOpt, cmpOpt); diff != "" {
+				t.Errorf("%s: mismatch found in retry queue after running processor; (-want, +got)\n%s", f.name(), diff)
+			}
+
+			gotDead := f.getDead(t)
+			if diff := cmp.Diff(tc.wantDead, gotDead, h.SortMsgOpt); diff != "" {
+				t.Errorf("%s: mismatch found in dead queue after running processor; (-want, +got)\n%s", f.name(), diff)
+			}
+
+			if l := len(f.getInProgress(t)); l != 0 {
+				t.Errorf("%s: in-progress queue has %d tasks, want 0", f.name(), l)
+			}
+
+			if n != tc.wantErrCount {
+				t.Errorf("%s: error handler was called %d times, want %d", f.name(), n, tc.wantErrCount)
+			}
+		}
+	}
+}
+
+// retryOnlyBroker hides the optional interfaces of the broker
+// such as base.Rescheduler.
+type retryOnlyBroker struct {
+	base.Broker
+}
+
+func TestProcessorRescheduleWithoutRescheduler(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+	p := newProcessor(newProcessorParams{
+		logger:          testLogger,
+		broker:          retryOnlyBroker{rdb.NewRDB(r)},
+		ss:              base.NewServerState("localhost", 1234, 10, defaultQueueConfig, false),
+		retryDelayFunc:  defaultDelayFunc,
+		syncCh:          nil,
+		cancelations:    base.NewCancelations(),
+		errHandler:      nil,
+		shutdownTimeout: defaultShutdownTimeout,
+	})
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		return Reschedule(time.Hour)
+	})
+
+	var wg sync.WaitGroup
+	p.start(&wg)
+	time.Sleep(time.Second)
+	p.terminate()
+
+	// the task is retried at the time instead.
+	r1 := *m1
+	r1.Retried = 1
+	r1.ErrorMsg = Reschedule(time.Hour).Error()
+	want := []h.ZSetEntry{{Msg: &r1, Score: float64(time.Now().Add(time.Hour).Unix())}}
+	cmpOpt := cmpopts.EquateApprox(0, float64(time.Second)) // allow up to second difference in zset score
+	if diff := cmp.Diff(want, h.GetRetryEntries(t, r), cmpOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", h.Keys.RetryQueue(), diff)
+	}
+	if got := h.GetScheduledEntries(t, r); len(got) != 0 {
+		t.Errorf("%q has %d tasks, want 0", h.Keys.ScheduledQueue(), len(got))
+	}
+}
+
+func TestProcessorRetryPolicies(t *testing.T) {
+	m1 := h.NewTaskMessage("email:signup", nil)
+	m2 := h.NewTaskMessage("email:welcome", nil)
+	m3 := h.NewTaskMessage("csv:export", nil)
+
+	errMsg := "something went wrong"
+	errPermanent := errors.New("permanent error")
+	permMsg := errMsg + ": " + errPermanent.Error()
+
+	// r* is m* after retry
+	r1 := *m1
+	r1.ErrorMsg = errMsg
+	r1.Retried = m1.Retried + 1
+	r2 := *m2
+	r2.ErrorMsg = errMsg
+	r2.Retried = m2.Retried + 1
+	r3 := *m3
+	r3.ErrorMsg = errMsg
+	r3.Retried = m3.Retried + 1
+	// p* is m* after failing with a permanent error
+	p1 := *m1
+	p1.ErrorMsg = permMsg
+	p1.Retried = m1.Retried + 1
+	p2 := *m2
+	p2.ErrorMsg = permMsg
+
+	mux := NewRetryPolicyMux()
+	mux.Handle("email:", RetryPolicy{
+		Strategy: Fixed(10 * time.Minute),
+		Rules: []RetryRule{
+			{Match: ErrorIs(errPermanent), Skip: true},
+		},
+	})
+	mux.Handle("email:signup", RetryPolicy{Strategy: Fixed(time.Hour)})
+
+	now := time.Now()
+
+	tests := []struct {
+		enqueued  []*base.TaskMessage // initial default queue state
+		handler   Handler             // task handler
+		wantRetry []h.ZSetEntry       // tasks in retry queue at the end
+		wantDead  []*base.TaskMessage // tasks in dead queue at the end
+	}{
+		{
+			enqueued: []*base.TaskMessage{m1, m2, m3},
+			handler: HandlerFunc(func(ctx context.Context, task *Task) error {
+				return errors.New(errMsg)
+			}),
+			wantRetry: []h.ZSetEntry{
+				{Msg: &r1, Score: float64(now.Add(time.Hour).Unix())},
+				{Msg: &r2, Score: float64(now.Add(10 * time.Minute).Unix())},
+				// no policy matches csv:export, so retryDelayFunc is used.
+				{Msg: &r3, Score: float64(now.Add(time.Minute).Unix())},
+			},
+			wantDead: nil,
+		},
+		{
+			enqueued: []*base.TaskMessage{m1, m2},
+			handler: HandlerFunc(func(ctx context.Context, task *Task) error {
+				return fmt.Errorf("%s: %w", errMsg, errPermanent)
+			}),
+			// policy for email:signup has no rules, so the task is retried.
+			wantRetry: []h.ZSetEntry{
+				{Msg: &p1, Score: float64(now.Add(time.Hour).Unix())},
+			},
+			wantDead: []*base.TaskMessage{&p2},
+		},
+	}
+
+	for _, f := range brokerFixtures(t) {
+		for _, tc := range tests {
+			f.flush(t)                                            // clean up db before each test case.
+			f.seedEnqueued(t, tc.enqueued, base.DefaultQueueName) // initialize default queue.
+
+			delayFunc := func(n int, e error, t *Task) time.Duration {
+				return time.Minute
+			}
+			ss := base.NewServerState("localhost", 1234, 10, defaultQueueConfig, false)
+			cancelations := base.NewCancelations()
+			p := newProcessor(newProcessorParams{
+				logger:          testLogger,
+				broker:          f.broker(),
+				ss:              ss,
+				retryDelayFunc:  delayFunc,
+				retryPolicies:   mux,
+				syncCh:          nil,
+				cancelations:    cancelations,
+				errHandler:      nil,
+				shutdownTimeout: defaultShutdownTimeout,
+			})
+			p.handler = tc.handler
+
+			var wg sync.WaitGroup
+			p.start(&wg)
+			time.Sleep(time.Second)
+			p.terminate()
+
+			cmpOpt := cmpopts.EquateApprox(0, float64(time.Second)) // allow up to second difference in zset score
+			gotRetry := f.getRetryEntries(t)
+			if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortZSetEntryOpt, cmpOpt); diff != "" {
+				t.Errorf("%s: mismatch found in retry queue after running processor; (-want, +got)\n%s", f.name(), diff)
+			}
+
+			gotDead := f.getDead(t)
+			if diff := cmp.Diff(tc.wantDead, gotDead, h.SortMsgOpt); diff != "" {
+				t.Errorf("%s: mismatch found in dead queue after running processor; (-want, +got)\n%s", f.name(), diff)
+			}
+		}
+	}
+}
+
+func TestProcessorRetryDelayMaxElapsed(t *testing.T) {
+	mux := NewRetryPolicyMux()
+	mux.Handle("email:", RetryPolicy{Strategy: Fixed(time.Minute), MaxElapsed: time.Hour})
+	p := newProcessor(newProcessorParams{
+		logger:          testLogger,
+		broker:          nil,
+		ss:              base.NewServerState("localhost", 1234, 10, defaultQueueConfig, false),
+		retryDelayFunc:  defaultDelayFunc,
+		retryPolicies:   mux,
+		syncCh:          nil,
+		cancelations:    base.NewCancelations(),
+		errHandler:      nil,
+		shutdownTimeout: defaultShutdownTimeout,
+	})
+	now := time.Now()
+
+	tests := []struct {
+		readyAt time.Time // zero if unknown
+		want    bool
+	}{
+		{readyAt: time.Time{}, want: true}, // measured from the ID, created now
+		{readyAt: now.Add(-30 * time.Minute), want: true},
+		// e.g. imported with a new ID; the budget is not reset.
+		{readyAt: now.Add(-2 * time.Hour), want: false},
 	}
 
 	for _, tc := range tests {
-		h.FlushDB(t, r)                        // clean up db before each test case.
-		h.SeedEnqueuedQueue(t, r, tc.enqueued) // initialize default queue.
+		msg := h.NewTaskMessage("email:welcome", nil)
+		if !tc.readyAt.IsZero() {
+			msg.ReadyAt = tc.readyAt.UnixNano()
+		}
+		if _, got := p.retryDelay(msg, errors.New("oops")); got != tc.want {
+			t.Errorf("retryDelay of task ready at %v returned %t, want %t", tc.readyAt, got, tc.want)
+		}
+	}
+}
+
+func TestProcessorRecordsHistory(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+	m1 := h.NewTaskMessage("send_email", nil) // fails and is retried
+	m2 := h.NewTaskMessage("reindex", nil)    // succeeds
+	m3 := h.NewTaskMessage("sync", nil)       // fails and is killed
+	m3.Retried = m3.Retry
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1, m2, m3})
+
+	ss := base.NewServerState("localhost", 1234, 10, defaultQueueConfig, false)
+	serverID := ss.GetInfo().ServerID
+	p := newProcessor(newProcessorParams{
+		logger:          testLogger,
+		broker:          rdbClient,
+		ss:              ss,
+		retryDelayFunc:  func(n int, e error, t *Task) time.Duration { return time.Minute },
+		syncCh:          nil,
+		cancelations:    base.NewCancelations(),
+		errHandler:      nil,
+		shutdownTimeout: defaultShutdownTimeout,
+		historyTTL:      time.Hour,
+	})
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		if task.Type == "reindex" {
+			return nil
+		}
+		return errors.New("oops")
+	})
+
+	var wg sync.WaitGroup
+	p.start(&wg)
+	time.Sleep(time.Second)
+	p.terminate()
+
+	dequeued := func(attempt int) *base.TaskEvent {
+		return &base.TaskEvent{Kind: base.EventDequeued, Queue: "default", Host: "localhost", PID: 1234, ServerID: serverID, Attempt: attempt}
+	}
+	tests := []struct {
+		msg  *base.TaskMessage
+		want []*base.TaskEvent
+	}{
+		{
+			msg: m1,
+			want: []*base.TaskEvent{
+				dequeued(1),
+				{Kind: base.EventRetry, Queue: "default", Host: "localhost", PID: 1234, ServerID: serverID, Attempt: 1, ErrorMsg: "oops"},
+			},
+		},
+		{
+			msg: m2,
+			want: []*base.TaskEvent{
+				dequeued(1),
+				{Kind: base.EventDone, Queue: "default", Host: "localhost", PID: 1234, ServerID: serverID, Attempt: 1},
+			},
+		},
+		{
+			msg: m3,
+			want: []*base.TaskEvent{
+				dequeued(m3.Retry + 1),
+				{Kind: base.EventDead, Queue: "default", Host: "localhost", PID: 1234, ServerID: serverID, Attempt: m3.Retry + 1, ErrorMsg: "oops"},
+			},
+		},
+	}
+
+	ignoreOpt := cmpopts.IgnoreFields(base.TaskEvent{}, "Time", "ProcessAt")
+	for _, tc := range tests {
+		got, err := rdbClient.History(tc.msg.ID)
+		if err != nil {
+			t.Errorf("could not read history of task %s: %v", tc.msg.Type, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got, ignoreOpt); diff != "" {
+			t.Errorf("mismatch found in history of task %s; (-want, +got)\n%s", tc.msg.Type, diff)
+		}
+	}
+}
+
+// cancelingBroker cancels a task right after it is dequeued and before
+// the processor starts it, and counts the tombstone checks.
+type cancelingBroker struct {
+	*rdb.RDB
+	cancelations *base.Cancelations
+	id           string // ID of the task to cancel
+	checks       int32
+}
+
+func (b *cancelingBroker) Dequeue(qnames ...string) (*base.TaskMessage, error) {
+	msg, err := b.RDB.Dequeue(qnames...)
+	if err == nil && msg.ID.String() == b.id {
+		if _, err := b.RDB.Cancel(b.id, time.Hour); err != nil {
+			return nil, err
+		}
+		b.cancelations.Signal(b.id)
+	}
+	return msg, err
+}
+
+func (b *cancelingBroker) SkipCanceled(msg *base.TaskMessage) (bool, error) {
+	atomic.AddInt32(&b.checks, 1)
+	return b.RDB.SkipCanceled(msg)
+}
+
+func TestProcessorSkipsCanceledTasks(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil) // canceled after it is dequeued
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("sync", nil) // canceled while its server was down
+	m3.Recovered = 1
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1, m2, m3})
+	h.SeedTaskIndex(t, r, []*base.TaskMessage{m1, m2, m3})
+	if err := r.Set(h.Keys.TombstoneKey(m3.ID.String()), 1, time.Hour).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu        sync.Mutex
+		processed []string
+	)
+	cancelations := base.NewCancelations()
+	broker := &cancelingBroker{RDB: rdb.NewRDB(r), cancelations: cancelations, id: m1.ID.String()}
+	p := newProcessor(newProcessorParams{
+		logger:          testLogger,
+		broker:          broker,
+		ss:              base.NewServerState("localhost", 1234, 10, defaultQueueConfig, false),
+		retryDelayFunc:  defaultDelayFunc,
+		syncCh:          nil,
+		cancelations:    cancelations,
+		errHandler:      nil,
+		shutdownTimeout: defaultShutdownTimeout,
+	})
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		mu.Lock()
+		processed = append(processed, task.Type)
+		mu.Unlock()
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	p.start(&wg)
+	time.Sleep(time.Second)
+	p.terminate()
+
+	if diff := cmp.Diff([]string{"reindex"}, processed); diff != "" {
+		t.Errorf("mismatch found in processed tasks; (-want, +got)\n%s", diff)
+	}
+	if l := r.LLen(h.Keys.InProgressQueue()).Val(); l != 0 {
+		t.Errorf("%q has %d tasks, want 0", h.Keys.InProgressQueue(), l)
+	}
+	for _, msg := range []*base.TaskMessage{m1, m3} {
+		if n := r.Exists(h.Keys.TombstoneKey(msg.ID.String())).Val(); n != 0 {
+			t.Errorf("tombstone of the canceled task %s still exists", msg.Type)
+		}
+	}
+	// Tombstone of m2 is not checked since no cancelation signal
+	// was received after it was dequeued.
+	if n := atomic.LoadInt32(&broker.checks); n != 2 {
+		t.Errorf("tombstones were checked %d times, want 2", n)
+	}
+}
 
-		// instantiate a new processor
-		delayFunc := func(n int, e error, t *Task) time.Duration {
-			return tc.delay
+func TestProcessorRecoversCrashedTasks(t *testing.T) {
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("gen_thumbnail", nil)
+	m2.Recovered = 2
+	m3 := h.NewTaskMessage("segfault", nil)
+	m3.Recovered = 3
+
+	// d3 is m3 after being moved to the dead queue.
+	d3 := *m3
+	d3.Recovered = 4
+	d3.ErrorMsg = errMsgCrashed
+
+	tests := []struct {
+		inProgress    []*base.TaskMessage // tasks left in-progress by a crashed process
+		maxRecovery   int                 // crash recovery limit
+		wait          time.Duration       // wait duration between starting and stopping processor for this test case
+		wantProcessed []*Task             // tasks to be processed at the end
+		wantDead      []*base.TaskMessage // tasks in dead queue at the end
+	}{
+		{
+			inProgress:    []*base.TaskMessage{m1, m2, m3},
+			maxRecovery:   3,
+			wait:          time.Second,
+			wantProcessed: []*Task{NewTask(m1.Type, m1.Payload), NewTask(m2.Type, m2.Payload)},
+			wantDead:      []*base.TaskMessage{&d3},
+		},
+	}
+
+	for _, f := range brokerFixtures(t) {
+		for _, tc := range tests {
+			f.flush(t) // clean up db before each test case.
+			f.seedInProgress(t, tc.inProgress)
+
+			var mu sync.Mutex
+			var processed []*Task
+			handler := func(ctx context.Context, task *Task) error {
+				mu.Lock()
+				defer mu.Unlock()
+				processed = append(processed, task)
+				return nil
+			}
+			ss := base.NewServerState("localhost", 1234, 10, defaultQueueConfig, false)
+			cancelations := base.NewCancelations()
+			p := newProcessor(newProcessorParams{
+				logger:           testLogger,
+				broker:           f.broker(),
+				ss:               ss,
+				retryDelayFunc:   defaultDelayFunc,
+				maxCrashRecovery: tc.maxRecovery,
+				syncCh:           nil,
+				cancelations:     cancelations,
+				errHandler:       nil,
+				shutdownTimeout:  defaultShutdownTimeout,
+			})
+			p.handler = HandlerFunc(handler)
+
+			var wg sync.WaitGroup
+			p.start(&wg)
+			time.Sleep(tc.wait)
+			p.terminate()
+
+			if diff := cmp.Diff(tc.wantProcessed, processed, sortTaskOpt, cmp.AllowUnexported(Payload{})); diff != "" {
+				t.Errorf("%s: mismatch found in processed tasks; (-want, +got)\n%s", f.name(), diff)
+			}
+
+			gotDead := f.getDead(t)
+			if diff := cmp.Diff(tc.wantDead, gotDead, h.SortMsgOpt); diff != "" {
+				t.Errorf("%s: mismatch found in dead queue after running processor; (-want, +got)\n%s", f.name(), diff)
+			}
 		}
+	}
+}
+
+func TestProcessorPicksUpTaskInIdleQueues(t *testing.T) {
+	msg := h.NewTaskMessage("send_email", nil)
+	msg.Queue = "low"
+	queueCfg := map[string]int{"critical": 3, "default": 2, "low": 1}
+
+	for _, f := range brokerFixtures(t) {
+		f.flush(t) // clean up db before each test case.
+
+		processed := make(chan string, 1)
+		handler := func(ctx context.Context, task *Task) error {
+			processed <- task.Type
+			return nil
+		}
+		p := newProcessor(newProcessorParams{
+			logger:          testLogger,
+			broker:          f.broker(),
+			ss:              base.NewServerState("localhost", 1234, 10, queueCfg, false),
+			retryDelayFunc:  defaultDelayFunc,
+			syncCh:          nil,
+			cancelations:    base.NewCancelations(),
+			errHandler:      nil,
+			shutdownTimeout: defaultShutdownTimeout,
+		})
+		p.handler = HandlerFunc(handler)
+
+		var wg sync.WaitGroup
+		p.start(&wg)
+		time.Sleep(100 * time.Millisecond) // let the processor wait on empty queues.
+		if err := f.broker().Enqueue(msg); err != nil {
+			p.terminate()
+			t.Fatal(err)
+		}
+		select {
+		case <-processed:
+		case <-time.After(500 * time.Millisecond):
+			t.Errorf("%s: task enqueued into idle queues was not processed within 500ms", f.name())
+		}
+		p.terminate()
+	}
+}
+
+// countingBroker records the number of calls to Dequeue and DequeueN.
+type countingBroker struct {
+	*rdb.RDB
+
+	mu       sync.Mutex
+	dequeues int
+}
+
+func (b *countingBroker) Dequeue(qnames ...string) (*base.TaskMessage, error) {
+	b.mu.Lock()
+	b.dequeues++
+	b.mu.Unlock()
+	return b.RDB.Dequeue(qnames...)
+}
+
+func (b *countingBroker) DequeueN(n int, quotas []int, qnames ...string) ([]*base.TaskMessage, error) {
+	b.mu.Lock()
+	b.dequeues++
+	b.mu.Unlock()
+	return b.RDB.DequeueN(n, quotas, qnames...)
+}
+
+func TestProcessorPrefetch(t *testing.T) {
+	r := setup(t)
+	var msgs []*base.TaskMessage
+	for i := 0; i < 20; i++ {
+		msgs = append(msgs, h.NewTaskMessage(fmt.Sprintf("task%d", i), nil))
+	}
+
+	tests := []struct {
+		concurrency  int
+		prefetch     int
+		maxDequeues  int // max number of calls to dequeue all tasks
+		wantInFlight int // max number of tasks running at the same time
+	}{
+		{concurrency: 10, prefetch: 10, maxDequeues: 10, wantInFlight: 10},
+		{concurrency: 4, prefetch: 10, maxDequeues: 10, wantInFlight: 4},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r) // clean up db before each test case.
+		h.SeedEnqueuedQueue(t, r, msgs)
+		b := &countingBroker{RDB: rdb.NewRDB(r)}
+
 		var (
-			mu sync.Mutex // guards n
-			n  int        // number of times error handler is called
+			mu       sync.Mutex
+			inFlight int
+			maxSeen  int
 		)
-		errHandler := func(t *Task, err error, retried, maxRetry int) {
+		processed := make(chan string, len(msgs))
+		handler := func(ctx context.Context, task *Task) error {
 			mu.Lock()
-			defer mu.Unlock()
-			n++
+			inFlight++
+			if inFlight > maxSeen {
+				maxSeen = inFlight
+			}
+			mu.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			processed <- task.Type
+			return nil
 		}
-		ss := base.NewServerState("localhost", 1234, 10, defaultQueueConfig, false)
-		cancelations := base.NewCancelations()
 		p := newProcessor(newProcessorParams{
 			logger:          testLogger,
-			broker:          rdbClient,
-			ss:              ss,
-			retryDelayFunc:  delayFunc,
+			broker:          b,
+			ss:              base.NewServerState("localhost", 1234, tc.concurrency, defaultQueueConfig, false),
+			retryDelayFunc:  defaultDelayFunc,
 			syncCh:          nil,
-			cancelations:    cancelations,
-			errHandler:      ErrorHandlerFunc(errHandler),
+			cancelations:    base.NewCancelations(),
+			errHandler:      nil,
 			shutdownTimeout: defaultShutdownTimeout,
+			prefetchCount:   tc.prefetch,
 		})
-		p.handler = tc.handler
+		p.handler = HandlerFunc(handler)
 
 		var wg sync.WaitGroup
 		p.start(&wg)
-		for _, msg := range tc.incoming {
-			err := rdbClient.Enqueue(msg)
-			if err != nil {
+		for range msgs {
+			select {
+			case <-processed:
+			case <-time.After(5 * time.Second):
 				p.terminate()
-				t.Fatal(err)
+				t.Fatalf("not all tasks were processed")
 			}
 		}
-		time.Sleep(tc.wait)
+		b.mu.Lock()
+		dequeues := b.dequeues
+		b.mu.Unlock()
 		p.terminate()
 
-		cmpOpt := cmpopts.EquateApprox(0, float64(time.Second)) // allow up to second difference in zset score
-		gotRetry := h.GetRetryEntries(t, r)
-		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortZSetEntryOpt, cmpOpt); diff != "" {
-			t.Errorf("mismatch found in %q after running processor; (-want, +got)\n%s", base.RetryQueue, diff)
+		if dequeues > tc.maxDequeues {
+			t.Errorf("concurrency=%d prefetch=%d: dequeued %d times, want at most %d",
+				tc.concurrency, tc.prefetch, dequeues, tc.maxDequeues)
 		}
-
-		gotDead := h.GetDeadMessages(t, r)
-		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q after running processor; (-want, +got)\n%s", base.DeadQueue, diff)
+		if maxSeen > tc.wantInFlight {
+			t.Errorf("concurrency=%d prefetch=%d: %d tasks ran at the same time, want at most %d",
+				tc.concurrency, tc.prefetch, maxSeen, tc.wantInFlight)
 		}
+	}
+}
 
-		if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
-			t.Errorf("%q has %d tasks, want 0", base.InProgressQueue, l)
-		}
+func TestProcessorPrefetchStop(t *testing.T) {
+	r := setup(t)
+	var msgs []*base.TaskMessage
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, h.NewTaskMessage(fmt.Sprintf("task%d", i), nil))
+	}
+	h.SeedEnqueuedQueue(t, r, msgs)
 
-		if n != tc.wantErrCount {
-			t.Errorf("error handler was called %d times, want %d", n, tc.wantErrCount)
-		}
+	started := make(chan struct{}, len(msgs))
+	handler := func(ctx context.Context, task *Task) error {
+		started <- struct{}{}
+		<-ctx.Done() // block until canceled.
+		return nil
+	}
+	p := newProcessor(newProcessorParams{
+		logger:          testLogger,
+		broker:          rdb.NewRDB(r),
+		ss:              base.NewServerState("localhost", 1234, 2, defaultQueueConfig, false),
+		retryDelayFunc:  defaultDelayFunc,
+		syncCh:          nil,
+		cancelations:    base.NewCancelations(),
+		errHandler:      nil,
+		shutdownTimeout: defaultShutdownTimeout,
+		prefetchCount:   5,
+	})
+	p.handler = HandlerFunc(handler)
+
+	var wg sync.WaitGroup
+	p.start(&wg)
+	for i := 0; i < 2; i++ {
+		<-started
+	}
+	p.stop() // stop processing new tasks, e.g. when the server is quiet.
+
+	// only the tasks being processed remain in-progress.
+	if n := len(h.GetInProgressMessages(t, r)); n != 2 {
+		t.Errorf("in-progress queue has %d tasks after stop, want 2", n)
 	}
+	if n := len(h.GetEnqueuedMessages(t, r)); n != 3 {
+		t.Errorf("default queue has %d tasks after stop, want 3", n)
+	}
+	p.terminate()
 }
 
 func TestProcessorQueues(t *testing.T) {
@@ -269,10 +939,60 @@ func TestProcessorQueues(t *testing.T) {
 	}
 }
 
-func TestProcessorWithStrictPriority(t *testing.T) {
-	r := setup(t)
-	rdbClient := rdb.NewRDB(r)
+func TestProcessorQuotas(t *testing.T) {
+	queueCfg := map[string]int{
+		"high":    6,
+		"default": 3,
+		"low":     1,
+	}
+	qnames := []string{"low", "high", "default"}
 
+	tests := []struct {
+		strict bool
+		n      int
+		want   []int // nil if quotas should be nil
+	}{
+		{strict: false, n: 1000, want: []int{100, 600, 300}},
+		{strict: true, n: 1000, want: nil},
+	}
+
+	for _, tc := range tests {
+		ss := base.NewServerState("localhost", 1234, 10, queueCfg, tc.strict)
+		p := newProcessor(newProcessorParams{
+			logger:          testLogger,
+			broker:          nil,
+			ss:              ss,
+			retryDelayFunc:  defaultDelayFunc,
+			syncCh:          nil,
+			cancelations:    base.NewCancelations(),
+			errHandler:      nil,
+			shutdownTimeout: defaultShutdownTimeout,
+		})
+		got := p.quotas(qnames, tc.n)
+		if tc.want == nil {
+			if got != nil {
+				t.Errorf("with strict=%t, (*processor).quotas(%v, %d) = %v, want nil", tc.strict, qnames, tc.n, got)
+			}
+			continue
+		}
+		if len(got) != len(qnames) {
+			t.Fatalf("(*processor).quotas(%v, %d) = %v, want %d quotas", qnames, tc.n, got, len(qnames))
+		}
+		sum := 0
+		for i, quota := range got {
+			sum += quota
+			// allow for the randomness of the picks.
+			if quota < tc.want[i]*2/3 || quota > tc.want[i]*4/3 {
+				t.Errorf("(*processor).quotas(%v, %d)[%d] = %d, want about %d", qnames, tc.n, i, quota, tc.want[i])
+			}
+		}
+		if sum != tc.n {
+			t.Errorf("sum of (*processor).quotas(%v, %d) = %d, want %d", qnames, tc.n, sum, tc.n)
+		}
+	}
+}
+
+func TestProcessorWithStrictPriority(t *testing.T) {
 	m1 := h.NewTaskMessage("send_email", nil)
 	m2 := h.NewTaskMessage("send_email", nil)
 	m3 := h.NewTaskMessage("send_email", nil)
@@ -305,52 +1025,54 @@ func TestProcessorWithStrictPriority(t *testing.T) {
 		},
 	}
 
-	for _, tc := range tests {
-		h.FlushDB(t, r) // clean up db before each test case.
-		for qname, msgs := range tc.enqueued {
-			h.SeedEnqueuedQueue(t, r, msgs, qname)
-		}
+	for _, f := range brokerFixtures(t) {
+		for _, tc := range tests {
+			f.flush(t) // clean up db before each test case.
+			for qname, msgs := range tc.enqueued {
+				f.seedEnqueued(t, msgs, qname)
+			}
 
-		// instantiate a new processor
-		var mu sync.Mutex
-		var processed []*Task
-		handler := func(ctx context.Context, task *Task) error {
-			mu.Lock()
-			defer mu.Unlock()
-			processed = append(processed, task)
-			return nil
-		}
-		queueCfg := map[string]int{
-			"critical":            3,
-			base.DefaultQueueName: 2,
-			"low":                 1,
-		}
-		// Note: Set concurrency to 1 to make sure tasks are processed one at a time.
-		cancelations := base.NewCancelations()
-		ss := base.NewServerState("localhost", 1234, 1 /* concurrency */, queueCfg, true /*strict*/)
-		p := newProcessor(newProcessorParams{
-			logger:          testLogger,
-			broker:          rdbClient,
-			ss:              ss,
-			retryDelayFunc:  defaultDelayFunc,
-			syncCh:          nil,
-			cancelations:    cancelations,
-			errHandler:      nil,
-			shutdownTimeout: defaultShutdownTimeout,
-		})
-		p.handler = HandlerFunc(handler)
+			// instantiate a new processor
+			var mu sync.Mutex
+			var processed []*Task
+			handler := func(ctx context.Context, task *Task) error {
+				mu.Lock()
+				defer mu.Unlock()
+				processed = append(processed, task)
+				return nil
+			}
+			queueCfg := map[string]int{
+				"critical":            3,
+				base.DefaultQueueName: 2,
+				"low":                 1,
+			}
+			// Note: Set concurrency to 1 to make sure tasks are processed one at a time.
+			cancelations := base.NewCancelations()
+			ss := base.NewServerState("localhost", 1234, 1 /* concurrency */, queueCfg, true /*strict*/)
+			p := newProcessor(newProcessorParams{
+				logger:          testLogger,
+				broker:          f.broker(),
+				ss:              ss,
+				retryDelayFunc:  defaultDelayFunc,
+				syncCh:          nil,
+				cancelations:    cancelations,
+				errHandler:      nil,
+				shutdownTimeout: defaultShutdownTimeout,
+			})
+			p.handler = HandlerFunc(handler)
 
-		var wg sync.WaitGroup
-		p.start(&wg)
-		time.Sleep(tc.wait)
-		p.terminate()
+			var wg sync.WaitGroup
+			p.start(&wg)
+			time.Sleep(tc.wait)
+			p.terminate()
 
-		if diff := cmp.Diff(tc.wantProcessed, processed, cmp.AllowUnexported(Payload{})); diff != "" {
-			t.Errorf("mismatch found in processed tasks; (-want, +got)\n%s", diff)
-		}
+			if diff := cmp.Diff(tc.wantProcessed, processed, cmp.AllowUnexported(Payload{})); diff != "" {
+				t.Errorf("%s: mismatch found in processed tasks; (-want, +got)\n%s", f.name(), diff)
+			}
 
-		if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
-			t.Errorf("%q has %d tasks, want 0", base.InProgressQueue, l)
+			if l := len(f.getInProgress(t)); l != 0 {
+				t.Errorf("%s: in-progress queue has %d tasks, want 0", f.name(), l)
+			}
 		}
 	}
 }
@@ -562,3 +1284,30 @@ func TestNormalizeQueueCfg(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateContextWithTraceContext(t *testing.T) {
+	tests := []struct {
+		msg    *base.TaskMessage
+		want   TraceContext
+		wantOK bool
+	}{
+		{
+			msg:    &base.TaskMessage{Type: "something", ID: xid.New(), TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", TraceState: "congo=t61rcWkgMzE"},
+			want:   TraceContext{TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", TraceState: "congo=t61rcWkgMzE"},
+			wantOK: true,
+		},
+		{
+			msg:    &base.TaskMessage{Type: "something", ID: xid.New()},
+			wantOK: false,
+		},
+	}
+
+	for _, tc := range tests {
+		ctx, cancel := createContext(tc.msg)
+		got, ok := TraceContextFromContext(ctx)
+		if ok != tc.wantOK || got != tc.want {
+			t.Errorf("TraceContextFromContext(createContext(%+v)) = %+v, %t; want %+v, %t", tc.msg, got, ok, tc.want, tc.wantOK)
+		}
+		cancel()
+	}
+}
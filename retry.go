@@ -0,0 +1,245 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RetryStrategy computes the delay before retrying a failed task.
+type RetryStrategy interface {
+	// Delay returns the delay before the next retry
+	// given the number of times the task has been retried.
+	Delay(n int) time.Duration
+}
+
+// The RetryStrategyFunc type is an adapter to allow the use of ordinary functions as a RetryStrategy.
+// If f is a function with the appropriate signature, RetryStrategyFunc(f) is a RetryStrategy that calls f.
+type RetryStrategyFunc func(n int) time.Duration
+
+// Delay calls fn(n).
+func (fn RetryStrategyFunc) Delay(n int) time.Duration {
+	return fn(n)
+}
+
+// ExponentialJitter returns a RetryStrategy which doubles the delay on every
+// retry starting from the given initial delay.
+//
+// A random jitter of up to half the delay is subtracted from each delay
+// to spread out retries of tasks which failed at the same time.
+func ExponentialJitter(initial time.Duration) RetryStrategy {
+	return RetryStrategyFunc(func(n int) time.Duration {
+		var d int64 = math.MaxInt64
+		if f := float64(initial) * math.Pow(2, float64(n)); f < math.MaxInt64 {
+			d = int64(f)
+		}
+		if d/2 <= 0 {
+			return time.Duration(d)
+		}
+		return time.Duration(d - rand.Int63n(d/2))
+	})
+}
+
+// Linear returns a RetryStrategy which increases the delay by step
+// on every retry starting from the given initial delay.
+func Linear(initial, step time.Duration) RetryStrategy {
+	return RetryStrategyFunc(func(n int) time.Duration {
+		return initial + time.Duration(n)*step
+	})
+}
+
+// Fixed returns a RetryStrategy which always waits for the given delay.
+func Fixed(d time.Duration) RetryStrategy {
+	return RetryStrategyFunc(func(n int) time.Duration {
+		return d
+	})
+}
+
+// RetryRule specifies how to retry a task which failed with a particular error.
+type RetryRule struct {
+	// Match reports whether the rule applies to the error returned by the handler.
+	//
+	// ErrorIs and ErrorAs create matchers for common cases.
+	Match func(error) bool
+
+	// Skip specifies whether to move the task to the dead queue
+	// without retrying.
+	Skip bool
+
+	// Strategy overrides the strategy of the policy for matching errors.
+	//
+	// If nil, the strategy of the policy is used.
+	Strategy RetryStrategy
+}
+
+// ErrorIs returns a matcher for RetryRule which reports whether
+// the error matches target as defined by errors.Is.
+func ErrorIs(target error) func(error) bool {
+	return func(err error) bool {
+		return errors.Is(err, target)
+	}
+}
+
+// ErrorAs returns a matcher for RetryRule which reports whether
+// the error matches the type of target as defined by errors.As.
+//
+// target must be a non-nil pointer to either a type that implements error
+// or to any interface type, as is required by errors.As.
+//
+// Example:
+//
+//	asynq.ErrorAs(new(*net.OpError))
+func ErrorAs(target interface{}) func(error) bool {
+	typ := reflect.TypeOf(target)
+	if typ == nil || typ.Kind() != reflect.Ptr {
+		panic("asynq: ErrorAs target must be a non-nil pointer")
+	}
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	if e := typ.Elem(); e.Kind() != reflect.Interface && !e.Implements(errorType) {
+		panic("asynq: ErrorAs *target must be interface or implement error")
+	}
+	return func(err error) bool {
+		// allocate a new target for each call so that
+		// the matcher is safe for concurrent use.
+		return errors.As(err, reflect.New(typ.Elem()).Interface())
+	}
+}
+
+// RetryPolicy specifies how failed tasks are retried.
+type RetryPolicy struct {
+	// Strategy computes the delay before each retry.
+	//
+	// If nil, the default exponential backoff is used.
+	Strategy RetryStrategy
+
+	// MaxDelay specifies the maximum delay before a retry.
+	//
+	// Zero means no limit.
+	MaxDelay time.Duration
+
+	// MaxElapsed specifies how long a task may be retried, measured from
+	// the time the task was first ready to be processed, or from the time
+	// the task was created if that time is unknown.
+	// A task whose next retry would happen after the limit is moved
+	// to the dead queue.
+	//
+	// Zero means no limit.
+	MaxElapsed time.Duration
+
+	// Rules specifies how to handle particular errors.
+	// Rules are checked in order and the first rule that matches
+	// the error applies.
+	Rules []RetryRule
+}
+
+// delay returns the delay before retrying a task that has been retried n
+// times and failed with err, where start is the time MaxElapsed is measured
+// from. It returns false if the task should not be retried.
+func (p *RetryPolicy) delay(n int, err error, start time.Time) (time.Duration, bool) {
+	strategy := p.Strategy
+	for _, r := range p.Rules {
+		if r.Match == nil || !r.Match(err) {
+			continue
+		}
+		if r.Skip {
+			return 0, false
+		}
+		if r.Strategy != nil {
+			strategy = r.Strategy
+		}
+		break
+	}
+	var d time.Duration
+	if strategy != nil {
+		d = strategy.Delay(n)
+	} else {
+		d = defaultDelayFunc(n, err, nil)
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.MaxElapsed > 0 && time.Now().Add(d).After(start.Add(p.MaxElapsed)) {
+		return 0, false
+	}
+	return d, true
+}
+
+// RetryPolicyMux is a registry of retry policies.
+// It matches the type of each failed task against a list of registered
+// patterns and applies the policy for the pattern that most closely
+// matches the task's type name.
+//
+// Patterns are matched in the same way as ServeMux patterns.
+// Longer patterns take precedence over shorter ones, so that if there are
+// policies registered for both "images" and "images:thumbnails",
+// the latter policy applies to tasks with a type name beginning with
+// "images:thumbnails" and the former applies to tasks with type name
+// beginning with "images".
+//
+// Tasks which don't match any pattern are retried according to
+// Config.RetryDelayFunc.
+type RetryPolicyMux struct {
+	mu       sync.RWMutex
+	m        map[string]*RetryPolicy
+	patterns []string // sorted from longest to shortest.
+}
+
+// NewRetryPolicyMux allocates and returns a new RetryPolicyMux.
+func NewRetryPolicyMux() *RetryPolicyMux {
+	return new(RetryPolicyMux)
+}
+
+// Handle registers the policy for the given pattern.
+// If a policy already exists for pattern, Handle panics.
+func (mux *RetryPolicyMux) Handle(pattern string, policy RetryPolicy) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if pattern == "" {
+		panic("asynq: invalid pattern")
+	}
+	if _, exist := mux.m[pattern]; exist {
+		panic("asynq: multiple registrations for " + pattern)
+	}
+
+	if mux.m == nil {
+		mux.m = make(map[string]*RetryPolicy)
+	}
+	mux.m[pattern] = &policy
+	i := sort.Search(len(mux.patterns), func(i int) bool {
+		return len(mux.patterns[i]) < len(pattern)
+	})
+	mux.patterns = append(mux.patterns, "")
+	copy(mux.patterns[i+1:], mux.patterns[i:])
+	mux.patterns[i] = pattern
+}
+
+// Policy returns the policy to apply to tasks of the given type
+// along with the registered pattern that matches the type.
+//
+// If there is no registered policy that applies to the type,
+// Policy returns nil.
+func (mux *RetryPolicyMux) Policy(typename string) (policy *RetryPolicy, pattern string) {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+
+	// Check for exact match first.
+	if p, ok := mux.m[typename]; ok {
+		return p, typename
+	}
+	// Check for longest valid match.
+	for _, pattern := range mux.patterns {
+		if len(typename) >= len(pattern) && typename[:len(pattern)] == pattern {
+			return mux.m[pattern], pattern
+		}
+	}
+	return nil, ""
+}
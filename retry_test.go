@@ -0,0 +1,255 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetryStrategies(t *testing.T) {
+	tests := []struct {
+		desc     string
+		strategy RetryStrategy
+		n        int
+		want     time.Duration
+	}{
+		{"Fixed", Fixed(time.Minute), 0, time.Minute},
+		{"Fixed", Fixed(time.Minute), 5, time.Minute},
+		{"Linear", Linear(time.Minute, 30*time.Second), 0, time.Minute},
+		{"Linear", Linear(time.Minute, 30*time.Second), 4, 3 * time.Minute},
+	}
+
+	for _, tc := range tests {
+		if got := tc.strategy.Delay(tc.n); got != tc.want {
+			t.Errorf("%s: Delay(%d) = %v, want %v", tc.desc, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestExponentialJitter(t *testing.T) {
+	s := ExponentialJitter(10 * time.Second)
+	tests := []struct {
+		n        int
+		min, max time.Duration // inclusive range of the delay
+	}{
+		{0, 5 * time.Second, 10 * time.Second},
+		{1, 10 * time.Second, 20 * time.Second},
+		{3, 40 * time.Second, 80 * time.Second},
+	}
+
+	for _, tc := range tests {
+		for i := 0; i < 100; i++ {
+			if got := s.Delay(tc.n); got < tc.min || got > tc.max {
+				t.Errorf("Delay(%d) = %v, want between %v and %v", tc.n, got, tc.min, tc.max)
+				break
+			}
+		}
+	}
+	// delay does not overflow.
+	if got := s.Delay(1000); got <= 0 {
+		t.Errorf("Delay(1000) = %v, want positive duration", got)
+	}
+}
+
+var errTemporary = errors.New("temporary error")
+
+func TestRetryPolicyDelay(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		desc    string
+		policy  RetryPolicy
+		n       int
+		err     error
+		created time.Time
+		want    time.Duration
+		wantOK  bool
+	}{
+		{
+			desc:    "uses strategy",
+			policy:  RetryPolicy{Strategy: Linear(time.Minute, time.Minute)},
+			n:       2,
+			err:     errors.New("oops"),
+			created: now,
+			want:    3 * time.Minute,
+			wantOK:  true,
+		},
+		{
+			desc:    "caps delay",
+			policy:  RetryPolicy{Strategy: Linear(time.Minute, time.Minute), MaxDelay: 2 * time.Minute},
+			n:       5,
+			err:     errors.New("oops"),
+			created: now,
+			want:    2 * time.Minute,
+			wantOK:  true,
+		},
+		{
+			desc:    "gives up after budget",
+			policy:  RetryPolicy{Strategy: Fixed(10 * time.Minute), MaxElapsed: time.Hour},
+			n:       5,
+			err:     errors.New("oops"),
+			created: now.Add(-55 * time.Minute),
+			want:    0,
+			wantOK:  false,
+		},
+		{
+			desc:    "retries within budget",
+			policy:  RetryPolicy{Strategy: Fixed(time.Minute), MaxElapsed: time.Hour},
+			n:       5,
+			err:     errors.New("oops"),
+			created: now.Add(-55 * time.Minute),
+			want:    time.Minute,
+			wantOK:  true,
+		},
+		{
+			desc: "rule overrides strategy",
+			policy: RetryPolicy{
+				Strategy: Fixed(time.Hour),
+				Rules: []RetryRule{
+					{Match: ErrorIs(errTemporary), Strategy: Fixed(time.Second)},
+				},
+			},
+			n:       1,
+			err:     fmt.Errorf("could not connect: %w", errTemporary),
+			created: now,
+			want:    time.Second,
+			wantOK:  true,
+		},
+		{
+			desc: "rule skips retry",
+			policy: RetryPolicy{
+				Strategy: Fixed(time.Hour),
+				Rules: []RetryRule{
+					{Match: ErrorAs(new(*os.PathError)), Skip: true},
+				},
+			},
+			n:       1,
+			err:     fmt.Errorf("could not read config: %w", &os.PathError{Op: "open", Path: "/etc/app.conf", Err: os.ErrNotExist}),
+			created: now,
+			want:    0,
+			wantOK:  false,
+		},
+		{
+			desc: "first matching rule applies",
+			policy: RetryPolicy{
+				Strategy: Fixed(time.Hour),
+				Rules: []RetryRule{
+					{Match: ErrorIs(os.ErrNotExist), Skip: true},
+					{Match: ErrorIs(errTemporary), Strategy: Fixed(time.Second)},
+					{Match: ErrorIs(errTemporary), Skip: true},
+				},
+			},
+			n:       1,
+			err:     errTemporary,
+			created: now,
+			want:    time.Second,
+			wantOK:  true,
+		},
+		{
+			desc: "no matching rule",
+			policy: RetryPolicy{
+				Strategy: Fixed(time.Hour),
+				Rules: []RetryRule{
+					{Match: ErrorIs(errTemporary), Skip: true},
+				},
+			},
+			n:       1,
+			err:     errors.New("oops"),
+			created: now,
+			want:    time.Hour,
+			wantOK:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		got, ok := tc.policy.delay(tc.n, tc.err, tc.created)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("%s: delay(%d, %v) = %v, %t; want %v, %t",
+				tc.desc, tc.n, tc.err, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestRetryPolicyDefaultStrategy(t *testing.T) {
+	p := RetryPolicy{}
+	for n := 0; n < 5; n++ {
+		got, ok := p.delay(n, errors.New("oops"), time.Now())
+		// same range as defaultDelayFunc.
+		min := time.Duration(n*n*n*n+15) * time.Second
+		max := min + time.Duration(29*(n+1))*time.Second
+		if !ok || got < min || got > max {
+			t.Errorf("delay(%d) = %v, %t; want between %v and %v, true", n, got, ok, min, max)
+		}
+	}
+}
+
+func TestRetryPolicyMux(t *testing.T) {
+	mux := NewRetryPolicyMux()
+	mux.Handle("email:", RetryPolicy{Strategy: Fixed(1 * time.Minute)})
+	mux.Handle("email:signup", RetryPolicy{Strategy: Fixed(2 * time.Minute)})
+	mux.Handle("csv:export", RetryPolicy{Strategy: Fixed(3 * time.Minute)})
+
+	tests := []struct {
+		typename    string
+		wantPattern string
+		wantDelay   time.Duration
+	}{
+		{"email:signup", "email:signup", 2 * time.Minute},
+		{"csv:export", "csv:export", 3 * time.Minute},
+		{"email:daily", "email:", 1 * time.Minute},
+		{"csv:import", "", 0},
+	}
+
+	for _, tc := range tests {
+		policy, pattern := mux.Policy(tc.typename)
+		if pattern != tc.wantPattern {
+			t.Errorf("Policy(%q) returned pattern %q, want %q", tc.typename, pattern, tc.wantPattern)
+			continue
+		}
+		if tc.wantPattern == "" {
+			if policy != nil {
+				t.Errorf("Policy(%q) = %v, want nil", tc.typename, policy)
+			}
+			continue
+		}
+		if got := policy.Strategy.Delay(0); got != tc.wantDelay {
+			t.Errorf("Policy(%q) returned a policy with delay %v, want %v", tc.typename, got, tc.wantDelay)
+		}
+	}
+}
+
+func TestRetryPolicyMuxRegisterDuplicatePattern(t *testing.T) {
+	defer func() {
+		if err := recover(); err == nil {
+			t.Error("expected call to mux.Handle to panic")
+		}
+	}()
+
+	mux := NewRetryPolicyMux()
+	mux.Handle("email", RetryPolicy{})
+	mux.Handle("email", RetryPolicy{})
+}
+
+func TestErrorAsInvalidTarget(t *testing.T) {
+	tests := []interface{}{
+		nil,
+		os.PathError{},
+		new(string),
+	}
+
+	for _, target := range tests {
+		func() {
+			defer func() {
+				if err := recover(); err == nil {
+					t.Errorf("expected ErrorAs(%T) to panic", target)
+				}
+			}()
+			ErrorAs(target)
+		}()
+	}
+}
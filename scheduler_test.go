@@ -77,17 +77,17 @@ func TestScheduler(t *testing.T) {
 
 		gotScheduled := h.GetScheduledMessages(t, r)
 		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q after running scheduler: (-want, +got)\n%s", base.ScheduledQueue, diff)
+			t.Errorf("mismatch found in %q after running scheduler: (-want, +got)\n%s", h.Keys.ScheduledQueue(), diff)
 		}
 
 		gotRetry := h.GetRetryMessages(t, r)
 		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q after running scheduler: (-want, +got)\n%s", base.RetryQueue, diff)
+			t.Errorf("mismatch found in %q after running scheduler: (-want, +got)\n%s", h.Keys.RetryQueue(), diff)
 		}
 
 		gotEnqueued := h.GetEnqueuedMessages(t, r)
 		if diff := cmp.Diff(tc.wantQueue, gotEnqueued, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q after running scheduler: (-want, +got)\n%s", base.DefaultQueue, diff)
+			t.Errorf("mismatch found in %q after running scheduler: (-want, +got)\n%s", h.Keys.DefaultQueue(), diff)
 		}
 	}
 }
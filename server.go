@@ -10,11 +10,14 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"runtime"
 	"sync"
 	"time"
 
+	"github.com/hibiken/asynq/broker"
 	"github.com/hibiken/asynq/internal/base"
 	"github.com/hibiken/asynq/internal/log"
 	"github.com/hibiken/asynq/internal/rdb"
@@ -31,7 +34,7 @@ import (
 // If a task exhausts its retries, it will be moved to the "dead" queue and
 // will be kept in the queue for some time until a certain condition is met
 // (e.g., queue size reaches a certain limit, or the task has been in the
-// queue for a certain amount of time).
+// queue for a certain amount of time). See Config.DeadRetention.
 type Server struct {
 	ss *base.ServerState
 
@@ -46,6 +49,12 @@ type Server struct {
 	syncer      *syncer
 	heartbeater *heartbeater
 	subscriber  *subscriber
+	janitor     *janitor
+
+	metrics *metrics
+	// metricsAddr is the address to serve metrics on; empty if disabled.
+	metricsAddr   string
+	metricsServer *http.Server
 }
 
 // Config specifies the server's background-task processing behavior.
@@ -65,6 +74,15 @@ type Config struct {
 	// t is the task in question.
 	RetryDelayFunc func(n int, e error, t *Task) time.Duration
 
+	// RetryPolicies specifies retry policies for tasks by task type.
+	//
+	// Failed tasks whose type matches a registered pattern are retried
+	// according to the policy. Other tasks are retried after the delay
+	// computed by RetryDelayFunc.
+	//
+	// If nil, all tasks are retried according to RetryDelayFunc.
+	RetryPolicies *RetryPolicyMux
+
 	// List of queues to process with given priority value. Keys are the names of the
 	// queues and values are associated priority value.
 	//
@@ -117,6 +135,123 @@ type Config struct {
 	//
 	// If unset or zero, default timeout of 8 seconds is used.
 	ShutdownTimeout time.Duration
+
+	// MaxCrashRecovery specifies the maximum number of times a task is put back
+	// to its queue after the process running the task crashed.
+	//
+	// When a server starts, it restores tasks left unfinished by a crashed process.
+	// Servers sharing a redis server keep restoring the tasks of servers which
+	// stopped sending heartbeats periodically, and never restore tasks still
+	// processed by running servers. A task that has been restored more than
+	// MaxCrashRecovery times is considered to be crashing the process and is
+	// moved to the dead queue instead.
+	//
+	// If unset or zero, default limit of 3 is used.
+	// Negative value means no limit; tasks are never moved to the dead queue.
+	MaxCrashRecovery int
+
+	// Namespace specifies the prefix of all redis keys and pub/sub channels
+	// used by the server.
+	//
+	// Servers and clients process only the tasks in their own namespace, which
+	// allows independent applications to share a single redis database.
+	// Client should be created with NewClientWithNamespace to enqueue
+	// tasks to servers with a non-default namespace.
+	//
+	// If unset, default namespace "asynq" is used.
+	Namespace string
+
+	// PrefetchCount specifies the maximum number of tasks the server claims
+	// from the broker in a single round trip.
+	//
+	// Claimed tasks are kept in a local buffer until a worker becomes available,
+	// so the number of tasks processed concurrently is still limited by Concurrency.
+	// Tasks left in the buffer are put back to their queues when the server
+	// stops processing new tasks.
+	//
+	// Each batch is split among the queues based on their priority, the same way
+	// as tasks dequeued one at a time, unless StrictPriority is true.
+	//
+	// Prefetching reduces the load on redis when processing a large number of
+	// short-running tasks. Brokers which don't support dequeuing multiple tasks
+	// at once ignore the value.
+	//
+	// If unset, zero or one, tasks are dequeued one at a time.
+	PrefetchCount int
+
+	// DeadRetention specifies how many tasks are kept in the dead queue
+	// and for how long.
+	//
+	// The server checks the dead queue periodically and evicts the oldest
+	// tasks exceeding the limits. The dead queue is not trimmed while no server
+	// is running, so tasks killed from the CLI are kept until a server starts.
+	//
+	// All servers sharing a redis server trim the same dead queue, so they
+	// should use the same limits; otherwise the strictest limits apply.
+	//
+	// If MaxSize is zero, default limit of 10000 tasks is used.
+	// If MaxAge is zero, default limit of 90 days is used.
+	// Negative values mean no limit.
+	DeadRetention Retention
+
+	// QueueDeadRetention overrides DeadRetention for the dead tasks
+	// from the given queues.
+	//
+	// Dead tasks from a queue in the map count only towards the limits
+	// for the queue. Zero fields are set to the values of DeadRetention.
+	//
+	// Example:
+	// QueueDeadRetention: map[string]asynq.Retention{
+	//     "critical": {MaxSize: 100000, MaxAge: 365 * 24 * time.Hour},
+	// }
+	QueueDeadRetention map[string]Retention
+
+	// DeadTaskSink receives the tasks evicted from the dead queue
+	// before they are removed.
+	//
+	// If the sink returns an error, the tasks are kept in the dead queue
+	// and the eviction is retried later.
+	//
+	// If unset, evicted tasks are discarded.
+	DeadTaskSink DeadTaskSink
+
+	// HistoryTTL specifies how long the lifecycle history of a task is kept
+	// after its last event.
+	//
+	// If set, the server records when each task is dequeued, retried,
+	// rescheduled, killed or done along with the server and the error,
+	// if any. A bounded number of the latest events are kept for each task.
+	// Use Client.SetHistoryTTL to record when tasks are enqueued.
+	// History is recorded only if the broker supports it.
+	//
+	// If unset or zero, task history is not recorded.
+	HistoryTTL time.Duration
+
+	// MetricsAddr specifies the TCP address to serve metrics on
+	// in Prometheus text format at "/metrics" while the server is running.
+	//
+	// See Server.MetricsHandler for the metrics reported.
+	//
+	// If unset, metrics are not served. Server.MetricsHandler can be
+	// used to serve them from an HTTP server of your own.
+	MetricsAddr string
+
+	// Tracer opens spans for the tasks processed by the server.
+	//
+	// The context passed to the handler carries the trace context
+	// of the caller which enqueued the task even if Tracer is unset.
+	// See TraceContext.
+	Tracer Tracer
+}
+
+// Retention specifies how many dead tasks are kept and for how long.
+type Retention struct {
+	// MaxSize is the maximum number of dead tasks kept.
+	MaxSize int
+
+	// MaxAge is the maximum duration a task is kept after it was moved
+	// to the dead queue.
+	MaxAge time.Duration
 }
 
 // An ErrorHandler handles errors returned by the task handler.
@@ -165,9 +300,25 @@ var defaultQueueConfig = map[string]int{
 
 const defaultShutdownTimeout = 8 * time.Second
 
+const defaultMaxCrashRecovery = 3
+
+var defaultDeadRetention = Retention{
+	MaxSize: 10000,
+	MaxAge:  90 * 24 * time.Hour,
+}
+
 // NewServer returns a new Server given a redis connection option
 // and background processing configuration.
 func NewServer(r RedisConnOpt, cfg Config) *Server {
+	return NewServerWithBroker(rdb.NewRDBWithNamespace(createRedisClient(r), cfg.Namespace), cfg)
+}
+
+// NewServerWithBroker returns a new Server which processes tasks stored
+// in the given broker, with the given background processing configuration.
+//
+// The Namespace field of cfg is ignored since the broker
+// determines where the tasks are stored.
+func NewServerWithBroker(b broker.Broker, cfg Config) *Server {
 	n := cfg.Concurrency
 	if n < 1 {
 		n = runtime.NumCPU()
@@ -193,6 +344,19 @@ func NewServer(r RedisConnOpt, cfg Config) *Server {
 	if shutdownTimeout == 0 {
 		shutdownTimeout = defaultShutdownTimeout
 	}
+	maxCrashRecovery := cfg.MaxCrashRecovery
+	if maxCrashRecovery == 0 {
+		maxCrashRecovery = defaultMaxCrashRecovery
+	}
+
+	deadRetention := mergeRetention(cfg.DeadRetention, defaultDeadRetention)
+	queueDeadRetention := make(map[string]base.Retention)
+	for qname, r := range cfg.QueueDeadRetention {
+		queueDeadRetention[qname] = base.Retention(mergeRetention(r, deadRetention))
+	}
+	if _, ok := b.(base.DeadTrimmer); !ok && (cfg.DeadRetention != Retention{} || len(cfg.QueueDeadRetention) > 0 || cfg.DeadTaskSink != nil) {
+		logger.Warn("Broker does not support trimming the dead queue; DeadRetention, QueueDeadRetention and DeadTaskSink are ignored")
+	}
 
 	host, err := os.Hostname()
 	if err != nil {
@@ -200,34 +364,62 @@ func NewServer(r RedisConnOpt, cfg Config) *Server {
 	}
 	pid := os.Getpid()
 
-	rdb := rdb.NewRDB(createRedisClient(r))
 	ss := base.NewServerState(host, pid, n, queues, cfg.StrictPriority)
 	syncCh := make(chan *syncRequest)
 	cancels := base.NewCancelations()
+	metrics := newMetrics()
 	syncer := newSyncer(logger, syncCh, 5*time.Second)
-	heartbeater := newHeartbeater(logger, rdb, ss, 5*time.Second)
-	scheduler := newScheduler(logger, rdb, 5*time.Second, queues)
-	subscriber := newSubscriber(logger, rdb, cancels)
+	heartbeater := newHeartbeater(logger, b, ss, 5*time.Second)
+	scheduler := newScheduler(logger, b, 5*time.Second, queues)
+	subscriber := newSubscriber(logger, b, cancels)
+	janitor := newJanitor(newJanitorParams{
+		logger:         logger,
+		broker:         b,
+		interval:       time.Minute,
+		retention:      base.Retention(deadRetention),
+		queueRetention: queueDeadRetention,
+		sink:           cfg.DeadTaskSink,
+	})
 	processor := newProcessor(newProcessorParams{
-		logger:          logger,
-		broker:          rdb,
-		ss:              ss,
-		retryDelayFunc:  delayFunc,
-		syncCh:          syncCh,
-		cancelations:    cancels,
-		errHandler:      cfg.ErrorHandler,
-		shutdownTimeout: shutdownTimeout,
+		logger:           logger,
+		broker:           b,
+		ss:               ss,
+		retryDelayFunc:   delayFunc,
+		retryPolicies:    cfg.RetryPolicies,
+		maxCrashRecovery: maxCrashRecovery,
+		syncCh:           syncCh,
+		cancelations:     cancels,
+		errHandler:       cfg.ErrorHandler,
+		shutdownTimeout:  shutdownTimeout,
+		prefetchCount:    cfg.PrefetchCount,
+		historyTTL:       cfg.HistoryTTL,
+		metrics:          metrics,
+		tracer:           cfg.Tracer,
 	})
 	return &Server{
 		ss:          ss,
 		logger:      logger,
-		broker:      rdb,
+		broker:      b,
 		scheduler:   scheduler,
 		processor:   processor,
 		syncer:      syncer,
 		heartbeater: heartbeater,
 		subscriber:  subscriber,
+		janitor:     janitor,
+		metrics:     metrics,
+		metricsAddr: cfg.MetricsAddr,
+	}
+}
+
+// mergeRetention returns r with zero fields set to the values of def.
+func mergeRetention(r, def Retention) Retention {
+	if r.MaxSize == 0 {
+		r.MaxSize = def.MaxSize
+	}
+	if r.MaxAge == 0 {
+		r.MaxAge = def.MaxAge
 	}
+	return r
 }
 
 // A Handler processes tasks.
@@ -237,6 +429,8 @@ func NewServer(r RedisConnOpt, cfg Config) *Server {
 //
 // If ProcessTask return a non-nil error or panics, the task
 // will be retried after delay.
+// ProcessTask can control the retry by returning SkipRetry,
+// or an error created by RetryAfter or Reschedule.
 type Handler interface {
 	ProcessTask(context.Context, *Task) error
 }
@@ -252,6 +446,60 @@ func (fn HandlerFunc) ProcessTask(ctx context.Context, task *Task) error {
 	return fn(ctx, task)
 }
 
+// SkipRetry is used as a return value from Handler.ProcessTask to indicate
+// that the task should not be retried and should be moved to the dead queue
+// right away.
+//
+// The error may be wrapped to record the cause of the failure:
+//
+//	return fmt.Errorf("invalid payload: %v: %w", err, asynq.SkipRetry)
+var SkipRetry = errors.New("skip retry for the task")
+
+// RetryAfter returns an error wrapping err which tells the server to retry
+// the task after the given delay instead of the delay computed by
+// Config.RetryDelayFunc.
+//
+// The retry is counted as any other failure. If the task has no retry
+// left, it is moved to the dead queue.
+func RetryAfter(d time.Duration, err error) error {
+	return &retryAfterError{delay: d, err: err}
+}
+
+type retryAfterError struct {
+	delay time.Duration
+	err   error
+}
+
+func (e *retryAfterError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("retry after %v", e.delay)
+	}
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// Reschedule returns an error which tells the server to process the task
+// again after the given delay.
+//
+// Unlike RetryAfter, the task does not consume a retry, is not counted
+// as failed, and is not passed to the ErrorHandler. It is useful when
+// a task cannot be processed yet, e.g. a resource it needs is not ready.
+//
+// If the broker of the server does not implement broker.Rescheduler,
+// the task is retried after the delay instead, which consumes a retry.
+func Reschedule(d time.Duration) error {
+	return &rescheduleError{delay: d}
+}
+
+type rescheduleError struct {
+	delay time.Duration
+}
+
+func (e *rescheduleError) Error() string {
+	return fmt.Sprintf("reschedule task after %v", e.delay)
+}
+
 // ErrServerStopped indicates that the operation is now illegal because of the server being stopped.
 var ErrServerStopped = errors.New("asynq: the server has been stopped")
 
@@ -288,6 +536,16 @@ func (srv *Server) Start(handler Handler) error {
 	case base.StatusStopped:
 		return ErrServerStopped
 	}
+	if srv.metricsAddr != "" {
+		ln, err := net.Listen("tcp", srv.metricsAddr)
+		if err != nil {
+			return fmt.Errorf("asynq: cannot serve metrics: %v", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", srv.MetricsHandler())
+		srv.metricsServer = &http.Server{Handler: mux}
+		go srv.metricsServer.Serve(ln)
+	}
 	srv.ss.SetStatus(base.StatusRunning)
 	srv.processor.handler = handler
 
@@ -304,6 +562,7 @@ func (srv *Server) Start(handler Handler) error {
 	srv.subscriber.start(&srv.wg)
 	srv.syncer.start(&srv.wg)
 	srv.scheduler.start(&srv.wg)
+	srv.janitor.start(&srv.wg)
 	srv.processor.start(&srv.wg)
 	return nil
 }
@@ -325,6 +584,7 @@ func (srv *Server) Stop() {
 	// Sender goroutines should be terminated before the receiver goroutines.
 	// processor -> syncer (via syncCh)
 	srv.scheduler.terminate()
+	srv.janitor.terminate()
 	srv.processor.terminate()
 	srv.syncer.terminate()
 	srv.subscriber.terminate()
@@ -332,6 +592,9 @@ func (srv *Server) Stop() {
 
 	srv.wg.Wait()
 
+	if srv.metricsServer != nil {
+		srv.metricsServer.Close()
+	}
 	srv.broker.Close()
 	srv.ss.SetStatus(base.StatusStopped)
 
@@ -6,9 +6,17 @@ package asynq
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/broker"
+	"github.com/hibiken/asynq/broker/inmem"
+	"github.com/hibiken/asynq/broker/rstream"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
 	"go.uber.org/goleak"
 )
 
@@ -83,3 +91,184 @@ func TestServerErrServerRunning(t *testing.T) {
 	}
 	srv.Stop()
 }
+
+// wrappingBroker wraps errors returned by the underlying broker
+// to simulate a third-party broker implementation.
+type wrappingBroker struct {
+	broker.Broker
+}
+
+func (b *wrappingBroker) Dequeue(qnames ...string) (*broker.TaskMessage, error) {
+	msg, err := b.Broker.Dequeue(qnames...)
+	if err != nil {
+		return nil, fmt.Errorf("wrappingBroker: %w", err)
+	}
+	return msg, nil
+}
+
+func TestServerWithBroker(t *testing.T) {
+	b := &wrappingBroker{rdb.NewRDB(setup(t))}
+	c := NewClientWithBroker(b)
+	srv := NewServerWithBroker(b, Config{
+		Concurrency: 10,
+		Logger:      testLogger,
+	})
+
+	processed := make(chan string, 1)
+	h := func(ctx context.Context, task *Task) error {
+		processed <- task.Type
+		return nil
+	}
+
+	if err := srv.Start(HandlerFunc(h)); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	if err := c.Enqueue(NewTask("send_email", nil)); err != nil {
+		t.Fatalf("could not enqueue a task: %v", err)
+	}
+
+	select {
+	case got := <-processed:
+		if got != "send_email" {
+			t.Errorf("processed task type = %q, want %q", got, "send_email")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("task enqueued to user-supplied broker was not processed")
+	}
+}
+
+func TestServerWithInMemoryBroker(t *testing.T) {
+	b := inmem.New()
+	c := NewClientWithBroker(b)
+	srv := NewServerWithBroker(b, Config{
+		Concurrency: 10,
+		Logger:      testLogger,
+	})
+
+	processed := make(chan string, 2)
+	h := func(ctx context.Context, task *Task) error {
+		processed <- task.Type
+		return nil
+	}
+
+	if err := srv.Start(HandlerFunc(h)); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	for _, typename := range []string{"send_email", "reindex"} {
+		if err := c.Enqueue(NewTask(typename, nil), Unique(time.Hour)); err != nil {
+			t.Fatalf("could not enqueue a task: %v", err)
+		}
+	}
+	if err := c.Enqueue(NewTask("send_email", nil), Unique(time.Hour)); !errors.Is(err, ErrDuplicateTask) {
+		t.Errorf("enqueueing duplicate task returned %v, want ErrDuplicateTask", err)
+	}
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		select {
+		case typename := <-processed:
+			got = append(got, typename)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("processed %v, want both tasks to be processed", got)
+		}
+	}
+}
+
+func TestServerWithRedisStreamsBroker(t *testing.T) {
+	r := setup(t)
+	b := rstream.New(redis.NewClient(&redis.Options{
+		Addr: redisAddr,
+		DB:   redisDB,
+	}), rstream.Options{Namespace: "myapp"})
+	c := NewClientWithBroker(b)
+	srv := NewServerWithBroker(b, Config{
+		Concurrency: 10,
+		Logger:      testLogger,
+	})
+
+	processed := make(chan string, 2)
+	h := func(ctx context.Context, task *Task) error {
+		processed <- task.Type
+		return nil
+	}
+
+	if err := srv.Start(HandlerFunc(h)); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	task := NewTask("send_email", nil)
+	if err := c.Enqueue(task, Unique(time.Hour)); err != nil {
+		t.Fatalf("could not enqueue a task: %v", err)
+	}
+	// uniqueness lock is created under the broker's namespace.
+	ukey := uniqueKey(b.Keys(), task, time.Hour, base.DefaultQueueName)
+	if n := r.Exists(ukey).Val(); n != 1 {
+		t.Errorf("EXISTS %q = %d, want 1", ukey, n)
+	}
+	if err := c.EnqueueIn(time.Second, NewTask("reindex", nil)); err != nil {
+		t.Fatalf("could not schedule a task: %v", err)
+	}
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		select {
+		case typename := <-processed:
+			got = append(got, typename)
+		case <-time.After(10 * time.Second): // scheduler polls every 5s
+			t.Fatalf("processed %v, want both tasks to be processed", got)
+		}
+	}
+}
+
+func TestServerWithRedisStreamsBrokerSkipsCanceledTasks(t *testing.T) {
+	r := setup(t)
+	b := rstream.New(redis.NewClient(&redis.Options{
+		Addr: redisAddr,
+		DB:   redisDB,
+	}), rstream.Options{Namespace: "myapp"})
+	c := NewClientWithBroker(b)
+
+	if err := c.Enqueue(NewTask("send_email", nil)); err != nil {
+		t.Fatalf("could not enqueue a task: %v", err)
+	}
+	ids := r.HKeys(b.Keys().TaskIndex()).Val()
+	if len(ids) != 1 {
+		t.Fatalf("task index has %d tasks, want 1", len(ids))
+	}
+	if res, err := c.Cancel(ids[0]); err != nil || res != CancelRemoved {
+		t.Fatalf("c.Cancel(%q) = %v, %v; want %v, nil", ids[0], res, err, CancelRemoved)
+	}
+	if err := c.Enqueue(NewTask("reindex", nil)); err != nil {
+		t.Fatalf("could not enqueue a task: %v", err)
+	}
+
+	srv := NewServerWithBroker(b, Config{
+		Concurrency: 10,
+		Logger:      testLogger,
+	})
+	processed := make(chan string, 2)
+	h := func(ctx context.Context, task *Task) error {
+		processed <- task.Type
+		return nil
+	}
+	if err := srv.Start(HandlerFunc(h)); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	// tasks in a stream are processed in order, so the canceled task would
+	// have been processed before the second one.
+	select {
+	case typename := <-processed:
+		if typename != "reindex" {
+			t.Errorf("processed %q, want %q", typename, "reindex")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("task was not processed")
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// EvictedTask is a task evicted from the dead queue.
+type EvictedTask struct {
+	ID       string                 `json:"id"`
+	Type     string                 `json:"type"`
+	Payload  map[string]interface{} `json:"payload"`
+	Queue    string                 `json:"queue"`
+	Retry    int                    `json:"retry"`
+	Retried  int                    `json:"retried"`
+	ErrorMsg string                 `json:"error_msg"`
+	Timeout  string                 `json:"timeout,omitempty"`
+	Deadline string                 `json:"deadline,omitempty"`
+
+	Headers     map[string]string `json:"headers,omitempty"`
+	TraceParent string            `json:"trace_parent,omitempty"`
+	TraceState  string            `json:"trace_state,omitempty"`
+
+	// DiedAt is the time the task was moved to the dead queue.
+	DiedAt time.Time `json:"died_at"`
+}
+
+// A DeadTaskSink receives the tasks evicted from the dead queue.
+//
+// Archive is called with the tasks before they are removed from the dead
+// queue. If Archive returns an error, the tasks are kept and passed to
+// Archive again later, so a sink may receive the same task more than once.
+type DeadTaskSink interface {
+	Archive(tasks []*EvictedTask) error
+}
+
+// The DeadTaskSinkFunc type is an adapter to allow the use of ordinary functions as a DeadTaskSink.
+// If f is a function with the appropriate signature, DeadTaskSinkFunc(f) is a DeadTaskSink that calls f.
+type DeadTaskSinkFunc func(tasks []*EvictedTask) error
+
+// Archive calls fn(tasks).
+func (fn DeadTaskSinkFunc) Archive(tasks []*EvictedTask) error {
+	return fn(tasks)
+}
+
+const defaultSinkMaxBytes = 100 << 20 // 100MB
+
+// NDJSONSink is a DeadTaskSink which writes evicted tasks to files in
+// newline delimited JSON format, one task per line.
+//
+// Tasks are appended to a file named dead-<timestamp>.ndjson in Dir.
+// A new file is started when the current file reaches MaxBytes.
+//
+// Example:
+//
+//	sink := &asynq.NDJSONSink{Dir: "/var/lib/myapp/dead"}
+//	defer sink.Close()
+//	srv := asynq.NewServer(redis, asynq.Config{DeadTaskSink: sink})
+type NDJSONSink struct {
+	// Dir is the directory to write files to.
+	// It is created if it does not exist.
+	Dir string
+
+	// MaxBytes is the size at which a file is rotated.
+	//
+	// If unset or zero, default size of 100MB is used.
+	MaxBytes int64
+
+	// MaxFiles is the maximum number of files kept in Dir.
+	// The oldest files are removed when a new file is started.
+	//
+	// If unset or zero, all files are kept.
+	MaxFiles int
+
+	mu   sync.Mutex
+	f    *os.File // current file; nil until the first write
+	size int64    // size of the current file
+}
+
+const sinkFilePrefix, sinkFileExt = "dead-", ".ndjson"
+
+// Archive appends the tasks to the current file and flushes
+// the file to stable storage.
+func (s *NDJSONSink) Archive(tasks []*EvictedTask) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, t := range tasks {
+		if err := enc.Encode(t); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	maxBytes := s.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultSinkMaxBytes
+	}
+	if s.f == nil || (s.size > 0 && s.size+int64(buf.Len()) > maxBytes) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(buf.Bytes())
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// rotate closes the current file and starts a new one.
+func (s *NDJSONSink) rotate() error {
+	if s.f != nil {
+		if err := s.f.Close(); err != nil {
+			return err
+		}
+		s.f = nil
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	name := sinkFilePrefix + time.Now().UTC().Format("20060102T150405.000000000") + sinkFileExt
+	f, err := os.OpenFile(filepath.Join(s.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.f, s.size = f, 0
+	return s.prune()
+}
+
+// prune removes the oldest files if there are more than MaxFiles files.
+func (s *NDJSONSink) prune() error {
+	if s.MaxFiles <= 0 {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(s.Dir, sinkFilePrefix+"*"+sinkFileExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files) // file names sort by time.
+	for len(files) > s.MaxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return fmt.Errorf("could not remove %s: %v", files[0], err)
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// Close closes the current file.
+func (s *NDJSONSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
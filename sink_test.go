@@ -0,0 +1,110 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func readNDJSON(t *testing.T, path string) []*EvictedTask {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var tasks []*EvictedTask
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var task EvictedTask
+		if err := json.Unmarshal(s.Bytes(), &task); err != nil {
+			t.Fatalf("could not decode line %q: %v", s.Text(), err)
+		}
+		tasks = append(tasks, &task)
+	}
+	return tasks
+}
+
+func sinkFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "dead-*.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestNDJSONSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asynq-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	diedAt := time.Date(2020, time.May, 1, 12, 0, 0, 0, time.UTC)
+	t1 := &EvictedTask{ID: "1", Type: "send_email", Payload: map[string]interface{}{"user_id": 42.0}, Queue: "default", Retry: 25, Retried: 25, ErrorMsg: "oops", Timeout: "30s", Headers: map[string]string{"request_id": "abc123"}, TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", DiedAt: diedAt}
+	t2 := &EvictedTask{ID: "2", Type: "reindex", Payload: map[string]interface{}{}, Queue: "low", Retry: 3, Retried: 3, ErrorMsg: "oops", DiedAt: diedAt}
+
+	sink := &NDJSONSink{Dir: filepath.Join(dir, "dead")}
+	if err := sink.Archive([]*EvictedTask{t1}); err != nil {
+		t.Fatalf("Archive returned error: %v", err)
+	}
+	if err := sink.Archive([]*EvictedTask{t2}); err != nil {
+		t.Fatalf("Archive returned error: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	files := sinkFiles(t, sink.Dir)
+	if len(files) != 1 {
+		t.Fatalf("sink wrote %d files, want 1", len(files))
+	}
+	got := readNDJSON(t, files[0])
+	if diff := cmp.Diff([]*EvictedTask{t1, t2}, got); diff != "" {
+		t.Errorf("mismatch found in %s; (-want, +got)\n%s", files[0], diff)
+	}
+}
+
+func TestNDJSONSinkRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asynq-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := &NDJSONSink{Dir: dir, MaxBytes: 1, MaxFiles: 2}
+	defer sink.Close()
+	ids := []string{"1", "2", "3"}
+	for _, id := range ids {
+		if err := sink.Archive([]*EvictedTask{{ID: id, Type: "send_email"}}); err != nil {
+			t.Fatalf("Archive returned error: %v", err)
+		}
+		time.Sleep(time.Millisecond) // file names have a timestamp.
+	}
+
+	// each batch exceeds MaxBytes and is written to a new file;
+	// the oldest file is removed.
+	files := sinkFiles(t, dir)
+	var got []string
+	for _, f := range files {
+		for _, task := range readNDJSON(t, f) {
+			got = append(got, task.ID)
+		}
+	}
+	if diff := cmp.Diff(ids[1:], got); diff != "" {
+		t.Errorf("mismatch found in tasks archived in %v; (-want, +got)\n%s", files, diff)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/go-redis/redis/v7"
 	"github.com/hibiken/asynq/internal/base"
 )
 
@@ -47,12 +46,12 @@ func (s *subscriber) start(wg *sync.WaitGroup) {
 	go func() {
 		defer wg.Done()
 		var (
-			pubsub *redis.PubSub
-			err    error
+			sub base.Subscription
+			err error
 		)
 		// Try until successfully connect to Redis.
 		for {
-			pubsub, err = s.broker.CancelationPubSub()
+			sub, err = s.broker.SubscribeCancelation()
 			if err != nil {
 				s.logger.Error("cannot subscribe to cancelation channel: %v", err)
 				select {
@@ -65,18 +64,22 @@ func (s *subscriber) start(wg *sync.WaitGroup) {
 			}
 			break
 		}
-		cancelCh := pubsub.Channel()
+		cancelCh := sub.Channel()
 		for {
 			select {
 			case <-s.done:
-				pubsub.Close()
+				sub.Close()
 				s.logger.Info("Subscriber done")
 				return
-			case msg := <-cancelCh:
-				cancel, ok := s.cancelations.Get(msg.Payload)
-				if ok {
-					cancel()
+			case id, ok := <-cancelCh:
+				if !ok {
+					// subscription was closed by the broker; stop receiving
+					// from the closed channel and wait for shutdown.
+					s.logger.Warn("Cancelation subscription was closed")
+					cancelCh = nil
+					continue
 				}
+				s.cancelations.Signal(id)
 			}
 		}
 	}()
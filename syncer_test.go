@@ -45,7 +45,7 @@ func TestSyncer(t *testing.T) {
 
 	gotInProgress := h.GetInProgressMessages(t, r)
 	if l := len(gotInProgress); l != 0 {
-		t.Errorf("%q has length %d; want 0", base.InProgressQueue, l)
+		t.Errorf("%q has length %d; want 0", h.Keys.InProgressQueue(), l)
 	}
 }
 
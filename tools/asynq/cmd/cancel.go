@@ -7,24 +7,26 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
-	"github.com/go-redis/redis/v7"
-	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/hibiken/asynq/internal/base"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 // cancelCmd represents the cancel command
 var cancelCmd = &cobra.Command{
 	Use:   "cancel [task id]",
-	Short: "Sends a cancelation signal to the goroutine processing the specified task",
-	Long: `Cancel (asynq cancel) will send a cancelation signal to the goroutine processing 
-the specified task. 
+	Short: "Cancels the specified task",
+	Long: `Cancel (asynq cancel) will cancel the specified task.
 
 The command takes one argument which specifies the task to cancel.
-The task should be in in-progress state.
 Identifier for a task should be obtained by running "asynq ls" command.
 
+If the task is enqueued, scheduled or waiting to be retried, it is removed.
+If the task is in in-progress state, a cancelation signal is sent to the
+goroutine processing the task, and a server which has dequeued the task
+but not yet started it skips the task.
+
 Handler implementation needs to be context aware for cancelation signal to
 actually cancel the processing.
 
@@ -33,21 +35,38 @@ Example: asynq cancel bnogo8gt6toe23vhef0g`,
 	Run:  cancel,
 }
 
+// tombstoneTTL is how long servers skip a canceled task, see asynq.Client.Cancel.
+const tombstoneTTL = 24 * time.Hour
+
 func init() {
 	rootCmd.AddCommand(cancelCmd)
 }
 
 func cancel(cmd *cobra.Command, args []string) {
-	r := rdb.NewRDB(redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("uri"),
-		DB:       viper.GetInt("db"),
-		Password: viper.GetString("password"),
-	}))
+	id, err := parseTaskID(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	r := createRDB()
 
-	err := r.PublishCancelation(args[0])
+	res, err := r.Cancel(id.String(), tombstoneTTL)
+	if err != nil {
+		fmt.Printf("could not cancel task: %v\n", err)
+		os.Exit(1)
+	}
+	switch res {
+	case base.CancelRemoved:
+		fmt.Printf("Successfully removed task %s\n", id)
+		return
+	case base.CancelNotFound:
+		// The task may have been enqueued by a version without the task index.
+		fmt.Printf("Task %s is not enqueued, scheduled or retrying; sending cancelation signal\n", id)
+	}
+	err = r.PublishCancelation(id.String())
 	if err != nil {
 		fmt.Printf("could not send cancelation signal: %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("Successfully sent cancelation siganl for task %s\n", args[0])
+	fmt.Printf("Successfully sent cancelation siganl for task %s\n", id)
 }
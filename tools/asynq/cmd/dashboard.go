@@ -0,0 +1,38 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"github.com/hibiken/asynq/admin"
+	"github.com/spf13/cobra"
+)
+
+// dashboardCmd represents the dashboard command
+var dashboardCmd = &cobra.Command{
+	Use:   "dashboard",
+	Short: "Serves the web dashboard",
+	Long: `Dashboard (asynq dashboard) will serve a web dashboard to monitor and
+administer queues and tasks.
+
+The dashboard shows queue sizes, charts of processed and failed tasks,
+servers and active workers, and lets users browse, retry, kill and delete tasks.
+Use --read-only to disable the actions, and --basic-auth or --token to
+require credentials.
+The dashboard listens on localhost by default. Listening on other addresses
+requires one of --read-only, --basic-auth or --token.
+
+Example: asynq dashboard --addr :8080 --basic-auth admin:s3cr3t`,
+	Args: cobra.NoArgs,
+	Run:  dashboard,
+}
+
+func init() {
+	rootCmd.AddCommand(dashboardCmd)
+	addAdminFlags(dashboardCmd)
+}
+
+func dashboard(cmd *cobra.Command, args []string) {
+	serveAdmin("dashboard", admin.NewDashboard)
+}
@@ -8,14 +8,14 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/go-redis/redis/v7"
-	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var delallValidArgs = []string{"scheduled", "retry", "dead"}
 
+// delallFilter holds the flags to select the tasks to delete.
+var delallFilter filterFlags
+
 // delallCmd represents the delall command
 var delallCmd = &cobra.Command{
 	Use:   "delall [state]",
@@ -24,7 +24,12 @@ var delallCmd = &cobra.Command{
 
 The argument should be one of "scheduled", "retry", or "dead".
 
-Example: asynq delall dead -> Deletes all dead tasks`,
+Example: asynq delall dead -> Deletes all dead tasks
+
+Flags select the tasks to delete by type, queue, error, time and payload.
+Use --dry-run to see how many tasks match before deleting them.
+
+Example: asynq delall retry --payload tenant=42 -> Deletes retry tasks for tenant 42`,
 	ValidArgs: delallValidArgs,
 	Args:      cobra.ExactValidArgs(1),
 	Run:       delall,
@@ -32,6 +37,7 @@ Example: asynq delall dead -> Deletes all dead tasks`,
 
 func init() {
 	rootCmd.AddCommand(delallCmd)
+	delallFilter.register(delallCmd)
 
 	// Here you will define your flags and configuration settings.
 
@@ -45,20 +51,22 @@ func init() {
 }
 
 func delall(cmd *cobra.Command, args []string) {
-	c := redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("uri"),
-		DB:       viper.GetInt("db"),
-		Password: viper.GetString("password"),
-	})
-	r := rdb.NewRDB(c)
-	var err error
+	r := createRDB()
+	if delallFilter.isSet() {
+		delallFilter.run(r, args[0], "Deleted", r.DeleteTasks)
+		return
+	}
+	var (
+		n   int64
+		err error
+	)
 	switch args[0] {
 	case "scheduled":
-		err = r.DeleteAllScheduledTasks()
+		n, err = r.DeleteAllScheduledTasks()
 	case "retry":
-		err = r.DeleteAllRetryTasks()
+		n, err = r.DeleteAllRetryTasks()
 	case "dead":
-		err = r.DeleteAllDeadTasks()
+		n, err = r.DeleteAllDeadTasks()
 	default:
 		fmt.Printf("error: `asynq delall [state]` only accepts %v as the argument.\n", delallValidArgs)
 		os.Exit(1)
@@ -67,5 +75,5 @@ func delall(cmd *cobra.Command, args []string) {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	fmt.Printf("Deleted all tasks in %q state\n", args[0])
+	fmt.Printf("Deleted all %d tasks in %q state\n", n, args[0])
 }
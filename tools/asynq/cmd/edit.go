@@ -0,0 +1,101 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/spf13/cobra"
+)
+
+// editCmd represents the edit command
+var editCmd = &cobra.Command{
+	Use:   "edit [task id]",
+	Short: "Edits a task and enqueues it",
+	Long: `Edit (asynq edit) will change the payload, queue, max retry or timeout
+of a scheduled, retry or dead task and enqueue it for processing.
+
+The task keeps its ID and retry count, and an "edited" event is added
+to its history.
+
+The argument should be a task ID, or an identifier obtained by running "asynq ls" command.
+
+Payload values are parsed as JSON if valid (e.g. 42, true, "42"), otherwise used as strings.
+
+Example: asynq edit bnogo8gt6toe23vhef0g --payload to=user@example.com --retry 5`,
+	Args: cobra.ExactArgs(1),
+	Run:  edit,
+}
+
+var (
+	editPayload    []string
+	editUnset      []string
+	editQueue      string
+	editRetry      int
+	editTimeout    time.Duration
+	editHistoryTTL time.Duration
+)
+
+func init() {
+	rootCmd.AddCommand(editCmd)
+	editCmd.Flags().StringArrayVar(&editPayload, "payload", nil, "set the payload field, in key=value format (repeatable)")
+	editCmd.Flags().StringArrayVar(&editUnset, "unset", nil, "remove the payload field (repeatable)")
+	editCmd.Flags().StringVar(&editQueue, "queue", "", "enqueue the task to the queue")
+	editCmd.Flags().IntVar(&editRetry, "retry", 0, "set the max number of retries")
+	editCmd.Flags().DurationVar(&editTimeout, "timeout", 0, "set the timeout of the task")
+	editCmd.Flags().DurationVar(&editHistoryTTL, "history-ttl", 7*24*time.Hour, "retention of the task history if the task has none")
+}
+
+func edit(cmd *cobra.Command, args []string) {
+	id, err := parseTaskID(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	e := rdb.TaskEdit{Queue: editQueue}
+	for _, kv := range editPayload {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			fmt.Printf("invalid --payload %q: want key=value\n", kv)
+			os.Exit(1)
+		}
+		if e.Payload == nil {
+			e.Payload = make(map[string]interface{})
+		}
+		var v interface{}
+		if err := json.Unmarshal([]byte(kv[i+1:]), &v); err != nil || v == nil {
+			v = kv[i+1:]
+		}
+		e.Payload[kv[:i]] = v
+	}
+	for _, k := range editUnset {
+		if e.Payload == nil {
+			e.Payload = make(map[string]interface{})
+		}
+		e.Payload[k] = nil
+	}
+	if cmd.Flags().Changed("retry") {
+		e.Retry = &editRetry
+	}
+	if cmd.Flags().Changed("timeout") {
+		e.Timeout = editTimeout.String()
+	}
+	r := createRDB()
+	msg, fields, err := r.EditTask(id, e, editHistoryTTL)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(fields) == 0 {
+		fmt.Printf("Enqueued task %v to queue %q without changes\n", msg.ID, msg.Queue)
+		return
+	}
+	fmt.Printf("Edited %s of task %v and enqueued it to queue %q\n", strings.Join(fields, ", "), msg.ID, msg.Queue)
+}
@@ -8,14 +8,14 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/go-redis/redis/v7"
-	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var enqallValidArgs = []string{"scheduled", "retry", "dead"}
 
+// enqallFilter holds the flags to select the tasks to enqueue.
+var enqallFilter filterFlags
+
 // enqallCmd represents the enqall command
 var enqallCmd = &cobra.Command{
 	Use:   "enqall [state]",
@@ -27,7 +27,12 @@ The argument should be one of "scheduled", "retry", or "dead".
 The tasks enqueued by this command will be processed as soon as it
 gets dequeued by a processor.
 
-Example: asynq enqall dead -> Enqueues all dead tasks`,
+Example: asynq enqall dead -> Enqueues all dead tasks
+
+Flags select the tasks to enqueue by type, queue, error, time and payload.
+Use --dry-run to see how many tasks match before enqueueing them.
+
+Example: asynq enqall dead --type email:send --error timeout -> Enqueues dead email:send tasks which timed out`,
 	ValidArgs: enqallValidArgs,
 	Args:      cobra.ExactValidArgs(1),
 	Run:       enqall,
@@ -35,6 +40,7 @@ Example: asynq enqall dead -> Enqueues all dead tasks`,
 
 func init() {
 	rootCmd.AddCommand(enqallCmd)
+	enqallFilter.register(enqallCmd)
 
 	// Here you will define your flags and configuration settings.
 
@@ -48,12 +54,11 @@ func init() {
 }
 
 func enqall(cmd *cobra.Command, args []string) {
-	c := redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("uri"),
-		DB:       viper.GetInt("db"),
-		Password: viper.GetString("password"),
-	})
-	r := rdb.NewRDB(c)
+	r := createRDB()
+	if enqallFilter.isSet() {
+		enqallFilter.run(r, args[0], "Enqueued", r.EnqueueTasks)
+		return
+	}
 	var n int64
 	var err error
 	switch args[0] {
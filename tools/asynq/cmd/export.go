@@ -0,0 +1,80 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/spf13/cobra"
+)
+
+var exportValidArgs = []string{"enqueued", "scheduled", "retry", "dead"}
+
+var (
+	exportQueue     string
+	exportOutput    string
+	exportBatchSize int
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export [state]",
+	Short: "Exports tasks in the specified state as NDJSON",
+	Long: `Export (asynq export) will write the tasks in the specified state
+as newline delimited JSON, one task per line.
+
+The argument should be one of "enqueued", "scheduled", "retry", or "dead".
+
+Exported tasks keep their IDs, retry counts, process times and last errors,
+and can be loaded back with the import command.
+Exporting enqueued tasks requires --queue; for other states,
+--queue exports only the tasks in the queue.
+
+Example: asynq export dead --output dead.ndjson -> Writes all dead tasks to dead.ndjson`,
+	ValidArgs: exportValidArgs,
+	Args:      cobra.ExactValidArgs(1),
+	Run:       export,
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().StringVarP(&exportQueue, "queue", "q", "", "queue to export tasks from")
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "file to write tasks to (default stdout)")
+	exportCmd.Flags().IntVar(&exportBatchSize, "batch", rdb.DefaultBatchSize, "number of tasks to read at a time")
+}
+
+func export(cmd *cobra.Command, args []string) {
+	var w io.Writer = os.Stdout
+	if exportOutput != "" && exportOutput != "-" {
+		f, err := os.Create(exportOutput)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	r := createRDB()
+	n, err := r.ExportTasks(args[0], exportQueue, exportBatchSize, func(recs []*rdb.TaskRecord) error {
+		for _, rec := range recs {
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Exported %d tasks before error: %v\n", n, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d tasks in %q state\n", n, args[0])
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/spf13/cobra"
+)
+
+// filterFlags holds the flags to select tasks for bulk operations.
+type filterFlags struct {
+	typePattern string
+	queue       string
+	errContains string
+	from        string
+	to          string
+	payload     []string
+	dryRun      bool
+	batchSize   int
+}
+
+// register adds the filter flags to the command.
+func (f *filterFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.typePattern, "type", "", `only tasks whose type matches the pattern (e.g. "email:*")`)
+	cmd.Flags().StringVar(&f.queue, "queue", "", "only tasks in the queue")
+	cmd.Flags().StringVar(&f.errContains, "error", "", "only tasks whose last error contains the string")
+	cmd.Flags().StringVar(&f.from, "from", "", "only tasks processed or killed at or after the time (RFC3339)")
+	cmd.Flags().StringVar(&f.to, "to", "", "only tasks processed or killed at or before the time (RFC3339)")
+	cmd.Flags().StringArrayVar(&f.payload, "payload", nil, "only tasks whose payload field has the value, in key=value format (repeatable)")
+	cmd.Flags().BoolVar(&f.dryRun, "dry-run", false, "print the number of matching tasks without changing them")
+	cmd.Flags().IntVar(&f.batchSize, "batch", rdb.DefaultBatchSize, "number of tasks to process at a time")
+}
+
+// isSet reports whether any flag which requires a filtered operation is set.
+func (f *filterFlags) isSet() bool {
+	return f.typePattern != "" || f.queue != "" || f.errContains != "" ||
+		f.from != "" || f.to != "" || len(f.payload) > 0 || f.dryRun
+}
+
+// filter returns the task filter specified by the flags.
+func (f *filterFlags) filter() (rdb.TaskFilter, error) {
+	filter := rdb.TaskFilter{
+		TypePattern:   f.typePattern,
+		Queue:         f.queue,
+		ErrorContains: f.errContains,
+	}
+	var err error
+	if f.from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, f.from); err != nil {
+			return filter, fmt.Errorf("invalid --from: %v", err)
+		}
+	}
+	if f.to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, f.to); err != nil {
+			return filter, fmt.Errorf("invalid --to: %v", err)
+		}
+	}
+	for _, kv := range f.payload {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return filter, fmt.Errorf("invalid --payload %q: want key=value", kv)
+		}
+		if filter.Payload == nil {
+			filter.Payload = make(map[string]string)
+		}
+		filter.Payload[kv[:i]] = kv[i+1:]
+	}
+	return filter, nil
+}
+
+// run runs the bulk operation on the tasks in the given state which match
+// the filter, and prints the result with the given verb (e.g. "Deleted").
+// If --dry-run is set, it prints the number of matching tasks instead.
+func (f *filterFlags) run(r *rdb.RDB, state, verb string, op func(state string, f rdb.TaskFilter, batchSize int) (int64, error)) {
+	filter, err := f.filter()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if f.dryRun {
+		n, err := r.CountTasks(state, filter)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("%d tasks in %q state match the filter (dry run)\n", n, state)
+		return
+	}
+	n, err := op(state, filter, f.batchSize)
+	if err != nil {
+		fmt.Printf("%s %d tasks before error: %v\n", verb, n, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s %d tasks in %q state matching the filter\n", verb, n, state)
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/spf13/cobra"
+)
+
+var (
+	importRegenerateIDs bool
+	importBatchSize     int
+)
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:   "import [file]",
+	Short: "Imports tasks from an NDJSON file",
+	Long: `Import (asynq import) will add the tasks in the NDJSON file
+written by the export command back to their recorded states.
+
+Tasks are read from stdin if no file or "-" is given.
+Tasks with the ID of a task which already exists are skipped,
+unless --regenerate-ids is set to give each imported task a new ID.
+
+Example: asynq import dead.ndjson -> Adds the tasks in dead.ndjson`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  importTasks,
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+	importCmd.Flags().BoolVar(&importRegenerateIDs, "regenerate-ids", false, "give each imported task a new ID")
+	importCmd.Flags().IntVar(&importBatchSize, "batch", rdb.DefaultBatchSize, "number of tasks to add at a time")
+}
+
+func importTasks(cmd *cobra.Command, args []string) {
+	var rd io.Reader = os.Stdin
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		rd = f
+	}
+	r := createRDB()
+	read, imported, err := r.ImportTasksFrom(rd, importRegenerateIDs, importBatchSize)
+	if err != nil {
+		fmt.Printf("Imported %d tasks before error: %v\n", imported, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Imported %d tasks, skipped %d tasks which already exist\n", imported, read-imported)
+}
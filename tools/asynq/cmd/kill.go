@@ -8,10 +8,7 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/go-redis/redis/v7"
-	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 // killCmd represents the kill command
@@ -24,6 +21,9 @@ The command takes one argument which specifies the task to kill.
 The task should be in either scheduled or retry state.
 Identifier for a task should be obtained by running "asynq ls" command.
 
+The dead queue is not trimmed by the command; running servers trim it
+according to their DeadRetention config.
+
 Example: asynq kill r:1575732274:bnogo8gt6toe23vhef0g`,
 	Args: cobra.ExactArgs(1),
 	Run:  kill,
@@ -49,11 +49,7 @@ func kill(cmd *cobra.Command, args []string) {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	r := rdb.NewRDB(redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("uri"),
-		DB:       viper.GetInt("db"),
-		Password: viper.GetString("password"),
-	}))
+	r := createRDB()
 	switch qtype {
 	case "s":
 		err = r.KillScheduledTask(id, score)
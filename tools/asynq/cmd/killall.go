@@ -8,14 +8,14 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/go-redis/redis/v7"
-	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var killallValidArgs = []string{"scheduled", "retry"}
 
+// killallFilter holds the flags to select the tasks to kill.
+var killallFilter filterFlags
+
 // killallCmd represents the killall command
 var killallCmd = &cobra.Command{
 	Use:   "killall [state]",
@@ -24,7 +24,15 @@ var killallCmd = &cobra.Command{
 
 The argument should be either "scheduled" or "retry".
 
-Example: asynq killall retry -> Update all retry tasks to dead tasks`,
+Example: asynq killall retry -> Update all retry tasks to dead tasks
+
+Flags select the tasks to kill by type, queue, error, time and payload.
+Use --dry-run to see how many tasks match before killing them.
+
+The dead queue is not trimmed by the command; running servers trim it
+according to their DeadRetention config.
+
+Example: asynq killall scheduled --type "report:*" -> Kills scheduled report tasks`,
 	ValidArgs: killallValidArgs,
 	Args:      cobra.ExactValidArgs(1),
 	Run:       killall,
@@ -32,6 +40,7 @@ Example: asynq killall retry -> Update all retry tasks to dead tasks`,
 
 func init() {
 	rootCmd.AddCommand(killallCmd)
+	killallFilter.register(killallCmd)
 
 	// Here you will define your flags and configuration settings.
 
@@ -45,12 +54,11 @@ func init() {
 }
 
 func killall(cmd *cobra.Command, args []string) {
-	c := redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("uri"),
-		DB:       viper.GetInt("db"),
-		Password: viper.GetString("password"),
-	})
-	r := rdb.NewRDB(c)
+	r := createRDB()
+	if killallFilter.isSet() {
+		killallFilter.run(r, args[0], "Killed", r.KillTasks)
+		return
+	}
 	var n int64
 	var err error
 	switch args[0] {
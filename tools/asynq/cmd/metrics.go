@@ -0,0 +1,53 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/hibiken/asynq"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// metricsCmd represents the metrics command
+var metricsCmd = &cobra.Command{
+	Use:   "metrics",
+	Short: "Serves metrics in Prometheus format",
+	Long: `Metrics (asynq metrics) will serve metrics of the queues and servers
+in Prometheus text format at /metrics.
+
+The metrics are the number of tasks in each queue and state, the number of
+tasks processed and failed today, and the concurrency and active workers
+of each server. Run a single instance of the command, since every instance
+reports the same numbers. Set Config.MetricsAddr in servers to export task
+processing durations as well.
+
+Example: asynq metrics --addr :9090`,
+	Args: cobra.NoArgs,
+	Run:  metrics,
+}
+
+var metricsAddr string
+
+func init() {
+	rootCmd.AddCommand(metricsCmd)
+	metricsCmd.Flags().StringVar(&metricsAddr, "addr", ":9090", "address to listen on")
+}
+
+func metrics(cmd *cobra.Command, args []string) {
+	inspector := asynq.NewInspectorWithNamespace(redisConnOpt(), viper.GetString("namespace"))
+	defer inspector.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", asynq.NewMetricsHandler(inspector))
+	fmt.Fprintf(os.Stderr, "Serving metrics on %s/metrics\n", metricsAddr)
+	if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Migrates keys written by previous versions of asynq",
+	Long: `Migrate (asynq migrate) will move the queues, tasks and stats stored
+under the "asynq:" key prefix used by previous versions of asynq to the
+"{asynq}:" prefix, or the prefix of the namespace given with --namespace.
+
+Run the command against the redis server used by the previous version after
+upgrading. Tasks in the legacy keys are not processed until they are migrated.
+Running the command more than once is safe.
+
+Example: asynq migrate`,
+	Args: cobra.NoArgs,
+	Run:  migrate,
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+}
+
+func migrate(cmd *cobra.Command, args []string) {
+	r := createRDB()
+	n, err := r.MigrateLegacyKeys()
+	if err != nil {
+		fmt.Printf("error: migrated %d keys before failure: %v\n", n, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Migrated %d keys\n", n)
+}
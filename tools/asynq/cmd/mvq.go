@@ -0,0 +1,52 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/spf13/cobra"
+)
+
+// mvqCmd represents the mvq command
+var mvqCmd = &cobra.Command{
+	Use:   "mvq [source queue] [destination queue]",
+	Short: "Moves tasks from one queue to another",
+	Long: `Mvq (asynq mvq) will move the tasks in the source queue to the destination queue.
+
+Enqueued tasks are moved to the destination queue in the same order,
+and scheduled and retry tasks targeting the source queue are changed
+to be processed in the destination queue at the same time.
+Tasks in progress are not moved.
+
+Use --type to move only the tasks whose type matches the pattern.
+
+Example: asynq mvq default low --type "email:*" -> Moves email tasks from "default" queue to "low" queue`,
+	Args: cobra.ExactArgs(2),
+	Run:  mvq,
+}
+
+var (
+	mvqTypePattern string
+	mvqBatchSize   int
+)
+
+func init() {
+	rootCmd.AddCommand(mvqCmd)
+	mvqCmd.Flags().StringVar(&mvqTypePattern, "type", "", `only tasks whose type matches the pattern (e.g. "email:*")`)
+	mvqCmd.Flags().IntVar(&mvqBatchSize, "batch", rdb.DefaultBatchSize, "number of tasks to move at a time")
+}
+
+func mvq(cmd *cobra.Command, args []string) {
+	r := createRDB()
+	n, err := r.MoveTasks(args[0], args[1], mvqTypePattern, mvqBatchSize)
+	if err != nil {
+		fmt.Printf("Moved %d tasks before error: %v\n", n, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Moved %d tasks from queue %q to queue %q\n", n, args[0], args[1])
+}
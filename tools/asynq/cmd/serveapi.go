@@ -0,0 +1,128 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/hibiken/asynq"
+	"github.com/hibiken/asynq/admin"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// serveAPICmd represents the serve-api command
+var serveAPICmd = &cobra.Command{
+	Use:   "serve-api",
+	Short: "Serves the HTTP admin API",
+	Long: `ServeAPI (asynq serve-api) will serve a JSON HTTP API to inspect and
+administer queues and tasks.
+
+The API provides the stats, history, ls, enq, del, kill, servers, workers,
+cancel and rmq operations. Use --read-only to disable the endpoints which
+change queues and tasks, and --basic-auth or --token to require credentials.
+The API listens on localhost by default. Listening on other addresses
+requires one of --read-only, --basic-auth or --token.
+
+Example: asynq serve-api --addr :8080 --prefix /api --token s3cr3t`,
+	Args: cobra.NoArgs,
+	Run:  serveAPI,
+}
+
+// Flags of the commands serving the admin API and dashboard.
+var (
+	adminAddr      string
+	adminPrefix    string
+	adminReadOnly  bool
+	adminBasicAuth string
+	adminToken     string
+)
+
+func init() {
+	rootCmd.AddCommand(serveAPICmd)
+	addAdminFlags(serveAPICmd)
+}
+
+// addAdminFlags adds the flags to serve the admin API to the command.
+func addAdminFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&adminAddr, "addr", "localhost:8080", "address to listen on")
+	cmd.Flags().StringVar(&adminPrefix, "prefix", "", "path prefix to serve under")
+	cmd.Flags().BoolVar(&adminReadOnly, "read-only", false, "disable the endpoints which change queues and tasks")
+	cmd.Flags().StringVar(&adminBasicAuth, "basic-auth", "", "require HTTP basic authentication, in user:password format")
+	cmd.Flags().StringVar(&adminToken, "token", "", "require the bearer token")
+}
+
+func serveAPI(cmd *cobra.Command, args []string) {
+	serveAdmin("admin API", admin.NewHandler)
+}
+
+// serveAdmin serves the handler created by newHandler
+// as configured by the admin flags.
+func serveAdmin(name string, newHandler func(*asynq.Inspector, admin.Options) http.Handler) {
+	if !adminReadOnly && adminBasicAuth == "" && adminToken == "" && !isLoopback(adminAddr) {
+		fmt.Printf("refusing to serve the %s on %q without credentials: use --basic-auth, --token or --read-only, or listen on localhost\n", name, adminAddr)
+		os.Exit(1)
+	}
+	opts := admin.Options{ReadOnly: adminReadOnly}
+	if adminBasicAuth != "" {
+		i := strings.Index(adminBasicAuth, ":")
+		if i <= 0 {
+			fmt.Printf("invalid --basic-auth %q: want user:password\n", adminBasicAuth)
+			os.Exit(1)
+		}
+		opts.Middleware = append(opts.Middleware, admin.BasicAuth(adminBasicAuth[:i], adminBasicAuth[i+1:]))
+	}
+	if adminToken != "" {
+		opts.Middleware = append(opts.Middleware, admin.BearerAuth(adminToken))
+	}
+	inspector := asynq.NewInspectorWithNamespace(redisConnOpt(), viper.GetString("namespace"))
+	defer inspector.Close()
+
+	handler := newHandler(inspector, opts)
+	prefix := strings.TrimRight(adminPrefix, "/")
+	if prefix != "" {
+		mux := http.NewServeMux()
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, handler))
+		handler = mux
+	}
+	fmt.Fprintf(os.Stderr, "Serving the %s on %s%s/\n", name, adminAddr, prefix)
+	if err := http.ListenAndServe(adminAddr, handler); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// isLoopback reports whether addr only accepts connections from the local host.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// redisConnOpt returns the option to connect to redis
+// from the global flags.
+func redisConnOpt() asynq.RedisConnOpt {
+	if viper.GetBool("cluster") {
+		return asynq.RedisClusterClientOpt{
+			Addrs:    strings.Split(viper.GetString("cluster_addrs"), ","),
+			Password: viper.GetString("password"),
+		}
+	}
+	return asynq.RedisClientOpt{
+		Addr:     viper.GetString("uri"),
+		DB:       viper.GetInt("db"),
+		Password: viper.GetString("password"),
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/rs/xid"
+	"github.com/spf13/cobra"
+)
+
+// taskCmd represents the task command
+var taskCmd = &cobra.Command{
+	Use:   "task",
+	Short: "Inspects a single task",
+	Long: `Task (asynq task) groups the commands to inspect a single task.
+
+Commands take a task ID, either the ID of the task or an identifier
+obtained by running "asynq ls" command.`,
+}
+
+// taskHistoryCmd represents the task history command
+var taskHistoryCmd = &cobra.Command{
+	Use:   "history [task id]",
+	Short: "Shows the lifecycle history of a task",
+	Long: `History (asynq task history) will show the recorded lifecycle events of a task,
+oldest first.
+
+History is recorded only by servers and clients with task history enabled,
+and is kept for a limited time after the last event.
+
+Example: asynq task history bnogo8gt6toe23vhef0g`,
+	Args: cobra.ExactArgs(1),
+	Run:  taskHistory,
+}
+
+// taskShowCmd represents the task show command
+var taskShowCmd = &cobra.Command{
+	Use:   "show [task id]",
+	Short: "Shows the current state of a task",
+	Long: `Show (asynq task show) will look up a task by its ID and show its state,
+queue, payload, retry counts, last error and timestamps.
+
+The task is looked up in the task index, so tasks enqueued before upgrading
+to a version that maintains the index are not found.
+
+For scheduled, retry and dead tasks, the output includes the identifier
+to use with "asynq enq", "asynq del" and "asynq kill" commands.
+
+Example: asynq task show bnogo8gt6toe23vhef0g`,
+	Args: cobra.ExactArgs(1),
+	Run:  taskShow,
+}
+
+func init() {
+	rootCmd.AddCommand(taskCmd)
+	taskCmd.AddCommand(taskHistoryCmd)
+	taskCmd.AddCommand(taskShowCmd)
+}
+
+// parseTaskID parses either a task ID or a query ID shown by "asynq ls".
+func parseTaskID(s string) (xid.ID, error) {
+	if strings.Contains(s, ":") {
+		id, _, _, err := parseQueryID(s)
+		return id, err
+	}
+	id, err := xid.FromString(s)
+	if err != nil {
+		return xid.NilID(), fmt.Errorf("invalid id")
+	}
+	return id, nil
+}
+
+func taskHistory(cmd *cobra.Command, args []string) {
+	id, err := parseTaskID(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	r := createRDB()
+	events, err := r.History(id)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	cols := []string{"Time", "Event", "Queue", "Attempt", "Server", "Process At", "Error"}
+	printRows := func(w io.Writer, tmpl string) {
+		for _, e := range events {
+			var server, processAt string
+			if e.Host != "" {
+				server = fmt.Sprintf("%s:%d", e.Host, e.PID)
+			}
+			if !e.ProcessAt.IsZero() {
+				processAt = e.ProcessAt.Format(time.RFC3339)
+			}
+			var attempt string
+			if e.Attempt > 0 {
+				attempt = fmt.Sprintf("%d", e.Attempt)
+			}
+			kind := e.Kind
+			if len(e.Fields) > 0 {
+				kind = fmt.Sprintf("%s (%s)", e.Kind, strings.Join(e.Fields, ", "))
+			}
+			fmt.Fprintf(w, tmpl, e.Time.Format(time.RFC3339), kind, e.Queue, attempt, server, processAt, e.ErrorMsg)
+		}
+	}
+	printTable(cols, printRows)
+}
+
+func taskShow(cmd *cobra.Command, args []string) {
+	id, err := parseTaskID(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	r := createRDB()
+	info, err := r.GetTask(id)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	tw := new(tabwriter.Writer).Init(os.Stdout, 0, 8, 2, ' ', 0)
+	format := "%s:\t%v\n"
+	fmt.Fprintf(tw, format, "ID", info.ID)
+	switch info.State {
+	case rdb.StateScheduled:
+		fmt.Fprintf(tw, format, "Query ID", queryID(info.ID, info.Score, "s"))
+	case rdb.StateRetry:
+		fmt.Fprintf(tw, format, "Query ID", queryID(info.ID, info.Score, "r"))
+	case rdb.StateDead:
+		fmt.Fprintf(tw, format, "Query ID", queryID(info.ID, info.Score, "d"))
+	}
+	fmt.Fprintf(tw, format, "State", info.State)
+	fmt.Fprintf(tw, format, "Type", info.Type)
+	fmt.Fprintf(tw, format, "Payload", info.Payload)
+	if len(info.Headers) > 0 {
+		fmt.Fprintf(tw, format, "Headers", formatHeaders(info.Headers))
+	}
+	fmt.Fprintf(tw, format, "Queue", info.Queue)
+	fmt.Fprintf(tw, format, "Retried", fmt.Sprintf("%d/%d", info.Retried, info.Retry))
+	fmt.Fprintf(tw, format, "Created", info.ID.Time().Format(time.RFC3339))
+	if !info.ProcessAt.IsZero() {
+		fmt.Fprintf(tw, format, "Process At", info.ProcessAt.Format(time.RFC3339))
+	}
+	if !info.LastFailedAt.IsZero() {
+		fmt.Fprintf(tw, format, "Last Failed", info.LastFailedAt.Format(time.RFC3339))
+	}
+	if info.ErrorMsg != "" {
+		fmt.Fprintf(tw, format, "Last Error", info.ErrorMsg)
+	}
+	tw.Flush()
+}
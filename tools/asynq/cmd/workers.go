@@ -10,10 +10,7 @@ import (
 	"os"
 	"sort"
 
-	"github.com/go-redis/redis/v7"
-	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 // workersCmd represents the workers command
@@ -38,11 +35,7 @@ func init() {
 }
 
 func workers(cmd *cobra.Command, args []string) {
-	r := rdb.NewRDB(redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("uri"),
-		DB:       viper.GetInt("db"),
-		Password: viper.GetString("password"),
-	}))
+	r := createRDB()
 
 	workers, err := r.ListWorkers()
 	if err != nil {
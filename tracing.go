@@ -0,0 +1,84 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"regexp"
+	"time"
+)
+
+// TraceContext is a W3C trace context, which identifies the trace and
+// the span a task was enqueued in.
+//
+// See https://www.w3.org/TR/trace-context/ for the format of the fields.
+type TraceContext struct {
+	// TraceParent is the value of the "traceparent" header,
+	// e.g. "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+	TraceParent string
+
+	// TraceState is the value of the "tracestate" header; may be empty.
+	TraceState string
+}
+
+// traceParentRe matches a valid traceparent. Versions other than "00" may
+// have more fields, and all-zero trace and parent IDs are invalid.
+var traceParentRe = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}(-.*)?$`)
+
+// valid reports whether the trace parent is well-formed.
+func (tc TraceContext) valid() bool {
+	m := traceParentRe.FindStringSubmatch(tc.TraceParent)
+	if m == nil || m[1] == "ff" || (m[1] == "00" && m[4] != "") {
+		return false
+	}
+	return m[2] != "00000000000000000000000000000000" && m[3] != "0000000000000000"
+}
+
+type traceContextKey struct{}
+
+// ContextWithTraceContext returns a copy of ctx carrying the trace context.
+//
+// Client.EnqueueContext carries the trace context of the given context
+// in the task, and the context passed to the handler processing the task
+// carries it as well.
+func ContextWithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceContextFromContext returns the trace context carried by ctx.
+// It returns false if ctx carries no valid trace context.
+func TraceContextFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	if !ok || !tc.valid() {
+		return TraceContext{}, false
+	}
+	return tc, true
+}
+
+// Tracer opens spans to trace tasks from the caller enqueuing a task
+// to the handler processing it.
+//
+// A Tracer adapts the hooks to a tracing library. Trace context is passed
+// in contexts with ContextWithTraceContext and TraceContextFromContext;
+// the spans opened by the returned contexts should be ended when the
+// returned functions are called.
+//
+// Set a Tracer with Client.SetTracer and Config.Tracer.
+type Tracer interface {
+	// StartEnqueue is called when a client enqueues the task, with the context
+	// passed to Client.EnqueueContext. The trace context of the returned context
+	// is carried in the task. end is called with the result of the enqueue.
+	StartEnqueue(ctx context.Context, task *Task) (_ context.Context, end func(err error))
+
+	// QueueWait is called when the server starts the first attempt to process
+	// the task, with the context carrying the task's trace context, the time the task
+	// was ready to be processed and the time the server started processing it.
+	QueueWait(ctx context.Context, task *Task, readyAt, startedAt time.Time)
+
+	// StartProcess is called before the handler processes the task, with the
+	// context carrying the task's trace context. The handler is called with
+	// the returned context. end is called with the error returned by the handler.
+	StartProcess(ctx context.Context, task *Task) (_ context.Context, end func(err error))
+}
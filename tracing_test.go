@@ -0,0 +1,191 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hibiken/asynq/broker/inmem"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+)
+
+const (
+	testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	testTraceState  = "congo=t61rcWkgMzE"
+)
+
+func TestTraceContextFromContext(t *testing.T) {
+	tests := []struct {
+		traceParent string
+		wantOK      bool
+	}{
+		{testTraceParent, true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+		{"", false},
+	}
+
+	for _, tc := range tests {
+		want := TraceContext{TraceParent: tc.traceParent, TraceState: testTraceState}
+		got, ok := TraceContextFromContext(ContextWithTraceContext(context.Background(), want))
+		if ok != tc.wantOK {
+			t.Errorf("TraceContextFromContext with traceparent %q returned %t, want %t", tc.traceParent, ok, tc.wantOK)
+			continue
+		}
+		if ok && got != want {
+			t.Errorf("TraceContextFromContext returned %+v, want %+v", got, want)
+		}
+	}
+
+	if _, ok := TraceContextFromContext(context.Background()); ok {
+		t.Error("TraceContextFromContext(context.Background()) returned true, want false")
+	}
+}
+
+func TestClientEnqueueContextCarriesTraceContext(t *testing.T) {
+	r := setup(t)
+	client := NewClient(RedisClientOpt{Addr: redisAddr, DB: redisDB})
+	tc := TraceContext{TraceParent: testTraceParent, TraceState: testTraceState}
+	ctx := ContextWithTraceContext(context.Background(), tc)
+	now := time.Now()
+
+	if err := client.EnqueueContext(ctx, NewTask("send_email", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.EnqueueInContext(ctx, time.Hour, NewTask("send_email", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Enqueue(NewTask("reindex", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	enqueued := h.GetEnqueuedMessages(t, r)
+	scheduled := h.GetScheduledMessages(t, r)
+	if len(enqueued) != 2 || len(scheduled) != 1 {
+		t.Fatalf("enqueued %d and scheduled %d tasks, want 2 and 1", len(enqueued), len(scheduled))
+	}
+	for _, msg := range append(enqueued, scheduled...) {
+		want := TraceContext{}
+		if msg.Type == "send_email" {
+			want = tc
+		}
+		if got := (TraceContext{msg.TraceParent, msg.TraceState}); got != want {
+			t.Errorf("%s task has trace context %+v, want %+v", msg.Type, got, want)
+		}
+	}
+	if got, want := time.Unix(0, scheduled[0].ReadyAt), now.Add(time.Hour); !cmp.Equal(got, want, cmpApproxTime) {
+		t.Errorf("scheduled task has ReadyAt %v, want %v", got, want)
+	}
+}
+
+var cmpApproxTime = cmp.Comparer(func(x, y time.Time) bool {
+	d := x.Sub(y)
+	return -time.Second < d && d < time.Second
+})
+
+// fakeTracer records the hooks called and opens spans as
+// new span IDs in the trace of the context.
+type fakeTracer struct {
+	mu     sync.Mutex
+	events []string
+	spans  int
+}
+
+func (tr *fakeTracer) record(format string, args ...interface{}) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.events = append(tr.events, fmt.Sprintf(format, args...))
+}
+
+func (tr *fakeTracer) startSpan(ctx context.Context) context.Context {
+	tr.mu.Lock()
+	tr.spans++
+	span := tr.spans
+	tr.mu.Unlock()
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	if tc, ok := TraceContextFromContext(ctx); ok {
+		traceID = tc.TraceParent[3:35]
+	}
+	return ContextWithTraceContext(ctx, TraceContext{TraceParent: fmt.Sprintf("00-%s-%016x-01", traceID, span)})
+}
+
+func (tr *fakeTracer) StartEnqueue(ctx context.Context, task *Task) (context.Context, func(error)) {
+	ctx = tr.startSpan(ctx)
+	tc, _ := TraceContextFromContext(ctx)
+	return ctx, func(err error) { tr.record("enqueue %s %s %v", task.Type, tc.TraceParent, err) }
+}
+
+func (tr *fakeTracer) QueueWait(ctx context.Context, task *Task, readyAt, startedAt time.Time) {
+	tc, _ := TraceContextFromContext(ctx)
+	tr.record("wait %s %s %t", task.Type, tc.TraceParent, !startedAt.Before(readyAt))
+}
+
+func (tr *fakeTracer) StartProcess(ctx context.Context, task *Task) (context.Context, func(error)) {
+	parent, _ := TraceContextFromContext(ctx)
+	ctx = tr.startSpan(ctx)
+	return ctx, func(err error) { tr.record("process %s %s %v", task.Type, parent.TraceParent, err) }
+}
+
+func TestTracer(t *testing.T) {
+	b := inmem.New()
+	tracer := &fakeTracer{}
+	client := NewClientWithBroker(b)
+	client.SetTracer(tracer)
+	srv := NewServerWithBroker(b, Config{
+		Concurrency: 1,
+		Logger:      testLogger,
+		Tracer:      tracer,
+	})
+
+	var handlerTrace string
+	done := make(chan struct{})
+	handler := func(ctx context.Context, task *Task) error {
+		defer close(done)
+		tc, _ := TraceContextFromContext(ctx)
+		handlerTrace = tc.TraceParent
+		return errors.New("failed")
+	}
+	if err := srv.Start(HandlerFunc(handler)); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	ctx := ContextWithTraceContext(context.Background(), TraceContext{TraceParent: testTraceParent})
+	if err := client.EnqueueContext(ctx, NewTask("send_email", nil), MaxRetry(0)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the task to be processed")
+	}
+	time.Sleep(100 * time.Millisecond) // let the worker end the span
+
+	enqueueSpan := "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000001-01"
+	want := []string{
+		"enqueue send_email " + enqueueSpan + " <nil>",
+		"wait send_email " + enqueueSpan + " true",
+		"process send_email " + enqueueSpan + " failed",
+	}
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if diff := cmp.Diff(want, tracer.events); diff != "" {
+		t.Errorf("tracer events = %v, want %v; (-want, +got)\n%s", tracer.events, want, diff)
+	}
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000002-01"; handlerTrace != want {
+		t.Errorf("handler context has traceparent %q, want %q", handlerTrace, want)
+	}
+}